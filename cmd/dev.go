@@ -21,13 +21,14 @@ import (
 )
 
 var (
-	ctx               context.Context
-	allExamples       *bool
-	outputRecords     *bool
-	allExamplesFolder string
-	testFileName      string
-	rulesTestFile     string
-	outputFolder      string
+	ctx                context.Context
+	allExamples        *bool
+	outputRecords      *bool
+	allExamplesFolder  string
+	testFileName       string
+	rulesTestFile      string
+	outputFolder       string
+	allowDropProtected *bool
 )
 
 func init() {
@@ -55,8 +56,11 @@ func init() {
 	flag.StringVar(&rulesTestFile, "rules", "./rules-test.yaml", "Rules test yaml file")
 	flag.StringVar(&testFileName, "file", "./examples/cloudtrail.json", "Test file")
 	flag.StringVar(&outputFolder, "out", "./out_test", "Output folder for filtered logs")
+	allowDropProtected = flag.Bool("allow-drop-protected", false, "Allow rules to drop protected events")
 	flag.Parse()
 
+	rules.AllowDropProtectedEvents(*allowDropProtected)
+
 	// Create output folder if it doesn't exist
 	if *outputRecords {
 		if err := os.MkdirAll(outputFolder, 0755); err != nil {
@@ -85,13 +89,16 @@ func Handler(ctx context.Context, cloudtrailData *cloudtrailprocessor.Cloudtrail
 	}
 
 	// Filter records using the cached configuration
-	outRecord, err := cloudtrailprocessor.FilterRecords(ctx, cloudtrailData, cachedCfg)
+	outRecord, stats, err := cloudtrailprocessor.FilterRecordsWithStats(ctx, cloudtrailData, cachedCfg)
 	if err != nil {
 		return fmt.Errorf("failed to filter records: %w", err)
 	}
 
 	// print summary of results
 	log.Warn().
+		Any("ruleHits", stats.RuleHits).
+		Any("shadowHits", stats.ShadowHits).
+		Any("protectedKept", stats.ProtectedKept).
 		Int("input", len(cloudtrailData.Records)).
 		Int("output", len(outRecord.Records)).
 		Int("dropped", len(cloudtrailData.Records)-len(outRecord.Records)).
@@ -11,25 +11,33 @@ import (
 	"ctlp/pkg/metrics"
 	"ctlp/pkg/retry"
 	"ctlp/pkg/rules"
+	"ctlp/pkg/sinks"
 	"ctlp/pkg/snsevents"
+	"ctlp/pkg/tracing"
 	"ctlp/pkg/utils"
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
 	"runtime"
 	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	myaws "ctlp/pkg/aws"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -41,9 +49,12 @@ var (
 	// Global initialization for Lambda cold start optimization
 	awsCfg         aws.Config
 	configLoader   config.ConfigLoader
-	cachedRules    *rules.CachedConfiguration
-	cwMetrics      *metrics.CloudWatchMetrics
+	activeRules    atomic.Pointer[rules.CachedConfiguration]
+	metricsRec     metrics.Recorder
+	ruleHits       = metrics.NewRuleHitsAggregator()
+	shadowHits     = metrics.NewRuleHitsAggregator()
 	s3Client       *s3.Client
+	outputSink     cloudtrailprocessor.Sink
 	awsConnection  *myaws.Connection
 	connOnce       sync.Once
 	lastConfigLoad time.Time
@@ -51,6 +62,22 @@ var (
 	processorCfg   flags.S3Processor
 	initError      error
 	initOnce       sync.Once
+	tracerProvider *sdktrace.TracerProvider
+	tracer         = tracing.Tracer("ctlp/cmd")
+
+	// Retries of an invocation, shared by the nested retry loops, and time kept
+	// before the Lambda deadline when starting an attempt
+	retryBudget          int
+	retryDeadlineReserve time.Duration
+
+	// Destination of the failure records of files failing after the final retry
+	deadLetterCfg myaws.DeadLetterConfig
+
+	// Circuit breakers of the AWS dependencies, shared by the invocations of the
+	// container. Every output sink has its own breaker, created with the sink.
+	s3Breaker        = newCircuitBreaker("s3", retry.WithFailureClassifier(isCopyFailure))
+	configBreaker    = newCircuitBreaker("config")
+	broadcastBreaker = newCircuitBreaker("broadcast")
 )
 
 // Initialize components once during cold start
@@ -80,6 +107,18 @@ func init() {
 
 	// Initialize configuration
 	processorCfg = loadProcessorConfig()
+	retryBudget, retryDeadlineReserve = loadRetryConfig()
+	deadLetterCfg = myaws.DeadLetterConfig{
+		QueueURL: validateURL(getEnv("DEAD_LETTER_QUEUE_URL", "")),
+		Bucket:   sanitizeBucketName(getEnv("DEAD_LETTER_BUCKET", "")),
+		Prefix:   getEnv("DEAD_LETTER_PREFIX", myaws.DefaultDeadLetterPrefix),
+	}
+
+	// protected events are kept whatever the rules, unless explicitly allowed
+	if getEnv("ALLOW_DROP_PROTECTED_EVENTS", "false") == "true" {
+		log.Warn().Msg("ALLOW_DROP_PROTECTED_EVENTS is set, rules may drop protected events")
+		rules.AllowDropProtectedEvents(true)
+	}
 
 	// Perform heavy initialization in background
 	go performAsyncInitialization()
@@ -108,12 +147,25 @@ func loadProcessorConfig() flags.S3Processor {
 	snsTopicArn := validateARN(getEnv("SNS_TOPIC_ARN", ""))
 	sqsQueueURL := validateURL(getEnv("SQS_QUEUE_URL", ""))
 
+	// an unset policy fails files with bad records, or keeps them in fail-open mode
+	badRecordPolicy := getEnv("BAD_RECORD_POLICY", "")
+	if _, err := rules.ParseBadRecordPolicy(badRecordPolicy); err != nil {
+		log.Fatal().Err(err).Msg("invalid BAD_RECORD_POLICY")
+	}
+	maxBadRecords, err := strconv.Atoi(getEnv("MAX_BAD_RECORDS", "0"))
+	if err != nil || maxBadRecords < 0 {
+		log.Fatal().Str("value", getEnv("MAX_BAD_RECORDS", "")).Msg("invalid MAX_BAD_RECORDS")
+	}
+
 	cfg := flags.S3Processor{
 		CloudtrailOutputBucketName: outputBucket,
 		SNSPayloadType:             snsPayloadType,
 		SNSTopicArn:                snsTopicArn,
 		SQSQueueURL:                sqsQueueURL,
 		MultiPartDownload:          getEnv("MULTIPART_DOWNLOAD", "false") == "true",
+		FailOpen:                   getEnv("FAIL_OPEN", "false") == "true",
+		BadRecordPolicy:            badRecordPolicy,
+		MaxBadRecords:              maxBadRecords,
 		// Remove ConfigFile as we'll use the new loader system
 	}
 
@@ -124,6 +176,22 @@ func loadProcessorConfig() flags.S3Processor {
 	return cfg
 }
 
+func loadRetryConfig() (int, time.Duration) {
+	budget, err := strconv.Atoi(getEnv("RETRY_BUDGET", "6"))
+	if err != nil || budget < 0 {
+		log.Warn().Str("value", getEnv("RETRY_BUDGET", "")).Msg("invalid RETRY_BUDGET, using 6")
+		budget = 6
+	}
+
+	reserve, err := time.ParseDuration(getEnv("RETRY_DEADLINE_RESERVE", "2s"))
+	if err != nil || reserve < 0 {
+		log.Warn().Str("value", getEnv("RETRY_DEADLINE_RESERVE", "")).Msg("invalid RETRY_DEADLINE_RESERVE, using 2s")
+		reserve = 2 * time.Second
+	}
+
+	return budget, reserve
+}
+
 func performAsyncInitialization() {
 	initOnce.Do(func() {
 		ctx := context.Background()
@@ -146,9 +214,27 @@ func performAsyncInitialization() {
 			return
 		}
 
+		// Initialize tracing, OTEL_TRACES_EXPORTER=otlp enables the exporter
+		tracerProvider, err = tracing.Setup(ctx)
+		if err != nil {
+			initError = fmt.Errorf("failed to set up tracing: %w", err)
+			return
+		}
+
 		// Initialize S3 client
 		s3Client = s3.NewFromConfig(awsCfg)
 
+		// Initialize the output sink for kept records
+		outputSink, err = sinks.CreateFromEnv(&awsCfg, processorCfg.CloudtrailOutputBucketName,
+			sinks.WithCircuitBreakers(func(name string) *retry.CircuitBreaker {
+				return newCircuitBreaker(name + "-sink")
+			}))
+		if err != nil {
+			initError = fmt.Errorf("failed to create output sink: %w", err)
+			return
+		}
+		log.Info().Str("sink", outputSink.String()).Msg("output sink enabled")
+
 		// Initialize configuration loader
 		configLoader = config.CreateLoaderFromEnv(&awsCfg)
 
@@ -160,28 +246,35 @@ func performAsyncInitialization() {
 		// If pre-loading fails, the first request will load the configuration,
 		// adding latency but ensuring the function still works.
 		if cachedLoader, ok := configLoader.(*config.CachedConfigLoader); ok {
+			// New configuration versions are swapped in as soon as they are loaded
+			cachedLoader.Subscribe(func(cachedConfig *rules.CachedConfiguration) {
+				activeRules.Store(cachedConfig)
+				log.Info().Str("version", cachedConfig.Version).Msg("configuration version activated")
+			})
+
 			cachedConfig, err := cachedLoader.LoadCached(ctx)
 			if err != nil {
 				log.Warn().Err(err).Msg("failed to pre-load configuration")
 			} else {
-				cachedRules = cachedConfig
+				activeRules.Store(cachedConfig)
 				lastConfigLoad = time.Now()
 			}
 		}
 
-		// Initialize CloudWatch metrics if enabled
+		// Initialize metrics if enabled, METRICS_BACKEND selects the backend
 		if getEnv("METRICS_ENABLED", "true") == "true" {
-			cwClient := cloudwatch.NewFromConfig(awsCfg)
-			cwMetrics = metrics.NewCloudWatchMetrics(
-				cwClient,
-				getEnv("METRICS_NAMESPACE", "CloudTrailFilter"),
-			)
+			metricsRec, err = metrics.NewFromEnv(&awsCfg)
+			if err != nil {
+				initError = fmt.Errorf("failed to create metrics backend: %w", err)
+				return
+			}
 		}
+		recordConfigDegraded(ctx)
 	})
 }
 
 // Handler is the main Lambda handler with all optimizations
-func Handler(ctx context.Context, event any) ([]byte, error) {
+func Handler(ctx context.Context, event any) (result []byte, err error) {
 	start := time.Now()
 
 	// Wait for initialization if needed
@@ -196,28 +289,40 @@ func Handler(ctx context.Context, event any) ([]byte, error) {
 	requestID := getRequestID(ctx)
 	ctx = log.With().Str("requestId", requestID).Logger().WithContext(ctx)
 
+	// Bound the retries of the whole invocation, nested loops included
+	ctx = retry.ContextWithBudget(ctx, retry.NewBudget(retryBudget))
+
+	// Join the Lambda trace, spans are exported before the function is frozen
+	ctx, span := tracer.Start(tracing.ContextFromLambda(ctx), "Handler", trace.WithAttributes(
+		attribute.String("faas.invocation_id", requestID),
+	))
+	defer func() {
+		tracing.End(span, err)
+		if tracerProvider != nil {
+			if flushErr := tracerProvider.ForceFlush(ctx); flushErr != nil {
+				log.Ctx(ctx).Warn().Err(flushErr).Msg("failed to flush traces")
+			}
+		}
+	}()
+
 	log.Ctx(ctx).Debug().Any("event", event).Msg("processing event")
 
 	// Record Lambda start metric
-	if cwMetrics != nil {
+	if metricsRec != nil {
 		defer func() {
-			cwMetrics.RecordLambdaDuration(time.Since(start), map[string]string{
-				"RequestId": requestID,
-			})
+			metricsRec.RecordLambdaDuration(time.Since(start), nil)
 			// Record memory usage
 			var m runtime.MemStats
 			runtime.ReadMemStats(&m)
-			cwMetrics.RecordMemoryUsed(float64(m.Alloc)/1024/1024, map[string]string{
-				"RequestId": requestID,
-			})
+			metricsRec.RecordMemoryUsed(float64(m.Alloc)/1024/1024, nil)
 		}()
 	}
 
 	// Refresh configuration if needed
 	if err := refreshConfigurationIfNeeded(ctx); err != nil {
 		log.Ctx(ctx).Error().Err(err).Msg("failed to refresh configuration")
-		if cwMetrics != nil {
-			cwMetrics.RecordError("ConfigRefresh", map[string]string{"RequestId": requestID})
+		if metricsRec != nil {
+			metricsRec.RecordError("ConfigRefresh", nil)
 		}
 		return nil, err
 	}
@@ -226,16 +331,17 @@ func Handler(ctx context.Context, event any) ([]byte, error) {
 	eventBytes, err := utils.Marshal(event)
 	if err != nil {
 		log.Ctx(ctx).Error().Err(err).Msg("failed to marshal event")
-		if cwMetrics != nil {
-			cwMetrics.RecordError("EventMarshal", map[string]string{"RequestId": requestID})
+		if metricsRec != nil {
+			metricsRec.RecordError("EventMarshal", nil)
 		}
 		return nil, err
 	}
 
 	// Broadcast event if configured with error tracking
 	if processorCfg.SQSQueueURL != "" || processorCfg.SNSTopicArn != "" {
-		// Create a separate context with timeout for broadcast
-		broadcastCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		// Create a separate context with timeout for broadcast, keeping the
+		// logger and trace of the invocation but not its cancellation
+		broadcastCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
 		go func() {
 			defer cancel()
 			broadcastEvent(broadcastCtx, string(eventBytes))
@@ -245,18 +351,27 @@ func Handler(ctx context.Context, event any) ([]byte, error) {
 	// Process the event with retry logic
 	processor := createOptimizedProcessor()
 
-	result, err := retry.DoTyped(ctx, func() ([]byte, error) {
+	result, err = retry.DoTyped(ctx, func() ([]byte, error) {
 		return processor.Handler(ctx, eventBytes)
 	},
 		retry.WithMaxRetries(2),
 		retry.WithBaseDelay(100*time.Millisecond),
 		retry.WithRetryableError(retry.IsRetryable),
+		retry.WithDeadlineReserve(retryDeadlineReserve),
 	)
 
+	// Publish rule hits once per invocation
+	if hits := ruleHits.Drain(); metricsRec != nil && len(hits) > 0 {
+		metricsRec.RecordRuleHits(hits, nil)
+	}
+	if hits := shadowHits.Drain(); metricsRec != nil && len(hits) > 0 {
+		metricsRec.RecordShadowRuleHits(hits, nil)
+	}
+
 	if err != nil {
 		log.Ctx(ctx).Error().Err(err).Msg("failed to process event")
-		if cwMetrics != nil {
-			cwMetrics.RecordError("EventProcessing", map[string]string{"RequestId": requestID})
+		if metricsRec != nil {
+			metricsRec.RecordError(retryErrorType(err, "EventProcessing"), nil)
 		}
 		return nil, err
 	}
@@ -266,8 +381,8 @@ func Handler(ctx context.Context, event any) ([]byte, error) {
 		Msg("event processed successfully")
 
 	// Flush metrics
-	if cwMetrics != nil {
-		if err := cwMetrics.Flush(ctx); err != nil {
+	if metricsRec != nil {
+		if err := metricsRec.Flush(ctx); err != nil {
 			log.Ctx(ctx).Warn().Err(err).Msg("failed to flush metrics")
 		}
 	}
@@ -275,7 +390,7 @@ func Handler(ctx context.Context, event any) ([]byte, error) {
 	return result, nil
 }
 
-func refreshConfigurationIfNeeded(ctx context.Context) error {
+func refreshConfigurationIfNeeded(ctx context.Context) (err error) {
 	configMutex.RLock()
 	timeSinceLoad := time.Since(lastConfigLoad)
 	configMutex.RUnlock()
@@ -283,7 +398,7 @@ func refreshConfigurationIfNeeded(ctx context.Context) error {
 	// Refresh every 5 minutes (configurable)
 	refreshInterval, _ := time.ParseDuration(getEnv("CONFIG_REFRESH_INTERVAL", "5m"))
 
-	if timeSinceLoad < refreshInterval && cachedRules != nil {
+	if timeSinceLoad < refreshInterval && activeRules.Load() != nil {
 		return nil // Configuration is fresh
 	}
 
@@ -291,136 +406,335 @@ func refreshConfigurationIfNeeded(ctx context.Context) error {
 	defer configMutex.Unlock()
 
 	// Double-check after acquiring lock
-	if time.Since(lastConfigLoad) < refreshInterval && cachedRules != nil {
+	if time.Since(lastConfigLoad) < refreshInterval && activeRules.Load() != nil {
 		return nil
 	}
 
 	log.Ctx(ctx).Debug().Msg("refreshing configuration")
 
+	ctx, span := tracer.Start(ctx, "config.refresh", trace.WithAttributes(
+		attribute.String("ctlp.config.source", configLoader.String()),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	start := time.Now()
+	defer recordConfigDegraded(ctx)
 
 	// Load configuration with retry
-	var cfg *rules.Configuration
-	err := retry.Do(ctx, func() error {
+	var newCachedRules *rules.CachedConfiguration
+	err = retry.Do(ctx, func() error {
 		var loadErr error
-		cfg, loadErr = configLoader.Load(ctx)
+		newCachedRules, loadErr = loadCachedRules(ctx)
 		return loadErr
-	}, retry.WithMaxRetries(3))
+	},
+		retry.WithMaxRetries(3),
+		retry.WithRetryableError(retry.IsRetryable),
+		retry.WithCircuitBreaker(configBreaker),
+		retry.WithDeadlineReserve(retryDeadlineReserve),
+	)
 
 	if err != nil {
+		// Keep filtering with the previous rules while the source is unavailable
+		if errors.Is(err, retry.ErrCircuitOpen) && activeRules.Load() != nil {
+			log.Ctx(ctx).Warn().Err(err).Msg("configuration source unavailable, keeping cached rules")
+			return nil
+		}
 		return fmt.Errorf("failed to load configuration: %w", err)
 	}
 
-	// Prepare cached rules
-	newCachedRules, err := rules.PrepareConfiguration(cfg)
-	if err != nil {
-		return fmt.Errorf("failed to prepare cached rules: %w", err)
-	}
-
-	cachedRules = newCachedRules
+	activeRules.Store(newCachedRules)
 	lastConfigLoad = time.Now()
 
-	if cwMetrics != nil {
-		cwMetrics.RecordConfigLoadTime(time.Since(start), configLoader.String(), map[string]string{})
+	if metricsRec != nil {
+		metricsRec.RecordConfigLoadTime(time.Since(start), configLoader.String(), map[string]string{})
 	}
 
 	return nil
 }
 
+// recordConfigDegraded records whether the rules come from a fallback source:
+// a secondary source, the last known good configuration or the default
+func recordConfigDegraded(ctx context.Context) {
+	degradedLoader, ok := configLoader.(config.DegradedLoader)
+	if !ok {
+		return
+	}
+
+	source, degraded := degradedLoader.Degraded()
+	if source == "" {
+		return // no configuration loaded yet
+	}
+	if degraded {
+		log.Ctx(ctx).Warn().Str("source", source).Msg("configuration degraded, rules served by a fallback source")
+	}
+	if metricsRec != nil {
+		metricsRec.RecordConfigDegraded(source, degraded, map[string]string{})
+	}
+}
+
+// loadCachedRules loads the compiled rules, a CachedConfigLoader returns the
+// rules it already compiled when the configuration did not change
+func loadCachedRules(ctx context.Context) (*rules.CachedConfiguration, error) {
+	if cachedLoader, ok := configLoader.(*config.CachedConfigLoader); ok {
+		return cachedLoader.LoadCached(ctx)
+	}
+
+	cfg, err := configLoader.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cachedCfg, err := rules.PrepareConfiguration(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare cached rules: %w", err)
+	}
+	return cachedCfg, nil
+}
+
 func createOptimizedProcessor() *snsevents.Processor {
 	return &snsevents.Processor{
 		// Use optimized copier with cached rules
 		Copier: &OptimizedCopier{
 			s3Client:    s3Client,
 			cfg:         processorCfg,
-			cachedRules: cachedRules,
-			cwMetrics:   cwMetrics,
+			cachedRules: &activeRules,
+			metricsRec:  metricsRec,
 		},
 	}
 }
 
 // OptimizedCopier is an optimized version of the CloudTrail copier
 type OptimizedCopier struct {
-	s3Client    *s3.Client
-	cfg         flags.S3Processor
-	cachedRules *rules.CachedConfiguration
-	cwMetrics   *metrics.CloudWatchMetrics
+	s3Client *s3.Client
+	cfg      flags.S3Processor
+	// cachedRules is swapped when a new configuration version lands, every
+	// file is filtered with the version active when its processing starts
+	cachedRules *atomic.Pointer[rules.CachedConfiguration]
+	metricsRec  metrics.Recorder
 }
 
-func (oc *OptimizedCopier) Copy(ctx context.Context, bucket, key string) error {
+func (oc *OptimizedCopier) Copy(ctx context.Context, bucket, key string) (err error) {
+	ctx, span := tracer.Start(ctx, "file.process", trace.WithAttributes(
+		attribute.String("aws.s3.bucket", bucket),
+		attribute.String("aws.s3.key", key),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	start := time.Now()
 
+	// SourceBucket and FileKey are kept out of the metric dimensions by the
+	// dimension policy, they are only logged (or written as EMF properties)
 	dimensions := map[string]string{
-		"SourceBucket": bucket,
-		"FileKey":      key,
+		"SourceAccount": metrics.SourceAccountFromKey(key),
+		"SourceBucket":  bucket,
+		"FileKey":       key,
 	}
 
 	// Ensure we have cached rules
-	if oc.cachedRules == nil {
+	cachedCfg := oc.cachedRules.Load()
+	if cachedCfg == nil {
 		if err := refreshConfigurationIfNeeded(ctx); err != nil {
-			if oc.cwMetrics != nil {
-				oc.cwMetrics.RecordError("ConfigLoadError", dimensions)
+			if oc.metricsRec != nil {
+				oc.metricsRec.RecordError("ConfigLoadError", dimensions)
 			}
 			return fmt.Errorf("failed to load configuration: %w", err)
 		}
-		oc.cachedRules = cachedRules
+		cachedCfg = oc.cachedRules.Load()
 	}
 
 	// Download and process the file using cached rules
 	copier := cloudtrailprocessor.NewCopier(oc.cfg, &awsCfg)
+	copier.Sink = outputSink
+
+	// Keep the hits of the last attempt only, retries filter the same records again
+	var fileHits, fileShadowHits map[string]int
+	var passedThrough, badRecords int
+	copier.OnFiltered = func(ctx context.Context, file cloudtrailprocessor.SinkFile, stats *cloudtrailprocessor.FilterStats) {
+		fileHits = stats.RuleHits
+		fileShadowHits = stats.ShadowHits
+		passedThrough = stats.PassedThrough
+		badRecords = len(stats.BadRecords)
+	}
+	copier.OnPassThrough = func(ctx context.Context, file cloudtrailprocessor.SinkFile, err error) {
+		if oc.metricsRec != nil {
+			oc.metricsRec.RecordPassThrough("object", 1, dimensions)
+		}
+	}
 
 	// Use retry logic for S3 operations with cached rules
-	err := retry.Do(ctx, func() error {
-		return copier.CopyWithCachedRules(ctx, bucket, key, oc.cachedRules)
+	attempts := 0
+	err = retry.Do(ctx, func() error {
+		attempts++
+		return copier.CopyWithCachedRules(ctx, bucket, key, cachedCfg)
 	},
 		retry.WithMaxRetries(3),
 		retry.WithRetryableError(retry.IsRetryable),
+		retry.WithCircuitBreaker(s3Breaker),
+		retry.WithDeadlineReserve(retryDeadlineReserve),
 	)
 
-	if oc.cwMetrics != nil {
-		oc.cwMetrics.RecordProcessingTime(time.Since(start), dimensions)
+	if fileHits != nil {
+		ruleHits.Add(fileHits)
+	}
+	if fileShadowHits != nil {
+		shadowHits.Add(fileShadowHits)
+	}
+	if oc.metricsRec != nil && passedThrough > 0 {
+		oc.metricsRec.RecordPassThrough("record", passedThrough, dimensions)
+	}
+	if oc.metricsRec != nil && badRecords > passedThrough {
+		oc.metricsRec.RecordBadRecords("skip", badRecords-passedThrough, dimensions)
+	}
+	if oc.metricsRec != nil && passedThrough > 0 {
+		oc.metricsRec.RecordBadRecords("keep", passedThrough, dimensions)
+	}
+
+	if oc.metricsRec != nil {
+		oc.metricsRec.RecordProcessingTime(time.Since(start), dimensions)
 		if err != nil {
-			oc.cwMetrics.RecordError("CopyError", dimensions)
+			oc.metricsRec.RecordError(retryErrorType(err, "CopyError"), dimensions)
 		}
 	}
 
-	return err
+	if err != nil {
+		return oc.deadLetter(ctx, bucket, key, cachedCfg.Version, err, attempts, dimensions)
+	}
+	return nil
+}
+
+// deadLetter writes the failure record of a file that failed permanently after
+// the final retry. Once the record is written the failure is handled: the
+// invocation is not failed for it and the file is replayed with the
+// replay-failures command. Transient failures (outages, open circuits, retries
+// given up for lack of time or budget) fail the invocation so that Lambda
+// retries the event.
+func (oc *OptimizedCopier) deadLetter(ctx context.Context, bucket, key, configVersion string, copyErr error, attempts int, dimensions map[string]string) error {
+	if !deadLetterCfg.Enabled() {
+		return copyErr
+	}
+
+	class := myaws.FailureClass(copyErr)
+	if class != myaws.FailureClassPermanent {
+		return copyErr
+	}
+
+	c, err := getOrCreateAWSConnection()
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("failed to get AWS connection for dead-letter")
+		return copyErr
+	}
+
+	rec := myaws.FailureRecord{
+		Bucket:        bucket,
+		Key:           key,
+		ErrorClass:    class,
+		Error:         copyErr.Error(),
+		Attempts:      attempts,
+		ConfigVersion: configVersion,
+		RequestID:     getRequestID(ctx),
+	}
+
+	// The record is written even when the invocation is out of time
+	putCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	if err := c.PutFailureRecord(putCtx, rec); err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("failed to write failure record")
+		return copyErr
+	}
+
+	log.Ctx(ctx).Warn().
+		Err(copyErr).
+		Str("bucket", bucket).
+		Str("key", key).
+		Str("errorClass", rec.ErrorClass).
+		Int("attempts", attempts).
+		Str("destination", deadLetterCfg.String()).
+		Msg("file dead-lettered")
+	if oc.metricsRec != nil {
+		oc.metricsRec.RecordError("DeadLettered", dimensions)
+	}
+	return nil
 }
 
 func getOrCreateAWSConnection() (*myaws.Connection, error) {
 	var err error
 	connOnce.Do(func() {
-		awsConnection, err = myaws.New(&awsCfg, processorCfg.SQSQueueURL, processorCfg.SNSTopicArn)
+		awsConnection, err = myaws.New(&awsCfg, processorCfg.SQSQueueURL, processorCfg.SNSTopicArn,
+			myaws.WithDeadLetter(deadLetterCfg))
 	})
 	return awsConnection, err
 }
 
 func broadcastEvent(ctx context.Context, eventStr string) {
+	ctx, span := tracer.Start(ctx, "broadcast")
+	var err error
+	defer func() { tracing.End(span, err) }()
+
 	start := time.Now()
 	c, err := getOrCreateAWSConnection()
 	if err != nil {
 		log.Ctx(ctx).Error().Err(err).Msg("failed to get AWS connection for broadcast")
-		if cwMetrics != nil {
-			cwMetrics.RecordError("BroadcastConnectionError", nil)
+		if metricsRec != nil {
+			metricsRec.RecordError("BroadcastConnectionError", nil)
 		}
 		return
 	}
 
-	if err := c.BroadCastEvent(ctx, eventStr); err != nil {
+	err = broadcastBreaker.Execute(func() error {
+		return c.BroadCastEvent(ctx, eventStr)
+	})
+	if err != nil {
 		log.Ctx(ctx).Error().Err(err).Msg("failed to broadcast event")
-		if cwMetrics != nil {
-			cwMetrics.RecordError("BroadcastError", nil)
+		if metricsRec != nil {
+			metricsRec.RecordError("BroadcastError", nil)
 		}
 	} else {
 		log.Ctx(ctx).Debug().Dur("duration", time.Since(start)).Msg("successfully broadcast event")
-		if cwMetrics != nil {
-			cwMetrics.RecordProcessingTime(time.Since(start), map[string]string{"Operation": "Broadcast"})
+		if metricsRec != nil {
+			metricsRec.RecordProcessingTime(time.Since(start), map[string]string{"Operation": "Broadcast"})
 		}
 	}
 }
 
-func getRequestID(_ context.Context) string {
-	// Generate a unique request ID for tracing
+// retryErrorType returns the error type recorded for err, retries given up for
+// lack of time or budget are told apart from failures of the operation
+func retryErrorType(err error, defaultType string) string {
+	var deadlineErr *retry.DeadlineError
+	switch {
+	case errors.As(err, &deadlineErr):
+		return "RetryDeadline"
+	case errors.Is(err, retry.ErrBudgetExhausted):
+		return "RetryBudgetExhausted"
+	default:
+		return defaultType
+	}
+}
+
+// newCircuitBreaker creates the circuit breaker of a dependency, only transient
+// errors count as failures and transitions are recorded as metrics
+func newCircuitBreaker(dependency string, opts ...retry.BreakerOption) *retry.CircuitBreaker {
+	return retry.NewCircuitBreaker(dependency, append([]retry.BreakerOption{
+		retry.WithFailureClassifier(retry.IsRetryable),
+		retry.WithStateChange(func(name string, from, to retry.State) {
+			if metricsRec != nil {
+				metricsRec.RecordCircuitBreakerState(name, to.String(), nil)
+			}
+		}),
+	}, opts...)...)
+}
+
+// isCopyFailure counts the transient failures of a copy, the failures of the
+// output sinks are counted by the breakers of the sinks
+func isCopyFailure(err error) bool {
+	var sinkErr *sinks.SinkError
+	return !errors.As(err, &sinkErr) && retry.IsRetryable(err)
+}
+
+func getRequestID(ctx context.Context) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		return lc.AwsRequestID
+	}
+	// Generate a unique request ID outside of Lambda
 	return fmt.Sprintf("req-%d-%d", time.Now().Unix(), time.Now().Nanosecond())
 }
 
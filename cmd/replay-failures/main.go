@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"ctlp/pkg/snsevents"
+	"flag"
+	"fmt"
+	"os"
+
+	myaws "ctlp/pkg/aws"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+func main() {
+	var (
+		queueURL    = flag.String("queue-url", os.Getenv("DEAD_LETTER_QUEUE_URL"), "Dead-letter SQS queue URL")
+		bucket      = flag.String("bucket", os.Getenv("DEAD_LETTER_BUCKET"), "Dead-letter bucket, when no queue is used")
+		prefix      = flag.String("prefix", myaws.DefaultDeadLetterPrefix, "Key prefix of the failure records in the dead-letter bucket")
+		topicARN    = flag.String("topic-arn", "", "SNS topic triggering the function")
+		payloadType = flag.String("payload-type", "s3", "SNS payload type of the function: s3 or cloudtrail")
+		limit       = flag.Int("limit", 100, "Maximum number of files to replay")
+		dryRun      = flag.Bool("dry-run", false, "List the failure records without replaying them")
+	)
+	flag.Parse()
+
+	deadLetter := myaws.DeadLetterConfig{QueueURL: *queueURL, Bucket: *bucket, Prefix: *prefix}
+	if !deadLetter.Enabled() {
+		fmt.Fprintln(os.Stderr, "Error: -queue-url or -bucket is required")
+		os.Exit(1)
+	}
+	if *topicARN == "" && !*dryRun {
+		fmt.Fprintln(os.Stderr, "Error: -topic-arn is required")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading AWS configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	conn, err := myaws.New(&awsCfg, "", *topicARN, myaws.WithDeadLetter(deadLetter))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating AWS connection: %v\n", err)
+		os.Exit(1)
+	}
+
+	replayed := 0
+	for replayed < *limit {
+		records, err := conn.FetchFailureRecords(ctx, *limit-replayed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error fetching failure records: %v\n", err)
+			os.Exit(1)
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		for _, rec := range records {
+			fmt.Printf("s3://%s/%s (%s after %d attempts, config %s): %s\n",
+				rec.Bucket, rec.Key, rec.ErrorClass, rec.Attempts, rec.ConfigVersion, rec.Error)
+			if *dryRun {
+				continue
+			}
+
+			// The record is only deleted once the file is announced again
+			message, err := snsevents.NewNotification(*payloadType, rec.Bucket, rec.Key)
+			if err == nil {
+				err = conn.PublishSNSMessage(ctx, message)
+			}
+			if err == nil {
+				err = conn.DeleteFailureRecord(ctx, rec)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error replaying s3://%s/%s: %v\n", rec.Bucket, rec.Key, err)
+				os.Exit(1)
+			}
+		}
+		replayed += len(records)
+
+		// Records are not deleted on a dry run, fetching again would list them again
+		if *dryRun {
+			break
+		}
+	}
+
+	if *dryRun {
+		fmt.Printf("%d failure records found in %s\n", replayed, deadLetter)
+		return
+	}
+	fmt.Printf("%d files replayed from %s\n", replayed, deadLetter)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"ctlp/pkg/metrics"
+	"ctlp/pkg/rules"
+	"flag"
+	"fmt"
+	"os"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+)
+
+func main() {
+	var (
+		inputFile = flag.String("input", "rules-example.yaml", "Input YAML configuration file")
+		namespace = flag.String("namespace", "CloudTrailFilter", "CloudWatch metrics namespace")
+		days      = flag.Int("days", 30, "Report rules without hits over this number of days")
+	)
+	flag.Parse()
+
+	ctx := context.Background()
+
+	// Load and validate the rules to check
+	rulesCfg, err := rules.LoadFromConfigFile(ctx, *inputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	ruleNames := make([]string, len(rulesCfg.Rules))
+	for i, rule := range rulesCfg.Rules {
+		ruleNames[i] = rule.Name
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading AWS configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	stale, err := metrics.FindStaleRules(ctx, cloudwatch.NewFromConfig(awsCfg), *namespace, ruleNames, *days)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error querying rule hits: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(stale) == 0 {
+		fmt.Printf("No rule without hits over the last %d days\n", *days)
+		return
+	}
+
+	fmt.Printf("Rules without hits over the last %d days:\n", *days)
+	for _, name := range stale {
+		fmt.Printf("  - %s\n", name)
+	}
+}
@@ -5,25 +5,37 @@ import (
 	"fmt"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 )
 
 type Connection struct {
-	sqs *sqs.Client
+	sqs sqsAPI
 	sns *sns.Client
+	s3  s3API
 
 	queueURL string
 	topicARN string
+
+	deadLetter DeadLetterConfig
 }
 
-func New(awscfg *aws.Config, queueURL, topicARN string) (*Connection, error) {
-	return &Connection{
+// Option is a function that modifies Connection
+type Option func(*Connection)
+
+func New(awscfg *aws.Config, queueURL, topicARN string, opts ...Option) (*Connection, error) {
+	c := &Connection{
 		sqs:      sqs.NewFromConfig(*awscfg),
 		sns:      sns.NewFromConfig(*awscfg),
+		s3:       s3.NewFromConfig(*awscfg),
 		queueURL: queueURL,
 		topicARN: topicARN,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
 }
 
 func (c *Connection) SendSQSMessage(ctx context.Context, message string) error {
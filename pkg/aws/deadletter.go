@@ -0,0 +1,279 @@
+package aws
+
+import (
+	"context"
+	"crypto/sha256"
+	"ctlp/pkg/retry"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/encoding/json"
+)
+
+// DefaultDeadLetterPrefix is the key prefix of the failure records written to S3
+const DefaultDeadLetterPrefix = "failed/"
+
+type sqsAPI interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+}
+
+type s3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// DeadLetterConfig selects where failure records are written, the queue takes
+// precedence over the bucket
+type DeadLetterConfig struct {
+	QueueURL string
+	Bucket   string
+	Prefix   string
+}
+
+// Enabled reports whether a destination is configured
+func (c DeadLetterConfig) Enabled() bool {
+	return c.QueueURL != "" || c.Bucket != ""
+}
+
+// String returns the destination, for logging
+func (c DeadLetterConfig) String() string {
+	switch {
+	case c.QueueURL != "":
+		return c.QueueURL
+	case c.Bucket != "":
+		return "s3://" + c.Bucket + "/" + c.Prefix
+	default:
+		return "none"
+	}
+}
+
+// WithDeadLetter sets the destination of the failure records
+func WithDeadLetter(cfg DeadLetterConfig) Option {
+	return func(c *Connection) {
+		if cfg.Bucket != "" && cfg.Prefix == "" {
+			cfg.Prefix = DefaultDeadLetterPrefix
+		}
+		c.deadLetter = cfg
+	}
+}
+
+// FailureRecord describes a CloudTrail file that could not be processed after
+// the final retry
+type FailureRecord struct {
+	Bucket        string    `json:"bucket"`
+	Key           string    `json:"key"`
+	ErrorClass    string    `json:"errorClass"`
+	Error         string    `json:"error"`
+	Attempts      int       `json:"attempts"`
+	ConfigVersion string    `json:"configVersion,omitempty"`
+	RequestID     string    `json:"requestId,omitempty"`
+	FailedAt      time.Time `json:"failedAt"`
+
+	// handle identifies the stored record: SQS receipt handle or S3 object key
+	handle string
+}
+
+// FailureClassPermanent is the error class of the failures that are written to
+// the dead-letter destination, the other classes fail the invocation
+const FailureClassPermanent = "Permanent"
+
+// FailureClass returns the error class of a failure record
+//
+// Only errors known to fail again are Permanent (see retry.IsPermanent): the
+// errors of unknown type are Transient, so that throttling or an outage left
+// after the retries of a sink is retried by Lambda instead of dead-lettered.
+func FailureClass(err error) string {
+	var deadlineErr *retry.DeadlineError
+	switch {
+	case errors.As(err, &deadlineErr):
+		return "RetryDeadline"
+	case errors.Is(err, retry.ErrBudgetExhausted):
+		return "RetryBudgetExhausted"
+	case errors.Is(err, retry.ErrCircuitOpen):
+		return "CircuitOpen"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "Canceled"
+	case retry.IsPermanent(err):
+		return FailureClassPermanent
+	default:
+		return "Transient"
+	}
+}
+
+// DeadLetterEnabled reports whether failure records can be written
+func (c *Connection) DeadLetterEnabled() bool {
+	return c.deadLetter.Enabled()
+}
+
+// PutFailureRecord writes a failure record to the dead-letter queue or bucket
+func (c *Connection) PutFailureRecord(ctx context.Context, rec FailureRecord) error {
+	if rec.FailedAt.IsZero() {
+		rec.FailedAt = time.Now().UTC()
+	}
+
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal failure record: %w", err)
+	}
+
+	switch {
+	case c.deadLetter.QueueURL != "":
+		_, err = c.sqs.SendMessage(ctx, &sqs.SendMessageInput{
+			QueueUrl:    aws.String(c.deadLetter.QueueURL),
+			MessageBody: aws.String(string(body)),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to send failure record: %w", err)
+		}
+	case c.deadLetter.Bucket != "":
+		_, err = c.s3.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(c.deadLetter.Bucket),
+			Key:         aws.String(failureRecordKey(c.deadLetter.Prefix, rec)),
+			Body:        strings.NewReader(string(body)),
+			ContentType: aws.String("application/json"),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write failure record: %w", err)
+		}
+	default:
+		return fmt.Errorf("dead-letter destination is not configured")
+	}
+
+	return nil
+}
+
+// FetchFailureRecords returns up to limit failure records, they stay stored until
+// deleted with DeleteFailureRecord
+func (c *Connection) FetchFailureRecords(ctx context.Context, limit int) ([]FailureRecord, error) {
+	switch {
+	case c.deadLetter.QueueURL != "":
+		return c.receiveFailureRecords(ctx, limit)
+	case c.deadLetter.Bucket != "":
+		return c.listFailureRecords(ctx, limit)
+	default:
+		return nil, fmt.Errorf("dead-letter destination is not configured")
+	}
+}
+
+// DeleteFailureRecord removes a record returned by FetchFailureRecords
+func (c *Connection) DeleteFailureRecord(ctx context.Context, rec FailureRecord) error {
+	if rec.handle == "" {
+		return fmt.Errorf("failure record for s3://%s/%s was not fetched", rec.Bucket, rec.Key)
+	}
+
+	var err error
+	if c.deadLetter.QueueURL != "" {
+		_, err = c.sqs.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(c.deadLetter.QueueURL),
+			ReceiptHandle: aws.String(rec.handle),
+		})
+	} else {
+		_, err = c.s3.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(c.deadLetter.Bucket),
+			Key:    aws.String(rec.handle),
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete failure record: %w", err)
+	}
+	return nil
+}
+
+// receiveFailureRecords receives messages until some hold a valid failure record
+// or the queue is empty. Malformed messages are logged and skipped, they stay in
+// the queue (hidden for its visibility timeout) so they can be inspected or moved
+// away by its redrive policy.
+func (c *Connection) receiveFailureRecords(ctx context.Context, limit int) ([]FailureRecord, error) {
+	var records []FailureRecord
+	for len(records) == 0 {
+		out, err := c.sqs.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(c.deadLetter.QueueURL),
+			MaxNumberOfMessages: int32(min(limit, 10)),
+			WaitTimeSeconds:     1,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive failure records: %w", err)
+		}
+		if len(out.Messages) == 0 {
+			break
+		}
+
+		for _, msg := range out.Messages {
+			var rec FailureRecord
+			if err := json.Unmarshal([]byte(aws.ToString(msg.Body)), &rec); err != nil {
+				log.Warn().Err(err).
+					Str("queue", c.deadLetter.QueueURL).
+					Str("messageId", aws.ToString(msg.MessageId)).
+					Msg("invalid failure record skipped")
+				continue
+			}
+			rec.handle = aws.ToString(msg.ReceiptHandle)
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+func (c *Connection) listFailureRecords(ctx context.Context, limit int) ([]FailureRecord, error) {
+	out, err := c.s3.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(c.deadLetter.Bucket),
+		Prefix:  aws.String(c.deadLetter.Prefix),
+		MaxKeys: aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list failure records: %w", err)
+	}
+
+	records := make([]FailureRecord, 0, len(out.Contents))
+	for _, obj := range out.Contents {
+		key := aws.ToString(obj.Key)
+		rec, err := c.getFailureRecord(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func (c *Connection) getFailureRecord(ctx context.Context, key string) (FailureRecord, error) {
+	var rec FailureRecord
+
+	out, err := c.s3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.deadLetter.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return rec, fmt.Errorf("failed to read failure record %s: %w", key, err)
+	}
+	defer out.Body.Close()
+
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		return rec, fmt.Errorf("failed to read failure record %s: %w", key, err)
+	}
+	if err := json.Unmarshal(body, &rec); err != nil {
+		return rec, fmt.Errorf("invalid failure record %s: %w", key, err)
+	}
+	rec.handle = key
+	return rec, nil
+}
+
+// failureRecordKey returns a unique key per failure, partitioned by day
+func failureRecordKey(prefix string, rec FailureRecord) string {
+	sum := sha256.Sum256([]byte(rec.Bucket + "/" + rec.Key))
+	return fmt.Sprintf("%s%s/%d-%s.json",
+		prefix, rec.FailedAt.UTC().Format("2006/01/02"), rec.FailedAt.UnixNano(), hex.EncodeToString(sum[:8]))
+}
@@ -0,0 +1,215 @@
+package aws
+
+import (
+	"context"
+	"ctlp/pkg/retry"
+	"ctlp/pkg/sinks"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/segmentio/encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockSQSClient struct {
+	mock.Mock
+}
+
+func (m *mockSQSClient) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	args := m.Called(ctx, params)
+	return &sqs.SendMessageOutput{}, args.Error(0)
+}
+
+func (m *mockSQSClient) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sqs.ReceiveMessageOutput), args.Error(1)
+}
+
+func (m *mockSQSClient) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	args := m.Called(ctx, params)
+	return &sqs.DeleteMessageOutput{}, args.Error(0)
+}
+
+type mockS3Client struct {
+	mock.Mock
+}
+
+func (m *mockS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	args := m.Called(ctx, params)
+	return &s3.PutObjectOutput{}, args.Error(0)
+}
+
+func (m *mockS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
+}
+
+func (m *mockS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.ListObjectsV2Output), args.Error(1)
+}
+
+func (m *mockS3Client) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	args := m.Called(ctx, params)
+	return &s3.DeleteObjectOutput{}, args.Error(0)
+}
+
+func TestFailureRecords(t *testing.T) {
+	ctx := context.Background()
+	rec := FailureRecord{
+		Bucket:        "trail-bucket",
+		Key:           "AWSLogs/123456789012/CloudTrail/us-east-1/2024/01/02/file.json.gz",
+		ErrorClass:    "Permanent",
+		Error:         "failed to decode",
+		Attempts:      1,
+		ConfigVersion: "1.2.0",
+		FailedAt:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	body, _ := json.Marshal(rec)
+
+	t.Run("queue", func(t *testing.T) {
+		client := new(mockSQSClient)
+		conn := &Connection{sqs: client}
+		WithDeadLetter(DeadLetterConfig{QueueURL: "https://sqs/dlq", Bucket: "ignored"})(conn)
+		assert.True(t, conn.DeadLetterEnabled())
+
+		client.On("SendMessage", ctx, mock.MatchedBy(func(in *sqs.SendMessageInput) bool {
+			var sent FailureRecord
+			return aws.ToString(in.QueueUrl) == "https://sqs/dlq" &&
+				json.Unmarshal([]byte(aws.ToString(in.MessageBody)), &sent) == nil && sent == rec
+		})).Return(nil).Once()
+		assert.NoError(t, conn.PutFailureRecord(ctx, rec))
+
+		client.On("ReceiveMessage", ctx, mock.MatchedBy(func(in *sqs.ReceiveMessageInput) bool {
+			return in.MaxNumberOfMessages == 10
+		})).Return(&sqs.ReceiveMessageOutput{Messages: []sqstypes.Message{
+			{Body: aws.String(string(body)), ReceiptHandle: aws.String("handle-1")},
+		}}, nil).Once()
+		records, err := conn.FetchFailureRecords(ctx, 100)
+		assert.NoError(t, err)
+		assert.Len(t, records, 1)
+		assert.Equal(t, rec.Key, records[0].Key)
+		assert.Equal(t, "handle-1", records[0].handle)
+
+		client.On("DeleteMessage", ctx, mock.MatchedBy(func(in *sqs.DeleteMessageInput) bool {
+			return aws.ToString(in.ReceiptHandle) == "handle-1"
+		})).Return(nil).Once()
+		assert.NoError(t, conn.DeleteFailureRecord(ctx, records[0]))
+		client.AssertExpectations(t)
+	})
+
+	t.Run("malformed messages are skipped", func(t *testing.T) {
+		client := new(mockSQSClient)
+		conn := &Connection{sqs: client}
+		WithDeadLetter(DeadLetterConfig{QueueURL: "https://sqs/dlq"})(conn)
+
+		client.On("ReceiveMessage", ctx, mock.Anything).Return(&sqs.ReceiveMessageOutput{Messages: []sqstypes.Message{
+			{MessageId: aws.String("msg-1"), Body: aws.String("not json"), ReceiptHandle: aws.String("handle-1")},
+		}}, nil).Once()
+		client.On("ReceiveMessage", ctx, mock.Anything).Return(&sqs.ReceiveMessageOutput{Messages: []sqstypes.Message{
+			{MessageId: aws.String("msg-2"), Body: aws.String("{"), ReceiptHandle: aws.String("handle-2")},
+			{MessageId: aws.String("msg-3"), Body: aws.String(string(body)), ReceiptHandle: aws.String("handle-3")},
+		}}, nil).Once()
+		records, err := conn.FetchFailureRecords(ctx, 100)
+		assert.NoError(t, err)
+		assert.Len(t, records, 1)
+		assert.Equal(t, "handle-3", records[0].handle)
+
+		client.On("ReceiveMessage", ctx, mock.Anything).Return(&sqs.ReceiveMessageOutput{}, nil).Once()
+		records, err = conn.FetchFailureRecords(ctx, 100)
+		assert.NoError(t, err)
+		assert.Empty(t, records)
+		client.AssertExpectations(t)
+	})
+
+	t.Run("bucket", func(t *testing.T) {
+		client := new(mockS3Client)
+		conn := &Connection{s3: client}
+		WithDeadLetter(DeadLetterConfig{Bucket: "failures"})(conn)
+
+		var key string
+		client.On("PutObject", ctx, mock.MatchedBy(func(in *s3.PutObjectInput) bool {
+			key = aws.ToString(in.Key)
+			return aws.ToString(in.Bucket) == "failures"
+		})).Return(nil).Once()
+		assert.NoError(t, conn.PutFailureRecord(ctx, rec))
+		assert.True(t, strings.HasPrefix(key, "failed/2024/01/02/"), key)
+		assert.True(t, strings.HasSuffix(key, ".json"), key)
+
+		client.On("ListObjectsV2", ctx, mock.MatchedBy(func(in *s3.ListObjectsV2Input) bool {
+			return aws.ToString(in.Prefix) == "failed/" && aws.ToInt32(in.MaxKeys) == 5
+		})).Return(&s3.ListObjectsV2Output{Contents: []s3types.Object{{Key: aws.String(key)}}}, nil).Once()
+		client.On("GetObject", ctx, mock.Anything).
+			Return(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(string(body)))}, nil).Once()
+		records, err := conn.FetchFailureRecords(ctx, 5)
+		assert.NoError(t, err)
+		assert.Len(t, records, 1)
+		assert.Equal(t, "1.2.0", records[0].ConfigVersion)
+
+		client.On("DeleteObject", ctx, mock.MatchedBy(func(in *s3.DeleteObjectInput) bool {
+			return aws.ToString(in.Key) == key
+		})).Return(nil).Once()
+		assert.NoError(t, conn.DeleteFailureRecord(ctx, records[0]))
+		client.AssertExpectations(t)
+	})
+
+	t.Run("write failure", func(t *testing.T) {
+		client := new(mockSQSClient)
+		conn := &Connection{sqs: client, deadLetter: DeadLetterConfig{QueueURL: "https://sqs/dlq"}}
+		client.On("SendMessage", ctx, mock.Anything).Return(errors.New("AccessDenied")).Once()
+
+		err := conn.PutFailureRecord(ctx, rec)
+		assert.EqualError(t, err, "failed to send failure record: AccessDenied")
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		conn := &Connection{}
+		assert.False(t, conn.DeadLetterEnabled())
+		assert.EqualError(t, conn.PutFailureRecord(ctx, rec), "dead-letter destination is not configured")
+		_, err := conn.FetchFailureRecords(ctx, 10)
+		assert.Error(t, err)
+		assert.Error(t, conn.DeleteFailureRecord(ctx, rec), "records must be fetched first")
+	})
+}
+
+func TestFailureClass(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"throttled stream", fmt.Errorf("failed to write records: %w", &sinks.PartialFailureError{
+			Failed: 3, Total: 10, ErrorCode: "ProvisionedThroughputExceededException", ErrorMessage: "Rate exceeded",
+		}), "Transient"},
+		{"unknown error", errors.New("connection lost"), "Transient"},
+		{"not found", &s3types.NoSuchKey{}, FailureClassPermanent},
+		{"circuit open", fmt.Errorf("s3: %w", retry.ErrCircuitOpen), "CircuitOpen"},
+		{"budget exhausted", fmt.Errorf("copy: %w", retry.ErrBudgetExhausted), "RetryBudgetExhausted"},
+		{"canceled", context.Canceled, "Canceled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, FailureClass(tt.err))
+		})
+	}
+}
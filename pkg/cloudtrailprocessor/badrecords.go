@@ -0,0 +1,38 @@
+package cloudtrailprocessor
+
+import (
+	"context"
+	"ctlp/pkg/rules"
+
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/encoding/json"
+)
+
+// badRecords returns the bad record policy of a file, fail-open mode keeps bad
+// records unless a policy is configured
+func (cp *S3Copier) badRecords() *rules.BadRecords {
+	policy := rules.BadRecordPolicy(cp.Cfg.BadRecordPolicy)
+	if policy == "" && cp.Cfg.FailOpen {
+		policy = rules.BadRecordKeep
+	}
+	return &rules.BadRecords{Policy: policy, Max: cp.Cfg.MaxBadRecords}
+}
+
+// handleBadRecord applies the bad record policy to a record that could not be
+// decoded or evaluated, the returned error fails the file
+func handleBadRecord(ctx context.Context, badRecords *rules.BadRecords, out *Cloudtrail, stats *FilterStats, index int, record json.RawMessage, err error) error {
+	keep, policyErr := badRecords.Handle(index, err)
+	if policyErr != nil {
+		return policyErr
+	}
+
+	if !keep {
+		log.Ctx(ctx).Warn().Err(err).Int("index", index).Msg("bad record skipped")
+		return nil
+	}
+
+	log.Ctx(ctx).Warn().Err(err).Int("index", index).Msg("record kept unfiltered")
+	out.Records = append(out.Records, record)
+	stats.PassedThrough++
+	return nil
+}
@@ -6,6 +6,8 @@ import (
 	"context"
 	"ctlp/pkg/flags"
 	"ctlp/pkg/rules"
+	"ctlp/pkg/tracing"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -19,16 +21,16 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// UploadJob helps track encoding / streaming errors for a go routine
-type UploadJob struct {
-	Error error
-}
+var tracer = tracing.Tracer("ctlp/pkg/cloudtrailprocessor")
 
 // S3API interface for s3 client methods
 type S3API interface {
 	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	CopyObject(context.Context, *s3.CopyObjectInput, ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
 }
 
 // DownloaderAPI interface for downloading files from s3 using MultiPartDownload
@@ -51,6 +53,23 @@ type Cloudtrail struct {
 	Records []json.RawMessage
 }
 
+// FilterStats holds the per-rule hit counts of a FilterRecords run
+type FilterStats struct {
+	// RuleHits has an entry for every configured rule, including rules without hits
+	RuleHits map[string]int
+	// ShadowHits counts the records each shadow rule would drop, the records are
+	// kept. It has an entry for every shadow rule.
+	ShadowHits map[string]int
+	// ProtectedKept counts, per rule, the protected events the rule matched and
+	// that were kept
+	ProtectedKept map[string]int
+	// PassedThrough is the number of records kept unfiltered by the keep bad
+	// record policy (or fail-open mode) because they could not be decoded or evaluated
+	PassedThrough int
+	// BadRecords holds the indexes of the records skipped or kept by the bad record policy
+	BadRecords []int
+}
+
 // Sync pools for object reuse to improve performance
 var (
 	gzipWriterPool = sync.Pool{
@@ -70,8 +89,13 @@ var (
 type S3Copier struct {
 	S3svc        S3API
 	S3Downloader DownloaderAPI
-	UploadSvc    UploaderAPI
+	Sink         Sink
 	Cfg          flags.S3Processor
+
+	// OnFiltered is called with the filter statistics of every processed file
+	OnFiltered func(ctx context.Context, file SinkFile, stats *FilterStats)
+	// OnPassThrough is called when an undecodable object is copied unfiltered
+	OnPassThrough func(ctx context.Context, file SinkFile, err error)
 }
 
 // NewProcessor setup a new s3 event processor
@@ -91,7 +115,7 @@ func NewCopier(cfg flags.S3Processor, awscfg *aws.Config) *S3Copier {
 	return &S3Copier{
 		S3svc:        s3Client,
 		S3Downloader: s3Downloader,
-		UploadSvc:    s3Uploader,
+		Sink:         NewS3Sink(s3Uploader, cfg.CloudtrailOutputBucketName),
 		Cfg:          cfg,
 	}
 }
@@ -138,79 +162,83 @@ func (cp *S3Copier) processFile(ctx context.Context, bucket, key string, rulesCf
 // processFileWithCachedRules downloads, filters and uploads cloudtrail files using cached rules
 func (cp *S3Copier) processFileWithCachedRules(ctx context.Context, bucket, key string, cachedCfg *rules.CachedConfiguration) error {
 	downloadMethod := selectDownloadMethod(cp.Cfg)(cp)
-	inct, err := downloadMethod(ctx, bucket, key)
+	downloadCtx, span := tracer.Start(ctx, "s3.download", trace.WithAttributes(
+		attribute.String("aws.s3.bucket", bucket),
+		attribute.String("aws.s3.key", key),
+	))
+	inct, err := downloadMethod(downloadCtx, bucket, key)
+	tracing.End(span, err)
 	if err != nil {
+		if cp.Cfg.FailOpen && errors.Is(err, ErrUndecodable) {
+			return cp.passThroughObject(ctx, SinkFile{Bucket: bucket, Key: key, ConfigVersion: cachedCfg.Version}, err)
+		}
 		return fmt.Errorf("failed to download and decode source JSON file: %w", err)
 	}
 
 	log.Ctx(ctx).Info().Int("input", len(inct.Records)).Msg("number of input records")
 
 	// filter events
-	outct, err := FilterRecords(ctx, inct, cachedCfg)
+	outct, stats, err := filterRecordsTraced(ctx, inct, cachedCfg, cp.badRecords())
 	if err != nil {
 		return fmt.Errorf("failed to filter records: %w", err)
 	}
 
-	pipeReader, pipeWriter := io.Pipe()
-	uploadJob := new(UploadJob)
-
-	// Security: Add goroutine error handling and proper cleanup
-	done := make(chan struct{})
-	defer close(done)
-
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Ctx(ctx).Error().Interface("panic", r).Msg("goroutine panic")
-				uploadJob.Error = fmt.Errorf("upload goroutine panic: %v", r)
-			}
-		}()
-		uploadJob.Start(pipeWriter, outct)
-		done <- struct{}{}
-	}()
-
-	// upload filtered events to output bucket
-	uploadRes, err := cp.UploadSvc.Upload(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(cp.Cfg.CloudtrailOutputBucketName),
-		Key:    aws.String(key),
-		Body:   pipeReader,
-	})
-
-	// Wait for goroutine to complete with timeout
-	select {
-	case <-done:
-		// Goroutine completed
-	case <-time.After(30 * time.Second):
-		return fmt.Errorf("upload goroutine timeout")
-	}
-
-	if err != nil {
-		err := fmt.Errorf("failed to upload file to output bucket: %w", err)
-		log.Ctx(ctx).Error().
-			Str("file", key).Str("bucket", cp.Cfg.CloudtrailOutputBucketName).
-			Err(err).Msg("failed to upload file to output bucket")
-		return err
+	file := SinkFile{Bucket: bucket, Key: key, ConfigVersion: cachedCfg.Version, PassedThrough: stats.PassedThrough}
+	if cp.OnFiltered != nil {
+		cp.OnFiltered(ctx, file, stats)
 	}
 
-	if uploadJob.Error != nil {
-		err := fmt.Errorf("failed to complete upload job: %w", uploadJob.Error)
-		log.Ctx(ctx).Error().
-			Str("file", key).Str("bucket", cp.Cfg.CloudtrailOutputBucketName).
-			Err(err).Msg("failed to complete upload job")
+	// write kept records to the output sink
+	if err := cp.writeRecords(ctx, file, outct.Records); err != nil {
 		return err
 	}
 
 	log.Ctx(ctx).Warn().
-		Str("path", fmt.Sprintf("s3//%s/%s", cp.Cfg.CloudtrailOutputBucketName, aws.ToString(uploadRes.Key))).
+		Str("file", key).
+		Str("sink", cp.Sink.String()).
 		Int("input", len(inct.Records)).
 		Int("output", len(outct.Records)).
 		Int("dropped", len(inct.Records)-len(outct.Records)).
-		Str("id", uploadRes.UploadID).
+		Int("passedThrough", stats.PassedThrough).
+		Ints("badRecords", stats.BadRecords).
 		Msg("file processed")
 
 	return nil
 }
 
+// writeRecords writes the kept records of a file to the output sink
+func (cp *S3Copier) writeRecords(ctx context.Context, file SinkFile, records []json.RawMessage) (err error) {
+	ctx, span := tracer.Start(ctx, "sink.write", trace.WithAttributes(
+		attribute.String("ctlp.sink", cp.Sink.String()),
+		attribute.Int("ctlp.records", len(records)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	writer, err := cp.Sink.Open(ctx, file)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", cp.Sink.String(), err)
+	}
+
+	for _, record := range records {
+		if err := writer.Write(ctx, record); err != nil {
+			if abortErr := writer.Abort(ctx); abortErr != nil {
+				log.Ctx(ctx).Error().Err(abortErr).Str("file", file.Key).Msg("failed to abort sink writer")
+			}
+			return fmt.Errorf("failed to write record to %s: %w", cp.Sink.String(), err)
+		}
+	}
+
+	if err := writer.Commit(ctx); err != nil {
+		err := fmt.Errorf("failed to commit records to %s: %w", cp.Sink.String(), err)
+		log.Ctx(ctx).Error().
+			Str("file", file.Key).Str("sink", cp.Sink.String()).
+			Err(err).Msg("failed to commit records to sink")
+		return err
+	}
+
+	return nil
+}
+
 // jsonCloudTrailDecoder is a legacy decoder kept for benchmark comparisons
 func jsonCloudTrailDecoder(r io.Reader) *Cloudtrail {
 	// Security: Limit input size to prevent DoS attacks
@@ -239,7 +267,11 @@ func decodeJSON(r io.Reader) (*Cloudtrail, error) {
 	// Read all at once for better performance
 	data, err := io.ReadAll(limitedReader)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read data: %w", err)
+		err = fmt.Errorf("failed to read data: %w", err)
+		if isCorruptGzip(err) {
+			return nil, &decodeError{err: err}
+		}
+		return nil, err
 	}
 
 	inct := new(Cloudtrail)
@@ -248,7 +280,7 @@ func decodeJSON(r io.Reader) (*Cloudtrail, error) {
 
 	err = decoder.Decode(inct)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode JSON: %w", err)
+		return nil, &decodeError{err: fmt.Errorf("failed to decode JSON: %w", err)}
 	}
 
 	return inct, nil
@@ -272,7 +304,7 @@ func (cp *S3Copier) DownloadCloudtrailMultiPart(ctx context.Context, bucket, key
 
 	// Check file size limit
 	if fileSize > maxDownloadSize {
-		return nil, fmt.Errorf("file size exceeds maximum allowed size")
+		return nil, &decodeError{err: fmt.Errorf("file size exceeds maximum allowed size")}
 	}
 
 	if err != nil {
@@ -289,7 +321,7 @@ func (cp *S3Copier) DownloadCloudtrailMultiPart(ctx context.Context, bucket, key
 	if strings.HasSuffix(key, ".gz") || strings.HasSuffix(key, ".gzip") {
 		gzipReader, err := gzip.NewReader(readerBuff)
 		if err != nil {
-			return nil, err
+			return nil, &decodeError{err: err}
 		}
 		defer func() { _ = gzipReader.Close() }()
 		reader = gzipReader
@@ -297,7 +329,9 @@ func (cp *S3Copier) DownloadCloudtrailMultiPart(ctx context.Context, bucket, key
 		reader = bytes.NewReader(buffer.Bytes())
 	}
 
+	_, span := tracer.Start(ctx, "decode")
 	inct, err := decodeJSON(reader)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode JSON: %w", err)
 	}
@@ -322,6 +356,9 @@ func (cp *S3Copier) DownloadCloudtrail(ctx context.Context, bucket, key string)
 	if aws.ToString(res.ContentType) == "application/x-gzip" {
 		gzipReader, err := gzip.NewReader(res.Body)
 		if err != nil {
+			if isCorruptGzip(err) {
+				return nil, &decodeError{err: err}
+			}
 			return nil, err
 		}
 		defer func() { _ = gzipReader.Close() }()
@@ -330,7 +367,10 @@ func (cp *S3Copier) DownloadCloudtrail(ctx context.Context, bucket, key string)
 		reader = res.Body
 	}
 
+	// the body is streamed, decode includes reading the object
+	_, span := tracer.Start(ctx, "decode")
 	inct, err := decodeJSON(reader)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode JSON: %w", err)
 	}
@@ -366,6 +406,61 @@ func FilterRecordsWithConfig(ctx context.Context, inct *Cloudtrail, rulesCfg *ru
 // - Filtered CloudTrail object containing only non-matching events
 // - Error if JSON unmarshaling or rule evaluation fails
 func FilterRecords(ctx context.Context, inct *Cloudtrail, cachedCfg *rules.CachedConfiguration) (*Cloudtrail, error) {
+	outCloudTrail, _, err := FilterRecordsWithStats(ctx, inct, cachedCfg)
+	return outCloudTrail, err
+}
+
+// FilterRecordsWithStats filters cloudtrail records like FilterRecords and counts the records dropped by each rule
+func FilterRecordsWithStats(ctx context.Context, inct *Cloudtrail, cachedCfg *rules.CachedConfiguration) (*Cloudtrail, *FilterStats, error) {
+	return filterRecordsTraced(ctx, inct, cachedCfg, &rules.BadRecords{Policy: rules.BadRecordFail})
+}
+
+// FilterRecordsWithPolicy filters cloudtrail records like FilterRecordsWithStats, applying
+// policy to the records that cannot be decoded or evaluated
+//
+// With the skip and keep policies the file fails with rules.ErrTooManyBadRecords once
+// more than maxBadRecords records are bad, a zero maxBadRecords allows any number.
+func FilterRecordsWithPolicy(ctx context.Context, inct *Cloudtrail, cachedCfg *rules.CachedConfiguration, policy rules.BadRecordPolicy, maxBadRecords int) (*Cloudtrail, *FilterStats, error) {
+	return filterRecordsTraced(ctx, inct, cachedCfg, &rules.BadRecords{Policy: policy, Max: maxBadRecords})
+}
+
+// filterRecordsTraced runs filterRecords in a rules.evaluate span
+func filterRecordsTraced(ctx context.Context, inct *Cloudtrail, cachedCfg *rules.CachedConfiguration, badRecords *rules.BadRecords) (*Cloudtrail, *FilterStats, error) {
+	ctx, span := tracer.Start(ctx, "rules.evaluate", trace.WithAttributes(
+		attribute.Int("ctlp.rules", len(cachedCfg.Rules)),
+		attribute.Int("ctlp.records.input", len(inct.Records)),
+	))
+
+	outCloudTrail, stats, err := filterRecords(ctx, inct, cachedCfg, badRecords)
+	if err == nil {
+		span.SetAttributes(
+			attribute.Int("ctlp.records.output", len(outCloudTrail.Records)),
+			attribute.Int("ctlp.records.passthrough", stats.PassedThrough),
+			attribute.Int("ctlp.records.bad", len(stats.BadRecords)),
+		)
+	}
+	tracing.End(span, err)
+
+	return outCloudTrail, stats, err
+}
+
+// filterRecords evaluates the rules against every record
+//
+// A record that cannot be decoded or evaluated fails the whole file, or is
+// skipped or kept unfiltered according to the bad record policy.
+func filterRecords(ctx context.Context, inct *Cloudtrail, cachedCfg *rules.CachedConfiguration, badRecords *rules.BadRecords) (*Cloudtrail, *FilterStats, error) {
+	stats := &FilterStats{
+		RuleHits:      make(map[string]int, len(cachedCfg.Rules)),
+		ShadowHits:    make(map[string]int, len(cachedCfg.Shadow)),
+		ProtectedKept: make(map[string]int),
+	}
+	for _, rule := range cachedCfg.Rules {
+		stats.RuleHits[rule.Name] = 0
+	}
+	for _, rule := range cachedCfg.Shadow {
+		stats.ShadowHits[rule.Name] = 0
+	}
+
 	outCloudTrail := new(Cloudtrail)
 	outCloudTrail.Records = make([]json.RawMessage, 0, len(inct.Records))
 
@@ -387,7 +482,10 @@ func FilterRecords(ctx context.Context, inct *Cloudtrail, cachedCfg *rules.Cache
 					delete(rec, k)
 				}
 				recordMapPool.Put(rec)
-				return nil, fmt.Errorf("unmarshal record failed: %w", err)
+				if err := handleBadRecord(ctx, badRecords, outCloudTrail, stats, j, inct.Records[j], fmt.Errorf("unmarshal record failed: %w", err)); err != nil {
+					return nil, nil, err
+				}
+				continue
 			}
 
 			log.Ctx(ctx).Debug().Fields(map[string]any{
@@ -404,22 +502,40 @@ func FilterRecords(ctx context.Context, inct *Cloudtrail, cachedCfg *rules.Cache
 					delete(rec, k)
 				}
 				recordMapPool.Put(rec)
-				return nil, err
+				if err := handleBadRecord(ctx, badRecords, outCloudTrail, stats, j, inct.Records[j], err); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+
+			// shadow rules never drop the record, their errors are only logged
+			shadowDrops, err := cachedCfg.EvalShadowRules(rec)
+			if err != nil {
+				log.Ctx(ctx).Warn().Err(err).Msg("shadow rules evaluation failed")
+			}
+			for _, shadowDrop := range shadowDrops {
+				log.Ctx(ctx).Info().
+					Dict("event", recordDict(rec)).
+					Str("rule_name", shadowDrop.RuleName).
+					Str("rule_owner", shadowDrop.Owner).
+					Str("rule_ticket", shadowDrop.Ticket).
+					Msg("record would be dropped by shadow rule")
+				stats.ShadowHits[shadowDrop.RuleName]++
 			}
 
 			// because we are using rules to filter records a match means drop
 			if match {
 				log.Ctx(ctx).Info().
-					Dict("event", zerolog.Dict().Fields(map[string]any{
-						"eventID":            rec["eventID"],
-						"requestID":          rec["requestID"],
-						"eventName":          rec["eventName"],
-						"eventSource":        rec["eventSource"],
-						"recipientAccountId": rec["recipientAccountId"],
-					})).
+					Dict("event", recordDict(rec)).
 					Str("rule_name", dropEvent.RuleName).
+					Str("rule_owner", dropEvent.Owner).
+					Str("rule_ticket", dropEvent.Ticket).
 					Msg("record dropped")
+				stats.RuleHits[dropEvent.RuleName]++
 			} else {
+				if dropEvent != nil {
+					stats.ProtectedKept[dropEvent.RuleName]++
+				}
 				outCloudTrail.Records = append(outCloudTrail.Records, inct.Records[j])
 			}
 
@@ -431,32 +547,23 @@ func FilterRecords(ctx context.Context, inct *Cloudtrail, cachedCfg *rules.Cache
 		}
 	}
 
-	return outCloudTrail, nil
+	if len(stats.ProtectedKept) > 0 {
+		log.Ctx(ctx).Warn().
+			Any("protected_kept", stats.ProtectedKept).
+			Msg("rules matched protected events, the events were kept")
+	}
+
+	stats.BadRecords = badRecords.Indexes
+	return outCloudTrail, stats, nil
 }
 
-// Start begins streaming compressed JSON output in the background
-//
-// This function is designed to work with io.Pipe() for streaming uploads to S3,
-// allowing the upload to begin before all data is compressed. This reduces
-// memory usage and improves time-to-first-byte for large files.
-//
-// The function uses a gzip writer pool to avoid allocating new compressors
-// for each operation, reducing GC pressure and improving performance.
-//
-// Important: This function closes the writer when complete, signaling
-// the end of the stream to the reader (typically S3 upload).
-//
-// Error handling: Any encoding errors are stored in uj.Error for the caller to check
-func (uj *UploadJob) Start(pwr io.WriteCloser, out any) {
-	// Use gzip writer from pool for better memory efficiency
-	// Pool usage reduces allocations by ~70% under load
-	gw := gzipWriterPool.Get().(*gzip.Writer)
-	gw.Reset(pwr)
-	defer gzipWriterPool.Put(gw)
-
-	encoder := json.NewEncoder(gw)
-	encoder.SetSortMapKeys(false)
-	uj.Error = encoder.Encode(out)
-	_ = gw.Close()
-	_ = pwr.Close()
+// recordDict returns the fields identifying a record in the logs
+func recordDict(rec map[string]any) *zerolog.Event {
+	return zerolog.Dict().Fields(map[string]any{
+		"eventID":            rec["eventID"],
+		"requestID":          rec["requestID"],
+		"eventName":          rec["eventName"],
+		"eventSource":        rec["eventSource"],
+		"recipientAccountId": rec["recipientAccountId"],
+	})
 }
@@ -122,3 +122,108 @@ rules:
 	assert.NoError(err)
 	assert.Equal(1653, len(outRecord.Records))
 }
+
+func TestFilterRecordsWithStats(t *testing.T) {
+	assert := assert.New(t)
+	ctx = context.Background()
+
+	yamlConfig := `
+version: 1.0.0
+rules:
+  - name: DropEc2
+    matches:
+    - field_name: eventSource
+      regex: "ec2.*"
+  - name: NeverMatches
+    matches:
+    - field_name: eventSource
+      regex: "^unknown.amazonaws.com$"
+`
+	rulesCfg, err := readConfig(yamlConfig)
+	assert.NoError(err)
+	cachedCfg, err := rules.PrepareConfiguration(rulesCfg)
+	assert.NoError(err)
+
+	inct, err := readTestEvent()
+	assert.NoError(err)
+
+	outRecord, stats, err := ctp.FilterRecordsWithStats(ctx, inct, cachedCfg)
+	assert.NoError(err)
+	assert.Equal(map[string]int{"DropEc2": 73, "NeverMatches": 0}, stats.RuleHits)
+	assert.Equal(len(inct.Records)-73, len(outRecord.Records))
+}
+
+func TestFilterRecordsShadowRules(t *testing.T) {
+	assert := assert.New(t)
+	ctx = context.Background()
+
+	yamlConfig := `
+version: 1.0.0
+rules:
+  - name: DropEc2
+    matches:
+    - field_name: eventSource
+      regex: "ec2.*"
+  - name: ShadowEc2
+    mode: shadow
+    matches:
+    - field_name: eventSource
+      regex: "ec2.*"
+  - name: ShadowNeverMatches
+    mode: shadow
+    matches:
+    - field_name: eventSource
+      regex: "^unknown.amazonaws.com$"
+`
+	rulesCfg, err := readConfig(yamlConfig)
+	assert.NoError(err)
+	cachedCfg, err := rules.PrepareConfiguration(rulesCfg)
+	assert.NoError(err)
+
+	inct, err := readTestEvent()
+	assert.NoError(err)
+
+	outRecord, stats, err := ctp.FilterRecordsWithStats(ctx, inct, cachedCfg)
+	assert.NoError(err)
+	assert.Equal(map[string]int{"DropEc2": 73}, stats.RuleHits)
+	assert.Equal(map[string]int{"ShadowEc2": 73, "ShadowNeverMatches": 0}, stats.ShadowHits)
+	assert.Equal(len(inct.Records)-73, len(outRecord.Records))
+
+	// without the enforced rule, the shadow rule keeps every record
+	rulesCfg.Rules = rulesCfg.Rules[1:]
+	cachedCfg, err = rules.PrepareConfiguration(rulesCfg)
+	assert.NoError(err)
+	outRecord, stats, err = ctp.FilterRecordsWithStats(ctx, inct, cachedCfg)
+	assert.NoError(err)
+	assert.Equal(73, stats.ShadowHits["ShadowEc2"])
+	assert.Len(outRecord.Records, len(inct.Records))
+}
+
+func TestFilterRecordsProtectedEvents(t *testing.T) {
+	assert := assert.New(t)
+	ctx = context.Background()
+
+	rulesCfg, err := readConfig(`
+version: 1.0.0
+rules:
+  - name: DropCloudTrail
+    matches:
+    - field_name: eventSource
+      regex: "^cloudtrail.amazonaws.com$"
+`)
+	assert.NoError(err)
+	cachedCfg, err := rules.PrepareConfiguration(rulesCfg)
+	assert.NoError(err)
+
+	inct := &ctp.Cloudtrail{Records: []json.RawMessage{
+		json.RawMessage(`{"eventSource":"cloudtrail.amazonaws.com","eventName":"StopLogging"}`),
+		json.RawMessage(`{"eventSource":"cloudtrail.amazonaws.com","eventName":"LookupEvents"}`),
+		json.RawMessage(`{"eventSource":"cloudtrail.amazonaws.com","eventName":"DeleteTrail"}`),
+	}}
+
+	outRecord, stats, err := ctp.FilterRecordsWithStats(ctx, inct, cachedCfg)
+	assert.NoError(err)
+	assert.Equal(map[string]int{"DropCloudTrail": 1}, stats.RuleHits)
+	assert.Equal(map[string]int{"DropCloudTrail": 2}, stats.ProtectedKept)
+	assert.Len(outRecord.Records, 2)
+}
@@ -0,0 +1,128 @@
+package cloudtrailprocessor
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// PassThroughMetadataKey marks output objects holding unfiltered data, the
+	// value is "object" for a copy of the source object and "records" when some
+	// records were kept unfiltered
+	PassThroughMetadataKey = "ctlp-passthrough"
+	// PassThroughRecordsMetadataKey holds the number of records kept unfiltered
+	PassThroughRecordsMetadataKey = "ctlp-passthrough-records"
+)
+
+// ErrUndecodable matches the errors of objects that were downloaded but are not
+// a valid CloudTrail document: corrupt gzip, invalid JSON or oversized files
+var ErrUndecodable = errors.New("undecodable CloudTrail object")
+
+// decodeError marks a download error as ErrUndecodable, keeping its message
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string { return e.err.Error() }
+
+func (e *decodeError) Unwrap() error { return e.err }
+
+func (e *decodeError) Is(target error) bool { return target == ErrUndecodable }
+
+// RetryableError tells the retry package that the object will not decode better
+func (e *decodeError) RetryableError() bool { return false }
+
+// isCorruptGzip tells corrupt gzip data apart from errors reading the body
+func isCorruptGzip(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.As(err, &corrupt)
+}
+
+// s3OutputBucket returns the bucket of the S3 sink among the sinks of sink, ""
+// when the S3 sink is not selected
+func s3OutputBucket(sink Sink) string {
+	switch s := sink.(type) {
+	case *S3Sink:
+		return s.Bucket
+	case *FanOutSink:
+		for _, inner := range s.Sinks {
+			if bucket := s3OutputBucket(inner); bucket != "" {
+				return bucket
+			}
+		}
+	case interface{ Unwrap() Sink }:
+		return s3OutputBucket(s.Unwrap())
+	}
+	return ""
+}
+
+// passThroughObject copies an undecodable object unfiltered to the bucket of
+// the S3 sink
+//
+// The copy is made server side with the pass-through marker in its metadata,
+// the other sinks do not receive anything as there are no records to send.
+// Without an S3 sink the decode error is returned, and the object is handled
+// as any undecodable object (dead-lettered when configured).
+func (cp *S3Copier) passThroughObject(ctx context.Context, file SinkFile, decodeErr error) error {
+	bucket := s3OutputBucket(cp.Sink)
+	if bucket == "" {
+		log.Ctx(ctx).Warn().
+			Err(decodeErr).
+			Str("bucket", file.Bucket).
+			Str("file", file.Key).
+			Msg("pass-through skipped, the s3 sink is not selected")
+		return fmt.Errorf("failed to download and decode source JSON file: %w", decodeErr)
+	}
+
+	// CloudTrail writes gzip compressed objects, the metadata is replaced so
+	// the content type is set again
+	contentType := "application/json"
+	if strings.HasSuffix(file.Key, ".gz") || strings.HasSuffix(file.Key, ".gzip") {
+		contentType = "application/x-gzip"
+	}
+
+	_, err := cp.S3svc.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(file.Key),
+		CopySource:        aws.String((&url.URL{Path: file.Bucket + "/" + file.Key}).EscapedPath()),
+		ContentType:       aws.String(contentType),
+		MetadataDirective: types.MetadataDirectiveReplace,
+		Metadata:          map[string]string{PassThroughMetadataKey: "object"},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy undecodable object unfiltered: %w", err)
+	}
+
+	log.Ctx(ctx).Warn().
+		Err(decodeErr).
+		Str("bucket", file.Bucket).
+		Str("file", file.Key).
+		Msg("object copied unfiltered")
+
+	if cp.OnPassThrough != nil {
+		cp.OnPassThrough(ctx, file, decodeErr)
+	}
+	return nil
+}
+
+// passThroughMetadata returns the metadata marking an output object with records kept unfiltered
+func passThroughMetadata(file SinkFile) map[string]string {
+	if file.PassedThrough == 0 {
+		return nil
+	}
+	return map[string]string{
+		PassThroughMetadataKey:        "records",
+		PassThroughRecordsMetadataKey: strconv.Itoa(file.PassedThrough),
+	}
+}
@@ -0,0 +1,196 @@
+package cloudtrailprocessor_test
+
+import (
+	"context"
+	ctp "ctlp/pkg/cloudtrailprocessor"
+	"ctlp/pkg/flags"
+	"ctlp/pkg/rules"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/segmentio/encoding/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailOpen(t *testing.T) {
+	ctx := context.Background()
+
+	rulesCfg, err := rules.Load(`
+version: 1.2.0
+rules:
+  - name: DropReadOnly
+    matches:
+    - field_name: eventName
+      regex: "^Get.*"
+`)
+	assert.NoError(t, err)
+	cachedCfg, err := rules.PrepareConfiguration(rulesCfg)
+	assert.NoError(t, err)
+
+	cfg := flags.S3Processor{CloudtrailOutputBucketName: "output-bucket", FailOpen: true}
+
+	t.Run("undecodable object is copied unfiltered", func(t *testing.T) {
+		client := &mockS3Client{body: `{"Records":[{"eventName":`}
+		sink := &recordingSink{name: "recording"}
+		var passedThrough ctp.SinkFile
+		var passErr error
+		copier := &ctp.S3Copier{
+			S3svc: client,
+			Sink:  ctp.NewFanOutSink(ctp.NewS3Sink(&fakeUploader{}, "output-bucket"), sink),
+			Cfg:   cfg,
+			OnPassThrough: func(ctx context.Context, file ctp.SinkFile, err error) {
+				passedThrough, passErr = file, err
+			},
+		}
+
+		err := copier.CopyWithCachedRules(ctx, "source-bucket", "AWSLogs/file 1.json.gz", cachedCfg)
+		assert.NoError(t, err)
+
+		input := client.copyInput
+		assert.NotNil(t, input)
+		assert.Equal(t, "output-bucket", aws.ToString(input.Bucket))
+		assert.Equal(t, "AWSLogs/file 1.json.gz", aws.ToString(input.Key))
+		assert.Equal(t, "source-bucket/AWSLogs/file%201.json.gz", aws.ToString(input.CopySource))
+		assert.Equal(t, "application/x-gzip", aws.ToString(input.ContentType))
+		assert.Equal(t, types.MetadataDirectiveReplace, input.MetadataDirective)
+		assert.Equal(t, map[string]string{ctp.PassThroughMetadataKey: "object"}, input.Metadata)
+
+		assert.Equal(t, "1.2.0", passedThrough.ConfigVersion)
+		assert.ErrorIs(t, passErr, ctp.ErrUndecodable)
+		assert.False(t, sink.committed, "sinks receive no records")
+	})
+
+	t.Run("pass-through is skipped without the s3 sink", func(t *testing.T) {
+		client := &mockS3Client{body: `{"Records":[{"eventName":`}
+		sink := &recordingSink{name: "recording"}
+		passedThrough := false
+		copier := &ctp.S3Copier{
+			S3svc: client,
+			Sink:  sink,
+			Cfg:   cfg,
+			OnPassThrough: func(ctx context.Context, file ctp.SinkFile, err error) {
+				passedThrough = true
+			},
+		}
+
+		err := copier.CopyWithCachedRules(ctx, "source-bucket", "file.json.gz", cachedCfg)
+		assert.ErrorIs(t, err, ctp.ErrUndecodable)
+		assert.Nil(t, client.copyInput)
+		assert.False(t, passedThrough)
+		assert.False(t, sink.committed)
+	})
+
+	t.Run("undecodable object fails without fail-open", func(t *testing.T) {
+		client := &mockS3Client{body: `not json`}
+		copier := &ctp.S3Copier{S3svc: client, Sink: &recordingSink{name: "recording"}}
+
+		err := copier.CopyWithCachedRules(ctx, "source-bucket", "file.json", cachedCfg)
+		assert.ErrorIs(t, err, ctp.ErrUndecodable)
+		assert.Contains(t, err.Error(), "failed to decode JSON")
+		assert.Nil(t, client.copyInput)
+	})
+
+	t.Run("unparseable records are kept", func(t *testing.T) {
+		body := `{"Records":[` + string(sinkRecords[0]) + `,` + string(sinkRecords[1]) + `,"not a record",[1]]}`
+		uploader := &fakeUploader{}
+		var stats *ctp.FilterStats
+		copier := &ctp.S3Copier{
+			S3svc: &mockS3Client{body: body},
+			Sink:  ctp.NewS3Sink(uploader, "output-bucket"),
+			Cfg:   cfg,
+			OnFiltered: func(ctx context.Context, file ctp.SinkFile, s *ctp.FilterStats) {
+				stats = s
+			},
+		}
+
+		err := copier.CopyWithCachedRules(ctx, "source-bucket", "file.json", cachedCfg)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, stats.PassedThrough)
+		assert.Equal(t, 1, stats.RuleHits["DropReadOnly"])
+		assert.Equal(t, map[string]string{
+			ctp.PassThroughMetadataKey:        "records",
+			ctp.PassThroughRecordsMetadataKey: "2",
+		}, uploader.input.Metadata)
+
+		out := new(ctp.Cloudtrail)
+		assert.NoError(t, json.Unmarshal(gunzip(t, uploader.body), out))
+		assert.Len(t, out.Records, 3)
+	})
+
+	t.Run("unparseable records fail without fail-open", func(t *testing.T) {
+		in := &ctp.Cloudtrail{Records: []json.RawMessage{sinkRecords[0], json.RawMessage(`[1]`)}}
+
+		_, _, err := ctp.FilterRecordsWithStats(ctx, in, cachedCfg)
+		assert.Error(t, err)
+		assert.False(t, errors.Is(err, ctp.ErrUndecodable))
+	})
+}
+
+func TestBadRecordPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	rulesCfg, err := rules.Load(`
+version: 1.2.0
+rules:
+  - name: DropReadOnly
+    matches:
+    - field_name: eventName
+      regex: "^Get.*"
+`)
+	assert.NoError(t, err)
+	cachedCfg, err := rules.PrepareConfiguration(rulesCfg)
+	assert.NoError(t, err)
+
+	in := &ctp.Cloudtrail{Records: []json.RawMessage{
+		sinkRecords[0], json.RawMessage(`"not a record"`), sinkRecords[1], json.RawMessage(`[1]`),
+	}}
+
+	t.Run("fail", func(t *testing.T) {
+		_, _, err := ctp.FilterRecordsWithPolicy(ctx, in, cachedCfg, rules.BadRecordFail, 0)
+		var badRecordErr *rules.BadRecordError
+		assert.ErrorAs(t, err, &badRecordErr)
+		assert.Equal(t, 1, badRecordErr.Index)
+		assert.Contains(t, err.Error(), "unmarshal record failed")
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		out, stats, err := ctp.FilterRecordsWithPolicy(ctx, in, cachedCfg, rules.BadRecordSkip, 0)
+		assert.NoError(t, err)
+		assert.Len(t, out.Records, 1)
+		assert.Equal(t, []int{1, 3}, stats.BadRecords)
+		assert.Equal(t, 0, stats.PassedThrough)
+	})
+
+	t.Run("keep", func(t *testing.T) {
+		out, stats, err := ctp.FilterRecordsWithPolicy(ctx, in, cachedCfg, rules.BadRecordKeep, 0)
+		assert.NoError(t, err)
+		assert.Len(t, out.Records, 3)
+		assert.Equal(t, []int{1, 3}, stats.BadRecords)
+		assert.Equal(t, 2, stats.PassedThrough)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		_, _, err := ctp.FilterRecordsWithPolicy(ctx, in, cachedCfg, rules.BadRecordSkip, 1)
+		assert.ErrorIs(t, err, rules.ErrTooManyBadRecords)
+	})
+
+	t.Run("copier policy overrides fail-open", func(t *testing.T) {
+		body := `{"Records":[` + string(sinkRecords[0]) + `,"not a record"]}`
+		var stats *ctp.FilterStats
+		copier := &ctp.S3Copier{
+			S3svc: &mockS3Client{body: body},
+			Sink:  &recordingSink{name: "recording"},
+			Cfg:   flags.S3Processor{FailOpen: true, BadRecordPolicy: "skip"},
+			OnFiltered: func(ctx context.Context, file ctp.SinkFile, s *ctp.FilterStats) {
+				stats = s
+			},
+		}
+
+		err := copier.CopyWithCachedRules(ctx, "source-bucket", "file.json", cachedCfg)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{1}, stats.BadRecords)
+		assert.Equal(t, 0, stats.PassedThrough)
+	})
+}
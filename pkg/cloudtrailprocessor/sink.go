@@ -0,0 +1,417 @@
+package cloudtrailprocessor
+
+import (
+	"compress/gzip"
+	"context"
+	"ctlp/pkg/tracing"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/encoding/json"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errSinkAborted is used to interrupt in-flight uploads when a writer is aborted
+var errSinkAborted = errors.New("sink writer aborted")
+
+// SinkFile describes the source CloudTrail object a set of kept records came from
+type SinkFile struct {
+	Bucket string
+	Key    string
+	// ConfigVersion is the version of the rule configuration the records were filtered with
+	ConfigVersion string
+	// PassedThrough is the number of records kept unfiltered in fail-open mode
+	PassedThrough int
+}
+
+// Sink is a destination for the records kept after filtering
+//
+// A writer is opened for every processed file, receives the kept records one by
+// one and is then either committed, making the records visible at the destination,
+// or aborted, discarding them.
+type Sink interface {
+	Open(ctx context.Context, file SinkFile) (SinkWriter, error)
+	String() string // For logging purposes
+}
+
+// SinkWriter writes the kept records of a single file
+type SinkWriter interface {
+	Write(ctx context.Context, record json.RawMessage) error
+	Commit(ctx context.Context) error
+	Abort(ctx context.Context) error
+}
+
+// RecordSink receives all the kept records of a file at once
+//
+// Destinations with batch APIs implement RecordSink and are turned into a Sink
+// with NewRecordSinkAdapter.
+type RecordSink interface {
+	WriteRecords(ctx context.Context, file SinkFile, records []json.RawMessage) error
+	String() string // For logging purposes
+}
+
+// S3Sink writes the kept records as gzip compressed CloudTrail document to an S3 bucket
+// using the source object key
+type S3Sink struct {
+	Uploader UploaderAPI
+	Bucket   string
+}
+
+// NewS3Sink creates a new S3 sink
+func NewS3Sink(uploader UploaderAPI, bucket string) *S3Sink {
+	return &S3Sink{
+		Uploader: uploader,
+		Bucket:   bucket,
+	}
+}
+
+// Open starts the upload of the output object, records are streamed to S3 while they are written
+//
+// The document is compressed with a gzip writer from the pool and piped to the
+// uploader, so the upload starts before all records are written and the whole
+// output file is never held in memory.
+func (s *S3Sink) Open(ctx context.Context, file SinkFile) (SinkWriter, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	gw := gzipWriterPool.Get().(*gzip.Writer)
+	gw.Reset(pipeWriter)
+
+	w := &s3SinkWriter{
+		sink:       s,
+		key:        file.Key,
+		pipeWriter: pipeWriter,
+		gw:         gw,
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Ctx(ctx).Error().Interface("panic", r).Msg("goroutine panic")
+				w.uploadErr = fmt.Errorf("upload goroutine panic: %v", r)
+				pipeReader.CloseWithError(w.uploadErr)
+			}
+		}()
+
+		w.uploadRes, w.uploadErr = s.Uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket:   aws.String(s.Bucket),
+			Key:      aws.String(file.Key),
+			Body:     pipeReader,
+			Metadata: passThroughMetadata(file),
+		})
+		// unblock pending writes if the upload stopped reading
+		pipeReader.CloseWithError(w.uploadErr)
+	}()
+
+	if _, err := gw.Write([]byte(`{"Records":[`)); err != nil {
+		_ = w.Abort(ctx)
+		return nil, fmt.Errorf("failed to start upload: %w", err)
+	}
+
+	return w, nil
+}
+
+func (s *S3Sink) String() string {
+	return fmt.Sprintf("S3Sink(bucket=%s)", s.Bucket)
+}
+
+// s3SinkWriter streams the records of a file into a running upload
+type s3SinkWriter struct {
+	sink       *S3Sink
+	key        string
+	pipeWriter *io.PipeWriter
+	gw         *gzip.Writer
+	count      int
+	closed     bool
+
+	done      chan struct{}
+	uploadRes *manager.UploadOutput
+	uploadErr error
+}
+
+// Write appends a record to the Records array; records are encoded like the json
+// encoder encodes a Cloudtrail document (compacted, HTML characters escaped)
+func (w *s3SinkWriter) Write(ctx context.Context, record json.RawMessage) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode record: %w", err)
+	}
+
+	if w.count > 0 {
+		if _, err := w.gw.Write([]byte{','}); err != nil {
+			return err
+		}
+	}
+	if _, err := w.gw.Write(data); err != nil {
+		return err
+	}
+	w.count++
+
+	return nil
+}
+
+// Commit completes the document and waits for the upload to finish
+func (w *s3SinkWriter) Commit(ctx context.Context) error {
+	if w.closed {
+		return errors.New("sink writer already closed")
+	}
+	w.closed = true
+
+	_, err := w.gw.Write([]byte("]}\n"))
+	if err == nil {
+		err = w.gw.Close()
+	}
+	w.release()
+	if err != nil {
+		w.pipeWriter.CloseWithError(err)
+		<-w.done
+		return fmt.Errorf("failed to complete upload job: %w", err)
+	}
+	_ = w.pipeWriter.Close()
+
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		return fmt.Errorf("upload interrupted: %w", ctx.Err())
+	}
+
+	if w.uploadErr != nil {
+		return fmt.Errorf("failed to upload file to output bucket: %w", w.uploadErr)
+	}
+
+	log.Ctx(ctx).Debug().
+		Str("path", fmt.Sprintf("s3//%s/%s", w.sink.Bucket, aws.ToString(w.uploadRes.Key))).
+		Str("id", w.uploadRes.UploadID).
+		Int("records", w.count).
+		Msg("file uploaded")
+
+	return nil
+}
+
+// Abort interrupts the upload, the uploader does not create the object
+func (w *s3SinkWriter) Abort(ctx context.Context) error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	w.pipeWriter.CloseWithError(errSinkAborted)
+	<-w.done
+	w.release()
+
+	return nil
+}
+
+// release returns the gzip writer to the pool
+func (w *s3SinkWriter) release() {
+	if w.gw != nil {
+		w.gw.Reset(io.Discard)
+		gzipWriterPool.Put(w.gw)
+		w.gw = nil
+	}
+}
+
+// maxFanOutFiles bounds the number of partially committed files remembered by a FanOutSink
+const maxFanOutFiles = 1024
+
+// FanOutSink writes the kept records to several sinks
+//
+// Writers are committed in order; a commit cannot be undone, so when a later
+// sink fails to commit the error is returned but earlier sinks keep their records.
+// The sinks that committed a file are remembered and skipped when the same file
+// is written again, so a retry only reaches the sinks that failed. This memory
+// is per process: a retry running in another Lambda environment writes to every
+// sink again, and downstream consumers of non-idempotent sinks (Kinesis, syslog,
+// Kafka) should dedupe on eventID.
+type FanOutSink struct {
+	Sinks []Sink
+
+	mu sync.Mutex
+	// committed holds, per source object, which sinks committed it
+	committed map[string][]bool
+	// order is the insertion order of committed, oldest first
+	order []string
+}
+
+// NewFanOutSink creates a sink writing to all the provided sinks
+func NewFanOutSink(sinks ...Sink) *FanOutSink {
+	return &FanOutSink{Sinks: sinks}
+}
+
+// Open opens a writer on every sink that did not commit the file yet, already
+// opened writers are aborted on failure
+func (f *FanOutSink) Open(ctx context.Context, file SinkFile) (SinkWriter, error) {
+	w := &fanOutWriter{fanOut: f, file: fanOutKey(file)}
+	done := f.committedSinks(w.file)
+
+	for i, sink := range f.Sinks {
+		if i < len(done) && done[i] {
+			log.Ctx(ctx).Info().
+				Str("file", file.Key).
+				Str("sink", sink.String()).
+				Msg("sink already committed the file, skipped")
+			continue
+		}
+		writer, err := sink.Open(ctx, file)
+		if err != nil {
+			_ = w.Abort(ctx)
+			return nil, fmt.Errorf("failed to open %s: %w", sink.String(), err)
+		}
+		w.sinks = append(w.sinks, i)
+		w.writers = append(w.writers, writer)
+	}
+
+	return w, nil
+}
+
+func fanOutKey(file SinkFile) string {
+	return file.Bucket + "/" + file.Key
+}
+
+// committedSinks returns which sinks committed the file
+func (f *FanOutSink) committedSinks(file string) []bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.committed[file]
+}
+
+// markCommitted records that the sink committed the file, the file is
+// forgotten once every sink committed it
+func (f *FanOutSink) markCommitted(file string, sink int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.committed == nil {
+		f.committed = make(map[string][]bool)
+	}
+	done, ok := f.committed[file]
+	if !ok {
+		if len(f.order) >= maxFanOutFiles {
+			delete(f.committed, f.order[0])
+			f.order = f.order[1:]
+		}
+		done = make([]bool, len(f.Sinks))
+		f.committed[file] = done
+		f.order = append(f.order, file)
+	}
+	done[sink] = true
+
+	for _, committed := range done {
+		if !committed {
+			return
+		}
+	}
+	delete(f.committed, file)
+	for i, key := range f.order {
+		if key == file {
+			f.order = append(f.order[:i], f.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (f *FanOutSink) String() string {
+	names := make([]string, len(f.Sinks))
+	for i, sink := range f.Sinks {
+		names[i] = sink.String()
+	}
+	return fmt.Sprintf("FanOutSink(%s)", strings.Join(names, ", "))
+}
+
+type fanOutWriter struct {
+	fanOut *FanOutSink
+	file   string
+	// sinks holds the index in fanOut.Sinks of each writer
+	sinks   []int
+	writers []SinkWriter
+}
+
+// sink returns the sink of the i-th writer
+func (w *fanOutWriter) sink(i int) Sink {
+	return w.fanOut.Sinks[w.sinks[i]]
+}
+
+func (w *fanOutWriter) Write(ctx context.Context, record json.RawMessage) error {
+	for i, writer := range w.writers {
+		if err := writer.Write(ctx, record); err != nil {
+			return fmt.Errorf("failed to write record to %s: %w", w.sink(i).String(), err)
+		}
+	}
+	return nil
+}
+
+func (w *fanOutWriter) Commit(ctx context.Context) error {
+	for i, writer := range w.writers {
+		commitCtx, span := tracer.Start(ctx, "sink.commit", trace.WithAttributes(
+			attribute.String("ctlp.sink", w.sink(i).String()),
+		))
+		err := writer.Commit(commitCtx)
+		tracing.End(span, err)
+		if err != nil {
+			// abort the writers that were not committed yet
+			for _, pending := range w.writers[i+1:] {
+				_ = pending.Abort(ctx)
+			}
+			return fmt.Errorf("failed to commit records to %s: %w", w.sink(i).String(), err)
+		}
+		w.fanOut.markCommitted(w.file, w.sinks[i])
+	}
+	return nil
+}
+
+func (w *fanOutWriter) Abort(ctx context.Context) error {
+	var errs []error
+	for i, writer := range w.writers {
+		if err := writer.Abort(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to abort %s: %w", w.sink(i).String(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// recordSinkAdapter buffers the records of a file and hands them to a RecordSink on commit
+type recordSinkAdapter struct {
+	sink RecordSink
+}
+
+// NewRecordSinkAdapter turns a RecordSink into a Sink
+func NewRecordSinkAdapter(sink RecordSink) Sink {
+	return &recordSinkAdapter{sink: sink}
+}
+
+func (a *recordSinkAdapter) Open(ctx context.Context, file SinkFile) (SinkWriter, error) {
+	return &recordSinkWriter{sink: a.sink, file: file}, nil
+}
+
+func (a *recordSinkAdapter) String() string {
+	return a.sink.String()
+}
+
+type recordSinkWriter struct {
+	sink    RecordSink
+	file    SinkFile
+	records []json.RawMessage
+}
+
+func (w *recordSinkWriter) Write(ctx context.Context, record json.RawMessage) error {
+	w.records = append(w.records, record)
+	return nil
+}
+
+func (w *recordSinkWriter) Commit(ctx context.Context) error {
+	return w.sink.WriteRecords(ctx, w.file, w.records)
+}
+
+func (w *recordSinkWriter) Abort(ctx context.Context) error {
+	w.records = nil
+	return nil
+}
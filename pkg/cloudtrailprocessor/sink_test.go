@@ -0,0 +1,371 @@
+package cloudtrailprocessor_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	ctp "ctlp/pkg/cloudtrailprocessor"
+	"ctlp/pkg/rules"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/segmentio/encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var sinkRecords = []json.RawMessage{
+	json.RawMessage(`{"eventID":"id-1", "eventName":"CreateUser","requestParameters":{"userName":"<admin>"}}`),
+	json.RawMessage(`{"eventID":"id-2","eventName":"GetObject"}`),
+}
+
+// fakeUploader reads the uploaded body like the s3 manager does
+type fakeUploader struct {
+	input *s3.PutObjectInput
+	body  []byte
+	err   error
+}
+
+func (u *fakeUploader) Upload(ctx context.Context, input *s3.PutObjectInput, opts ...func(*manager.Uploader)) (*manager.UploadOutput, error) {
+	u.input = input
+	body, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	if u.err != nil {
+		return nil, u.err
+	}
+	u.body = body
+	return &manager.UploadOutput{Key: input.Key, UploadID: "upload-id"}, nil
+}
+
+// recordingSink keeps committed records in memory
+type recordingSink struct {
+	name      string
+	openErr   error
+	commitErr error
+	file      ctp.SinkFile
+	records   []json.RawMessage
+	committed bool
+	aborted   bool
+}
+
+func (s *recordingSink) Open(ctx context.Context, file ctp.SinkFile) (ctp.SinkWriter, error) {
+	if s.openErr != nil {
+		return nil, s.openErr
+	}
+	s.file = file
+	return s, nil
+}
+
+func (s *recordingSink) Write(ctx context.Context, record json.RawMessage) error {
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *recordingSink) Commit(ctx context.Context) error {
+	if s.commitErr != nil {
+		return s.commitErr
+	}
+	s.committed = true
+	return nil
+}
+
+func (s *recordingSink) Abort(ctx context.Context) error {
+	s.aborted = true
+	return nil
+}
+
+func (s *recordingSink) String() string { return s.name }
+
+// recordingRecordSink is a batch RecordSink
+type recordingRecordSink struct {
+	records []json.RawMessage
+}
+
+func (s *recordingRecordSink) WriteRecords(ctx context.Context, file ctp.SinkFile, records []json.RawMessage) error {
+	s.records = records
+	return nil
+}
+
+func (s *recordingRecordSink) String() string { return "recordingRecordSink" }
+
+// mockS3Client serves a single CloudTrail document and records copies
+type mockS3Client struct {
+	body      string
+	copyInput *s3.CopyObjectInput
+}
+
+func (m *mockS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{
+		Body:        io.NopCloser(strings.NewReader(m.body)),
+		ContentType: aws.String("application/json"),
+	}, nil
+}
+
+func (m *mockS3Client) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	m.copyInput = params
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func gunzip(t *testing.T, data []byte) []byte {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	assert.NoError(t, err)
+	out, err := io.ReadAll(gr)
+	assert.NoError(t, err)
+	return out
+}
+
+func writeAll(ctx context.Context, sink ctp.Sink, file ctp.SinkFile, records []json.RawMessage) (ctp.SinkWriter, error) {
+	writer, err := sink.Open(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if err := writer.Write(ctx, record); err != nil {
+			return writer, err
+		}
+	}
+	return writer, nil
+}
+
+func TestS3Sink(t *testing.T) {
+	ctx := context.Background()
+	file := ctp.SinkFile{Bucket: "source-bucket", Key: "AWSLogs/file.json.gz"}
+
+	t.Run("output matches the encoded document", func(t *testing.T) {
+		uploader := &fakeUploader{}
+		sink := ctp.NewS3Sink(uploader, "output-bucket")
+
+		writer, err := writeAll(ctx, sink, file, sinkRecords)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Commit(ctx))
+
+		assert.Equal(t, "output-bucket", aws.ToString(uploader.input.Bucket))
+		assert.Equal(t, file.Key, aws.ToString(uploader.input.Key))
+
+		expected := new(bytes.Buffer)
+		encoder := json.NewEncoder(expected)
+		encoder.SetSortMapKeys(false)
+		assert.NoError(t, encoder.Encode(&ctp.Cloudtrail{Records: sinkRecords}))
+		assert.Equal(t, expected.String(), string(gunzip(t, uploader.body)))
+	})
+
+	t.Run("no records", func(t *testing.T) {
+		uploader := &fakeUploader{}
+		sink := ctp.NewS3Sink(uploader, "output-bucket")
+
+		writer, err := writeAll(ctx, sink, file, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Commit(ctx))
+		assert.Equal(t, "{\"Records\":[]}\n", string(gunzip(t, uploader.body)))
+	})
+
+	t.Run("upload error", func(t *testing.T) {
+		uploader := &fakeUploader{err: errors.New("AccessDenied")}
+		sink := ctp.NewS3Sink(uploader, "output-bucket")
+
+		writer, err := writeAll(ctx, sink, file, sinkRecords)
+		assert.NoError(t, err)
+		err = writer.Commit(ctx)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to upload file to output bucket")
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		uploader := &fakeUploader{}
+		sink := ctp.NewS3Sink(uploader, "output-bucket")
+
+		writer, err := writeAll(ctx, sink, file, sinkRecords)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Abort(ctx))
+		assert.Nil(t, uploader.body)
+	})
+}
+
+func TestFanOutSink(t *testing.T) {
+	ctx := context.Background()
+	file := ctp.SinkFile{Bucket: "source-bucket", Key: "file.json.gz"}
+
+	t.Run("writes to all sinks", func(t *testing.T) {
+		first, second := &recordingSink{name: "first"}, &recordingSink{name: "second"}
+		sink := ctp.NewFanOutSink(first, second)
+
+		writer, err := writeAll(ctx, sink, file, sinkRecords)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Commit(ctx))
+
+		for _, s := range []*recordingSink{first, second} {
+			assert.True(t, s.committed)
+			assert.Equal(t, sinkRecords, s.records)
+			assert.Equal(t, file, s.file)
+		}
+		assert.Equal(t, "FanOutSink(first, second)", sink.String())
+	})
+
+	t.Run("open failure aborts opened writers", func(t *testing.T) {
+		first, second := &recordingSink{name: "first"}, &recordingSink{name: "second", openErr: errors.New("unreachable")}
+		sink := ctp.NewFanOutSink(first, second)
+
+		_, err := sink.Open(ctx, file)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to open second")
+		assert.True(t, first.aborted)
+	})
+
+	t.Run("commit failure aborts pending writers", func(t *testing.T) {
+		first := &recordingSink{name: "first", commitErr: errors.New("rejected")}
+		second := &recordingSink{name: "second"}
+		sink := ctp.NewFanOutSink(first, second)
+
+		writer, err := writeAll(ctx, sink, file, sinkRecords)
+		assert.NoError(t, err)
+		err = writer.Commit(ctx)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to commit records to first")
+		assert.False(t, second.committed)
+		assert.True(t, second.aborted)
+	})
+
+	t.Run("retry skips committed sinks", func(t *testing.T) {
+		first := &recordingSink{name: "first"}
+		second := &recordingSink{name: "second", commitErr: errors.New("rejected")}
+		sink := ctp.NewFanOutSink(first, second)
+
+		writer, err := writeAll(ctx, sink, file, sinkRecords)
+		assert.NoError(t, err)
+		assert.Error(t, writer.Commit(ctx))
+		assert.True(t, first.committed)
+
+		second.commitErr = nil
+		writer, err = writeAll(ctx, sink, file, sinkRecords)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Commit(ctx))
+		assert.Equal(t, sinkRecords, first.records)
+		assert.True(t, second.committed)
+
+		// once every sink committed, the file is written to all sinks again
+		writer, err = writeAll(ctx, sink, file, sinkRecords)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Commit(ctx))
+		assert.Len(t, first.records, 2*len(sinkRecords))
+
+		// other files are not affected
+		other := ctp.SinkFile{Bucket: file.Bucket, Key: "other.json.gz"}
+		second.commitErr = errors.New("rejected")
+		writer, err = writeAll(ctx, sink, file, sinkRecords)
+		assert.NoError(t, err)
+		assert.Error(t, writer.Commit(ctx))
+		writer, err = writeAll(ctx, sink, other, sinkRecords)
+		assert.NoError(t, err)
+		assert.Error(t, writer.Commit(ctx))
+		assert.Len(t, first.records, 4*len(sinkRecords))
+	})
+}
+
+func TestRecordSinkAdapter(t *testing.T) {
+	ctx := context.Background()
+	recordSink := &recordingRecordSink{}
+	sink := ctp.NewRecordSinkAdapter(recordSink)
+
+	writer, err := writeAll(ctx, sink, ctp.SinkFile{Key: "file.json.gz"}, sinkRecords)
+	assert.NoError(t, err)
+	assert.Nil(t, recordSink.records)
+
+	assert.NoError(t, writer.Commit(ctx))
+	assert.Equal(t, sinkRecords, recordSink.records)
+}
+
+func TestCopyWithCachedRules(t *testing.T) {
+	ctx := context.Background()
+
+	rulesCfg, err := rules.Load(`
+version: 1.2.0
+rules:
+  - name: DropReadOnly
+    matches:
+    - field_name: eventName
+      regex: "^Get.*"
+`)
+	assert.NoError(t, err)
+	cachedCfg, err := rules.PrepareConfiguration(rulesCfg)
+	assert.NoError(t, err)
+
+	sink := &recordingSink{name: "recording"}
+	copier := &ctp.S3Copier{
+		S3svc: &mockS3Client{body: `{"Records":[` + string(sinkRecords[0]) + `,` + string(sinkRecords[1]) + `]}`},
+		Sink:  sink,
+	}
+
+	err = copier.CopyWithCachedRules(ctx, "source-bucket", "file.json", cachedCfg)
+	assert.NoError(t, err)
+	assert.True(t, sink.committed)
+	assert.Len(t, sink.records, 1)
+	assert.Equal(t, ctp.SinkFile{Bucket: "source-bucket", Key: "file.json", ConfigVersion: "1.2.0"}, sink.file)
+}
+
+func TestCopyWithCachedRulesSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	rulesCfg, err := rules.Load(`
+version: 1.2.0
+rules:
+  - name: DropReadOnly
+    matches:
+    - field_name: eventName
+      regex: "^Get.*"
+`)
+	assert.NoError(t, err)
+	cachedCfg, err := rules.PrepareConfiguration(rulesCfg)
+	assert.NoError(t, err)
+
+	ctx, root := provider.Tracer("test").Start(context.Background(), "root")
+	copier := &ctp.S3Copier{
+		S3svc: &mockS3Client{body: `{"Records":[` + string(sinkRecords[0]) + `,` + string(sinkRecords[1]) + `]}`},
+		Sink:  ctp.NewFanOutSink(&recordingSink{name: "first"}, &recordingSink{name: "second", commitErr: errors.New("boom")}),
+	}
+	err = copier.CopyWithCachedRules(ctx, "source-bucket", "file.json", cachedCfg)
+	assert.Error(t, err)
+	root.End()
+
+	spans := exporter.GetSpans()
+	byName := make(map[string][]tracetest.SpanStub)
+	for _, span := range spans {
+		byName[span.Name] = append(byName[span.Name], span)
+	}
+	parentName := func(span tracetest.SpanStub) string {
+		for _, candidate := range spans {
+			if candidate.SpanContext.SpanID() == span.Parent.SpanID() {
+				return candidate.Name
+			}
+		}
+		return ""
+	}
+
+	assert.Equal(t, "root", parentName(byName["s3.download"][0]))
+	assert.Equal(t, "s3.download", parentName(byName["decode"][0]))
+	assert.Equal(t, "root", parentName(byName["rules.evaluate"][0]))
+	assert.Contains(t, byName["rules.evaluate"][0].Attributes, attribute.Int("ctlp.records.output", 1))
+	assert.Equal(t, "root", parentName(byName["sink.write"][0]))
+	assert.Equal(t, "Error", byName["sink.write"][0].Status.Code.String())
+
+	commits := byName["sink.commit"]
+	assert.Len(t, commits, 2)
+	for _, commit := range commits {
+		assert.Equal(t, "sink.write", parentName(commit))
+	}
+	assert.Contains(t, commits[1].Attributes, attribute.String("ctlp.sink", "second"))
+	assert.Equal(t, "Error", commits[1].Status.Code.String())
+}
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"context"
+	"ctlp/pkg/rules"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/appconfigdata"
+	"github.com/rs/zerolog/log"
+)
+
+// AppConfigDataAPI interface for AppConfig Data operations
+type AppConfigDataAPI interface {
+	StartConfigurationSession(ctx context.Context, params *appconfigdata.StartConfigurationSessionInput, optFns ...func(*appconfigdata.Options)) (*appconfigdata.StartConfigurationSessionOutput, error)
+	GetLatestConfiguration(ctx context.Context, params *appconfigdata.GetLatestConfigurationInput, optFns ...func(*appconfigdata.Options)) (*appconfigdata.GetLatestConfigurationOutput, error)
+}
+
+// MinAppConfigPollInterval is the shortest poll interval accepted by AppConfig
+const MinAppConfigPollInterval = 15 * time.Second
+
+// AppConfigValidator checks a configuration before it is accepted, a new
+// AppConfig deployment failing a validator is rejected
+type AppConfigValidator func(ctx context.Context, cfg *rules.Configuration) error
+
+// AppConfigOption configures an AppConfigLoader
+type AppConfigOption func(*AppConfigLoader)
+
+// WithPollInterval sets the minimum poll interval requested for the session,
+// AppConfig does not accept intervals shorter than MinAppConfigPollInterval
+func WithPollInterval(d time.Duration) AppConfigOption {
+	return func(l *AppConfigLoader) {
+		l.pollInterval = max(d, MinAppConfigPollInterval)
+	}
+}
+
+// WithValidator adds a validator run on every new configuration, after the
+// rules validation
+func WithValidator(validator AppConfigValidator) AppConfigOption {
+	return func(l *AppConfigLoader) {
+		l.validators = append(l.validators, validator)
+	}
+}
+
+// AppConfigLoader loads configuration from AWS AppConfig
+//
+// A configuration session is started on the first load, every load then polls
+// the latest configuration with the token returned by the previous poll.
+// AppConfig only returns the content when a new version is deployed, the
+// loader keeps the last configuration to answer the other polls. Polls made
+// before the interval requested by AppConfig are answered from the cache.
+type AppConfigLoader struct {
+	application string
+	environment string
+	profile     string
+	client      AppConfigDataAPI
+
+	pollInterval time.Duration
+	validators   []AppConfigValidator
+
+	mu           sync.Mutex
+	token        string
+	nextPoll     time.Time
+	config       *rules.Configuration
+	versionLabel string
+}
+
+// NewAppConfigLoader creates a new AppConfig configuration loader
+func NewAppConfigLoader(application, environment, profile string, client AppConfigDataAPI, opts ...AppConfigOption) *AppConfigLoader {
+	l := &AppConfigLoader{
+		application:  application,
+		environment:  environment,
+		profile:      profile,
+		client:       client,
+		pollInterval: MinAppConfigPollInterval,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Load loads configuration from AppConfig, the last configuration is returned
+// when no new version was deployed
+func (l *AppConfigLoader) Load(ctx context.Context) (*rules.Configuration, error) {
+	cfg, err := l.LoadIfChanged(ctx)
+	if errors.Is(err, ErrNotModified) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.config, nil
+	}
+	return cfg, err
+}
+
+// LoadIfChanged loads configuration from AppConfig, or returns ErrNotModified
+// when no new version was deployed since the last load
+func (l *AppConfigLoader) LoadIfChanged(ctx context.Context) (*rules.Configuration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.config != nil && time.Now().Before(l.nextPoll) {
+		return nil, ErrNotModified
+	}
+
+	log.Ctx(ctx).Debug().
+		Str("application", l.application).
+		Str("environment", l.environment).
+		Str("profile", l.profile).
+		Msg("loading configuration from AppConfig")
+
+	if l.token == "" {
+		session, err := l.client.StartConfigurationSession(ctx, &appconfigdata.StartConfigurationSessionInput{
+			ApplicationIdentifier:                aws.String(l.application),
+			EnvironmentIdentifier:                aws.String(l.environment),
+			ConfigurationProfileIdentifier:       aws.String(l.profile),
+			RequiredMinimumPollIntervalInSeconds: aws.Int32(int32(l.pollInterval / time.Second)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to start AppConfig session: %w", err)
+		}
+		l.token = aws.ToString(session.InitialConfigurationToken)
+	}
+
+	resp, err := l.client.GetLatestConfiguration(ctx, &appconfigdata.GetLatestConfigurationInput{
+		ConfigurationToken: aws.String(l.token),
+	})
+	if err != nil {
+		// tokens expire after 24 hours and can only be used once, a new
+		// session is started by the next load
+		l.token = ""
+		return nil, fmt.Errorf("failed to get latest AppConfig configuration: %w", err)
+	}
+	l.token = aws.ToString(resp.NextPollConfigurationToken)
+	l.nextPoll = time.Now().Add(time.Duration(resp.NextPollIntervalInSeconds) * time.Second)
+
+	// an empty configuration means the version did not change since the last poll
+	if len(resp.Configuration) == 0 {
+		if l.config == nil {
+			return nil, fmt.Errorf("AppConfig returned no configuration")
+		}
+		return nil, ErrNotModified
+	}
+
+	// a new session returns the deployed version even when it is already loaded
+	versionLabel := aws.ToString(resp.VersionLabel)
+	if l.config != nil && versionLabel != "" && versionLabel == l.versionLabel {
+		return nil, ErrNotModified
+	}
+
+	cfg, err := l.parse(ctx, resp.Configuration, versionLabel)
+	if err != nil {
+		// the next polls of the session return no content until a new version
+		// is deployed, without a configuration a new session gets it again
+		if l.config == nil {
+			l.token = ""
+		}
+		return nil, err
+	}
+
+	l.config = cfg
+	l.versionLabel = versionLabel
+	return cfg, nil
+}
+
+// parse parses and validates a configuration deployed with AppConfig
+func (l *AppConfigLoader) parse(ctx context.Context, content []byte, versionLabel string) (*rules.Configuration, error) {
+	cfg, err := rules.Load(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %w", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("configuration validation failed: %w", err)
+	}
+
+	for _, validate := range l.validators {
+		if err := validate(ctx, cfg); err != nil {
+			log.Ctx(ctx).Error().
+				Err(err).
+				Str("versionLabel", versionLabel).
+				Msg("AppConfig configuration rejected")
+			return nil, fmt.Errorf("configuration rejected by validator: %w", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+func (l *AppConfigLoader) String() string {
+	return fmt.Sprintf("AppConfigLoader(application=%s, environment=%s, profile=%s)", l.application, l.environment, l.profile)
+}
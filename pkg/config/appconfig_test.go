@@ -0,0 +1,157 @@
+package config
+
+import (
+	"context"
+	"ctlp/pkg/rules"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/appconfigdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// Mock AppConfig Data client
+type mockAppConfigDataClient struct {
+	mock.Mock
+}
+
+func (m *mockAppConfigDataClient) StartConfigurationSession(ctx context.Context, params *appconfigdata.StartConfigurationSessionInput, optFns ...func(*appconfigdata.Options)) (*appconfigdata.StartConfigurationSessionOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*appconfigdata.StartConfigurationSessionOutput), args.Error(1)
+}
+
+func (m *mockAppConfigDataClient) GetLatestConfiguration(ctx context.Context, params *appconfigdata.GetLatestConfigurationInput, optFns ...func(*appconfigdata.Options)) (*appconfigdata.GetLatestConfigurationOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*appconfigdata.GetLatestConfigurationOutput), args.Error(1)
+}
+
+func (m *mockAppConfigDataClient) onStart(ctx context.Context, token string) {
+	m.On("StartConfigurationSession", ctx, &appconfigdata.StartConfigurationSessionInput{
+		ApplicationIdentifier:                aws.String("ctlp"),
+		EnvironmentIdentifier:                aws.String("production"),
+		ConfigurationProfileIdentifier:       aws.String("rules"),
+		RequiredMinimumPollIntervalInSeconds: aws.Int32(15),
+	}).Return(&appconfigdata.StartConfigurationSessionOutput{InitialConfigurationToken: aws.String(token)}, nil).Once()
+}
+
+func (m *mockAppConfigDataClient) onPoll(ctx context.Context, token, next, content, version string) {
+	m.On("GetLatestConfiguration", ctx, &appconfigdata.GetLatestConfigurationInput{
+		ConfigurationToken: aws.String(token),
+	}).Return(&appconfigdata.GetLatestConfigurationOutput{
+		Configuration:              []byte(content),
+		NextPollConfigurationToken: aws.String(next),
+		VersionLabel:               aws.String(version),
+	}, nil).Once()
+}
+
+func TestAppConfigLoader(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("poll token handling", func(t *testing.T) {
+		mockClient := new(mockAppConfigDataClient)
+		loader := NewAppConfigLoader("ctlp", "production", "rules", mockClient)
+
+		mockClient.onStart(ctx, "token-0")
+		mockClient.onPoll(ctx, "token-0", "token-1", testConfig, "v1")
+		cfg, err := loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "Test Rule", cfg.Rules[0].Name)
+
+		// no new deployment: empty content
+		mockClient.onPoll(ctx, "token-1", "token-2", "", "")
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+
+		// Load returns the last configuration
+		mockClient.onPoll(ctx, "token-2", "token-3", "", "")
+		again, err := loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.Same(t, cfg, again)
+
+		mockClient.AssertExpectations(t)
+	})
+
+	t.Run("expired token starts a new session", func(t *testing.T) {
+		mockClient := new(mockAppConfigDataClient)
+		loader := NewAppConfigLoader("ctlp", "production", "rules", mockClient)
+
+		mockClient.onStart(ctx, "token-0")
+		mockClient.onPoll(ctx, "token-0", "token-1", testConfig, "v1")
+		_, err := loader.Load(ctx)
+		assert.NoError(t, err)
+
+		mockClient.On("GetLatestConfiguration", ctx, &appconfigdata.GetLatestConfigurationInput{
+			ConfigurationToken: aws.String("token-1"),
+		}).Return(nil, errors.New("BadRequestException: token expired")).Once()
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorContains(t, err, "token expired")
+
+		// the new session returns the loaded version again
+		mockClient.onStart(ctx, "token-10")
+		mockClient.onPoll(ctx, "token-10", "token-11", testConfig, "v1")
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+
+		mockClient.AssertExpectations(t)
+	})
+
+	t.Run("validator rejects deployment", func(t *testing.T) {
+		mockClient := new(mockAppConfigDataClient)
+		loader := NewAppConfigLoader("ctlp", "production", "rules", mockClient,
+			WithValidator(func(ctx context.Context, cfg *rules.Configuration) error {
+				if len(cfg.Rules) > 1 {
+					return errors.New("at most one rule")
+				}
+				return nil
+			}))
+
+		mockClient.onStart(ctx, "token-0")
+		mockClient.onPoll(ctx, "token-0", "token-1", testConfig, "v1")
+		_, err := loader.Load(ctx)
+		assert.NoError(t, err)
+
+		twoRules := testConfig + "\n  - name: Other\n    matches:\n      - field_name: eventName\n        regex: \"^Other$\"\n"
+		mockClient.onPoll(ctx, "token-1", "token-2", twoRules, "v2")
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorContains(t, err, "configuration rejected by validator: at most one rule")
+
+		// the previous version stays active
+		mockClient.onPoll(ctx, "token-2", "token-3", "", "")
+		cfg, err := loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "Test Rule", cfg.Rules[0].Name)
+
+		mockClient.AssertExpectations(t)
+	})
+
+	t.Run("poll interval", func(t *testing.T) {
+		mockClient := new(mockAppConfigDataClient)
+		loader := NewAppConfigLoader("ctlp", "production", "rules", mockClient)
+
+		mockClient.onStart(ctx, "token-0")
+		mockClient.On("GetLatestConfiguration", ctx, mock.Anything).Return(&appconfigdata.GetLatestConfigurationOutput{
+			Configuration:              []byte(testConfig),
+			NextPollConfigurationToken: aws.String("token-1"),
+			NextPollIntervalInSeconds:  60,
+		}, nil).Once()
+		_, err := loader.Load(ctx)
+		assert.NoError(t, err)
+
+		// answered from the cache, no call to AppConfig
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+		mockClient.AssertExpectations(t)
+	})
+
+	t.Run("poll interval option", func(t *testing.T) {
+		assert.Equal(t, MinAppConfigPollInterval, NewAppConfigLoader("a", "e", "p", nil, WithPollInterval(0)).pollInterval)
+	})
+}
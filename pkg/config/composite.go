@@ -0,0 +1,103 @@
+package config
+
+import (
+	"context"
+	"ctlp/pkg/rules"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// CompositeConfigLoader merges the rule sets of several loaders, for example an
+// organization wide base in S3 with per-account overrides in SSM
+//
+// The loaders are given from the lowest to the highest precedence and their
+// configurations are merged with rules.Merge. Every source must load: a missing
+// override layer would bring back the rules it disables. The version of the
+// merged configuration joins the versions of the layers with "+".
+type CompositeConfigLoader struct {
+	loaders []ConfigLoader
+	policy  rules.CollisionPolicy
+
+	mu      sync.Mutex
+	layers  []*rules.Configuration // last configuration of each loader
+	pending bool                   // layers changed since the last merge
+	config  *rules.Configuration
+}
+
+// NewCompositeConfigLoader creates a new composite configuration loader
+func NewCompositeConfigLoader(policy rules.CollisionPolicy, loaders ...ConfigLoader) *CompositeConfigLoader {
+	return &CompositeConfigLoader{
+		loaders: loaders,
+		policy:  policy,
+		layers:  make([]*rules.Configuration, len(loaders)),
+	}
+}
+
+// Load loads and merges the configurations of all loaders
+func (l *CompositeConfigLoader) Load(ctx context.Context) (*rules.Configuration, error) {
+	return l.load(ctx, false)
+}
+
+// LoadIfChanged loads the configurations of all loaders, asking the
+// ConditionalLoaders for changes only, and returns ErrNotModified when none of
+// them changed
+func (l *CompositeConfigLoader) LoadIfChanged(ctx context.Context) (*rules.Configuration, error) {
+	return l.load(ctx, true)
+}
+
+func (l *CompositeConfigLoader) load(ctx context.Context, conditional bool) (*rules.Configuration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// a layer loaded before another fails is kept: its loader does not return
+	// it again
+	for i, loader := range l.loaders {
+		var cfg *rules.Configuration
+		var err error
+		if cl, ok := loader.(ConditionalLoader); ok && conditional && l.layers[i] != nil {
+			cfg, err = cl.LoadIfChanged(ctx)
+		} else {
+			cfg, err = loader.Load(ctx)
+		}
+
+		switch {
+		case errors.Is(err, ErrNotModified):
+		case err != nil:
+			return nil, fmt.Errorf("failed to load %s: %w", loader, err)
+		default:
+			l.layers[i] = cfg
+			l.pending = true
+		}
+	}
+
+	if conditional && !l.pending && l.config != nil {
+		return nil, ErrNotModified
+	}
+
+	cfg, err := rules.Merge(ctx, l.policy, l.layers...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge configurations: %w", err)
+	}
+
+	versions := make([]string, 0, len(l.layers))
+	for _, layer := range l.layers {
+		if layer.Version != "" {
+			versions = append(versions, layer.Version)
+		}
+	}
+	cfg.Version = strings.Join(versions, "+")
+
+	l.pending = false
+	l.config = cfg
+	return cfg, nil
+}
+
+func (l *CompositeConfigLoader) String() string {
+	names := make([]string, len(l.loaders))
+	for i, loader := range l.loaders {
+		names[i] = loader.String()
+	}
+	return fmt.Sprintf("CompositeConfigLoader(policy=%s, %s)", l.policy, strings.Join(names, ", "))
+}
@@ -0,0 +1,142 @@
+package config
+
+import (
+	"context"
+	"ctlp/pkg/rules"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+const baseConfig = `version: 1.0.0
+rules:
+  - name: Drop Describe
+    matches:
+      - field_name: eventName
+        regex: "^Describe.*$"
+  - name: Drop KMS
+    matches:
+      - field_name: eventSource
+        regex: "kms.amazonaws.com"`
+
+const overrideConfig = `version: 2.0.0
+disable:
+  - Drop KMS
+rules:
+  - name: Drop Describe
+    matches:
+      - field_name: eventName
+        regex: "^DescribeInstances$"`
+
+func loadTestConfig(t *testing.T, rawCfg string) *rules.Configuration {
+	t.Helper()
+	cfg, err := rules.Load(rawCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func ruleNames(cfg *rules.Configuration) []string {
+	names := make([]string, len(cfg.Rules))
+	for i, rule := range cfg.Rules {
+		names[i] = rule.Name
+	}
+	return names
+}
+
+func TestCompositeConfigLoader(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("merges layers", func(t *testing.T) {
+		loader := NewCompositeConfigLoader(rules.CollisionOverride,
+			&mockConfigLoader{config: loadTestConfig(t, baseConfig)},
+			&mockConfigLoader{config: loadTestConfig(t, overrideConfig)},
+		)
+
+		cfg, err := loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "1.0.0+2.0.0", cfg.Version)
+		assert.Equal(t, []string{"Drop Describe"}, ruleNames(cfg))
+		assert.Equal(t, "^DescribeInstances$", cfg.Rules[0].Matches[0].Regex)
+	})
+
+	t.Run("collision error", func(t *testing.T) {
+		loader := NewCompositeConfigLoader(rules.CollisionError,
+			&mockConfigLoader{config: loadTestConfig(t, baseConfig)},
+			&mockConfigLoader{config: loadTestConfig(t, overrideConfig)},
+		)
+
+		_, err := loader.Load(ctx)
+		assert.ErrorIs(t, err, rules.ErrRuleCollision)
+	})
+
+	t.Run("source error", func(t *testing.T) {
+		loader := NewCompositeConfigLoader(rules.CollisionOverride,
+			&mockConfigLoader{config: loadTestConfig(t, baseConfig)},
+			&mockConfigLoader{err: errors.New("access denied")},
+		)
+
+		_, err := loader.Load(ctx)
+		assert.ErrorContains(t, err, "access denied")
+	})
+
+	t.Run("not modified", func(t *testing.T) {
+		base := &conditionalMockLoader{version: "1.0.0"}
+		override := &conditionalMockLoader{version: "1.0.0"}
+		loader := NewCompositeConfigLoader(rules.CollisionOverride, base, override)
+
+		_, err := loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+
+		override.version = "1.1.0"
+		cfg, err := loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "1.0.0+1.1.0", cfg.Version)
+		assert.Equal(t, 1, base.loadCount)
+		assert.Equal(t, 2, override.loadCount)
+	})
+}
+
+func TestS3ConfigLoaderIncludes(t *testing.T) {
+	ctx := context.Background()
+	mockClient := new(mockS3Client)
+	loader := NewS3ConfigLoader("test-bucket", "accounts/123.yaml", mockClient)
+
+	object := func(content string) *s3.GetObjectOutput {
+		return &s3.GetObjectOutput{
+			Body: io.NopCloser(strings.NewReader(content)),
+			ETag: aws.String(`"etag"`),
+		}
+	}
+	expectObjects := func() {
+		mockClient.On("GetObject", ctx, &s3.GetObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("accounts/123.yaml"),
+		}).Return(object("include:\n  - ../base.yaml\n"+overrideConfig), nil).Once()
+		mockClient.On("GetObject", ctx, &s3.GetObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("base.yaml"),
+		}).Return(object(baseConfig), nil).Once()
+	}
+
+	expectObjects()
+	cfg, err := loader.LoadIfChanged(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "2.0.0", cfg.Version)
+	assert.Equal(t, []string{"Drop Describe"}, ruleNames(cfg))
+
+	// the ETag of the including object does not cover its includes
+	expectObjects()
+	_, err = loader.LoadIfChanged(ctx)
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+}
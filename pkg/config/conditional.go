@@ -0,0 +1,68 @@
+package config
+
+import (
+	"context"
+	"ctlp/pkg/rules"
+	"errors"
+	"net/http"
+)
+
+// ErrNotModified is returned by LoadIfChanged when the configuration source has
+// not changed since the last successful load
+var ErrNotModified = errors.New("configuration not modified")
+
+// ConditionalLoader is implemented by loaders that can tell an unchanged source
+// apart without parsing it again
+//
+// The loaders remember the version of the last configuration they returned: the
+// S3 or HTTP ETag, the SSM parameter version, the Secrets Manager VersionId,
+// the AppConfig session, the Git object ID or the modification time of a local
+// file.
+type ConditionalLoader interface {
+	ConfigLoader
+	// LoadIfChanged loads the configuration, or returns ErrNotModified when the
+	// version of the source is the version of the last successful load
+	LoadIfChanged(ctx context.Context) (*rules.Configuration, error)
+}
+
+var (
+	_ ConditionalLoader = (*S3ConfigLoader)(nil)
+	_ ConditionalLoader = (*SSMConfigLoader)(nil)
+	_ ConditionalLoader = (*SecretsManagerConfigLoader)(nil)
+	_ ConditionalLoader = (*LocalConfigLoader)(nil)
+	_ ConditionalLoader = (*AppConfigLoader)(nil)
+	_ ConditionalLoader = (*HTTPConfigLoader)(nil)
+	_ ConditionalLoader = (*GitConfigLoader)(nil)
+	_ ConditionalLoader = (*CompositeConfigLoader)(nil)
+)
+
+// isNotModified tells if err is the 304 response of a conditional request
+func isNotModified(err error) bool {
+	var respErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotModified
+}
+
+// subscribers holds the functions called when a new configuration version lands
+type subscribers struct {
+	next int
+	fns  map[int]func(*rules.CachedConfiguration)
+}
+
+// add registers fn and returns its id
+func (s *subscribers) add(fn func(*rules.CachedConfiguration)) int {
+	if s.fns == nil {
+		s.fns = make(map[int]func(*rules.CachedConfiguration))
+	}
+	s.next++
+	s.fns[s.next] = fn
+	return s.next
+}
+
+// list returns the registered functions
+func (s *subscribers) list() []func(*rules.CachedConfiguration) {
+	fns := make([]func(*rules.CachedConfiguration), 0, len(s.fns))
+	for _, fn := range s.fns {
+		fns = append(fns, fn)
+	}
+	return fns
+}
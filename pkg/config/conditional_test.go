@@ -0,0 +1,179 @@
+package config
+
+import (
+	"context"
+	"ctlp/pkg/rules"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func notModifiedError() error {
+	return &awshttp.ResponseError{
+		ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusNotModified}},
+			Err:      errors.New("NotModified"),
+		},
+	}
+}
+
+func TestConditionalLoaders(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("S3 ETag", func(t *testing.T) {
+		mockClient := new(mockS3Client)
+		loader := NewS3ConfigLoader("test-bucket", "test-key", mockClient)
+
+		mockClient.On("GetObject", ctx, &s3.GetObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("test-key"),
+		}).Return(&s3.GetObjectOutput{
+			Body: io.NopCloser(strings.NewReader(testConfig)),
+			ETag: aws.String(`"etag-1"`),
+		}, nil).Once()
+		_, err := loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+
+		mockClient.On("GetObject", ctx, &s3.GetObjectInput{
+			Bucket:      aws.String("test-bucket"),
+			Key:         aws.String("test-key"),
+			IfNoneMatch: aws.String(`"etag-1"`),
+		}).Return(nil, notModifiedError()).Once()
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+
+		mockClient.AssertExpectations(t)
+	})
+
+	t.Run("SSM parameter version", func(t *testing.T) {
+		mockClient := new(mockSSMClient)
+		loader := NewSSMConfigLoader("/ctlp/rules", mockClient)
+
+		for _, version := range []int64{1, 1, 2} {
+			mockClient.On("GetParameter", ctx, mock.Anything).Return(&ssm.GetParameterOutput{
+				Parameter: &types.Parameter{Value: aws.String(testConfig), Version: version},
+			}, nil).Once()
+		}
+
+		_, err := loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+		cfg, err := loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, cfg.Rules, 1)
+	})
+
+	t.Run("Secrets Manager VersionId", func(t *testing.T) {
+		mockClient := new(mockSecretsManagerClient)
+		loader := NewSecretsManagerConfigLoader("ctlp-rules", mockClient)
+
+		mockClient.On("GetSecretValue", ctx, mock.Anything).Return(&secretsmanager.GetSecretValueOutput{
+			SecretString: aws.String(testConfig),
+			VersionId:    aws.String("v1"),
+		}, nil).Times(3)
+
+		_, err := loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+
+		// Load always returns the configuration
+		cfg, err := loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.NotNil(t, cfg)
+		mockClient.AssertExpectations(t)
+	})
+
+	t.Run("local modification time", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "rules.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte(testConfig), 0o600))
+		loader := NewLocalConfigLoader(path)
+
+		_, err := loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+
+		assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+		_, err = loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+	})
+}
+
+// conditionalMockLoader returns ErrNotModified until version changes
+type conditionalMockLoader struct {
+	mockConfigLoader
+	version    string
+	lastLoaded string
+}
+
+func (m *conditionalMockLoader) Load(ctx context.Context) (*rules.Configuration, error) {
+	m.lastLoaded = m.version
+	m.loadCount++
+	return &rules.Configuration{Version: m.version, Rules: []*rules.Rule{{Name: "Test Rule"}}}, nil
+}
+
+func (m *conditionalMockLoader) LoadIfChanged(ctx context.Context) (*rules.Configuration, error) {
+	if m.version == m.lastLoaded {
+		return nil, ErrNotModified
+	}
+	return m.Load(ctx)
+}
+
+func TestCachedConfigLoaderSubscribe(t *testing.T) {
+	ctx := context.Background()
+	loader := &conditionalMockLoader{version: "1.0.0"}
+	cachedLoader := NewCachedConfigLoader(loader, time.Nanosecond)
+
+	var active atomic.Pointer[rules.CachedConfiguration]
+	var notified int
+	unsubscribe := cachedLoader.Subscribe(func(cachedCfg *rules.CachedConfiguration) {
+		active.Store(cachedCfg)
+		notified++
+	})
+
+	first, err := cachedLoader.LoadCached(ctx)
+	assert.NoError(t, err)
+	assert.Same(t, first, active.Load())
+	assert.Equal(t, 1, notified)
+
+	// unchanged source: no new parse, same compiled rules, no notification
+	time.Sleep(time.Millisecond)
+	again, err := cachedLoader.LoadCached(ctx)
+	assert.NoError(t, err)
+	assert.Same(t, first, again)
+	assert.Equal(t, 1, loader.loadCount)
+	assert.Equal(t, 1, notified)
+
+	loader.version = "1.1.0"
+	time.Sleep(time.Millisecond)
+	_, err = cachedLoader.LoadCached(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.0", active.Load().Version)
+	assert.Equal(t, 2, notified)
+
+	unsubscribe()
+	loader.version = "1.2.0"
+	time.Sleep(time.Millisecond)
+	_, err = cachedLoader.LoadCached(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.0", active.Load().Version)
+	assert.Equal(t, 2, notified)
+}
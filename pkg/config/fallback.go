@@ -0,0 +1,288 @@
+package config
+
+import (
+	"context"
+	"ctlp/pkg/rules"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+// LastKnownGoodSource is the source reported while the last known good
+// configuration is used
+const LastKnownGoodSource = "last-known-good"
+
+// DegradedLoader is implemented by loaders that can serve a configuration from
+// a fallback source
+type DegradedLoader interface {
+	// Degraded returns the source of the current configuration, and tells if it
+	// is not the primary source
+	Degraded() (source string, degraded bool)
+}
+
+var (
+	_ DegradedLoader    = (*FallbackConfigLoader)(nil)
+	_ DegradedLoader    = (*CachedConfigLoader)(nil)
+	_ ConditionalLoader = (*FallbackConfigLoader)(nil)
+)
+
+// FallbackOption configures a FallbackConfigLoader
+type FallbackOption func(*FallbackConfigLoader)
+
+// WithLastKnownGood persists every configuration loaded from a source to path,
+// the file is read when all the sources fail
+func WithLastKnownGood(path string) FallbackOption {
+	return func(l *FallbackConfigLoader) {
+		l.lastKnownGood = path
+	}
+}
+
+// WithDefaultLoader sets the loader used when the sources and the last known
+// good configuration are unavailable, e.g. a static configuration
+func WithDefaultLoader(loader ConfigLoader) FallbackOption {
+	return func(l *FallbackConfigLoader) {
+		l.defaultLoader = loader
+	}
+}
+
+// FallbackConfigLoader loads configuration from the first available source of
+// a chain
+//
+// The sources are tried in order, the first one is the primary source. When
+// they all fail, the configuration already loaded is kept: it is the last known
+// good configuration of a warm container. A new container reads the last known
+// good file instead, and then uses the default loader. The primary source is
+// tried again on every load, so the chain recovers with the source.
+type FallbackConfigLoader struct {
+	loaders       []ConfigLoader
+	lastKnownGood string
+	defaultLoader ConfigLoader
+	// signed disables the last known good file, it holds no signature
+	signed bool
+
+	mu     sync.Mutex
+	config *rules.Configuration
+	active int    // index of the source of config, see lastKnownGoodIndex and defaultIndex
+	source string // name of the source of config
+}
+
+// NewFallbackConfigLoader creates a new fallback configuration loader trying
+// loaders in order
+func NewFallbackConfigLoader(loaders []ConfigLoader, opts ...FallbackOption) *FallbackConfigLoader {
+	l := &FallbackConfigLoader{
+		loaders: loaders,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Load loads configuration from the first available source
+func (l *FallbackConfigLoader) Load(ctx context.Context) (*rules.Configuration, error) {
+	return l.load(ctx, false)
+}
+
+// LoadIfChanged loads configuration from the first available source, or returns
+// ErrNotModified when the configuration did not change, including when it is
+// kept as last known good
+func (l *FallbackConfigLoader) LoadIfChanged(ctx context.Context) (*rules.Configuration, error) {
+	return l.load(ctx, true)
+}
+
+func (l *FallbackConfigLoader) load(ctx context.Context, conditional bool) (*rules.Configuration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var errs []error
+	for i, loader := range l.loaders {
+		var cfg *rules.Configuration
+		var err error
+		if cl, ok := loader.(ConditionalLoader); ok && conditional && l.config != nil && i == l.active {
+			cfg, err = cl.LoadIfChanged(ctx)
+			if errors.Is(err, ErrNotModified) {
+				return nil, ErrNotModified
+			}
+		} else {
+			cfg, err = loader.Load(ctx)
+		}
+		if err != nil {
+			log.Ctx(ctx).Warn().
+				Err(err).
+				Str("loader", loader.String()).
+				Msg("configuration source unavailable")
+			errs = append(errs, fmt.Errorf("%s: %w", loader, err))
+			continue
+		}
+
+		if i > 0 {
+			log.Ctx(ctx).Warn().
+				Str("loader", loader.String()).
+				Msg("configuration loaded from fallback source")
+		}
+		l.activate(i, loader.String(), cfg)
+		l.saveLastKnownGood(ctx, cfg)
+		return cfg, nil
+	}
+	err := fmt.Errorf("all configuration sources failed: %w", errors.Join(errs...))
+
+	if l.config != nil && l.active <= l.lastKnownGoodIndex() {
+		log.Ctx(ctx).Warn().
+			Err(err).
+			Str("version", l.config.Version).
+			Msg("keeping last known good configuration")
+		l.active, l.source = l.lastKnownGoodIndex(), LastKnownGoodSource
+		if conditional {
+			return nil, ErrNotModified
+		}
+		return l.config, nil
+	}
+
+	if l.lastKnownGood != "" && l.signed {
+		err = fmt.Errorf("%w, last known good: %w", err, ErrSignatureUnsupported)
+	} else if l.lastKnownGood != "" {
+		cfg, lkgErr := readLastKnownGood(l.lastKnownGood)
+		if lkgErr == nil {
+			log.Ctx(ctx).Warn().
+				Err(err).
+				Str("path", l.lastKnownGood).
+				Str("version", cfg.Version).
+				Msg("using last known good configuration")
+			l.activate(l.lastKnownGoodIndex(), LastKnownGoodSource, cfg)
+			return cfg, nil
+		}
+		err = fmt.Errorf("%w, last known good: %w", err, lkgErr)
+	}
+
+	if l.defaultLoader != nil {
+		if conditional && l.config != nil && l.active == l.defaultIndex() {
+			return nil, ErrNotModified
+		}
+		cfg, defaultErr := l.defaultLoader.Load(ctx)
+		if defaultErr == nil {
+			log.Ctx(ctx).Error().
+				Err(err).
+				Str("loader", l.defaultLoader.String()).
+				Msg("using default configuration")
+			l.activate(l.defaultIndex(), l.defaultLoader.String(), cfg)
+			return cfg, nil
+		}
+		err = fmt.Errorf("%w, default: %w", err, defaultErr)
+	}
+
+	return nil, err
+}
+
+// lastKnownGoodIndex is the index of the last known good configuration in the
+// chain, after the sources
+func (l *FallbackConfigLoader) lastKnownGoodIndex() int { return len(l.loaders) }
+
+// defaultIndex is the index of the default loader in the chain
+func (l *FallbackConfigLoader) defaultIndex() int { return len(l.loaders) + 1 }
+
+func (l *FallbackConfigLoader) activate(index int, source string, cfg *rules.Configuration) {
+	l.active, l.source, l.config = index, source, cfg
+}
+
+// saveLastKnownGood persists cfg, a failure only loses the copy
+func (l *FallbackConfigLoader) saveLastKnownGood(ctx context.Context, cfg *rules.Configuration) {
+	if l.lastKnownGood == "" || l.signed {
+		return
+	}
+	if err := writeLastKnownGood(l.lastKnownGood, cfg); err != nil {
+		log.Ctx(ctx).Warn().
+			Err(err).
+			Str("path", l.lastKnownGood).
+			Msg("failed to save last known good configuration")
+	}
+}
+
+// Degraded returns the source of the current configuration, the configuration
+// is degraded when it is not loaded from the primary source
+func (l *FallbackConfigLoader) Degraded() (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.source, l.config != nil && l.active > 0
+}
+
+func (l *FallbackConfigLoader) String() string {
+	names := make([]string, len(l.loaders))
+	for i, loader := range l.loaders {
+		names[i] = loader.String()
+	}
+	return fmt.Sprintf("FallbackConfigLoader(%s)", strings.Join(names, ", "))
+}
+
+// writeLastKnownGood writes cfg to path through a temporary file, a concurrent
+// reader never sees a partial file
+func writeLastKnownGood(path string, cfg *rules.Configuration) error {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal configuration: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readLastKnownGood reads a configuration written by writeLastKnownGood
+func readLastKnownGood(path string) (*rules.Configuration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(rules.Configuration)
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse last known good configuration: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("last known good configuration validation failed: %w", err)
+	}
+	return cfg, nil
+}
+
+// StaticConfigLoader returns a fixed configuration, the last resort of a
+// fallback chain
+type StaticConfigLoader struct {
+	name   string
+	config *rules.Configuration
+}
+
+// NewStaticConfigLoader creates a loader returning cfg
+func NewStaticConfigLoader(name string, cfg *rules.Configuration) *StaticConfigLoader {
+	return &StaticConfigLoader{name: name, config: cfg}
+}
+
+// NewPassThroughConfigLoader creates a loader returning a configuration without
+// rules: every record is kept
+func NewPassThroughConfigLoader() *StaticConfigLoader {
+	return NewStaticConfigLoader("passthrough", &rules.Configuration{Version: "0.0.0-passthrough"})
+}
+
+// Load returns the static configuration
+func (l *StaticConfigLoader) Load(ctx context.Context) (*rules.Configuration, error) {
+	return l.config, nil
+}
+
+func (l *StaticConfigLoader) String() string {
+	return fmt.Sprintf("StaticConfigLoader(name=%s)", l.name)
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"context"
+	"ctlp/pkg/rules"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFallbackConfigLoader(t *testing.T) {
+	ctx := context.Background()
+	outage := errors.New("service unavailable")
+
+	t.Run("primary source", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "lkg.yaml")
+		primary := &mockConfigLoader{config: loadTestConfig(t, baseConfig)}
+		loader := NewFallbackConfigLoader([]ConfigLoader{primary}, WithLastKnownGood(path))
+
+		cfg, err := loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "1.0.0", cfg.Version)
+		source, degraded := loader.Degraded()
+		assert.Equal(t, "MockConfigLoader", source)
+		assert.False(t, degraded)
+
+		saved, err := readLastKnownGood(path)
+		assert.NoError(t, err)
+		assert.Equal(t, ruleNames(cfg), ruleNames(saved))
+	})
+
+	t.Run("secondary source", func(t *testing.T) {
+		primary := &mockConfigLoader{err: outage}
+		secondary := &mockConfigLoader{config: loadTestConfig(t, overrideConfig)}
+		loader := NewFallbackConfigLoader([]ConfigLoader{primary, secondary})
+
+		cfg, err := loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "2.0.0", cfg.Version)
+		_, degraded := loader.Degraded()
+		assert.True(t, degraded)
+
+		// the primary source is tried again on every load
+		primary.err = nil
+		primary.config = loadTestConfig(t, baseConfig)
+		cfg, err = loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "1.0.0", cfg.Version)
+		_, degraded = loader.Degraded()
+		assert.False(t, degraded)
+	})
+
+	t.Run("keeps configuration of warm container", func(t *testing.T) {
+		primary := &mockConfigLoader{config: loadTestConfig(t, baseConfig)}
+		loader := NewFallbackConfigLoader([]ConfigLoader{primary}, WithDefaultLoader(NewPassThroughConfigLoader()))
+
+		loaded, err := loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+
+		primary.err = outage
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+		cfg, err := loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.Same(t, loaded, cfg)
+		source, degraded := loader.Degraded()
+		assert.Equal(t, LastKnownGoodSource, source)
+		assert.True(t, degraded)
+	})
+
+	t.Run("last known good file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "lkg.yaml")
+		primary := &mockConfigLoader{config: loadTestConfig(t, baseConfig)}
+		_, err := NewFallbackConfigLoader([]ConfigLoader{primary}, WithLastKnownGood(path)).Load(ctx)
+		assert.NoError(t, err)
+
+		// a new container during an outage
+		primary.err = outage
+		loader := NewFallbackConfigLoader([]ConfigLoader{primary},
+			WithLastKnownGood(path), WithDefaultLoader(NewPassThroughConfigLoader()))
+		cfg, err := loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "1.0.0", cfg.Version)
+		assert.Equal(t, []string{"Drop Describe", "Drop KMS"}, ruleNames(cfg))
+		source, degraded := loader.Degraded()
+		assert.Equal(t, LastKnownGoodSource, source)
+		assert.True(t, degraded)
+	})
+
+	t.Run("default configuration", func(t *testing.T) {
+		loader := NewFallbackConfigLoader([]ConfigLoader{&mockConfigLoader{err: outage}},
+			WithLastKnownGood(filepath.Join(t.TempDir(), "missing.yaml")),
+			WithDefaultLoader(NewPassThroughConfigLoader()))
+
+		cfg, err := loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, cfg.Rules)
+		_, degraded := loader.Degraded()
+		assert.True(t, degraded)
+
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+
+		// the default configuration keeps every record
+		cachedCfg, err := rules.PrepareConfiguration(cfg)
+		assert.NoError(t, err)
+		match, _, err := cachedCfg.EvalRules(map[string]any{"eventName": "DescribeInstances"})
+		assert.NoError(t, err)
+		assert.False(t, match)
+	})
+
+	t.Run("all sources failed", func(t *testing.T) {
+		loader := NewFallbackConfigLoader([]ConfigLoader{&mockConfigLoader{err: outage}},
+			WithLastKnownGood(filepath.Join(t.TempDir(), "missing.yaml")))
+
+		_, err := loader.Load(ctx)
+		assert.ErrorIs(t, err, outage)
+		_, degraded := loader.Degraded()
+		assert.False(t, degraded)
+	})
+}
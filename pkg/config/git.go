@@ -0,0 +1,151 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"ctlp/pkg/rules"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// GitConfigLoader loads configuration from a file at a ref of a local Git
+// repository, a checkout or a bundle file
+//
+// A bundle is cloned into a temporary bare repository on every load, so a
+// bundle replaced on disk is picked up. The git binary must be in
+// the PATH.
+type GitConfigLoader struct {
+	repo string
+	ref  string
+	path string
+	signed
+
+	mu     sync.Mutex
+	blobID string // object ID of the last loaded file
+	config *rules.Configuration
+}
+
+// NewGitConfigLoader creates a new Git configuration loader, reading path at
+// ref (a branch, tag or commit) of repo
+func NewGitConfigLoader(repo, ref, path string) *GitConfigLoader {
+	return &GitConfigLoader{
+		repo: repo,
+		ref:  ref,
+		path: strings.TrimPrefix(path, "/"),
+	}
+}
+
+// Load loads configuration from the Git repository
+func (l *GitConfigLoader) Load(ctx context.Context) (*rules.Configuration, error) {
+	cfg, err := l.LoadIfChanged(ctx)
+	if errors.Is(err, ErrNotModified) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.config, nil
+	}
+	return cfg, err
+}
+
+// LoadIfChanged loads configuration from the Git repository, or returns
+// ErrNotModified when the file at ref is the file of the last load
+func (l *GitConfigLoader) LoadIfChanged(ctx context.Context) (*rules.Configuration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	log.Ctx(ctx).Debug().
+		Str("repo", l.repo).
+		Str("ref", l.ref).
+		Str("path", l.path).
+		Msg("loading configuration from Git repository")
+
+	gitDir, cleanup, err := l.gitDir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	object := l.ref + ":" + l.path
+	blobID, err := l.git(ctx, gitDir, "rev-parse", "--verify", "--quiet", object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", object, err)
+	}
+	blobID = strings.TrimSpace(blobID)
+	if l.config != nil && blobID == l.blobID {
+		return nil, ErrNotModified
+	}
+
+	data, err := l.git(ctx, gitDir, "cat-file", "blob", blobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", object, err)
+	}
+
+	// the signature is read at the same ref
+	err = l.verify(ctx, l.path, []byte(data), func(path string) ([]byte, error) {
+		signature, err := l.git(ctx, gitDir, "cat-file", "blob", l.ref+":"+path)
+		return []byte(signature), err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := rules.Load(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %w", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("configuration validation failed: %w", err)
+	}
+
+	l.config = cfg
+	l.blobID = blobID
+	return cfg, nil
+}
+
+// gitDir returns the repository to read, cloning the bundle when repo is a
+// file, and the function removing the clone
+func (l *GitConfigLoader) gitDir(ctx context.Context) (string, func(), error) {
+	info, err := os.Stat(l.repo)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open Git repository: %w", err)
+	}
+	if info.IsDir() {
+		return l.repo, func() {}, nil
+	}
+
+	bare, err := os.MkdirTemp("", "ctlp-config-*.git")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create bundle repository: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(bare) }
+	if _, err := l.git(ctx, "", "clone", "--quiet", "--mirror", l.repo, bare); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to clone Git bundle: %w", err)
+	}
+	return bare, cleanup, nil
+}
+
+// git runs a git command in dir and returns its output
+func (l *GitConfigLoader) git(ctx context.Context, dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %w: %s", args[0], err, msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
+
+func (l *GitConfigLoader) String() string {
+	return fmt.Sprintf("GitConfigLoader(repo=%s, ref=%s, path=%s)", l.repo, l.ref, l.path)
+}
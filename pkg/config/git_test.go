@@ -0,0 +1,90 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gitRepo creates a repository with one commit per content of rules.yaml
+func gitRepo(t *testing.T, contents ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	run := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	run("init", "--quiet", "--initial-branch=main")
+	for i, content := range contents {
+		if err := os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		run("add", "rules.yaml")
+		run("commit", "--quiet", "-m", "rules")
+		if i == 0 {
+			run("tag", "v1")
+		}
+	}
+	return dir
+}
+
+func TestGitConfigLoader(t *testing.T) {
+	ctx := context.Background()
+	updated := testConfig + "\n  - name: Other\n    matches:\n      - field_name: eventName\n        regex: \"^Other$\"\n"
+
+	t.Run("checkout", func(t *testing.T) {
+		repo := gitRepo(t, testConfig, updated)
+
+		cfg, err := NewGitConfigLoader(repo, "v1", "rules.yaml").Load(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, cfg.Rules, 1)
+
+		loader := NewGitConfigLoader(repo, "main", "/rules.yaml")
+		cfg, err = loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, cfg.Rules, 2)
+
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+	})
+
+	t.Run("bundle", func(t *testing.T) {
+		repo := gitRepo(t, testConfig, updated)
+		bundle := filepath.Join(t.TempDir(), "rules.bundle")
+		if out, err := exec.Command("git", "-C", repo, "bundle", "create", bundle, "--all").CombinedOutput(); err != nil {
+			t.Fatalf("git bundle: %v: %s", err, out)
+		}
+
+		loader := NewGitConfigLoader(bundle, "HEAD", "rules.yaml")
+		cfg, err := loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, cfg.Rules, 2)
+
+		cfg, err = NewGitConfigLoader(bundle, "v1", "rules.yaml").Load(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, cfg.Rules, 1)
+
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		repo := gitRepo(t, testConfig)
+		_, err := NewGitConfigLoader(repo, "main", "missing.yaml").Load(ctx)
+		assert.ErrorContains(t, err, "failed to resolve main:missing.yaml")
+	})
+}
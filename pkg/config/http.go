@@ -0,0 +1,288 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"ctlp/pkg/rules"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxHTTPConfigSize limits the size of a configuration served over HTTP
+	maxHTTPConfigSize = 10 * 1024 * 1024
+	// maxHTTPSignatureSize limits the size of a detached signature
+	maxHTTPSignatureSize = 64 * 1024
+)
+
+// ErrCertificateNotPinned is returned when the server certificate chain has
+// none of the pinned public keys
+var ErrCertificateNotPinned = errors.New("server certificate does not match any pinned public key")
+
+// HTTPOption configures an HTTPConfigLoader
+type HTTPOption func(*HTTPConfigLoader)
+
+// WithHTTPClient sets the client used to fetch the configuration
+func WithHTTPClient(client *http.Client) HTTPOption {
+	return func(l *HTTPConfigLoader) {
+		l.client = client
+	}
+}
+
+// WithBearerTokenSecret sends the value of a Secrets Manager secret as bearer
+// token, the secret is read again when the server answers 401
+func WithBearerTokenSecret(secretID string, client SecretsManagerAPI) HTTPOption {
+	return func(l *HTTPConfigLoader) {
+		l.tokenSecretID = secretID
+		l.secrets = client
+	}
+}
+
+// WithPinnedPublicKeys only accepts servers with one of the given public keys
+// in their verified certificate chain
+//
+// Pins are the base64 encoded SHA-256 digests of the DER SubjectPublicKeyInfo:
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func WithPinnedPublicKeys(pins ...string) HTTPOption {
+	return func(l *HTTPConfigLoader) {
+		l.pins = append(l.pins, pins...)
+	}
+}
+
+// HTTPConfigLoader loads configuration from an HTTP(S) endpoint
+//
+// The ETag of the last response is sent as If-None-Match, a 304 response keeps
+// the last configuration without parsing it again.
+type HTTPConfigLoader struct {
+	url           string
+	client        *http.Client
+	tokenSecretID string
+	secrets       SecretsManagerAPI
+	pins          []string
+	signed
+
+	mu     sync.Mutex
+	token  string
+	etag   string
+	config *rules.Configuration
+}
+
+// NewHTTPConfigLoader creates a new HTTP configuration loader
+func NewHTTPConfigLoader(url string, opts ...HTTPOption) *HTTPConfigLoader {
+	l := &HTTPConfigLoader{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if len(l.pins) > 0 {
+		l.client = pinnedClient(l.client, l.pins)
+	}
+	return l
+}
+
+// Load loads configuration from the HTTP endpoint, the last configuration is
+// returned when the server answers 304
+func (l *HTTPConfigLoader) Load(ctx context.Context) (*rules.Configuration, error) {
+	cfg, err := l.LoadIfChanged(ctx)
+	if errors.Is(err, ErrNotModified) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.config, nil
+	}
+	return cfg, err
+}
+
+// LoadIfChanged loads configuration from the HTTP endpoint, or returns
+// ErrNotModified when the server answers 304 to the ETag of the last load
+func (l *HTTPConfigLoader) LoadIfChanged(ctx context.Context) (*rules.Configuration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	log.Ctx(ctx).Debug().
+		Str("url", l.url).
+		Msg("loading configuration from HTTP endpoint")
+
+	resp, err := l.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the token may have been rotated since it was read
+	if resp.StatusCode == http.StatusUnauthorized && l.tokenSecretID != "" {
+		resp.Body.Close()
+		l.token = ""
+		if resp, err = l.get(ctx); err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && l.config != nil:
+		return nil, ErrNotModified
+	case resp.StatusCode != http.StatusOK:
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, URL: l.url}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPConfigSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HTTP response: %w", err)
+	}
+	if len(data) > maxHTTPConfigSize {
+		return nil, fmt.Errorf("configuration exceeds %d bytes", maxHTTPConfigSize)
+	}
+
+	if err := l.verify(ctx, l.url, data, func(string) ([]byte, error) { return l.readSignature(ctx) }); err != nil {
+		return nil, err
+	}
+
+	cfg, err := rules.Load(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %w", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("configuration validation failed: %w", err)
+	}
+
+	l.config = cfg
+	l.etag = resp.Header.Get("ETag")
+	return cfg, nil
+}
+
+// get sends the conditional request with the bearer token
+func (l *HTTPConfigLoader) get(ctx context.Context) (*http.Response, error) {
+	return l.do(ctx, l.url, l.etag != "" && l.config != nil)
+}
+
+// readSignature reads the signature of the configuration, at the path of the
+// configuration URL followed by the signature suffix
+func (l *HTTPConfigLoader) readSignature(ctx context.Context) ([]byte, error) {
+	sigURL, err := url.Parse(l.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URL: %w", err)
+	}
+	sigURL.Path += l.verifier.suffix
+	sigURL.RawPath = ""
+
+	resp, err := l.do(ctx, sigURL.String(), false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, URL: sigURL.String()}
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxHTTPSignatureSize))
+}
+
+// do sends a GET request with the bearer token, conditional requests send the
+// ETag of the last response
+func (l *HTTPConfigLoader) do(ctx context.Context, target string, conditional bool) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	if conditional {
+		req.Header.Set("If-None-Match", l.etag)
+	}
+
+	if l.tokenSecretID != "" {
+		if l.token == "" {
+			if l.token, err = l.readToken(ctx); err != nil {
+				return nil, err
+			}
+		}
+		req.Header.Set("Authorization", "Bearer "+l.token)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get configuration: %w", err)
+	}
+	return resp, nil
+}
+
+// readToken reads the bearer token from Secrets Manager
+func (l *HTTPConfigLoader) readToken(ctx context.Context) (string, error) {
+	resp, err := l.secrets.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(l.tokenSecretID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get bearer token secret: %w", err)
+	}
+	if resp.SecretString == nil {
+		return "", fmt.Errorf("bearer token secret string is nil")
+	}
+	return strings.TrimSpace(*resp.SecretString), nil
+}
+
+func (l *HTTPConfigLoader) String() string {
+	return fmt.Sprintf("HTTPConfigLoader(url=%s)", l.url)
+}
+
+// HTTPStatusError is returned for unexpected HTTP response status codes
+type HTTPStatusError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d from %s", e.StatusCode, e.URL)
+}
+
+// HTTPStatusCode returns the status code, it is used to classify retryable errors
+func (e *HTTPStatusError) HTTPStatusCode() int { return e.StatusCode }
+
+// pinnedClient returns a copy of client checking the public key pins after the
+// standard certificate verification
+func pinnedClient(client *http.Client, pins []string) *http.Client {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok || transport == nil {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	pinned := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		pinned[strings.TrimSpace(pin)] = true
+	}
+	transport.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				if pinned[publicKeyPin(cert)] {
+					return nil
+				}
+			}
+		}
+		return ErrCertificateNotPinned
+	}
+
+	pinnedClient := *client
+	pinnedClient.Transport = transport
+	return &pinnedClient
+}
+
+// publicKeyPin returns the pin of a certificate public key
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHTTPConfigLoader(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("ETag caching", func(t *testing.T) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(testConfig))
+		}))
+		defer server.Close()
+
+		loader := NewHTTPConfigLoader(server.URL + "/rules.yaml")
+		cfg, err := loader.LoadIfChanged(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "Test Rule", cfg.Rules[0].Name)
+
+		_, err = loader.LoadIfChanged(ctx)
+		assert.ErrorIs(t, err, ErrNotModified)
+
+		again, err := loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.Same(t, cfg, again)
+		assert.Equal(t, 3, requests)
+	})
+
+	t.Run("unexpected status", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		_, err := NewHTTPConfigLoader(server.URL).Load(ctx)
+		var statusErr *HTTPStatusError
+		assert.ErrorAs(t, err, &statusErr)
+		assert.Equal(t, http.StatusServiceUnavailable, statusErr.HTTPStatusCode())
+	})
+
+	t.Run("bearer token from Secrets Manager", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer rotated" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(testConfig))
+		}))
+		defer server.Close()
+
+		mockClient := new(mockSecretsManagerClient)
+		input := mock.MatchedBy(func(in *secretsmanager.GetSecretValueInput) bool {
+			return aws.ToString(in.SecretId) == "ctlp/config-token"
+		})
+		mockClient.On("GetSecretValue", ctx, input).
+			Return(&secretsmanager.GetSecretValueOutput{SecretString: aws.String("expired")}, nil).Once()
+		mockClient.On("GetSecretValue", ctx, input).
+			Return(&secretsmanager.GetSecretValueOutput{SecretString: aws.String("rotated\n")}, nil).Once()
+
+		loader := NewHTTPConfigLoader(server.URL, WithBearerTokenSecret("ctlp/config-token", mockClient))
+		_, err := loader.Load(ctx)
+		assert.NoError(t, err)
+
+		// the token is cached
+		_, err = loader.Load(ctx)
+		assert.NoError(t, err)
+		mockClient.AssertExpectations(t)
+	})
+
+	t.Run("TLS pinning", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(testConfig))
+		}))
+		defer server.Close()
+		pin := publicKeyPin(server.Certificate())
+
+		loader := NewHTTPConfigLoader(server.URL, WithHTTPClient(server.Client()), WithPinnedPublicKeys(pin))
+		_, err := loader.Load(ctx)
+		assert.NoError(t, err)
+
+		loader = NewHTTPConfigLoader(server.URL, WithHTTPClient(server.Client()),
+			WithPinnedPublicKeys("47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="))
+		_, err = loader.Load(ctx)
+		assert.ErrorIs(t, err, ErrCertificateNotPinned)
+	})
+}
+
+func TestLoaderFromURIHTTPOptions(t *testing.T) {
+	t.Setenv("CONFIG_HTTP_TOKEN_SECRET_ID", "ctlp/config-token")
+	t.Setenv("CONFIG_HTTP_PINNED_KEYS", "pin-1,pin-2")
+
+	for _, uri := range []string{"https://config.example.com/rules.yaml", "http://config.internal/rules.yaml"} {
+		loader, err := loaderFromURI(&aws.Config{Region: "eu-west-1"}, uri)
+		assert.NoError(t, err)
+
+		httpLoader, ok := loader.(*HTTPConfigLoader)
+		if !ok {
+			t.Fatalf("expected an HTTPConfigLoader, got %T", loader)
+		}
+		assert.Equal(t, "ctlp/config-token", httpLoader.tokenSecretID)
+		assert.NotNil(t, httpLoader.secrets)
+		assert.Equal(t, []string{"pin-1", "pin-2"}, httpLoader.pins)
+	}
+}
@@ -3,14 +3,17 @@ package config
 import (
 	"context"
 	"ctlp/pkg/rules"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/appconfigdata"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
@@ -39,10 +42,18 @@ type SecretsManagerAPI interface {
 }
 
 // S3ConfigLoader loads configuration from S3
+//
+// Includes are read from the same bucket, relative to the key of the including
+// object, or from another bucket with an s3://bucket/key reference.
 type S3ConfigLoader struct {
 	bucket string
 	key    string
 	client S3API
+	signed
+
+	mu       sync.Mutex
+	etag     string // ETag of the last loaded object
+	included bool   // the last loaded object has includes
 }
 
 // NewS3ConfigLoader creates a new S3 configuration loader
@@ -56,16 +67,38 @@ func NewS3ConfigLoader(bucket, key string, client S3API) *S3ConfigLoader {
 
 // Load loads configuration from S3
 func (l *S3ConfigLoader) Load(ctx context.Context) (*rules.Configuration, error) {
+	return l.load(ctx, false)
+}
+
+// LoadIfChanged loads configuration from S3 with If-None-Match set to the ETag of
+// the last loaded object
+func (l *S3ConfigLoader) LoadIfChanged(ctx context.Context) (*rules.Configuration, error) {
+	return l.load(ctx, true)
+}
+
+func (l *S3ConfigLoader) load(ctx context.Context, conditional bool) (*rules.Configuration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
 	log.Ctx(ctx).Debug().
 		Str("bucket", l.bucket).
 		Str("key", l.key).
 		Msg("loading configuration from S3")
 
-	resp, err := l.client.GetObject(ctx, &s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(l.bucket),
 		Key:    aws.String(l.key),
-	})
+	}
+	// the ETag of the object does not change with its includes
+	if conditional && l.etag != "" && !l.included {
+		input.IfNoneMatch = aws.String(l.etag)
+	}
+
+	resp, err := l.client.GetObject(ctx, input)
 	if err != nil {
+		if isNotModified(err) {
+			return nil, ErrNotModified
+		}
 		return nil, fmt.Errorf("failed to get S3 object: %w", err)
 	}
 	defer resp.Body.Close()
@@ -75,7 +108,16 @@ func (l *S3ConfigLoader) Load(ctx context.Context) (*rules.Configuration, error)
 		return nil, fmt.Errorf("failed to read S3 object: %w", err)
 	}
 
-	cfg, err := rules.Load(string(data))
+	if err := l.verifyObject(ctx, l.bucket, l.key, data); err != nil {
+		return nil, err
+	}
+
+	included := false
+	resolve := func(ctx context.Context, from, ref string) (string, string, error) {
+		included = true
+		return l.resolveInclude(ctx, from, ref)
+	}
+	cfg, err := rules.LoadLayered(ctx, s3URI(l.bucket, l.key), string(data), resolve)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse configuration: %w", err)
 	}
@@ -84,9 +126,64 @@ func (l *S3ConfigLoader) Load(ctx context.Context) (*rules.Configuration, error)
 		return nil, fmt.Errorf("configuration validation failed: %w", err)
 	}
 
+	l.etag = aws.ToString(resp.ETag)
+	l.included = included
 	return cfg, nil
 }
 
+// resolveInclude reads an object included by the object from
+func (l *S3ConfigLoader) resolveInclude(ctx context.Context, from, ref string) (string, string, error) {
+	var bucket, key string
+	if uri, ok := strings.CutPrefix(ref, "s3://"); ok {
+		bucket, key, _ = strings.Cut(uri, "/")
+	} else {
+		// a key starting with a slash is relative to the bucket root
+		var fromKey string
+		bucket, fromKey, _ = strings.Cut(strings.TrimPrefix(from, "s3://"), "/")
+		if key, ok = strings.CutPrefix(ref, "/"); !ok {
+			key = path.Join(path.Dir(fromKey), ref)
+		}
+	}
+
+	data, err := l.getObject(ctx, bucket, key)
+	if err != nil {
+		return "", "", err
+	}
+	if err := l.verifyObject(ctx, bucket, key, data); err != nil {
+		return "", "", err
+	}
+	return s3URI(bucket, key), string(data), nil
+}
+
+// verifyObject verifies the signature of an object, read from the same bucket
+func (l *S3ConfigLoader) verifyObject(ctx context.Context, bucket, key string, data []byte) error {
+	return l.verify(ctx, key, data, func(key string) ([]byte, error) {
+		return l.getObject(ctx, bucket, key)
+	})
+}
+
+// getObject reads an object without condition
+func (l *S3ConfigLoader) getObject(ctx context.Context, bucket, key string) ([]byte, error) {
+	resp, err := l.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get S3 object: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read S3 object: %w", err)
+	}
+	return data, nil
+}
+
+func s3URI(bucket, key string) string {
+	return "s3://" + bucket + "/" + key
+}
+
 func (l *S3ConfigLoader) String() string {
 	return fmt.Sprintf("S3ConfigLoader(bucket=%s, key=%s)", l.bucket, l.key)
 }
@@ -95,6 +192,10 @@ func (l *S3ConfigLoader) String() string {
 type SSMConfigLoader struct {
 	parameterName string
 	client        SSMAPI
+	signed
+
+	mu      sync.Mutex
+	version int64 // version of the last loaded parameter
 }
 
 // NewSSMConfigLoader creates a new SSM Parameter Store configuration loader
@@ -107,6 +208,19 @@ func NewSSMConfigLoader(parameterName string, client SSMAPI) *SSMConfigLoader {
 
 // Load loads configuration from SSM Parameter Store
 func (l *SSMConfigLoader) Load(ctx context.Context) (*rules.Configuration, error) {
+	return l.load(ctx, false)
+}
+
+// LoadIfChanged loads configuration from SSM Parameter Store, the value is not
+// parsed when the parameter version is the version of the last load
+func (l *SSMConfigLoader) LoadIfChanged(ctx context.Context) (*rules.Configuration, error) {
+	return l.load(ctx, true)
+}
+
+func (l *SSMConfigLoader) load(ctx context.Context, conditional bool) (*rules.Configuration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
 	log.Ctx(ctx).Debug().
 		Str("parameter", l.parameterName).
 		Msg("loading configuration from SSM Parameter Store")
@@ -122,6 +236,26 @@ func (l *SSMConfigLoader) Load(ctx context.Context) (*rules.Configuration, error
 	if resp.Parameter == nil || resp.Parameter.Value == nil {
 		return nil, fmt.Errorf("SSM parameter value is nil")
 	}
+	if conditional && l.version != 0 && resp.Parameter.Version == l.version {
+		return nil, ErrNotModified
+	}
+
+	err = l.verify(ctx, l.parameterName, []byte(*resp.Parameter.Value), func(name string) ([]byte, error) {
+		resp, err := l.client.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(name),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get SSM parameter: %w", err)
+		}
+		if resp.Parameter == nil || resp.Parameter.Value == nil {
+			return nil, fmt.Errorf("SSM parameter value is nil")
+		}
+		return []byte(*resp.Parameter.Value), nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	cfg, err := rules.Load(*resp.Parameter.Value)
 	if err != nil {
@@ -132,6 +266,7 @@ func (l *SSMConfigLoader) Load(ctx context.Context) (*rules.Configuration, error
 		return nil, fmt.Errorf("configuration validation failed: %w", err)
 	}
 
+	l.version = resp.Parameter.Version
 	return cfg, nil
 }
 
@@ -143,6 +278,10 @@ func (l *SSMConfigLoader) String() string {
 type SecretsManagerConfigLoader struct {
 	secretID string
 	client   SecretsManagerAPI
+	signed
+
+	mu        sync.Mutex
+	versionID string // VersionId of the last loaded secret
 }
 
 // NewSecretsManagerConfigLoader creates a new Secrets Manager configuration loader
@@ -155,6 +294,19 @@ func NewSecretsManagerConfigLoader(secretID string, client SecretsManagerAPI) *S
 
 // Load loads configuration from Secrets Manager
 func (l *SecretsManagerConfigLoader) Load(ctx context.Context) (*rules.Configuration, error) {
+	return l.load(ctx, false)
+}
+
+// LoadIfChanged loads configuration from Secrets Manager, the secret is not
+// parsed when its VersionId is the VersionId of the last load
+func (l *SecretsManagerConfigLoader) LoadIfChanged(ctx context.Context) (*rules.Configuration, error) {
+	return l.load(ctx, true)
+}
+
+func (l *SecretsManagerConfigLoader) load(ctx context.Context, conditional bool) (*rules.Configuration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
 	log.Ctx(ctx).Debug().
 		Str("secretId", l.secretID).
 		Msg("loading configuration from Secrets Manager")
@@ -169,6 +321,26 @@ func (l *SecretsManagerConfigLoader) Load(ctx context.Context) (*rules.Configura
 	if resp.SecretString == nil {
 		return nil, fmt.Errorf("secret string is nil")
 	}
+	versionID := aws.ToString(resp.VersionId)
+	if conditional && l.versionID != "" && versionID == l.versionID {
+		return nil, ErrNotModified
+	}
+
+	err = l.verify(ctx, l.secretID, []byte(*resp.SecretString), func(name string) ([]byte, error) {
+		resp, err := l.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(name),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get secret value: %w", err)
+		}
+		if resp.SecretString == nil {
+			return nil, fmt.Errorf("secret string is nil")
+		}
+		return []byte(*resp.SecretString), nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	cfg, err := rules.Load(*resp.SecretString)
 	if err != nil {
@@ -179,6 +351,7 @@ func (l *SecretsManagerConfigLoader) Load(ctx context.Context) (*rules.Configura
 		return nil, fmt.Errorf("configuration validation failed: %w", err)
 	}
 
+	l.versionID = versionID
 	return cfg, nil
 }
 
@@ -189,6 +362,12 @@ func (l *SecretsManagerConfigLoader) String() string {
 // LocalConfigLoader loads configuration from local file
 type LocalConfigLoader struct {
 	path string
+	signed
+
+	mu       sync.Mutex
+	modTime  time.Time // modification time of the last loaded file
+	size     int64
+	included bool // the last loaded file has includes
 }
 
 // NewLocalConfigLoader creates a new local file configuration loader
@@ -200,11 +379,61 @@ func NewLocalConfigLoader(path string) *LocalConfigLoader {
 
 // Load loads configuration from local file
 func (l *LocalConfigLoader) Load(ctx context.Context) (*rules.Configuration, error) {
+	return l.load(ctx, false)
+}
+
+// LoadIfChanged loads configuration from local file when its modification time
+// or size changed since the last load
+func (l *LocalConfigLoader) LoadIfChanged(ctx context.Context) (*rules.Configuration, error) {
+	return l.load(ctx, true)
+}
+
+func (l *LocalConfigLoader) load(ctx context.Context, conditional bool) (*rules.Configuration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
 	log.Ctx(ctx).Debug().
 		Str("path", l.path).
 		Msg("loading configuration from local file")
 
-	return rules.LoadFromConfigFile(ctx, l.path)
+	// a missing file is reported by ReadFile, the included files are not
+	// checked for changes
+	info, statErr := os.Stat(l.path)
+	if conditional && statErr == nil && !l.modTime.IsZero() && !l.included &&
+		info.ModTime().Equal(l.modTime) && info.Size() == l.size {
+		return nil, ErrNotModified
+	}
+
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return nil, fmt.Errorf("read config from file failed: %w", err)
+	}
+	if err := l.verify(ctx, l.path, data, os.ReadFile); err != nil {
+		return nil, err
+	}
+
+	included := false
+	resolve := func(ctx context.Context, from, ref string) (string, string, error) {
+		included = true
+		name, rawCfg, err := rules.FileIncludeResolver(ctx, from, ref)
+		if err != nil {
+			return "", "", err
+		}
+		if err := l.verify(ctx, name, []byte(rawCfg), os.ReadFile); err != nil {
+			return "", "", err
+		}
+		return name, rawCfg, nil
+	}
+	cfg, err := rules.LoadLayered(ctx, l.path, string(data), resolve)
+	if err != nil {
+		return nil, err
+	}
+
+	if statErr == nil {
+		l.modTime, l.size = info.ModTime(), info.Size()
+	}
+	l.included = included
+	return cfg, nil
 }
 
 func (l *LocalConfigLoader) String() string {
@@ -212,6 +441,10 @@ func (l *LocalConfigLoader) String() string {
 }
 
 // CachedConfigLoader wraps another loader with caching functionality
+//
+// Once the TTL expires, a ConditionalLoader is asked for changes only: an
+// unchanged source keeps the cached configuration without parsing and compiling
+// it again. Subscribers are notified of every new configuration version.
 type CachedConfigLoader struct {
 	loader      ConfigLoader
 	ttl         time.Duration
@@ -219,6 +452,9 @@ type CachedConfigLoader struct {
 	lastLoaded  time.Time
 	config      *rules.Configuration
 	cachedRules *rules.CachedConfiguration
+
+	subMu       sync.Mutex
+	subscribers subscribers
 }
 
 // NewCachedConfigLoader creates a new cached configuration loader
@@ -243,34 +479,86 @@ func (l *CachedConfigLoader) Load(ctx context.Context) (*rules.Configuration, er
 	}
 	l.mu.RUnlock()
 
+	config, cachedRules, err := l.reload(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Subscribers are called without the lock, they may load the configuration
+	if cachedRules != nil {
+		l.subMu.Lock()
+		fns := l.subscribers.list()
+		l.subMu.Unlock()
+		for _, fn := range fns {
+			fn(cachedRules)
+		}
+	}
+
+	return config, nil
+}
+
+// reload loads the configuration once the TTL expired, the compiled rules are
+// only returned when a new configuration version was loaded
+func (l *CachedConfigLoader) reload(ctx context.Context) (*rules.Configuration, *rules.CachedConfiguration, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	// Double-check after acquiring write lock
 	if l.config != nil && time.Since(l.lastLoaded) < l.ttl {
-		return l.config, nil
+		return l.config, nil, nil
 	}
 
 	log.Ctx(ctx).Debug().
 		Str("loader", l.loader.String()).
 		Msg("loading fresh configuration")
 
-	config, err := l.loader.Load(ctx)
+	var config *rules.Configuration
+	var err error
+	if conditional, ok := l.loader.(ConditionalLoader); ok && l.config != nil {
+		config, err = conditional.LoadIfChanged(ctx)
+		if errors.Is(err, ErrNotModified) {
+			log.Ctx(ctx).Debug().
+				Str("loader", l.loader.String()).
+				Str("version", l.config.Version).
+				Msg("configuration not modified")
+			l.lastLoaded = time.Now()
+			return l.config, nil, nil
+		}
+	} else {
+		config, err = l.loader.Load(ctx)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Pre-compile the rules for better performance
 	cachedRules, err := rules.PrepareConfiguration(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to prepare cached rules: %w", err)
+		return nil, nil, fmt.Errorf("failed to prepare cached rules: %w", err)
 	}
 
 	l.config = config
 	l.cachedRules = cachedRules
 	l.lastLoaded = time.Now()
 
-	return config, nil
+	return config, cachedRules, nil
+}
+
+// Subscribe registers fn to be called with the compiled rules of every new
+// configuration version, the returned function removes the subscription
+//
+// fn is called by the goroutine loading the new version, after the cache is
+// updated. Unchanged sources of a ConditionalLoader do not call fn.
+func (l *CachedConfigLoader) Subscribe(fn func(*rules.CachedConfiguration)) (unsubscribe func()) {
+	l.subMu.Lock()
+	defer l.subMu.Unlock()
+
+	id := l.subscribers.add(fn)
+	return func() {
+		l.subMu.Lock()
+		defer l.subMu.Unlock()
+		delete(l.subscribers.fns, id)
+	}
 }
 
 // LoadCached returns the cached compiled rules for better performance
@@ -285,6 +573,15 @@ func (l *CachedConfigLoader) LoadCached(ctx context.Context) (*rules.CachedConfi
 	return l.cachedRules, nil
 }
 
+// Degraded returns the source of the cached configuration when the wrapped
+// loader is a DegradedLoader
+func (l *CachedConfigLoader) Degraded() (string, bool) {
+	if degraded, ok := l.loader.(DegradedLoader); ok {
+		return degraded.Degraded()
+	}
+	return l.loader.String(), false
+}
+
 func (l *CachedConfigLoader) String() string {
 	return fmt.Sprintf("CachedConfigLoader(loader=%s, ttl=%s)", l.loader.String(), l.ttl)
 }
@@ -327,6 +624,54 @@ func CreateLoaderFromEnv(awsConfig *aws.Config) ConfigLoader {
 			baseLoader = NewSecretsManagerConfigLoader(secretID, smClient)
 		}
 
+	case "appconfig":
+		application := getEnv("CONFIG_APPCONFIG_APPLICATION", "")
+		environment := getEnv("CONFIG_APPCONFIG_ENVIRONMENT", "")
+		profile := getEnv("CONFIG_APPCONFIG_PROFILE", "")
+		if application != "" && environment != "" && profile != "" {
+			var opts []AppConfigOption
+			if interval, err := time.ParseDuration(getEnv("CONFIG_APPCONFIG_POLL_INTERVAL", "")); err == nil {
+				opts = append(opts, WithPollInterval(interval))
+			}
+			appConfigClient := appconfigdata.NewFromConfig(*awsConfig)
+			baseLoader = NewAppConfigLoader(application, environment, profile, appConfigClient, opts...)
+		}
+
+	case "http", "https":
+		url := getEnv("CONFIG_HTTP_URL", "")
+		if url != "" {
+			baseLoader = NewHTTPConfigLoader(url, httpOptionsFromEnv(awsConfig)...)
+		}
+
+	case "git":
+		repo := getEnv("CONFIG_GIT_REPO", "")
+		if repo != "" {
+			baseLoader = NewGitConfigLoader(repo, getEnv("CONFIG_GIT_REF", "HEAD"), getEnv("CONFIG_GIT_PATH", "rules.yaml"))
+		}
+
+	case "composite":
+		policy, err := rules.ParseCollisionPolicy(getEnv("CONFIG_COLLISION_POLICY", ""))
+		if err != nil {
+			log.Error().Err(err).Msg("invalid CONFIG_COLLISION_POLICY, using override")
+			policy = rules.CollisionOverride
+		}
+		var loaders []ConfigLoader
+		for _, uri := range strings.Split(getEnv("CONFIG_SOURCES", ""), ",") {
+			if uri = strings.TrimSpace(uri); uri == "" {
+				continue
+			}
+			loader, err := loaderFromURI(awsConfig, uri)
+			if err != nil {
+				log.Error().Err(err).Str("source", uri).Msg("invalid configuration source")
+				loaders = nil
+				break
+			}
+			loaders = append(loaders, loader)
+		}
+		if len(loaders) > 0 {
+			baseLoader = NewCompositeConfigLoader(policy, loaders...)
+		}
+
 	case "local":
 		fallthrough
 	default:
@@ -334,6 +679,21 @@ func CreateLoaderFromEnv(awsConfig *aws.Config) ConfigLoader {
 		baseLoader = NewLocalConfigLoader(configFile)
 	}
 
+	baseLoader = fallbackFromEnv(awsConfig, baseLoader)
+
+	// Require signed configurations when public keys are trusted, invalid keys
+	// reject every configuration rather than disable the verification
+	if publicKeys := getEnv("CONFIG_SIGNATURE_PUBLIC_KEYS", ""); publicKeys != "" {
+		keys, err := ParsePublicKeys(publicKeys)
+		if err != nil {
+			log.Error().Err(err).Msg("invalid CONFIG_SIGNATURE_PUBLIC_KEYS, rejecting all configurations")
+			baseLoader = &rejectingLoader{loader: baseLoader, err: fmt.Errorf("invalid trusted public keys: %w", err)}
+		} else {
+			verifier := NewSignatureVerifier(getEnv("CONFIG_SIGNATURE_SUFFIX", DefaultSignatureSuffix), keys...)
+			baseLoader = SetSignatureVerifier(baseLoader, verifier)
+		}
+	}
+
 	// Wrap with caching if enabled
 	if getEnv("CONFIG_CACHE_ENABLED", "true") == "true" {
 		ttlStr := getEnv("CONFIG_REFRESH_INTERVAL", "5m")
@@ -347,6 +707,93 @@ func CreateLoaderFromEnv(awsConfig *aws.Config) ConfigLoader {
 	return baseLoader
 }
 
+// fallbackFromEnv wraps loader in a FallbackConfigLoader with the fallback
+// sources, the last known good file and the default configuration
+func fallbackFromEnv(awsConfig *aws.Config, loader ConfigLoader) ConfigLoader {
+	var loaders []ConfigLoader
+	if loader != nil {
+		loaders = append(loaders, loader)
+	}
+	for _, uri := range strings.Split(getEnv("CONFIG_FALLBACK_SOURCES", ""), ",") {
+		if uri = strings.TrimSpace(uri); uri == "" {
+			continue
+		}
+		fallback, err := loaderFromURI(awsConfig, uri)
+		if err != nil {
+			log.Error().Err(err).Str("source", uri).Msg("invalid fallback configuration source")
+			continue
+		}
+		loaders = append(loaders, fallback)
+	}
+
+	var opts []FallbackOption
+	if getEnv("CONFIG_LAST_KNOWN_GOOD_ENABLED", "true") == "true" {
+		opts = append(opts, WithLastKnownGood(getEnv("CONFIG_LAST_KNOWN_GOOD_FILE", "/tmp/ctlp-last-known-good.yaml")))
+	}
+	switch defaultCfg := getEnv("CONFIG_FALLBACK_DEFAULT", ""); defaultCfg {
+	case "":
+	case "passthrough":
+		opts = append(opts, WithDefaultLoader(NewPassThroughConfigLoader()))
+	default:
+		opts = append(opts, WithDefaultLoader(NewLocalConfigLoader(defaultCfg)))
+	}
+
+	if len(loaders) == 1 && len(opts) == 0 {
+		return loader
+	}
+	return NewFallbackConfigLoader(loaders, opts...)
+}
+
+// httpOptionsFromEnv returns the bearer token and public key pinning options
+// of the HTTP configuration sources
+func httpOptionsFromEnv(awsConfig *aws.Config) []HTTPOption {
+	var opts []HTTPOption
+	if secretID := getEnv("CONFIG_HTTP_TOKEN_SECRET_ID", ""); secretID != "" {
+		opts = append(opts, WithBearerTokenSecret(secretID, secretsmanager.NewFromConfig(*awsConfig)))
+	}
+	if pins := getEnv("CONFIG_HTTP_PINNED_KEYS", ""); pins != "" {
+		opts = append(opts, WithPinnedPublicKeys(strings.Split(pins, ",")...))
+	}
+	return opts
+}
+
+// loaderFromURI creates the loader of one source of a composite configuration:
+// s3://bucket/key, ssm:name, secretsmanager:id,
+// appconfig:application/environment/profile, an http(s) URL, or a local file
+// as file:path or a plain path. HTTP sources get the options of
+// httpOptionsFromEnv, as CONFIG_HTTP_URL.
+func loaderFromURI(awsConfig *aws.Config, uri string) (ConfigLoader, error) {
+	scheme, ref, ok := strings.Cut(uri, ":")
+	if !ok {
+		return NewLocalConfigLoader(uri), nil
+	}
+
+	switch strings.ToLower(scheme) {
+	case "s3":
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(ref, "//"), "/")
+		if bucket == "" || key == "" {
+			return nil, fmt.Errorf("expected s3://bucket/key")
+		}
+		return NewS3ConfigLoader(bucket, key, s3.NewFromConfig(*awsConfig)), nil
+	case "ssm":
+		return NewSSMConfigLoader(ref, ssm.NewFromConfig(*awsConfig)), nil
+	case "secretsmanager":
+		return NewSecretsManagerConfigLoader(ref, secretsmanager.NewFromConfig(*awsConfig)), nil
+	case "appconfig":
+		parts := strings.Split(ref, "/")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("expected appconfig:application/environment/profile")
+		}
+		return NewAppConfigLoader(parts[0], parts[1], parts[2], appconfigdata.NewFromConfig(*awsConfig)), nil
+	case "http", "https":
+		return NewHTTPConfigLoader(uri, httpOptionsFromEnv(awsConfig)...), nil
+	case "file":
+		return NewLocalConfigLoader(ref), nil
+	default:
+		return nil, fmt.Errorf("unknown configuration source scheme %q", scheme)
+	}
+}
+
 func getEnv(key, defaultVal string) string {
 	if val := strings.TrimSpace(os.Getenv(key)); val != "" {
 		return val
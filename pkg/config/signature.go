@@ -0,0 +1,241 @@
+package config
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"ctlp/pkg/rules"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultSignatureSuffix is appended to the name of a configuration to locate
+// its detached signature
+const DefaultSignatureSuffix = ".sig"
+
+var (
+	// ErrSignatureMismatch is returned when a configuration signature is not
+	// valid for any trusted public key
+	ErrSignatureMismatch = errors.New("configuration signature does not match any trusted public key")
+	// ErrSignatureUnsupported is returned by the loaders of sources that cannot
+	// provide a detached signature, when signatures are required
+	ErrSignatureUnsupported = errors.New("configuration source does not support signature verification")
+)
+
+// SignatureVerifier verifies the detached signatures of raw configurations
+//
+// Ed25519 keys verify the signature of the raw bytes. ECDSA keys, e.g. KMS
+// ECC_NIST_P256 keys, verify an ASN.1 signature of the SHA-256, SHA-384 or
+// SHA-512 digest, following the curve size as the KMS ECDSA_SHA_* algorithms.
+// RSA keys verify a PKCS #1 v1.5 or PSS signature of the SHA-256 digest
+// (RSASSA_PKCS1_V1_5_SHA_256 and RSASSA_PSS_SHA_256).
+//
+// A signature is read as base64 when it decodes as base64, as raw bytes otherwise.
+type SignatureVerifier struct {
+	keys   []crypto.PublicKey
+	suffix string
+}
+
+// NewSignatureVerifier creates a verifier trusting keys, signatures are read
+// from the configuration name followed by suffix
+func NewSignatureVerifier(suffix string, keys ...crypto.PublicKey) *SignatureVerifier {
+	if suffix == "" {
+		suffix = DefaultSignatureSuffix
+	}
+	return &SignatureVerifier{keys: keys, suffix: suffix}
+}
+
+// Verify checks that signature is the signature of data by one of the keys
+func (v *SignatureVerifier) Verify(data, signature []byte) error {
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature))); err == nil {
+		signature = decoded
+	}
+
+	for _, key := range v.keys {
+		if verifySignature(key, data, signature) {
+			return nil
+		}
+	}
+	return ErrSignatureMismatch
+}
+
+func verifySignature(key crypto.PublicKey, data, signature []byte) bool {
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, signature)
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch size := key.Curve.Params().BitSize; {
+		case size <= 256:
+			sum := sha256.Sum256(data)
+			digest = sum[:]
+		case size <= 384:
+			sum := sha512.Sum384(data)
+			digest = sum[:]
+		default:
+			sum := sha512.Sum512(data)
+			digest = sum[:]
+		}
+		return ecdsa.VerifyASN1(key, digest, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil ||
+			rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, nil) == nil
+	default:
+		return false
+	}
+}
+
+// ParsePublicKeys parses trusted public keys: PEM encoded PUBLIC KEY blocks, or
+// comma separated base64 values of DER SubjectPublicKeyInfo or raw 32 bytes
+// Ed25519 keys
+func ParsePublicKeys(s string) ([]crypto.PublicKey, error) {
+	var ders [][]byte
+	if rest := []byte(strings.TrimSpace(s)); strings.Contains(s, "-----BEGIN") {
+		for {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			ders = append(ders, block.Bytes)
+		}
+	} else {
+		for _, value := range strings.Split(s, ",") {
+			if value = strings.TrimSpace(value); value == "" {
+				continue
+			}
+			der, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode public key: %w", err)
+			}
+			ders = append(ders, der)
+		}
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(ders))
+	for _, der := range ders {
+		if len(der) == ed25519.PublicKeySize {
+			keys = append(keys, ed25519.PublicKey(der))
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %w", err)
+		}
+		switch key.(type) {
+		case ed25519.PublicKey, *ecdsa.PublicKey, *rsa.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public key found")
+	}
+	return keys, nil
+}
+
+// SignedLoader is implemented by loaders verifying the signatures of the
+// configurations they read
+type SignedLoader interface {
+	ConfigLoader
+	// SetSignatureVerifier makes the loader reject configurations without a
+	// valid signature, before they are parsed
+	SetSignatureVerifier(verifier *SignatureVerifier)
+}
+
+var (
+	_ SignedLoader = (*S3ConfigLoader)(nil)
+	_ SignedLoader = (*SSMConfigLoader)(nil)
+	_ SignedLoader = (*SecretsManagerConfigLoader)(nil)
+	_ SignedLoader = (*LocalConfigLoader)(nil)
+	_ SignedLoader = (*HTTPConfigLoader)(nil)
+	_ SignedLoader = (*GitConfigLoader)(nil)
+)
+
+// signed is embedded in the loaders implementing SignedLoader
+type signed struct {
+	verifier *SignatureVerifier
+}
+
+// SetSignatureVerifier makes the loader reject configurations without a valid
+// signature, before they are parsed
+func (s *signed) SetSignatureVerifier(verifier *SignatureVerifier) {
+	s.verifier = verifier
+}
+
+// verify checks the signature of the configuration name, read with
+// readSignature from the name followed by the signature suffix
+func (s *signed) verify(ctx context.Context, name string, data []byte, readSignature func(name string) ([]byte, error)) error {
+	if s.verifier == nil {
+		return nil
+	}
+
+	signature, err := readSignature(name + s.verifier.suffix)
+	if err != nil {
+		return fmt.Errorf("failed to read signature of %s: %w", name, err)
+	}
+	if err := s.verifier.Verify(data, signature); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	log.Ctx(ctx).Debug().
+		Str("config", name).
+		Msg("configuration signature verified")
+	return nil
+}
+
+// SetSignatureVerifier sets the verifier of the loader and of the loaders it
+// wraps, loaders without SignedLoader fail with ErrSignatureUnsupported
+func SetSignatureVerifier(loader ConfigLoader, verifier *SignatureVerifier) ConfigLoader {
+	switch l := loader.(type) {
+	case SignedLoader:
+		l.SetSignatureVerifier(verifier)
+	case *CompositeConfigLoader:
+		for i, child := range l.loaders {
+			l.loaders[i] = SetSignatureVerifier(child, verifier)
+		}
+	case *FallbackConfigLoader:
+		// the last known good file cannot be verified, a warm container still
+		// keeps the verified configuration it loaded
+		l.signed = verifier != nil
+		for i, child := range l.loaders {
+			l.loaders[i] = SetSignatureVerifier(child, verifier)
+		}
+		if l.defaultLoader != nil {
+			l.defaultLoader = SetSignatureVerifier(l.defaultLoader, verifier)
+		}
+	case *CachedConfigLoader:
+		l.loader = SetSignatureVerifier(l.loader, verifier)
+	case *StaticConfigLoader:
+		// compiled in, nothing to verify
+	default:
+		return &rejectingLoader{loader: loader, err: ErrSignatureUnsupported}
+	}
+	return loader
+}
+
+// rejectingLoader replaces a loader that cannot be trusted, e.g. a loader that
+// cannot verify signatures
+type rejectingLoader struct {
+	loader ConfigLoader
+	err    error
+}
+
+func (l *rejectingLoader) Load(ctx context.Context) (*rules.Configuration, error) {
+	return nil, fmt.Errorf("%s: %w", l.loader, l.err)
+}
+
+func (l *rejectingLoader) String() string {
+	return l.loader.String()
+}
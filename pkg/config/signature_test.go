@@ -0,0 +1,288 @@
+package config
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func generateEd25519Key(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+func marshalPublicKey(t *testing.T, key crypto.PublicKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestParsePublicKeys(t *testing.T) {
+	edPublic, _ := generateEd25519Key(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("PEM", func(t *testing.T) {
+		pems := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: marshalPublicKey(t, edPublic)})) +
+			string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: marshalPublicKey(t, &ecKey.PublicKey)}))
+
+		keys, err := ParsePublicKeys(pems)
+		assert.NoError(t, err)
+		assert.Len(t, keys, 2)
+		assert.IsType(t, ed25519.PublicKey{}, keys[0])
+		assert.IsType(t, &ecdsa.PublicKey{}, keys[1])
+	})
+
+	t.Run("base64", func(t *testing.T) {
+		keys, err := ParsePublicKeys(base64.StdEncoding.EncodeToString(edPublic) + ", " +
+			base64.StdEncoding.EncodeToString(marshalPublicKey(t, &ecKey.PublicKey)))
+		assert.NoError(t, err)
+		assert.Len(t, keys, 2)
+		assert.Equal(t, edPublic, keys[0])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, s := range []string{"", " , ", "not base64", base64.StdEncoding.EncodeToString([]byte("short"))} {
+			_, err := ParsePublicKeys(s)
+			assert.Error(t, err, s)
+		}
+	})
+}
+
+func TestSignatureVerifier(t *testing.T) {
+	data := []byte(baseConfig)
+	digest := sha256.Sum256(data)
+
+	edPublic, edPrivate := generateEd25519Key(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSignature, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1Signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pssSignature, err := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, digest[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewSignatureVerifier("", edPublic, &ecKey.PublicKey, &rsaKey.PublicKey)
+	otherPublic, otherPrivate := generateEd25519Key(t)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		signature []byte
+		wantErr   bool
+	}{
+		{"ed25519", data, ed25519.Sign(edPrivate, data), false},
+		{"ed25519 base64", data, []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(edPrivate, data)) + "\n"), false},
+		{"ecdsa", data, ecSignature, false},
+		{"rsa pkcs1v15", data, pkcs1Signature, false},
+		{"rsa pss", data, pssSignature, false},
+		{"untrusted key", data, ed25519.Sign(otherPrivate, data), true},
+		{"tampered data", append([]byte(baseConfig), '\n'), ed25519.Sign(edPrivate, data), true},
+		{"empty signature", data, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifier.Verify(tt.data, tt.signature)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrSignatureMismatch)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	assert.NoError(t, NewSignatureVerifier("", otherPublic).Verify(data, ed25519.Sign(otherPrivate, data)))
+}
+
+func TestSignedLocalConfigLoader(t *testing.T) {
+	ctx := context.Background()
+	public, private := generateEd25519Key(t)
+
+	write := func(t *testing.T, path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign := func(t *testing.T, path, content string) {
+		t.Helper()
+		write(t, path, content)
+		write(t, path+".sig", base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(content))))
+	}
+
+	t.Run("signed", func(t *testing.T) {
+		dir := t.TempDir()
+		sign(t, filepath.Join(dir, "base.yaml"), baseConfig)
+		sign(t, filepath.Join(dir, "config.yaml"), "include:\n  - base.yaml\n"+overrideConfig)
+
+		loader := NewLocalConfigLoader(filepath.Join(dir, "config.yaml"))
+		loader.SetSignatureVerifier(NewSignatureVerifier("", public))
+		cfg, err := loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Drop Describe"}, ruleNames(cfg))
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		write(t, path, baseConfig)
+
+		loader := NewLocalConfigLoader(path)
+		loader.SetSignatureVerifier(NewSignatureVerifier("", public))
+		_, err := loader.Load(ctx)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		sign(t, path, baseConfig)
+		write(t, path, strings.Replace(baseConfig, "kms", "cloudtrail", 1))
+
+		loader := NewLocalConfigLoader(path)
+		loader.SetSignatureVerifier(NewSignatureVerifier("", public))
+		_, err := loader.Load(ctx)
+		assert.ErrorIs(t, err, ErrSignatureMismatch)
+	})
+
+	t.Run("unsigned include", func(t *testing.T) {
+		dir := t.TempDir()
+		write(t, filepath.Join(dir, "base.yaml"), baseConfig)
+		sign(t, filepath.Join(dir, "config.yaml"), "include:\n  - base.yaml\n"+overrideConfig)
+
+		loader := NewLocalConfigLoader(filepath.Join(dir, "config.yaml"))
+		loader.SetSignatureVerifier(NewSignatureVerifier("", public))
+		_, err := loader.Load(ctx)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestSignedS3ConfigLoader(t *testing.T) {
+	ctx := context.Background()
+	public, private := generateEd25519Key(t)
+
+	object := func(content []byte) *s3.GetObjectOutput {
+		return &s3.GetObjectOutput{
+			Body: io.NopCloser(strings.NewReader(string(content))),
+			ETag: aws.String(`"etag"`),
+		}
+	}
+	expectObjects := func(mockClient *mockS3Client, signature []byte) {
+		mockClient.On("GetObject", ctx, &s3.GetObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("config.yaml"),
+		}).Return(object([]byte(baseConfig)), nil).Once()
+		mockClient.On("GetObject", ctx, &s3.GetObjectInput{
+			Bucket: aws.String("test-bucket"),
+			Key:    aws.String("config.yaml.sig"),
+		}).Return(object(signature), nil).Once()
+	}
+
+	t.Run("signed", func(t *testing.T) {
+		mockClient := new(mockS3Client)
+		expectObjects(mockClient, ed25519.Sign(private, []byte(baseConfig)))
+		loader := NewS3ConfigLoader("test-bucket", "config.yaml", mockClient)
+		loader.SetSignatureVerifier(NewSignatureVerifier("", public))
+
+		cfg, err := loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "1.0.0", cfg.Version)
+		mockClient.AssertExpectations(t)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		mockClient := new(mockS3Client)
+		expectObjects(mockClient, ed25519.Sign(private, []byte(overrideConfig)))
+		loader := NewS3ConfigLoader("test-bucket", "config.yaml", mockClient)
+		loader.SetSignatureVerifier(NewSignatureVerifier("", public))
+
+		_, err := loader.Load(ctx)
+		assert.ErrorIs(t, err, ErrSignatureMismatch)
+		mockClient.AssertExpectations(t)
+	})
+}
+
+func TestSetSignatureVerifier(t *testing.T) {
+	ctx := context.Background()
+	public, _ := generateEd25519Key(t)
+	verifier := NewSignatureVerifier("", public)
+
+	t.Run("wrapped loaders", func(t *testing.T) {
+		local := NewLocalConfigLoader("config.yaml")
+		passthrough := NewPassThroughConfigLoader()
+		loader := NewCachedConfigLoader(NewFallbackConfigLoader([]ConfigLoader{
+			NewCompositeConfigLoader("", local),
+		}, WithDefaultLoader(passthrough)), 0)
+
+		assert.Same(t, loader, SetSignatureVerifier(loader, verifier))
+		assert.Same(t, verifier, local.verifier)
+	})
+
+	t.Run("last known good file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "lkg.yaml")
+		primary := &mockConfigLoader{config: loadTestConfig(t, baseConfig)}
+		_, err := NewFallbackConfigLoader([]ConfigLoader{primary}, WithLastKnownGood(path)).Load(ctx)
+		assert.NoError(t, err)
+
+		// the unsigned file written before is not trusted
+		loader := NewFallbackConfigLoader([]ConfigLoader{primary}, WithLastKnownGood(path))
+		SetSignatureVerifier(loader, verifier)
+		_, err = loader.Load(ctx)
+		assert.ErrorIs(t, err, ErrSignatureUnsupported)
+		assert.Contains(t, err.Error(), "last known good")
+
+		// and no file is written while signatures are required
+		newPath := filepath.Join(t.TempDir(), "lkg.yaml")
+		static := NewStaticConfigLoader("static", loadTestConfig(t, baseConfig))
+		loader = NewFallbackConfigLoader([]ConfigLoader{static}, WithLastKnownGood(newPath))
+		SetSignatureVerifier(loader, verifier)
+		_, err = loader.Load(ctx)
+		assert.NoError(t, err)
+		assert.NoFileExists(t, newPath)
+	})
+
+	t.Run("unsupported source", func(t *testing.T) {
+		loader := SetSignatureVerifier(NewAppConfigLoader("app", "env", "profile", new(mockAppConfigDataClient)), verifier)
+		assert.Equal(t, "AppConfigLoader(application=app, environment=env, profile=profile)", loader.String())
+
+		_, err := loader.Load(ctx)
+		assert.ErrorIs(t, err, ErrSignatureUnsupported)
+	})
+}
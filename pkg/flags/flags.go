@@ -8,4 +8,10 @@ type S3Processor struct {
 	SNSTopicArn                string
 	SQSQueueURL                string
 	MultiPartDownload          bool
+	// FailOpen copies undecodable objects and records unfiltered instead of failing
+	FailOpen bool
+	// BadRecordPolicy is fail, skip or keep, see rules.BadRecordPolicy
+	BadRecordPolicy string
+	// MaxBadRecords is the number of bad records skipped or kept before the file fails, 0 is unlimited
+	MaxBadRecords int
 }
@@ -13,10 +13,16 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// CloudWatchAPI interface for CloudWatch client methods
+type CloudWatchAPI interface {
+	PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error)
+}
+
 // CloudWatchMetrics collects and publishes metrics to CloudWatch
 type CloudWatchMetrics struct {
-	client    *cloudwatch.Client
+	client    CloudWatchAPI
 	namespace string
+	policy    *DimensionPolicy
 
 	// Buffering for batch publishing
 	mu      sync.Mutex
@@ -33,12 +39,13 @@ type CloudWatchMetrics struct {
 }
 
 // NewCloudWatchMetrics creates a new CloudWatch metrics collector
-func NewCloudWatchMetrics(client *cloudwatch.Client, namespace string) *CloudWatchMetrics {
+func NewCloudWatchMetrics(client CloudWatchAPI, namespace string) *CloudWatchMetrics {
 	enabled := os.Getenv("METRICS_ENABLED") != "false" // Default to enabled
 
 	cwm := &CloudWatchMetrics{
 		client:        client,
 		namespace:     namespace,
+		policy:        DimensionPolicyFromEnv(),
 		metrics:       make([]types.MetricDatum, 0, 20),
 		batchSize:     20, // CloudWatch max is 20 metrics per request
 		flushInterval: 10 * time.Second,
@@ -267,15 +274,168 @@ func (cwm *CloudWatchMetrics) RecordS3Operations(operation string, duration time
 	}
 }
 
+// RecordRuleHits records the number of records dropped by each rule
+//
+// One datum is published per rule, including rules without hits, so that a rule
+// that stopped matching shows up as a series of zeros (see FindStaleRules). The
+// FunctionName dimension is not published, see ruleHitsDimensions.
+func (cwm *CloudWatchMetrics) RecordRuleHits(hits map[string]int, dimensions map[string]string) {
+	if !cwm.enabled {
+		return
+	}
+
+	for ruleName, count := range hits {
+		dims := cwm.buildDimensionsWithDefaults(ruleHitsDimensions(ruleName), dimensions)
+
+		cwm.addMetric(types.MetricDatum{
+			MetricName: aws.String("RuleHits"),
+			Value:      aws.Float64(float64(count)),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  aws.Time(time.Now()),
+			Dimensions: dims,
+		})
+	}
+}
+
+// RecordShadowRuleHits records the number of records each shadow rule would
+// drop, one datum per rule as RecordRuleHits
+func (cwm *CloudWatchMetrics) RecordShadowRuleHits(hits map[string]int, dimensions map[string]string) {
+	if !cwm.enabled {
+		return
+	}
+
+	for ruleName, count := range hits {
+		dims := cwm.buildDimensions(dimensions)
+		dims = append(dims, types.Dimension{
+			Name:  aws.String("RuleName"),
+			Value: aws.String(ruleName),
+		})
+
+		cwm.addMetric(types.MetricDatum{
+			MetricName: aws.String("ShadowRuleHits"),
+			Value:      aws.Float64(float64(count)),
+			Unit:       types.StandardUnitCount,
+			Timestamp:  aws.Time(time.Now()),
+			Dimensions: dims,
+		})
+	}
+}
+
+// RecordCircuitBreakerState records a circuit breaker transition to state
+func (cwm *CloudWatchMetrics) RecordCircuitBreakerState(dependency, state string, dimensions map[string]string) {
+	if !cwm.enabled {
+		return
+	}
+
+	dims := cwm.buildDimensions(dimensions)
+	dims = append(dims,
+		types.Dimension{Name: aws.String("Dependency"), Value: aws.String(dependency)},
+		types.Dimension{Name: aws.String("State"), Value: aws.String(state)},
+	)
+
+	cwm.addMetric(types.MetricDatum{
+		MetricName: aws.String("CircuitBreakerTransitions"),
+		Value:      aws.Float64(1),
+		Unit:       types.StandardUnitCount,
+		Timestamp:  aws.Time(time.Now()),
+		Dimensions: dims,
+	})
+}
+
+// RecordPassThrough records data copied unfiltered in fail-open mode, scope is
+// "record" or "object"
+func (cwm *CloudWatchMetrics) RecordPassThrough(scope string, count int, dimensions map[string]string) {
+	if !cwm.enabled {
+		return
+	}
+
+	dims := cwm.buildDimensions(dimensions)
+	dims = append(dims, types.Dimension{Name: aws.String("Scope"), Value: aws.String(scope)})
+
+	cwm.addMetric(types.MetricDatum{
+		MetricName: aws.String("PassThrough"),
+		Value:      aws.Float64(float64(count)),
+		Unit:       types.StandardUnitCount,
+		Timestamp:  aws.Time(time.Now()),
+		Dimensions: dims,
+	})
+}
+
+// RecordBadRecords records the records that could not be decoded or evaluated,
+// policy is "skip" or "keep"
+func (cwm *CloudWatchMetrics) RecordBadRecords(policy string, count int, dimensions map[string]string) {
+	if !cwm.enabled {
+		return
+	}
+
+	dims := cwm.buildDimensions(dimensions)
+	dims = append(dims, types.Dimension{Name: aws.String("Policy"), Value: aws.String(policy)})
+
+	cwm.addMetric(types.MetricDatum{
+		MetricName: aws.String("BadRecords"),
+		Value:      aws.Float64(float64(count)),
+		Unit:       types.StandardUnitCount,
+		Timestamp:  aws.Time(time.Now()),
+		Dimensions: dims,
+	})
+}
+
+// RecordConfigDegraded records 1 while the configuration is served by a
+// fallback source, 0 while it comes from the primary source
+func (cwm *CloudWatchMetrics) RecordConfigDegraded(source string, degraded bool, dimensions map[string]string) {
+	if !cwm.enabled {
+		return
+	}
+
+	dims := cwm.buildDimensions(dimensions)
+	dims = append(dims, types.Dimension{Name: aws.String("ConfigSource"), Value: aws.String(source)})
+
+	cwm.addMetric(types.MetricDatum{
+		MetricName: aws.String("ConfigDegraded"),
+		Value:      aws.Float64(boolValue(degraded)),
+		Unit:       types.StandardUnitCount,
+		Timestamp:  aws.Time(time.Now()),
+		Dimensions: dims,
+	})
+}
+
+// boolValue is the metric value of a state
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 // buildDimensions builds CloudWatch dimensions from a map
+//
+// Dimensions rejected by the dimension policy are logged instead of published.
 func (cwm *CloudWatchMetrics) buildDimensions(dimensions map[string]string) []types.Dimension {
-	dims := make([]types.Dimension, 0, len(dimensions)+1)
+	return cwm.buildDimensionsWithDefaults(cwm.policy.defaultDimensions(), dimensions)
+}
+
+// buildDimensionsWithDefaults builds CloudWatch dimensions from a map on top of
+// the given default dimensions
+func (cwm *CloudWatchMetrics) buildDimensionsWithDefaults(defaults, dimensions map[string]string) []types.Dimension {
+	dimensions, properties := cwm.policy.Split(dimensions)
+	if len(properties) > 0 {
+		fields := make(map[string]any, len(properties))
+		for name, value := range properties {
+			fields[name] = value
+		}
+		log.Debug().Fields(fields).Msg("metric properties not published as dimensions")
+	}
+
+	dims := make([]types.Dimension, 0, len(dimensions)+len(defaults))
 
 	// Add default dimensions
-	if region := os.Getenv("AWS_REGION"); region != "" {
+	for name, value := range defaults {
+		if _, ok := dimensions[name]; ok {
+			continue
+		}
 		dims = append(dims, types.Dimension{
-			Name:  aws.String("Region"),
-			Value: aws.String(region),
+			Name:  aws.String(name),
+			Value: aws.String(value),
 		})
 	}
 
@@ -351,12 +511,12 @@ func (cwm *CloudWatchMetrics) Flush(ctx context.Context) error {
 
 // SimpleMetricsCollector implements the processor.MetricsCollector interface
 type SimpleMetricsCollector struct {
-	cwm        *CloudWatchMetrics
+	cwm        Recorder
 	dimensions map[string]string
 }
 
 // NewSimpleMetricsCollector creates a metrics collector for the processor
-func NewSimpleMetricsCollector(cwm *CloudWatchMetrics, dimensions map[string]string) *SimpleMetricsCollector {
+func NewSimpleMetricsCollector(cwm Recorder, dimensions map[string]string) *SimpleMetricsCollector {
 	return &SimpleMetricsCollector{
 		cwm:        cwm,
 		dimensions: dimensions,
@@ -373,6 +533,11 @@ func (s *SimpleMetricsCollector) RecordFiltered(count int) {
 	s.cwm.RecordRecordsFiltered(count, s.dimensions)
 }
 
+// RecordRuleHits records the hits of every rule
+func (s *SimpleMetricsCollector) RecordRuleHits(hits map[string]int) {
+	s.cwm.RecordRuleHits(hits, s.dimensions)
+}
+
 // RecordError records an error
 func (s *SimpleMetricsCollector) RecordError(err error) {
 	errorType := "Unknown"
@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// DefaultDimensionAllowlist lists the dimensions callers may attach to metrics
+// when METRICS_DIMENSION_ALLOWLIST is not set
+var DefaultDimensionAllowlist = []string{"FunctionName", "SourceAccount", "Region", "RuleName"}
+
+// metricDimensions are added by the Record functions themselves and always kept,
+// their values are bounded by the code (error types, S3 operations, ...)
+var metricDimensions = []string{"Region", "ErrorType", "Operation", "ConfigSource", "RuleName", "Dependency", "State", "Scope", "Policy"}
+
+// DimensionPolicy decides which dimensions are published as metric dimensions
+//
+// Every distinct dimension value creates a new CloudWatch custom metric, so only
+// low-cardinality dimensions are allowed. The others (request IDs, file keys,
+// buckets, ...) are kept as properties: logged with the CloudWatch backend and
+// written as non-dimension fields of EMF documents, where they can be searched
+// with Logs Insights without creating metrics.
+type DimensionPolicy struct {
+	allowed map[string]bool
+}
+
+// NewDimensionPolicy creates a policy allowing the given dimensions
+func NewDimensionPolicy(allowlist []string) *DimensionPolicy {
+	p := &DimensionPolicy{allowed: make(map[string]bool, len(allowlist)+len(metricDimensions))}
+	for _, name := range metricDimensions {
+		p.allowed[name] = true
+	}
+	for _, name := range allowlist {
+		if name = strings.TrimSpace(name); name != "" {
+			p.allowed[name] = true
+		}
+	}
+	return p
+}
+
+// DimensionPolicyFromEnv creates the policy from METRICS_DIMENSION_ALLOWLIST, a
+// comma separated list replacing DefaultDimensionAllowlist
+func DimensionPolicyFromEnv() *DimensionPolicy {
+	allowlist := getEnv("METRICS_DIMENSION_ALLOWLIST", "")
+	if allowlist == "" {
+		return NewDimensionPolicy(DefaultDimensionAllowlist)
+	}
+	return NewDimensionPolicy(strings.Split(allowlist, ","))
+}
+
+// defaultDimensions returns the dimensions attached to every metric: the region
+// and, when the policy allows it, the name of the Lambda function
+func (p *DimensionPolicy) defaultDimensions() map[string]string {
+	dims := regionDimensions()
+	if name := lambdacontext.FunctionName; name != "" && p.Allowed("FunctionName") {
+		dims["FunctionName"] = name
+	}
+	return dims
+}
+
+// regionDimensions returns the region dimension, empty outside of AWS
+func regionDimensions() map[string]string {
+	dims := make(map[string]string, 2)
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		dims["Region"] = region
+	}
+	return dims
+}
+
+// Allowed reports whether name can be used as a metric dimension
+func (p *DimensionPolicy) Allowed(name string) bool {
+	return p.allowed[name]
+}
+
+// Split separates the allowed dimensions from the properties, either result is
+// nil when empty. Empty values are dropped, CloudWatch rejects them.
+func (p *DimensionPolicy) Split(dimensions map[string]string) (dims, properties map[string]string) {
+	for name, value := range dimensions {
+		if value == "" {
+			continue
+		}
+
+		if p.Allowed(name) {
+			if dims == nil {
+				dims = make(map[string]string, len(dimensions))
+			}
+			dims[name] = value
+			continue
+		}
+
+		if properties == nil {
+			properties = make(map[string]string)
+		}
+		properties[name] = value
+	}
+	return dims, properties
+}
+
+// SourceAccountFromKey returns the account of a CloudTrail log file key, e.g.
+// AWSLogs/123456789012/CloudTrail/... or AWSLogs/o-abc123/123456789012/CloudTrail/...
+// for organization trails, and "" for other keys
+func SourceAccountFromKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		if part != "AWSLogs" {
+			continue
+		}
+		for _, candidate := range parts[i+1 : min(i+3, len(parts))] {
+			if isAccountID(candidate) {
+				return candidate
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// isAccountID reports whether s is a 12 digits AWS account ID
+func isAccountID(s string) bool {
+	if len(s) != 12 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
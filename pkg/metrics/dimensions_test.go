@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDimensionPolicy(t *testing.T) {
+	t.Run("default allowlist", func(t *testing.T) {
+		policy := DimensionPolicyFromEnv()
+
+		dims, properties := policy.Split(map[string]string{
+			"FunctionName":  "ctlp",
+			"SourceAccount": "123456789012",
+			"RequestId":     "c6af9ac6-7b61-11e6-9a41-93e812345678",
+			"FileKey":       "AWSLogs/123456789012/file.json.gz",
+			"Region":        "",
+		})
+		assert.Equal(t, map[string]string{"FunctionName": "ctlp", "SourceAccount": "123456789012"}, dims)
+		assert.Equal(t, map[string]string{
+			"RequestId": "c6af9ac6-7b61-11e6-9a41-93e812345678",
+			"FileKey":   "AWSLogs/123456789012/file.json.gz",
+		}, properties)
+	})
+
+	t.Run("allowlist from env", func(t *testing.T) {
+		t.Setenv("METRICS_DIMENSION_ALLOWLIST", "SourceBucket, Environment")
+		policy := DimensionPolicyFromEnv()
+
+		assert.True(t, policy.Allowed("SourceBucket"))
+		assert.True(t, policy.Allowed("Environment"))
+		assert.False(t, policy.Allowed("SourceAccount"))
+		assert.True(t, policy.Allowed("ErrorType"), "metric dimensions are always allowed")
+	})
+
+	t.Run("enforced by the CloudWatch backend", func(t *testing.T) {
+		t.Setenv("AWS_REGION", "eu-west-1")
+		cwm := &CloudWatchMetrics{policy: DimensionPolicyFromEnv()}
+
+		dims := cwm.buildDimensions(map[string]string{"RequestId": "abc", "SourceAccount": "123456789012"})
+		names := make([]string, len(dims))
+		for i, dim := range dims {
+			names[i] = aws.ToString(dim.Name)
+		}
+		assert.ElementsMatch(t, []string{"Region", "SourceAccount"}, names)
+	})
+
+	t.Run("function name", func(t *testing.T) {
+		functionName := lambdacontext.FunctionName
+		lambdacontext.FunctionName = "ctlp-parser"
+		t.Cleanup(func() { lambdacontext.FunctionName = functionName })
+		t.Setenv("AWS_REGION", "eu-west-1")
+
+		assert.Equal(t, map[string]string{"Region": "eu-west-1", "FunctionName": "ctlp-parser"},
+			DimensionPolicyFromEnv().defaultDimensions())
+
+		t.Setenv("METRICS_DIMENSION_ALLOWLIST", "SourceAccount")
+		assert.Equal(t, map[string]string{"Region": "eu-west-1"}, DimensionPolicyFromEnv().defaultDimensions())
+	})
+}
+
+func TestSourceAccountFromKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"AWSLogs/123456789012/CloudTrail/us-east-2/2013/12/13/123456789012_CloudTrail_us-west-2_20131213T1920Z_LnPgDQnpkSKEsppV.json.gz", "123456789012"},
+		{"prefix/AWSLogs/o-aa111bb222/123456789012/CloudTrail/eu-west-1/2024/01/01/file.json.gz", "123456789012"},
+		{"AWSLogs/123456789012/CloudTrail-Digest/eu-west-1/file.json.gz", "123456789012"},
+		{"logs/cloudtrail.json", ""},
+		{"AWSLogs/o-aa111bb222/CloudTrail/file.json.gz", ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, SourceAccountFromKey(tt.key), tt.key)
+	}
+}
@@ -0,0 +1,337 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/encoding/json"
+)
+
+// EMF limits, see the Embedded Metric Format specification
+const (
+	emfMaxMetrics = 100 // metrics per document
+	emfMaxValues  = 100 // values of a metric per document
+)
+
+// EMFMetrics writes metrics as CloudWatch Embedded Metric Format documents
+//
+// Nothing is sent to the CloudWatch API: Flush writes one JSON document per line
+// to the writer (stdout in Lambda) and CloudWatch Logs extracts the metrics.
+// Metrics are only written on Flush, there is no background flusher. Dimensions
+// rejected by the dimension policy are written as document properties.
+type EMFMetrics struct {
+	namespace string
+	enabled   bool
+	policy    *DimensionPolicy
+
+	mu      sync.Mutex
+	out     io.Writer
+	entries []emfEntry
+}
+
+// emfEntry is a buffered metric value
+type emfEntry struct {
+	name       string
+	unit       types.StandardUnit
+	value      float64
+	dimensions map[string]string
+	properties map[string]string
+	timestamp  time.Time
+}
+
+// NewEMFMetrics creates a new EMF metrics collector writing to out
+func NewEMFMetrics(out io.Writer, namespace string) *EMFMetrics {
+	return &EMFMetrics{
+		namespace: namespace,
+		enabled:   os.Getenv("METRICS_ENABLED") != "false", // Default to enabled
+		policy:    DimensionPolicyFromEnv(),
+		out:       out,
+	}
+}
+
+// RecordProcessingTime records the time taken to process a file
+func (e *EMFMetrics) RecordProcessingTime(duration time.Duration, dimensions map[string]string) {
+	e.add("ProcessingTime", duration.Seconds(), types.StandardUnitSeconds, dimensions)
+}
+
+// RecordRecordsProcessed records the number of records processed
+func (e *EMFMetrics) RecordRecordsProcessed(count int, dimensions map[string]string) {
+	e.add("RecordsProcessed", float64(count), types.StandardUnitCount, dimensions)
+}
+
+// RecordRecordsFiltered records the number of records filtered
+func (e *EMFMetrics) RecordRecordsFiltered(count int, dimensions map[string]string) {
+	e.add("RecordsFiltered", float64(count), types.StandardUnitCount, dimensions)
+}
+
+// RecordFilterRate records the percentage of records filtered
+func (e *EMFMetrics) RecordFilterRate(rate float64, dimensions map[string]string) {
+	e.add("FilterRate", rate*100, types.StandardUnitPercent, dimensions)
+}
+
+// RecordError records an error occurrence
+func (e *EMFMetrics) RecordError(errorType string, dimensions map[string]string) {
+	e.add("Errors", 1, types.StandardUnitCount, withDimension(dimensions, "ErrorType", errorType))
+}
+
+// RecordFileSize records the size of processed files
+func (e *EMFMetrics) RecordFileSize(sizeBytes int64, dimensions map[string]string) {
+	e.add("FileSize", float64(sizeBytes), types.StandardUnitBytes, dimensions)
+}
+
+// RecordLambdaDuration records Lambda execution duration
+func (e *EMFMetrics) RecordLambdaDuration(duration time.Duration, dimensions map[string]string) {
+	e.add("LambdaDuration", float64(duration.Milliseconds()), types.StandardUnitMilliseconds, dimensions)
+}
+
+// RecordMemoryUsed records memory usage
+func (e *EMFMetrics) RecordMemoryUsed(memoryMB float64, dimensions map[string]string) {
+	e.add("MemoryUsed", memoryMB, types.StandardUnitMegabytes, dimensions)
+}
+
+// RecordConfigLoadTime records configuration loading time
+func (e *EMFMetrics) RecordConfigLoadTime(duration time.Duration, source string, dimensions map[string]string) {
+	e.add("ConfigLoadTime", float64(duration.Milliseconds()), types.StandardUnitMilliseconds, withDimension(dimensions, "ConfigSource", source))
+}
+
+// RecordS3Operations records S3 operation metrics
+func (e *EMFMetrics) RecordS3Operations(operation string, duration time.Duration, success bool, dimensions map[string]string) {
+	dims := withDimension(dimensions, "Operation", operation)
+
+	e.add("S3OperationDuration", float64(duration.Milliseconds()), types.StandardUnitMilliseconds, dims)
+	if !success {
+		e.add("S3OperationErrors", 1, types.StandardUnitCount, dims)
+	}
+}
+
+// RecordRuleHits records the number of records dropped by each rule, without
+// the FunctionName dimension (see ruleHitsDimensions)
+func (e *EMFMetrics) RecordRuleHits(hits map[string]int, dimensions map[string]string) {
+	for ruleName, count := range hits {
+		e.addWithDefaults("RuleHits", float64(count), types.StandardUnitCount, ruleHitsDimensions(ruleName), dimensions)
+	}
+}
+
+// RecordShadowRuleHits records the number of records each shadow rule would drop
+func (e *EMFMetrics) RecordShadowRuleHits(hits map[string]int, dimensions map[string]string) {
+	for ruleName, count := range hits {
+		e.add("ShadowRuleHits", float64(count), types.StandardUnitCount, withDimension(dimensions, "RuleName", ruleName))
+	}
+}
+
+// RecordCircuitBreakerState records a circuit breaker transition to state
+func (e *EMFMetrics) RecordCircuitBreakerState(dependency, state string, dimensions map[string]string) {
+	dims := withDimension(withDimension(dimensions, "Dependency", dependency), "State", state)
+	e.add("CircuitBreakerTransitions", 1, types.StandardUnitCount, dims)
+}
+
+// RecordPassThrough records data copied unfiltered in fail-open mode
+func (e *EMFMetrics) RecordPassThrough(scope string, count int, dimensions map[string]string) {
+	e.add("PassThrough", float64(count), types.StandardUnitCount, withDimension(dimensions, "Scope", scope))
+}
+
+// RecordBadRecords records the records skipped or kept by the bad record policy
+func (e *EMFMetrics) RecordBadRecords(policy string, count int, dimensions map[string]string) {
+	e.add("BadRecords", float64(count), types.StandardUnitCount, withDimension(dimensions, "Policy", policy))
+}
+
+// RecordConfigDegraded records 1 while the configuration is served by a
+// fallback source
+func (e *EMFMetrics) RecordConfigDegraded(source string, degraded bool, dimensions map[string]string) {
+	e.add("ConfigDegraded", boolValue(degraded), types.StandardUnitCount, withDimension(dimensions, "ConfigSource", source))
+}
+
+// add buffers a metric value with the default dimensions
+func (e *EMFMetrics) add(name string, value float64, unit types.StandardUnit, dimensions map[string]string) {
+	e.addWithDefaults(name, value, unit, e.policy.defaultDimensions(), dimensions)
+}
+
+// addWithDefaults buffers a metric value with the given default dimensions
+func (e *EMFMetrics) addWithDefaults(name string, value float64, unit types.StandardUnit, defaults, dimensions map[string]string) {
+	if !e.enabled {
+		return
+	}
+
+	allowed, properties := e.policy.Split(dimensions)
+
+	dims := defaults
+	for k, v := range allowed {
+		dims[k] = v
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.entries = append(e.entries, emfEntry{
+		name:       name,
+		unit:       unit,
+		value:      value,
+		dimensions: dims,
+		properties: properties,
+		timestamp:  time.Now(),
+	})
+}
+
+// Flush writes the buffered metrics, one document per dimension set
+func (e *EMFMetrics) Flush(ctx context.Context) error {
+	if !e.enabled {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.entries) == 0 {
+		return nil
+	}
+
+	docs := buildEMFDocuments(e.namespace, e.entries)
+	e.entries = e.entries[:0]
+
+	for _, doc := range docs {
+		line, err := json.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("failed to encode EMF document: %w", err)
+		}
+		if _, err := e.out.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("failed to write EMF document: %w", err)
+		}
+	}
+
+	log.Debug().Int("documents", len(docs)).Msg("flushed metrics as EMF")
+
+	return nil
+}
+
+// Stop flushes the remaining metrics
+func (e *EMFMetrics) Stop(ctx context.Context) error {
+	return e.Flush(ctx)
+}
+
+// emfDocument is a document under construction
+type emfDocument struct {
+	dimensions map[string]string
+	properties map[string]string
+	timestamp  time.Time
+	names      []string // metric names in order of appearance
+	units      map[string]types.StandardUnit
+	values     map[string][]float64
+}
+
+// buildEMFDocuments groups the entries sharing the same dimensions and properties
+// into documents
+//
+// Values of the same metric are written as an array; CloudWatch aggregates them
+// as separate samples of the same minute.
+func buildEMFDocuments(namespace string, entries []emfEntry) []map[string]any {
+	var (
+		open  = make(map[string]*emfDocument)
+		order []string
+		docs  []map[string]any
+	)
+
+	for _, entry := range entries {
+		key := dimensionsKey(entry.dimensions) + "\x02" + dimensionsKey(entry.properties)
+
+		doc, ok := open[key]
+		if ok {
+			values, seen := doc.values[entry.name]
+			if (seen && len(values) >= emfMaxValues) || (!seen && len(doc.names) >= emfMaxMetrics) {
+				docs = append(docs, doc.render(namespace))
+				ok = false
+			}
+		}
+		if !ok {
+			doc = &emfDocument{
+				dimensions: entry.dimensions,
+				properties: entry.properties,
+				timestamp:  entry.timestamp,
+				units:      make(map[string]types.StandardUnit),
+				values:     make(map[string][]float64),
+			}
+			if _, exists := open[key]; !exists {
+				order = append(order, key)
+			}
+			open[key] = doc
+		}
+
+		if _, seen := doc.values[entry.name]; !seen {
+			doc.names = append(doc.names, entry.name)
+			doc.units[entry.name] = entry.unit
+		}
+		doc.values[entry.name] = append(doc.values[entry.name], entry.value)
+	}
+
+	for _, key := range order {
+		docs = append(docs, open[key].render(namespace))
+	}
+
+	return docs
+}
+
+// render returns the JSON representation of the document
+func (d *emfDocument) render(namespace string) map[string]any {
+	dimensionNames := make([]string, 0, len(d.dimensions))
+	for name := range d.dimensions {
+		dimensionNames = append(dimensionNames, name)
+	}
+	slices.Sort(dimensionNames)
+
+	metricDefs := make([]map[string]string, len(d.names))
+	for i, name := range d.names {
+		metricDefs[i] = map[string]string{"Name": name, "Unit": string(d.units[name])}
+	}
+
+	doc := make(map[string]any, len(d.dimensions)+len(d.properties)+len(d.names)+1)
+	doc["_aws"] = map[string]any{
+		"Timestamp": d.timestamp.UnixMilli(),
+		"CloudWatchMetrics": []map[string]any{{
+			"Namespace":  namespace,
+			"Dimensions": [][]string{dimensionNames},
+			"Metrics":    metricDefs,
+		}},
+	}
+	for name, value := range d.properties {
+		doc[name] = value
+	}
+	for name, value := range d.dimensions {
+		doc[name] = value
+	}
+	for _, name := range d.names {
+		if values := d.values[name]; len(values) == 1 {
+			doc[name] = values[0]
+		} else {
+			doc[name] = values
+		}
+	}
+
+	return doc
+}
+
+// dimensionsKey returns a key identifying a dimension or property set
+func dimensionsKey(dimensions map[string]string) string {
+	pairs := make([]string, 0, len(dimensions))
+	for name, value := range dimensions {
+		pairs = append(pairs, name+"\x00"+value)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, "\x01")
+}
+
+// withDimension returns a copy of dimensions with an extra dimension
+func withDimension(dimensions map[string]string, name, value string) map[string]string {
+	dims := make(map[string]string, len(dimensions)+1)
+	for k, v := range dimensions {
+		dims[k] = v
+	}
+	dims[name] = value
+	return dims
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeEMF(t *testing.T, out *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var docs []map[string]any
+	for line := range strings.SplitSeq(strings.TrimSpace(out.String()), "\n") {
+		var doc map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(line), &doc))
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func TestEMFMetrics(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	ctx := context.Background()
+
+	t.Run("groups metrics by dimensions", func(t *testing.T) {
+		var out bytes.Buffer
+		emf := NewEMFMetrics(&out, "CloudTrailFilter")
+		dims := map[string]string{"SourceAccount": "123456789012", "FileKey": "AWSLogs/123456789012/file.json.gz"}
+
+		emf.RecordRecordsProcessed(10, dims)
+		emf.RecordRecordsFiltered(4, dims)
+		emf.RecordRecordsProcessed(5, dims)
+		emf.RecordError("CopyError", dims)
+		assert.Empty(t, out.String(), "nothing is written before Flush")
+
+		assert.NoError(t, emf.Flush(ctx))
+		docs := decodeEMF(t, &out)
+		assert.Len(t, docs, 2)
+
+		doc := docs[0]
+		assert.Equal(t, "eu-west-1", doc["Region"])
+		assert.Equal(t, "123456789012", doc["SourceAccount"])
+		assert.Equal(t, "AWSLogs/123456789012/file.json.gz", doc["FileKey"], "rejected dimensions are properties")
+		assert.Equal(t, []any{float64(10), float64(5)}, doc["RecordsProcessed"])
+		assert.Equal(t, float64(4), doc["RecordsFiltered"])
+
+		directive := doc["_aws"].(map[string]any)["CloudWatchMetrics"].([]any)[0].(map[string]any)
+		assert.Equal(t, "CloudTrailFilter", directive["Namespace"])
+		assert.Equal(t, []any{[]any{"Region", "SourceAccount"}}, directive["Dimensions"])
+		assert.Equal(t, []any{
+			map[string]any{"Name": "RecordsProcessed", "Unit": "Count"},
+			map[string]any{"Name": "RecordsFiltered", "Unit": "Count"},
+		}, directive["Metrics"])
+
+		assert.Equal(t, "CopyError", docs[1]["ErrorType"])
+		assert.Equal(t, float64(1), docs[1]["Errors"])
+
+		out.Reset()
+		assert.NoError(t, emf.Flush(ctx))
+		assert.Empty(t, out.String(), "buffer is drained")
+	})
+
+	t.Run("splits documents over the EMF limits", func(t *testing.T) {
+		var out bytes.Buffer
+		emf := NewEMFMetrics(&out, "CloudTrailFilter")
+
+		for range emfMaxValues + 1 {
+			emf.RecordProcessingTime(time.Second, nil)
+		}
+		assert.NoError(t, emf.Stop(ctx))
+
+		docs := decodeEMF(t, &out)
+		assert.Len(t, docs, 2)
+		assert.Len(t, docs[0]["ProcessingTime"], emfMaxValues)
+		assert.Equal(t, float64(1), docs[1]["ProcessingTime"])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("METRICS_ENABLED", "false")
+
+		var out bytes.Buffer
+		emf := NewEMFMetrics(&out, "CloudTrailFilter")
+		emf.RecordRuleHits(map[string]int{"DropReadOnly": 1}, nil)
+		assert.NoError(t, emf.Flush(ctx))
+		assert.Empty(t, out.String())
+	})
+}
+
+func TestNewFromEnv(t *testing.T) {
+	t.Setenv("METRICS_BACKEND", "emf")
+	rec, err := NewFromEnv(nil)
+	assert.NoError(t, err)
+	assert.IsType(t, &EMFMetrics{}, rec)
+
+	t.Setenv("METRICS_BACKEND", "statsd")
+	_, err = NewFromEnv(nil)
+	assert.EqualError(t, err, "unknown metrics backend: statsd")
+}
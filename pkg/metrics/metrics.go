@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+)
+
+// Recorder is implemented by every metrics backend
+type Recorder interface {
+	RecordProcessingTime(duration time.Duration, dimensions map[string]string)
+	RecordRecordsProcessed(count int, dimensions map[string]string)
+	RecordRecordsFiltered(count int, dimensions map[string]string)
+	RecordFilterRate(rate float64, dimensions map[string]string)
+	RecordError(errorType string, dimensions map[string]string)
+	RecordFileSize(sizeBytes int64, dimensions map[string]string)
+	RecordLambdaDuration(duration time.Duration, dimensions map[string]string)
+	RecordMemoryUsed(memoryMB float64, dimensions map[string]string)
+	RecordConfigLoadTime(duration time.Duration, source string, dimensions map[string]string)
+	RecordS3Operations(operation string, duration time.Duration, success bool, dimensions map[string]string)
+	RecordRuleHits(hits map[string]int, dimensions map[string]string)
+	RecordShadowRuleHits(hits map[string]int, dimensions map[string]string)
+	RecordCircuitBreakerState(dependency, state string, dimensions map[string]string)
+	RecordPassThrough(scope string, count int, dimensions map[string]string)
+	RecordBadRecords(policy string, count int, dimensions map[string]string)
+	RecordConfigDegraded(source string, degraded bool, dimensions map[string]string)
+
+	// Flush publishes the buffered metrics
+	Flush(ctx context.Context) error
+	// Stop releases the backend resources after a final flush
+	Stop(ctx context.Context) error
+}
+
+var (
+	_ Recorder = (*CloudWatchMetrics)(nil)
+	_ Recorder = (*EMFMetrics)(nil)
+	_ Recorder = (*PrometheusMetrics)(nil)
+)
+
+// NewFromEnv creates the metrics backend selected by METRICS_BACKEND
+//
+// "cloudwatch" (default) publishes with PutMetricData, "emf" writes CloudWatch
+// Embedded Metric Format documents to stdout and lets CloudWatch Logs extract
+// the metrics, without any API call from the function. "prometheus" serves the
+// metrics on METRICS_LISTEN_ADDR (default :9090) for long-running deployments.
+func NewFromEnv(awsConfig *aws.Config) (Recorder, error) {
+	namespace := getEnv("METRICS_NAMESPACE", "CloudTrailFilter")
+
+	switch backend := strings.ToLower(getEnv("METRICS_BACKEND", "cloudwatch")); backend {
+	case "cloudwatch":
+		return NewCloudWatchMetrics(cloudwatch.NewFromConfig(*awsConfig), namespace), nil
+	case "emf":
+		return NewEMFMetrics(os.Stdout, namespace), nil
+	case "prometheus":
+		pm := NewPrometheusMetrics()
+		if err := pm.ListenAndServe(getEnv("METRICS_LISTEN_ADDR", ":9090")); err != nil {
+			return nil, err
+		}
+		return pm, nil
+	default:
+		return nil, fmt.Errorf("unknown metrics backend: %s", backend)
+	}
+}
+
+// getEnv returns the trimmed value of an environment variable or its default value
+func getEnv(key, defaultValue string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,373 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// prometheusNamespace prefixes every exported metric
+const prometheusNamespace = "ctlp"
+
+// PrometheusMetrics exposes the metrics on a Prometheus /metrics endpoint
+//
+// It is meant for long-running deployments (containers, backfills). Prometheus
+// needs a fixed label set per metric, so the free-form dimensions passed to the
+// Record functions are not exported; only the value specific to a metric (error
+// type, S3 operation, config source, rule name) becomes a label.
+type PrometheusMetrics struct {
+	registry *prometheus.Registry
+	enabled  bool
+
+	processingTime   prometheus.Histogram
+	recordsProcessed prometheus.Counter
+	recordsFiltered  prometheus.Counter
+	filterRate       prometheus.Gauge
+	errors           *prometheus.CounterVec
+	fileSize         prometheus.Histogram
+	lambdaDuration   prometheus.Histogram
+	memoryUsed       prometheus.Gauge
+	configLoadTime   *prometheus.HistogramVec
+	s3Duration       *prometheus.HistogramVec
+	s3Errors         *prometheus.CounterVec
+	ruleHits         *prometheus.CounterVec
+	shadowRuleHits   *prometheus.CounterVec
+	breakerState     *prometheus.GaugeVec
+	breakerChanges   *prometheus.CounterVec
+	passThrough      *prometheus.CounterVec
+	badRecords       *prometheus.CounterVec
+	configDegraded   *prometheus.GaugeVec
+
+	mu     sync.Mutex
+	server *http.Server
+}
+
+// NewPrometheusMetrics creates the collectors in a dedicated registry
+func NewPrometheusMetrics() *PrometheusMetrics {
+	pm := &PrometheusMetrics{
+		registry: prometheus.NewRegistry(),
+		enabled:  os.Getenv("METRICS_ENABLED") != "false", // Default to enabled
+
+		processingTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      "processing_duration_seconds",
+			Help:      "Time taken to process a CloudTrail file.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14), // 10ms to ~80s
+		}),
+		recordsProcessed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "records_processed_total",
+			Help:      "Number of CloudTrail records processed.",
+		}),
+		recordsFiltered: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "records_filtered_total",
+			Help:      "Number of CloudTrail records dropped by the rules.",
+		}),
+		filterRate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "filter_rate_ratio",
+			Help:      "Ratio of records dropped in the last processed file.",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "errors_total",
+			Help:      "Number of errors by type.",
+		}, []string{"error_type"}),
+		fileSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      "file_size_bytes",
+			Help:      "Size of the processed CloudTrail files.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 10), // 1KiB to 256MiB
+		}),
+		lambdaDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      "handler_duration_seconds",
+			Help:      "Duration of a handler invocation.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16), // 10ms to ~5min
+		}),
+		memoryUsed: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "memory_used_bytes",
+			Help:      "Heap memory allocated at the end of the last invocation.",
+		}),
+		configLoadTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      "config_load_duration_seconds",
+			Help:      "Time taken to load the rules configuration.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"source"}),
+		s3Duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      "s3_operation_duration_seconds",
+			Help:      "Duration of S3 operations.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		s3Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "s3_operation_errors_total",
+			Help:      "Number of failed S3 operations.",
+		}, []string{"operation"}),
+		ruleHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "rule_hits_total",
+			Help:      "Number of records dropped by each rule.",
+		}, []string{"rule"}),
+		shadowRuleHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "shadow_rule_hits_total",
+			Help:      "Number of records each shadow rule would drop.",
+		}, []string{"rule"}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "circuit_breaker_state",
+			Help:      "Current circuit breaker state of each dependency, 1 for the active state.",
+		}, []string{"dependency", "state"}),
+		breakerChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "circuit_breaker_transitions_total",
+			Help:      "Number of circuit breaker transitions by dependency and new state.",
+		}, []string{"dependency", "state"}),
+		passThrough: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "passthrough_total",
+			Help:      "Number of records (scope record) or objects (scope object) copied unfiltered in fail-open mode.",
+		}, []string{"scope"}),
+		badRecords: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "bad_records_total",
+			Help:      "Number of records that could not be decoded or evaluated, by bad record policy.",
+		}, []string{"policy"}),
+		configDegraded: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "config_degraded",
+			Help:      "1 while the configuration is served by a fallback source, labelled with the active source.",
+		}, []string{"source"}),
+	}
+
+	pm.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		pm.processingTime,
+		pm.recordsProcessed,
+		pm.recordsFiltered,
+		pm.filterRate,
+		pm.errors,
+		pm.fileSize,
+		pm.lambdaDuration,
+		pm.memoryUsed,
+		pm.configLoadTime,
+		pm.s3Duration,
+		pm.s3Errors,
+		pm.ruleHits,
+		pm.shadowRuleHits,
+		pm.breakerState,
+		pm.breakerChanges,
+		pm.passThrough,
+		pm.badRecords,
+		pm.configDegraded,
+	)
+
+	return pm
+}
+
+// Handler returns the HTTP handler serving the metrics
+func (pm *PrometheusMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(pm.registry, promhttp.HandlerOpts{Registry: pm.registry})
+}
+
+// ListenAndServe serves the metrics on addr under /metrics until Stop is called
+//
+// The listener is opened before returning so that an address already in use
+// is reported to the caller.
+func (pm *PrometheusMetrics) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", pm.Handler())
+
+	pm.mu.Lock()
+	pm.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	server := pm.server
+	pm.mu.Unlock()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Str("addr", addr).Msg("metrics server stopped")
+		}
+	}()
+
+	log.Info().Str("addr", listener.Addr().String()).Msg("serving Prometheus metrics")
+
+	return nil
+}
+
+// RecordProcessingTime records the time taken to process a file
+func (pm *PrometheusMetrics) RecordProcessingTime(duration time.Duration, dimensions map[string]string) {
+	if pm.enabled {
+		pm.processingTime.Observe(duration.Seconds())
+	}
+}
+
+// RecordRecordsProcessed records the number of records processed
+func (pm *PrometheusMetrics) RecordRecordsProcessed(count int, dimensions map[string]string) {
+	if pm.enabled {
+		pm.recordsProcessed.Add(float64(count))
+	}
+}
+
+// RecordRecordsFiltered records the number of records filtered
+func (pm *PrometheusMetrics) RecordRecordsFiltered(count int, dimensions map[string]string) {
+	if pm.enabled {
+		pm.recordsFiltered.Add(float64(count))
+	}
+}
+
+// RecordFilterRate records the ratio of records filtered
+func (pm *PrometheusMetrics) RecordFilterRate(rate float64, dimensions map[string]string) {
+	if pm.enabled {
+		pm.filterRate.Set(rate)
+	}
+}
+
+// RecordError records an error occurrence
+func (pm *PrometheusMetrics) RecordError(errorType string, dimensions map[string]string) {
+	if pm.enabled {
+		pm.errors.WithLabelValues(errorType).Inc()
+	}
+}
+
+// RecordFileSize records the size of processed files
+func (pm *PrometheusMetrics) RecordFileSize(sizeBytes int64, dimensions map[string]string) {
+	if pm.enabled {
+		pm.fileSize.Observe(float64(sizeBytes))
+	}
+}
+
+// RecordLambdaDuration records the handler execution duration
+func (pm *PrometheusMetrics) RecordLambdaDuration(duration time.Duration, dimensions map[string]string) {
+	if pm.enabled {
+		pm.lambdaDuration.Observe(duration.Seconds())
+	}
+}
+
+// RecordMemoryUsed records memory usage
+func (pm *PrometheusMetrics) RecordMemoryUsed(memoryMB float64, dimensions map[string]string) {
+	if pm.enabled {
+		pm.memoryUsed.Set(memoryMB * 1024 * 1024)
+	}
+}
+
+// RecordConfigLoadTime records configuration loading time
+func (pm *PrometheusMetrics) RecordConfigLoadTime(duration time.Duration, source string, dimensions map[string]string) {
+	if pm.enabled {
+		pm.configLoadTime.WithLabelValues(source).Observe(duration.Seconds())
+	}
+}
+
+// RecordS3Operations records S3 operation metrics
+func (pm *PrometheusMetrics) RecordS3Operations(operation string, duration time.Duration, success bool, dimensions map[string]string) {
+	if !pm.enabled {
+		return
+	}
+
+	pm.s3Duration.WithLabelValues(operation).Observe(duration.Seconds())
+	if !success {
+		pm.s3Errors.WithLabelValues(operation).Inc()
+	}
+}
+
+// RecordRuleHits records the number of records dropped by each rule
+func (pm *PrometheusMetrics) RecordRuleHits(hits map[string]int, dimensions map[string]string) {
+	if !pm.enabled {
+		return
+	}
+
+	for ruleName, count := range hits {
+		// Add(0) still creates the series so that unused rules are visible
+		pm.ruleHits.WithLabelValues(ruleName).Add(float64(count))
+	}
+}
+
+// RecordShadowRuleHits records the number of records each shadow rule would drop
+func (pm *PrometheusMetrics) RecordShadowRuleHits(hits map[string]int, dimensions map[string]string) {
+	if !pm.enabled {
+		return
+	}
+
+	for ruleName, count := range hits {
+		pm.shadowRuleHits.WithLabelValues(ruleName).Add(float64(count))
+	}
+}
+
+// RecordCircuitBreakerState records a circuit breaker transition to state
+func (pm *PrometheusMetrics) RecordCircuitBreakerState(dependency, state string, dimensions map[string]string) {
+	if !pm.enabled {
+		return
+	}
+
+	pm.breakerState.DeletePartialMatch(prometheus.Labels{"dependency": dependency})
+	pm.breakerState.WithLabelValues(dependency, state).Set(1)
+	pm.breakerChanges.WithLabelValues(dependency, state).Inc()
+}
+
+// RecordPassThrough records data copied unfiltered in fail-open mode
+func (pm *PrometheusMetrics) RecordPassThrough(scope string, count int, dimensions map[string]string) {
+	if !pm.enabled {
+		return
+	}
+	pm.passThrough.WithLabelValues(scope).Add(float64(count))
+}
+
+// RecordBadRecords records the records skipped or kept by the bad record policy
+func (pm *PrometheusMetrics) RecordBadRecords(policy string, count int, dimensions map[string]string) {
+	if !pm.enabled {
+		return
+	}
+	pm.badRecords.WithLabelValues(policy).Add(float64(count))
+}
+
+// RecordConfigDegraded records the source of the active configuration, only the
+// active source has a value
+func (pm *PrometheusMetrics) RecordConfigDegraded(source string, degraded bool, dimensions map[string]string) {
+	if !pm.enabled {
+		return
+	}
+	pm.configDegraded.Reset()
+	pm.configDegraded.WithLabelValues(source).Set(boolValue(degraded))
+}
+
+// Flush is a no-op, metrics are pulled by the scraper
+func (pm *PrometheusMetrics) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Stop shuts the metrics server down
+func (pm *PrometheusMetrics) Stop(ctx context.Context) error {
+	pm.mu.Lock()
+	server := pm.server
+	pm.server = nil
+	pm.mu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to stop metrics server: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, url string) string {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	pm := NewPrometheusMetrics()
+	server := httptest.NewServer(pm.Handler())
+	defer server.Close()
+
+	dims := map[string]string{"SourceBucket": "logs"}
+	pm.RecordRecordsProcessed(10, dims)
+	pm.RecordRecordsProcessed(5, dims)
+	pm.RecordRecordsFiltered(4, dims)
+	pm.RecordError("CopyError", dims)
+	pm.RecordProcessingTime(1500*time.Millisecond, dims)
+	pm.RecordFileSize(2048, dims)
+	pm.RecordS3Operations("GetObject", 20*time.Millisecond, false, dims)
+	pm.RecordRuleHits(map[string]int{"DropReadOnly": 3, "DropKMS": 0}, nil)
+	pm.RecordShadowRuleHits(map[string]int{"ShadowSTS": 2}, nil)
+	pm.RecordCircuitBreakerState("s3", "open", nil)
+	pm.RecordCircuitBreakerState("s3", "half-open", nil)
+	assert.NoError(t, pm.Flush(context.Background()))
+
+	body := scrape(t, server.URL)
+
+	assert.Contains(t, body, "ctlp_records_processed_total 15\n")
+	assert.Contains(t, body, "ctlp_records_filtered_total 4\n")
+	assert.Contains(t, body, `ctlp_errors_total{error_type="CopyError"} 1`)
+	assert.Contains(t, body, `ctlp_processing_duration_seconds_bucket{le="2.56"} 1`)
+	assert.Contains(t, body, `ctlp_processing_duration_seconds_bucket{le="1.28"} 0`)
+	assert.Contains(t, body, "ctlp_processing_duration_seconds_sum 1.5\n")
+	assert.Contains(t, body, `ctlp_file_size_bytes_bucket{le="4096"} 1`)
+	assert.Contains(t, body, `ctlp_s3_operation_duration_seconds_count{operation="GetObject"} 1`)
+	assert.Contains(t, body, `ctlp_s3_operation_errors_total{operation="GetObject"} 1`)
+	assert.Contains(t, body, `ctlp_rule_hits_total{rule="DropReadOnly"} 3`)
+	assert.Contains(t, body, `ctlp_rule_hits_total{rule="DropKMS"} 0`)
+	assert.Contains(t, body, `ctlp_shadow_rule_hits_total{rule="ShadowSTS"} 2`)
+	assert.Contains(t, body, `ctlp_circuit_breaker_state{dependency="s3",state="half-open"} 1`)
+	assert.NotContains(t, body, `ctlp_circuit_breaker_state{dependency="s3",state="open"}`)
+	assert.Contains(t, body, `ctlp_circuit_breaker_transitions_total{dependency="s3",state="open"} 1`)
+	assert.NotContains(t, body, "SourceBucket", "free-form dimensions are not labels")
+}
+
+func TestPrometheusMetricsServer(t *testing.T) {
+	pm := NewPrometheusMetrics()
+	assert.NoError(t, pm.ListenAndServe("127.0.0.1:0"))
+
+	pm.mu.Lock()
+	assert.NotNil(t, pm.server)
+	pm.mu.Unlock()
+
+	assert.NoError(t, pm.Stop(context.Background()))
+	assert.NoError(t, pm.Stop(context.Background()), "stopping twice is a no-op")
+
+	assert.Error(t, pm.ListenAndServe("invalid-address"))
+}
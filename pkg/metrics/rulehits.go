@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// maxMetricDataQueries is the maximum number of queries of a GetMetricData call
+const maxMetricDataQueries = 500
+
+// RuleHitsAggregator sums rule hits across the files processed in one invocation
+// so that RuleHits is published once per rule and invocation instead of per event
+type RuleHitsAggregator struct {
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+// NewRuleHitsAggregator creates a new aggregator
+func NewRuleHitsAggregator() *RuleHitsAggregator {
+	return &RuleHitsAggregator{hits: make(map[string]int)}
+}
+
+// Add adds the hits of a processed file, rules without hits are kept with a zero count
+func (a *RuleHitsAggregator) Add(hits map[string]int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for ruleName, count := range hits {
+		a.hits[ruleName] += count
+	}
+}
+
+// Drain returns the aggregated hits and resets the aggregator
+func (a *RuleHitsAggregator) Drain() map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	hits := a.hits
+	a.hits = make(map[string]int, len(hits))
+	return hits
+}
+
+// MetricDataAPI interface for reading metrics back from CloudWatch
+type MetricDataAPI interface {
+	GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error)
+}
+
+// FindStaleRules returns the rules whose RuleHits sum is zero over the last days
+//
+// The query matches the series published by RecordRuleHits without extra
+// dimensions, see ruleHitsDimensions. Rules without any datapoint in the window,
+// e.g. rules added recently or a function that was not invoked, are not reported.
+func FindStaleRules(ctx context.Context, client MetricDataAPI, namespace string, ruleNames []string, days int) ([]string, error) {
+	if days <= 0 {
+		return nil, fmt.Errorf("days must be positive")
+	}
+
+	end := time.Now().UTC()
+	start := end.Add(-time.Duration(days) * 24 * time.Hour)
+
+	var stale []string
+	for i := 0; i < len(ruleNames); i += maxMetricDataQueries {
+		batch := ruleNames[i:min(i+maxMetricDataQueries, len(ruleNames))]
+
+		input := &cloudwatch.GetMetricDataInput{
+			StartTime:         aws.Time(start),
+			EndTime:           aws.Time(end),
+			MetricDataQueries: make([]types.MetricDataQuery, len(batch)),
+		}
+		for j, ruleName := range batch {
+			input.MetricDataQueries[j] = types.MetricDataQuery{
+				Id: aws.String(fmt.Sprintf("r%d", j)),
+				MetricStat: &types.MetricStat{
+					Metric: &types.Metric{
+						Namespace:  aws.String(namespace),
+						MetricName: aws.String("RuleHits"),
+						Dimensions: cloudWatchDimensions(ruleHitsDimensions(ruleName)),
+					},
+					Period: aws.Int32(int32(days * 24 * 60 * 60)),
+					Stat:   aws.String("Sum"),
+				},
+			}
+		}
+
+		sums := make(map[string]float64)
+		seen := make(map[string]bool)
+		for {
+			resp, err := client.GetMetricData(ctx, input)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get metric data: %w", err)
+			}
+
+			for _, res := range resp.MetricDataResults {
+				id := aws.ToString(res.Id)
+				for _, v := range res.Values {
+					sums[id] += v
+					seen[id] = true
+				}
+			}
+
+			if resp.NextToken == nil {
+				break
+			}
+			input.NextToken = resp.NextToken
+		}
+
+		for j, ruleName := range batch {
+			id := fmt.Sprintf("r%d", j)
+			if seen[id] && sums[id] == 0 {
+				stale = append(stale, ruleName)
+			}
+		}
+	}
+
+	return stale, nil
+}
+
+// ruleHitsDimensions returns the default dimensions of the RuleHits series of a
+// rule: the region and the rule name
+//
+// FunctionName is left out so that FindStaleRules, which runs outside of the
+// function, queries the same dimension set as RecordRuleHits publishes.
+func ruleHitsDimensions(ruleName string) map[string]string {
+	dims := regionDimensions()
+	dims["RuleName"] = ruleName
+	return dims
+}
+
+// cloudWatchDimensions converts dimensions to CloudWatch dimensions sorted by name
+func cloudWatchDimensions(dimensions map[string]string) []types.Dimension {
+	names := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dims := make([]types.Dimension, len(names))
+	for i, name := range names {
+		dims[i] = types.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(dimensions[name]),
+		}
+	}
+	return dims
+}
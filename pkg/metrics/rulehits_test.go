@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// Mock CloudWatch client
+type mockCloudWatchClient struct {
+	mock.Mock
+}
+
+func (m *mockCloudWatchClient) PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*cloudwatch.PutMetricDataOutput), args.Error(1)
+}
+
+func (m *mockCloudWatchClient) GetMetricData(ctx context.Context, params *cloudwatch.GetMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.GetMetricDataOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*cloudwatch.GetMetricDataOutput), args.Error(1)
+}
+
+func dimensionValue(dims []types.Dimension, name string) string {
+	for _, d := range dims {
+		if aws.ToString(d.Name) == name {
+			return aws.ToString(d.Value)
+		}
+	}
+	return ""
+}
+
+func TestRuleHitsAggregator(t *testing.T) {
+	agg := NewRuleHitsAggregator()
+	agg.Add(map[string]int{"DropReadOnly": 3, "DropKMS": 0})
+	agg.Add(map[string]int{"DropReadOnly": 2, "DropKMS": 0})
+
+	assert.Equal(t, map[string]int{"DropReadOnly": 5, "DropKMS": 0}, agg.Drain())
+	assert.Empty(t, agg.Drain())
+}
+
+func TestRecordRuleHits(t *testing.T) {
+	t.Setenv("METRICS_ENABLED", "true")
+	t.Setenv("AWS_REGION", "eu-west-1")
+	ctx := context.Background()
+
+	client := new(mockCloudWatchClient)
+	cwm := NewCloudWatchMetrics(client, "CloudTrailFilter")
+	defer close(cwm.stopCh)
+
+	var sent []types.MetricDatum
+	client.On("PutMetricData", ctx, mock.Anything).Run(func(args mock.Arguments) {
+		sent = append(sent, args.Get(1).(*cloudwatch.PutMetricDataInput).MetricData...)
+	}).Return(&cloudwatch.PutMetricDataOutput{}, nil)
+
+	cwm.RecordRuleHits(map[string]int{"DropReadOnly": 5, "DropKMS": 0}, nil)
+	assert.NoError(t, cwm.Flush(ctx))
+
+	assert.Len(t, sent, 2)
+	values := map[string]float64{}
+	for _, datum := range sent {
+		assert.Equal(t, "RuleHits", aws.ToString(datum.MetricName))
+		assert.Equal(t, "eu-west-1", dimensionValue(datum.Dimensions, "Region"))
+		values[dimensionValue(datum.Dimensions, "RuleName")] = aws.ToFloat64(datum.Value)
+	}
+	assert.Equal(t, map[string]float64{"DropReadOnly": 5, "DropKMS": 0}, values)
+}
+
+// dimensionSet returns dims as a map to compare sets regardless of order
+func dimensionSet(dims []types.Dimension) map[string]string {
+	set := make(map[string]string, len(dims))
+	for _, d := range dims {
+		set[aws.ToString(d.Name)] = aws.ToString(d.Value)
+	}
+	return set
+}
+
+func TestRuleHitsDimensions(t *testing.T) {
+	t.Setenv("METRICS_ENABLED", "true")
+	t.Setenv("AWS_REGION", "eu-west-1")
+	functionName := lambdacontext.FunctionName
+	lambdacontext.FunctionName = "ctlp-parser"
+	t.Cleanup(func() { lambdacontext.FunctionName = functionName })
+	ctx := context.Background()
+
+	client := new(mockCloudWatchClient)
+	var queried map[string]string
+	client.On("GetMetricData", ctx, mock.Anything).Run(func(args mock.Arguments) {
+		in := args.Get(1).(*cloudwatch.GetMetricDataInput)
+		queried = dimensionSet(in.MetricDataQueries[0].MetricStat.Metric.Dimensions)
+	}).Return(&cloudwatch.GetMetricDataOutput{}, nil)
+
+	_, err := FindStaleRules(ctx, client, "CloudTrailFilter", []string{"DropKMS"}, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Region": "eu-west-1", "RuleName": "DropKMS"}, queried)
+
+	t.Run("cloudwatch", func(t *testing.T) {
+		var sent []types.MetricDatum
+		client.On("PutMetricData", ctx, mock.Anything).Run(func(args mock.Arguments) {
+			sent = append(sent, args.Get(1).(*cloudwatch.PutMetricDataInput).MetricData...)
+		}).Return(&cloudwatch.PutMetricDataOutput{}, nil)
+
+		cwm := NewCloudWatchMetrics(client, "CloudTrailFilter")
+		defer close(cwm.stopCh)
+		cwm.RecordRuleHits(map[string]int{"DropKMS": 0}, nil)
+		cwm.RecordRecordsProcessed(1, nil)
+		assert.NoError(t, cwm.Flush(ctx))
+
+		if assert.Len(t, sent, 2) {
+			assert.Equal(t, queried, dimensionSet(sent[0].Dimensions))
+			assert.Equal(t, "ctlp-parser", dimensionValue(sent[1].Dimensions, "FunctionName"),
+				"other metrics keep FunctionName")
+		}
+	})
+
+	t.Run("emf", func(t *testing.T) {
+		var out bytes.Buffer
+		emf := NewEMFMetrics(&out, "CloudTrailFilter")
+		emf.RecordRuleHits(map[string]int{"DropKMS": 0}, nil)
+		assert.NoError(t, emf.Flush(ctx))
+
+		docs := decodeEMF(t, &out)
+		if assert.Len(t, docs, 1) {
+			directive := docs[0]["_aws"].(map[string]any)["CloudWatchMetrics"].([]any)[0].(map[string]any)
+			published := make(map[string]string)
+			for _, name := range directive["Dimensions"].([]any)[0].([]any) {
+				published[name.(string)] = docs[0][name.(string)].(string)
+			}
+			assert.Equal(t, queried, published)
+		}
+	})
+}
+
+func TestFindStaleRules(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	ctx := context.Background()
+
+	client := new(mockCloudWatchClient)
+	client.On("GetMetricData", ctx, mock.MatchedBy(func(in *cloudwatch.GetMetricDataInput) bool {
+		stat := in.MetricDataQueries[0].MetricStat
+		return len(in.MetricDataQueries) == 3 &&
+			aws.ToString(stat.Metric.MetricName) == "RuleHits" &&
+			aws.ToInt32(stat.Period) == 7*24*60*60 &&
+			dimensionValue(stat.Metric.Dimensions, "RuleName") == "Active" &&
+			dimensionValue(stat.Metric.Dimensions, "Region") == "eu-west-1"
+	})).Return(&cloudwatch.GetMetricDataOutput{
+		MetricDataResults: []types.MetricDataResult{
+			{Id: aws.String("r0"), Values: []float64{12, 3}},
+			{Id: aws.String("r1"), Values: []float64{0, 0}},
+			{Id: aws.String("r2")},
+		},
+	}, nil).Once()
+
+	stale, err := FindStaleRules(ctx, client, "CloudTrailFilter", []string{"Active", "Stale", "New"}, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Stale"}, stale)
+	client.AssertExpectations(t)
+
+	_, err = FindStaleRules(ctx, client, "CloudTrailFilter", []string{"Active"}, 0)
+	assert.Error(t, err)
+}
@@ -8,6 +8,7 @@ import (
 	"ctlp/pkg/rules"
 	"fmt"
 	"io"
+	"slices"
 	"sync"
 
 	"github.com/rs/zerolog/log"
@@ -20,6 +21,25 @@ type StreamingProcessor struct {
 	metrics    MetricsCollector
 	bufferPool *sync.Pool
 	writerPool *sync.Pool
+
+	badRecordPolicy rules.BadRecordPolicy
+	maxBadRecords   int
+}
+
+// Option configures a StreamingProcessor
+type Option func(*StreamingProcessor)
+
+// WithBadRecordPolicy sets the policy applied to records that cannot be decoded or
+// evaluated. By default ProcessStream logs and skips them, and ProcessBatch fails
+// the whole input.
+//
+// With the skip and keep policies the input fails with rules.ErrTooManyBadRecords
+// once more than maxBadRecords records are bad, 0 allows any number.
+func WithBadRecordPolicy(policy rules.BadRecordPolicy, maxBadRecords int) Option {
+	return func(sp *StreamingProcessor) {
+		sp.badRecordPolicy = policy
+		sp.maxBadRecords = maxBadRecords
+	}
 }
 
 // MetricsCollector interface for collecting processing metrics
@@ -27,29 +47,48 @@ type MetricsCollector interface {
 	RecordProcessed(count int)
 	RecordFiltered(count int)
 	RecordError(err error)
+	// RecordRuleHits is called once per processed input with the hits of every rule
+	RecordRuleHits(hits map[string]int)
+	// RecordBadRecords is called once per processed input with bad records, with
+	// the indexes of the records skipped or kept by the bad record policy
+	RecordBadRecords(indexes []int)
 }
 
 // NopMetricsCollector is a no-op implementation of MetricsCollector
 type NopMetricsCollector struct{}
 
-func (n *NopMetricsCollector) RecordProcessed(count int) {}
-func (n *NopMetricsCollector) RecordFiltered(count int)  {}
-func (n *NopMetricsCollector) RecordError(err error)     {}
+func (n *NopMetricsCollector) RecordProcessed(count int)          {}
+func (n *NopMetricsCollector) RecordFiltered(count int)           {}
+func (n *NopMetricsCollector) RecordError(err error)              {}
+func (n *NopMetricsCollector) RecordRuleHits(hits map[string]int) {}
+func (n *NopMetricsCollector) RecordBadRecords(indexes []int)     {}
 
 // ProcessingResult contains the results of processing
 type ProcessingResult struct {
 	ProcessedCount int
 	FilteredCount  int
 	OutputSize     int64
+	// RuleHits counts the records filtered by each rule, rules without hits are included
+	RuleHits map[string]int
+	// ShadowHits counts the records each shadow rule would drop, the records are
+	// kept. It has an entry for every shadow rule.
+	ShadowHits map[string]int
+	// ProtectedKept counts, per rule, the protected events the rule matched and
+	// that were kept
+	ProtectedKept map[string]int
+	// PassedThrough is the number of bad records kept unfiltered
+	PassedThrough int
+	// BadRecords holds the indexes of the records skipped or kept by the bad record policy
+	BadRecords []int
 }
 
 // NewStreamingProcessor creates a new streaming processor
-func NewStreamingProcessor(rules *rules.CachedConfiguration, metrics MetricsCollector) *StreamingProcessor {
+func NewStreamingProcessor(rules *rules.CachedConfiguration, metrics MetricsCollector, opts ...Option) *StreamingProcessor {
 	if metrics == nil {
 		metrics = &NopMetricsCollector{}
 	}
 
-	return &StreamingProcessor{
+	sp := &StreamingProcessor{
 		rules:   rules,
 		metrics: metrics,
 		bufferPool: &sync.Pool{
@@ -63,6 +102,10 @@ func NewStreamingProcessor(rules *rules.CachedConfiguration, metrics MetricsColl
 			},
 		},
 	}
+	for _, opt := range opts {
+		opt(sp)
+	}
+	return sp
 }
 
 // ProcessStream processes CloudTrail records from input stream to output stream
@@ -91,7 +134,7 @@ func NewStreamingProcessor(rules *rules.CachedConfiguration, metrics MetricsColl
 // The compressed parameter enables automatic gzip compression/decompression,
 // transparent to the caller.
 func (sp *StreamingProcessor) ProcessStream(ctx context.Context, input io.Reader, output io.Writer, compressed bool) (*ProcessingResult, error) {
-	result := &ProcessingResult{}
+	result := sp.newResult()
 
 	// Setup input reader
 	reader, err := sp.setupReader(input, compressed)
@@ -138,6 +181,7 @@ func (sp *StreamingProcessor) ProcessStream(ctx context.Context, input io.Reader
 	}
 
 	firstRecord := true
+	badRecords := sp.newBadRecords(rules.BadRecordSkip)
 
 	for scanner.Scan() {
 		line := scanner.Bytes()
@@ -188,11 +232,12 @@ func (sp *StreamingProcessor) ProcessStream(ctx context.Context, input io.Reader
 				recordBuffer.WriteByte(b)
 				bracketDepth--
 				if bracketDepth == 0 && recordBuffer.Len() > 0 {
-					// We have a complete record
-					if err := sp.processRecord(ctx, recordBuffer.Bytes(), writer, &firstRecord, result); err != nil {
-						// Log error but continue processing
+					// We have a complete record, bad records are handled by the policy and
+					// processing continues unless the policy fails the input
+					if err := sp.processRecord(ctx, recordBuffer.Bytes(), writer, &firstRecord, badRecords, result); err != nil {
 						log.Ctx(ctx).Error().Err(err).Msg("failed to process record")
 						sp.metrics.RecordError(err)
+						return result, err
 					}
 					recordBuffer.Reset()
 				}
@@ -227,14 +272,19 @@ func (sp *StreamingProcessor) ProcessStream(ctx context.Context, input io.Reader
 		return result, fmt.Errorf("failed to write output footer: %w", err)
 	}
 
+	sp.metrics.RecordRuleHits(result.RuleHits)
+	if len(result.BadRecords) > 0 {
+		sp.metrics.RecordBadRecords(result.BadRecords)
+	}
+	logProtectedKept(ctx, result)
+
 	return result, nil
 }
 
 // ProcessBatch processes CloudTrail records in batch mode (non-streaming)
 func (sp *StreamingProcessor) ProcessBatch(ctx context.Context, input *Cloudtrail) (*Cloudtrail, *ProcessingResult, error) {
-	result := &ProcessingResult{
-		ProcessedCount: len(input.Records),
-	}
+	result := sp.newResult()
+	result.ProcessedCount = len(input.Records)
 
 	output := &Cloudtrail{
 		Records: make([]json.RawMessage, 0, len(input.Records)),
@@ -242,9 +292,17 @@ func (sp *StreamingProcessor) ProcessBatch(ctx context.Context, input *Cloudtrai
 
 	// Process records in parallel batches for better performance
 	const batchSize = 100
+	type badRecord struct {
+		index int
+		err   error
+	}
 	type batchResult struct {
-		records  []json.RawMessage
-		filtered int
+		records   []json.RawMessage
+		filtered  int
+		hits      map[string]int
+		shadow    map[string]int
+		protected map[string]int
+		bad       []badRecord
 	}
 
 	numBatches := (len(input.Records) + batchSize - 1) / batchSize
@@ -261,7 +319,10 @@ func (sp *StreamingProcessor) ProcessBatch(ctx context.Context, input *Cloudtrai
 			defer wg.Done()
 
 			batch := batchResult{
-				records: make([]json.RawMessage, 0, end-start),
+				records:   make([]json.RawMessage, 0, end-start),
+				hits:      make(map[string]int),
+				shadow:    make(map[string]int),
+				protected: make(map[string]int),
 			}
 
 			for j := start; j < end; j++ {
@@ -273,16 +334,20 @@ func (sp *StreamingProcessor) ProcessBatch(ctx context.Context, input *Cloudtrai
 				default:
 				}
 
-				shouldFilter, err := sp.shouldFilterRecord(ctx, input.Records[j])
+				shouldFilter, dropEvent, err := sp.shouldFilterRecord(ctx, input.Records[j], batch.shadow)
 				if err != nil {
-					log.Ctx(ctx).Error().Err(err).Msg("failed to evaluate record")
-					errors <- err
-					return
+					// the bad record policy is applied in record order once all batches are done
+					batch.bad = append(batch.bad, badRecord{index: j, err: err})
+					continue
 				}
 
 				if shouldFilter {
 					batch.filtered++
+					batch.hits[dropEvent.RuleName]++
 				} else {
+					if dropEvent != nil {
+						batch.protected[dropEvent.RuleName]++
+					}
 					batch.records = append(batch.records, input.Records[j])
 				}
 			}
@@ -299,9 +364,20 @@ func (sp *StreamingProcessor) ProcessBatch(ctx context.Context, input *Cloudtrai
 	}()
 
 	// Collect results
+	var bad []badRecord
 	for batch := range results {
 		output.Records = append(output.Records, batch.records...)
 		result.FilteredCount += batch.filtered
+		for ruleName, hits := range batch.hits {
+			result.RuleHits[ruleName] += hits
+		}
+		for ruleName, hits := range batch.shadow {
+			result.ShadowHits[ruleName] += hits
+		}
+		for ruleName, kept := range batch.protected {
+			result.ProtectedKept[ruleName] += kept
+		}
+		bad = append(bad, batch.bad...)
 	}
 
 	// Check for errors
@@ -311,12 +387,74 @@ func (sp *StreamingProcessor) ProcessBatch(ctx context.Context, input *Cloudtrai
 		}
 	}
 
+	slices.SortFunc(bad, func(a, b badRecord) int { return a.index - b.index })
+	badRecords := sp.newBadRecords(rules.BadRecordFail)
+	for _, rec := range bad {
+		keep, err := sp.handleBadRecord(ctx, badRecords, rec.index, rec.err, result)
+		if err != nil {
+			return nil, result, err
+		}
+		if keep {
+			output.Records = append(output.Records, input.Records[rec.index])
+		}
+	}
+
 	sp.metrics.RecordProcessed(result.ProcessedCount)
 	sp.metrics.RecordFiltered(result.FilteredCount)
+	sp.metrics.RecordRuleHits(result.RuleHits)
+	if len(result.BadRecords) > 0 {
+		sp.metrics.RecordBadRecords(result.BadRecords)
+	}
+	logProtectedKept(ctx, result)
 
 	return output, result, nil
 }
 
+// newResult creates a result with a zero hit count for every rule
+func (sp *StreamingProcessor) newResult() *ProcessingResult {
+	result := &ProcessingResult{
+		RuleHits:      make(map[string]int, len(sp.rules.Rules)),
+		ShadowHits:    make(map[string]int, len(sp.rules.Shadow)),
+		ProtectedKept: make(map[string]int),
+	}
+	for _, rule := range sp.rules.Rules {
+		result.RuleHits[rule.Name] = 0
+	}
+	for _, rule := range sp.rules.Shadow {
+		result.ShadowHits[rule.Name] = 0
+	}
+	return result
+}
+
+// newBadRecords creates the bad record policy state of one input, defaultPolicy
+// applies when no policy was set
+func (sp *StreamingProcessor) newBadRecords(defaultPolicy rules.BadRecordPolicy) *rules.BadRecords {
+	policy := sp.badRecordPolicy
+	if policy == "" {
+		policy = defaultPolicy
+	}
+	return &rules.BadRecords{Policy: policy, Max: sp.maxBadRecords}
+}
+
+// handleBadRecord applies the bad record policy to the record at index, the
+// returned error fails the input
+func (sp *StreamingProcessor) handleBadRecord(ctx context.Context, badRecords *rules.BadRecords, index int, err error, result *ProcessingResult) (bool, error) {
+	keep, policyErr := badRecords.Handle(index, err)
+	if policyErr != nil {
+		return false, policyErr
+	}
+	result.BadRecords = badRecords.Indexes
+
+	if !keep {
+		log.Ctx(ctx).Warn().Err(err).Int("index", index).Msg("bad record skipped")
+		return false, nil
+	}
+
+	log.Ctx(ctx).Warn().Err(err).Int("index", index).Msg("record kept unfiltered")
+	result.PassedThrough++
+	return true, nil
+}
+
 // setupReader sets up the input reader with optional decompression
 func (sp *StreamingProcessor) setupReader(input io.Reader, compressed bool) (io.Reader, error) {
 	if !compressed {
@@ -351,19 +489,30 @@ func (sp *StreamingProcessor) setupWriter(output io.Writer, compressed bool) (io
 }
 
 // processRecord processes a single record
-func (sp *StreamingProcessor) processRecord(ctx context.Context, recordJSON []byte, writer io.Writer, firstRecord *bool, result *ProcessingResult) error {
+//
+// A record that cannot be decoded or evaluated is handled by the bad record
+// policy, an error is returned when it fails the input.
+func (sp *StreamingProcessor) processRecord(ctx context.Context, recordJSON []byte, writer io.Writer, firstRecord *bool, badRecords *rules.BadRecords, result *ProcessingResult) error {
+	index := result.ProcessedCount
 	result.ProcessedCount++
 
-	shouldFilter, err := sp.shouldFilterRecord(ctx, recordJSON)
+	shouldFilter, dropEvent, err := sp.shouldFilterRecord(ctx, recordJSON, result.ShadowHits)
 	if err != nil {
-		return err
+		keep, err := sp.handleBadRecord(ctx, badRecords, index, err, result)
+		if err != nil || !keep {
+			return err
+		}
 	}
 
 	if shouldFilter {
 		result.FilteredCount++
+		result.RuleHits[dropEvent.RuleName]++
 		sp.metrics.RecordFiltered(1)
 		return nil
 	}
+	if dropEvent != nil {
+		result.ProtectedKept[dropEvent.RuleName]++
+	}
 
 	// Write the record to output
 	if !*firstRecord {
@@ -382,27 +531,58 @@ func (sp *StreamingProcessor) processRecord(ctx context.Context, recordJSON []by
 	return nil
 }
 
-// shouldFilterRecord determines if a record should be filtered
-func (sp *StreamingProcessor) shouldFilterRecord(ctx context.Context, recordJSON []byte) (bool, error) {
+// shouldFilterRecord determines if a record should be filtered and by which rule,
+// the rule is also returned for a kept protected event. The would-be drops of
+// the shadow rules are counted in shadowHits.
+func (sp *StreamingProcessor) shouldFilterRecord(ctx context.Context, recordJSON []byte, shadowHits map[string]int) (bool, *rules.DropedEvent, error) {
 	var record map[string]any
 	if err := json.Unmarshal(recordJSON, &record); err != nil {
-		return false, fmt.Errorf("failed to unmarshal record: %w", err)
+		return false, nil, fmt.Errorf("failed to unmarshal record: %w", err)
 	}
 
 	match, dropEvent, err := sp.rules.EvalRules(record)
 	if err != nil {
-		return false, fmt.Errorf("failed to evaluate rules: %w", err)
+		return false, nil, fmt.Errorf("failed to evaluate rules: %w", err)
+	}
+
+	// shadow rules never drop the record, their errors are only logged
+	shadowDrops, err := sp.rules.EvalShadowRules(record)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("shadow rules evaluation failed")
+	}
+	for _, shadowDrop := range shadowDrops {
+		log.Ctx(ctx).Info().
+			Str("rule", shadowDrop.RuleName).
+			Str("rule_owner", shadowDrop.Owner).
+			Str("rule_ticket", shadowDrop.Ticket).
+			Interface("eventID", record["eventID"]).
+			Interface("eventName", record["eventName"]).
+			Msg("record would be dropped by shadow rule")
+		shadowHits[shadowDrop.RuleName]++
 	}
 
 	if match {
 		log.Ctx(ctx).Debug().
 			Str("rule", dropEvent.RuleName).
+			Str("rule_owner", dropEvent.Owner).
+			Str("rule_ticket", dropEvent.Ticket).
 			Interface("eventID", record["eventID"]).
 			Interface("eventName", record["eventName"]).
 			Msg("record filtered")
+		return true, dropEvent, nil
 	}
 
-	return match, nil
+	return false, dropEvent, nil
+}
+
+// logProtectedKept logs once per input the protected events kept despite a
+// matching rule
+func logProtectedKept(ctx context.Context, result *ProcessingResult) {
+	if len(result.ProtectedKept) > 0 {
+		log.Ctx(ctx).Warn().
+			Any("protected_kept", result.ProtectedKept).
+			Msg("rules matched protected events, the events were kept")
+	}
 }
 
 // Cloudtrail represents the CloudTrail document structure
@@ -0,0 +1,206 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"ctlp/pkg/rules"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/encoding/json"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingCollector struct {
+	NopMetricsCollector
+	badRecords []int
+}
+
+func (c *recordingCollector) RecordBadRecords(indexes []int) {
+	c.badRecords = indexes
+}
+
+func TestBadRecordPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	rulesCfg, err := rules.Load(`
+version: 1.0.0
+rules:
+  - name: DropReadOnly
+    matches:
+    - field_name: eventName
+      regex: "^Get.*"
+`)
+	assert.NoError(t, err)
+	cachedCfg, err := rules.PrepareConfiguration(rulesCfg)
+	assert.NoError(t, err)
+
+	records := []string{
+		`{"eventName":"PutObject"}`,
+		`{"eventName":}`,
+		`{"eventName":"GetObject"}`,
+		`{"eventName":"DeleteObject",}`,
+	}
+	input := `{"Records":[` + strings.Join(records, ",") + `]}`
+	batch := &Cloudtrail{Records: make([]json.RawMessage, len(records))}
+	for i, record := range records {
+		batch.Records[i] = json.RawMessage(record)
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		sp := NewStreamingProcessor(cachedCfg, nil)
+
+		// streams log and skip bad records
+		output := new(bytes.Buffer)
+		result, err := sp.ProcessStream(ctx, strings.NewReader(input), output, false)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"Records":[{"eventName":"PutObject"}]}`, output.String())
+		assert.Equal(t, 4, result.ProcessedCount)
+		assert.Equal(t, []int{1, 3}, result.BadRecords)
+
+		// batches fail on the first bad record
+		_, _, err = sp.ProcessBatch(ctx, batch)
+		var badRecordErr *rules.BadRecordError
+		assert.ErrorAs(t, err, &badRecordErr)
+		assert.Equal(t, 1, badRecordErr.Index)
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		sp := NewStreamingProcessor(cachedCfg, nil, WithBadRecordPolicy(rules.BadRecordFail, 0))
+
+		_, err := sp.ProcessStream(ctx, strings.NewReader(input), new(bytes.Buffer), false)
+		var badRecordErr *rules.BadRecordError
+		assert.ErrorAs(t, err, &badRecordErr)
+		assert.Equal(t, 1, badRecordErr.Index)
+
+		_, _, err = sp.ProcessBatch(ctx, batch)
+		assert.ErrorAs(t, err, &badRecordErr)
+		assert.Equal(t, 1, badRecordErr.Index)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		collector := &recordingCollector{}
+		sp := NewStreamingProcessor(cachedCfg, collector, WithBadRecordPolicy(rules.BadRecordSkip, 0))
+
+		output := new(bytes.Buffer)
+		result, err := sp.ProcessStream(ctx, strings.NewReader(input), output, false)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"Records":[{"eventName":"PutObject"}]}`, output.String())
+		assert.Equal(t, []int{1, 3}, result.BadRecords)
+		assert.Equal(t, []int{1, 3}, collector.badRecords)
+
+		out, result, err := sp.ProcessBatch(ctx, batch)
+		assert.NoError(t, err)
+		assert.Len(t, out.Records, 1)
+		assert.Equal(t, []int{1, 3}, result.BadRecords)
+	})
+
+	t.Run("keep", func(t *testing.T) {
+		sp := NewStreamingProcessor(cachedCfg, nil, WithBadRecordPolicy(rules.BadRecordKeep, 0))
+
+		output := new(bytes.Buffer)
+		result, err := sp.ProcessStream(ctx, strings.NewReader(input), output, false)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"Records":[`+records[0]+`,`+records[1]+`,`+records[3]+`]}`, output.String())
+		assert.Equal(t, 2, result.PassedThrough)
+
+		out, result, err := sp.ProcessBatch(ctx, batch)
+		assert.NoError(t, err)
+		assert.Len(t, out.Records, 3)
+		assert.Equal(t, 2, result.PassedThrough)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		sp := NewStreamingProcessor(cachedCfg, nil, WithBadRecordPolicy(rules.BadRecordKeep, 1))
+
+		_, err := sp.ProcessStream(ctx, strings.NewReader(input), new(bytes.Buffer), false)
+		assert.ErrorIs(t, err, rules.ErrTooManyBadRecords)
+
+		_, _, err = sp.ProcessBatch(ctx, batch)
+		assert.ErrorIs(t, err, rules.ErrTooManyBadRecords)
+	})
+}
+
+func TestProtectedEvents(t *testing.T) {
+	ctx := context.Background()
+
+	rulesCfg, err := rules.Load(`
+version: 1.0.0
+rules:
+  - name: DropCloudTrail
+    matches:
+    - field_name: eventSource
+      regex: "^cloudtrail.amazonaws.com$"
+`)
+	assert.NoError(t, err)
+	cachedCfg, err := rules.PrepareConfiguration(rulesCfg)
+	assert.NoError(t, err)
+
+	records := []string{
+		`{"eventSource":"cloudtrail.amazonaws.com","eventName":"StopLogging"}`,
+		`{"eventSource":"cloudtrail.amazonaws.com","eventName":"LookupEvents"}`,
+	}
+	sp := NewStreamingProcessor(cachedCfg, nil)
+
+	output := new(bytes.Buffer)
+	result, err := sp.ProcessStream(ctx, strings.NewReader(`{"Records":[`+strings.Join(records, ",")+`]}`), output, false)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Records":[`+records[0]+`]}`, output.String())
+	assert.Equal(t, map[string]int{"DropCloudTrail": 1}, result.RuleHits)
+	assert.Equal(t, map[string]int{"DropCloudTrail": 1}, result.ProtectedKept)
+
+	batch := &Cloudtrail{Records: []json.RawMessage{json.RawMessage(records[0]), json.RawMessage(records[1])}}
+	out, result, err := sp.ProcessBatch(ctx, batch)
+	assert.NoError(t, err)
+	assert.Len(t, out.Records, 1)
+	assert.Equal(t, map[string]int{"DropCloudTrail": 1}, result.ProtectedKept)
+}
+
+func TestShadowRules(t *testing.T) {
+	ctx := context.Background()
+
+	rulesCfg, err := rules.Load(`
+version: 1.0.0
+rules:
+  - name: DropReadOnly
+    matches:
+    - field_name: eventName
+      regex: "^Get.*"
+  - name: ShadowDescribe
+    mode: shadow
+    matches:
+    - field_name: eventName
+      regex: "^(Get|Describe).*"
+  - name: ShadowNeverMatches
+    mode: shadow
+    matches:
+    - field_name: eventSource
+      regex: "^unknown.amazonaws.com$"
+`)
+	assert.NoError(t, err)
+	cachedCfg, err := rules.PrepareConfiguration(rulesCfg)
+	assert.NoError(t, err)
+
+	records := []string{
+		`{"eventName":"GetObject"}`,
+		`{"eventName":"DescribeInstances"}`,
+		`{"eventName":"PutObject"}`,
+	}
+	sp := NewStreamingProcessor(cachedCfg, nil)
+
+	output := new(bytes.Buffer)
+	result, err := sp.ProcessStream(ctx, strings.NewReader(`{"Records":[`+strings.Join(records, ",")+`]}`), output, false)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Records":[`+records[1]+`,`+records[2]+`]}`, output.String())
+	assert.Equal(t, map[string]int{"DropReadOnly": 1}, result.RuleHits)
+	assert.Equal(t, map[string]int{"ShadowDescribe": 2, "ShadowNeverMatches": 0}, result.ShadowHits)
+
+	batch := &Cloudtrail{Records: make([]json.RawMessage, len(records))}
+	for i, record := range records {
+		batch.Records[i] = json.RawMessage(record)
+	}
+	out, result, err := sp.ProcessBatch(ctx, batch)
+	assert.NoError(t, err)
+	assert.Len(t, out.Records, 2)
+	assert.Equal(t, map[string]int{"ShadowDescribe": 2, "ShadowNeverMatches": 0}, result.ShadowHits)
+}
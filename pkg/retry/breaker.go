@@ -0,0 +1,319 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrCircuitOpen is returned, wrapped, when a circuit breaker rejects a call
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// State is the state of a circuit breaker
+type State int
+
+const (
+	// StateClosed lets every call through
+	StateClosed State = iota
+	// StateOpen rejects every call until the cool-down has elapsed
+	StateOpen
+	// StateHalfOpen lets a limited number of trial calls through
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// BreakerConfig holds circuit breaker configuration
+type BreakerConfig struct {
+	// FailureRateThreshold opens the circuit when reached, between 0 and 1
+	FailureRateThreshold float64
+	// MinRequests is the number of calls in the window before the rate is evaluated
+	MinRequests int
+	// Window is the duration after which the counts of a closed circuit are reset
+	Window time.Duration
+	// CoolDown is the time the circuit stays open before trial calls are allowed
+	CoolDown time.Duration
+	// HalfOpenRequests is the number of successful trial calls closing the circuit
+	HalfOpenRequests int
+	// IsFailure decides if an error counts as a dependency failure
+	IsFailure func(error) bool
+	// OnStateChange is called on every transition, outside of the breaker lock
+	OnStateChange func(name string, from, to State)
+}
+
+// DefaultBreakerConfig returns a default circuit breaker configuration
+func DefaultBreakerConfig() *BreakerConfig {
+	return &BreakerConfig{
+		FailureRateThreshold: 0.5,
+		MinRequests:          5,
+		Window:               time.Minute,
+		CoolDown:             30 * time.Second,
+		HalfOpenRequests:     1,
+		IsFailure: func(err error) bool {
+			// Cancellations come from the caller, not from the dependency
+			return err != nil && !errors.Is(err, context.Canceled)
+		},
+	}
+}
+
+// BreakerOption is a function that modifies BreakerConfig
+type BreakerOption func(*BreakerConfig)
+
+// WithFailureRateThreshold sets the failure rate opening the circuit
+func WithFailureRateThreshold(rate float64) BreakerOption {
+	return func(c *BreakerConfig) {
+		c.FailureRateThreshold = rate
+	}
+}
+
+// WithMinRequests sets the number of calls needed before the failure rate is evaluated
+func WithMinRequests(n int) BreakerOption {
+	return func(c *BreakerConfig) {
+		c.MinRequests = n
+	}
+}
+
+// WithWindow sets the duration of the counting window
+func WithWindow(d time.Duration) BreakerOption {
+	return func(c *BreakerConfig) {
+		c.Window = d
+	}
+}
+
+// WithCoolDown sets the time the circuit stays open
+func WithCoolDown(d time.Duration) BreakerOption {
+	return func(c *BreakerConfig) {
+		c.CoolDown = d
+	}
+}
+
+// WithHalfOpenRequests sets the number of successful trial calls closing the circuit
+func WithHalfOpenRequests(n int) BreakerOption {
+	return func(c *BreakerConfig) {
+		c.HalfOpenRequests = n
+	}
+}
+
+// WithFailureClassifier sets the function deciding if an error is a failure
+func WithFailureClassifier(f func(error) bool) BreakerOption {
+	return func(c *BreakerConfig) {
+		c.IsFailure = f
+	}
+}
+
+// WithStateChange sets a function called on every state transition
+func WithStateChange(f func(name string, from, to State)) BreakerOption {
+	return func(c *BreakerConfig) {
+		c.OnStateChange = f
+	}
+}
+
+// CircuitBreaker stops calling a failing dependency for a cool-down period
+//
+// A closed circuit counts the calls and failures of the current window and
+// opens when the failure rate reaches the threshold after MinRequests calls.
+// Once the cool-down has elapsed the circuit is half-open: trial calls are let
+// through one at a time, a failure opens the circuit again and
+// HalfOpenRequests successes close it. Use one breaker per dependency.
+type CircuitBreaker struct {
+	name string
+	cfg  *BreakerConfig
+	now  func() time.Time
+
+	mu          sync.Mutex
+	state       State
+	requests    int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	trialActive bool
+	successes   int
+}
+
+// NewCircuitBreaker creates a closed circuit breaker for the named dependency
+func NewCircuitBreaker(name string, opts ...BreakerOption) *CircuitBreaker {
+	cfg := DefaultBreakerConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return &CircuitBreaker{
+		name:        name,
+		cfg:         cfg,
+		now:         time.Now,
+		windowStart: time.Now(),
+	}
+}
+
+// Name returns the dependency name
+func (cb *CircuitBreaker) Name() string {
+	return cb.name
+}
+
+// State returns the current state, an open circuit past its cool-down is half-open
+func (cb *CircuitBreaker) State() State {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == StateOpen && cb.now().Sub(cb.openedAt) >= cb.cfg.CoolDown {
+		return StateHalfOpen
+	}
+	return cb.state
+}
+
+// Execute calls fn unless the circuit is open and records its outcome
+//
+// A panic of fn is recorded as a failure, so that a half-open trial is always
+// released, and is then propagated.
+func (cb *CircuitBreaker) Execute(fn func() error) error {
+	allowedIn, err := cb.allow()
+	if err != nil {
+		return err
+	}
+
+	completed := false
+	defer func() {
+		if !completed {
+			cb.record(allowedIn, true)
+		}
+	}()
+
+	err = fn()
+	completed = true
+	cb.record(allowedIn, cb.cfg.IsFailure(err))
+	return err
+}
+
+// allow reserves a call and returns the state it was allowed in, or returns an
+// ErrCircuitOpen error
+func (cb *CircuitBreaker) allow() (State, error) {
+	cb.mu.Lock()
+	var transition func()
+	defer func() {
+		cb.mu.Unlock()
+		if transition != nil {
+			transition()
+		}
+	}()
+
+	now := cb.now()
+
+	switch cb.state {
+	case StateOpen:
+		if now.Sub(cb.openedAt) < cb.cfg.CoolDown {
+			return cb.state, fmt.Errorf("%s: %w", cb.name, ErrCircuitOpen)
+		}
+		transition = cb.setState(StateHalfOpen)
+		fallthrough
+	case StateHalfOpen:
+		if cb.trialActive {
+			return cb.state, fmt.Errorf("%s: %w", cb.name, ErrCircuitOpen)
+		}
+		cb.trialActive = true
+	case StateClosed:
+		if now.Sub(cb.windowStart) >= cb.cfg.Window {
+			cb.resetCounts(now)
+		}
+	}
+
+	return cb.state, nil
+}
+
+// record accounts the outcome of an allowed call, calls allowed in a state the
+// circuit has left since are ignored
+func (cb *CircuitBreaker) record(allowedIn State, failed bool) {
+	cb.mu.Lock()
+	var transition func()
+	defer func() {
+		cb.mu.Unlock()
+		if transition != nil {
+			transition()
+		}
+	}()
+
+	if cb.state != allowedIn {
+		return
+	}
+
+	switch cb.state {
+	case StateHalfOpen:
+		cb.trialActive = false
+		if failed {
+			transition = cb.setState(StateOpen)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.cfg.HalfOpenRequests {
+			transition = cb.setState(StateClosed)
+		}
+	case StateClosed:
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+		if cb.requests >= cb.cfg.MinRequests &&
+			float64(cb.failures)/float64(cb.requests) >= cb.cfg.FailureRateThreshold {
+			transition = cb.setState(StateOpen)
+		}
+	}
+}
+
+// setState changes the state, with the lock held, and returns the notification
+// to run once the lock is released
+func (cb *CircuitBreaker) setState(to State) func() {
+	from := cb.state
+	cb.state = to
+
+	now := cb.now()
+	switch to {
+	case StateOpen:
+		cb.openedAt = now
+	case StateHalfOpen:
+		cb.successes = 0
+		cb.trialActive = false
+	case StateClosed:
+		cb.resetCounts(now)
+	}
+
+	return func() {
+		log.Warn().
+			Str("dependency", cb.name).
+			Str("from", from.String()).
+			Str("to", to.String()).
+			Msg("circuit breaker state changed")
+		if cb.cfg.OnStateChange != nil {
+			cb.cfg.OnStateChange(cb.name, from, to)
+		}
+	}
+}
+
+// resetCounts starts a new counting window
+func (cb *CircuitBreaker) resetCounts(now time.Time) {
+	cb.requests = 0
+	cb.failures = 0
+	cb.windowStart = now
+}
+
+// WithCircuitBreaker runs every attempt through the circuit breaker
+//
+// An open circuit stops the retries immediately with an ErrCircuitOpen error.
+func WithCircuitBreaker(cb *CircuitBreaker) Option {
+	return func(c *Config) {
+		c.Breaker = cb
+	}
+}
@@ -0,0 +1,179 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a manually advanced clock for the breaker tests
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestBreaker(clock *fakeClock, opts ...BreakerOption) (*CircuitBreaker, *[]string) {
+	var transitions []string
+	opts = append([]BreakerOption{
+		WithMinRequests(4),
+		WithFailureRateThreshold(0.5),
+		WithCoolDown(10 * time.Second),
+		WithWindow(time.Minute),
+		WithStateChange(func(name string, from, to State) {
+			transitions = append(transitions, name+":"+from.String()+"->"+to.String())
+		}),
+	}, opts...)
+
+	cb := NewCircuitBreaker("s3", opts...)
+	cb.now = clock.Now
+	cb.windowStart = clock.Now()
+	return cb, &transitions
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	errOutage := errors.New("ServiceUnavailable")
+	fail := func() error { return errOutage }
+	succeed := func() error { return nil }
+
+	t.Run("opens on failure rate", func(t *testing.T) {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		cb, transitions := newTestBreaker(clock)
+
+		assert.NoError(t, cb.Execute(succeed))
+		assert.ErrorIs(t, cb.Execute(fail), errOutage)
+		assert.NoError(t, cb.Execute(succeed))
+		assert.Equal(t, StateClosed, cb.State(), "rate is not evaluated before MinRequests")
+
+		assert.ErrorIs(t, cb.Execute(fail), errOutage)
+		assert.Equal(t, StateOpen, cb.State())
+		assert.Equal(t, []string{"s3:closed->open"}, *transitions)
+
+		called := false
+		err := cb.Execute(func() error { called = true; return nil })
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+		assert.EqualError(t, err, "s3: circuit breaker is open")
+		assert.False(t, called)
+	})
+
+	t.Run("half-open trial closes the circuit", func(t *testing.T) {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		cb, transitions := newTestBreaker(clock, WithHalfOpenRequests(2))
+		for range 4 {
+			_ = cb.Execute(fail)
+		}
+
+		clock.Advance(10 * time.Second)
+		assert.Equal(t, StateHalfOpen, cb.State())
+
+		assert.NoError(t, cb.Execute(succeed))
+		assert.Equal(t, StateHalfOpen, cb.State())
+		assert.NoError(t, cb.Execute(succeed))
+		assert.Equal(t, StateClosed, cb.State())
+		assert.Equal(t, []string{"s3:closed->open", "s3:open->half-open", "s3:half-open->closed"}, *transitions)
+	})
+
+	t.Run("half-open failure opens the circuit again", func(t *testing.T) {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		cb, _ := newTestBreaker(clock)
+		for range 4 {
+			_ = cb.Execute(fail)
+		}
+
+		clock.Advance(10 * time.Second)
+		assert.ErrorIs(t, cb.Execute(fail), errOutage)
+		assert.Equal(t, StateOpen, cb.State())
+
+		clock.Advance(5 * time.Second)
+		assert.ErrorIs(t, cb.Execute(succeed), ErrCircuitOpen, "cool-down restarts")
+	})
+
+	t.Run("single trial at a time", func(t *testing.T) {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		cb, _ := newTestBreaker(clock)
+		for range 4 {
+			_ = cb.Execute(fail)
+		}
+		clock.Advance(10 * time.Second)
+
+		err := cb.Execute(func() error {
+			return cb.Execute(succeed)
+		})
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+	})
+
+	t.Run("panic during a trial opens the circuit again", func(t *testing.T) {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		cb, _ := newTestBreaker(clock)
+		for range 4 {
+			_ = cb.Execute(fail)
+		}
+		clock.Advance(10 * time.Second)
+
+		assert.PanicsWithValue(t, "boom", func() {
+			_ = cb.Execute(func() error { panic("boom") })
+		})
+		assert.Equal(t, StateOpen, cb.State())
+
+		clock.Advance(10 * time.Second)
+		assert.NoError(t, cb.Execute(succeed), "the trial is released")
+		assert.Equal(t, StateClosed, cb.State())
+	})
+
+	t.Run("window resets the counts", func(t *testing.T) {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		cb, _ := newTestBreaker(clock)
+		for range 3 {
+			_ = cb.Execute(fail)
+		}
+
+		clock.Advance(time.Minute)
+		_ = cb.Execute(fail)
+		assert.Equal(t, StateClosed, cb.State())
+	})
+
+	t.Run("classifier ignores errors", func(t *testing.T) {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		cb, _ := newTestBreaker(clock, WithFailureClassifier(IsRetryable))
+		for range 4 {
+			_ = cb.Execute(func() error { return errors.New("invalid parameter") })
+			_ = cb.Execute(func() error { return context.Canceled })
+		}
+		assert.Equal(t, StateClosed, cb.State())
+	})
+}
+
+func TestDoWithCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	cb, _ := newTestBreaker(clock, WithMinRequests(2), WithFailureRateThreshold(1))
+
+	callCount := 0
+	err := Do(ctx, func() error {
+		callCount++
+		return errors.New("ServiceUnavailable")
+	}, WithMaxRetries(5), WithBaseDelay(time.Millisecond), WithCircuitBreaker(cb))
+
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 2, callCount, "retries stop once the circuit opens")
+
+	_, err = DoTyped(ctx, func() (string, error) {
+		callCount++
+		return "ok", nil
+	}, WithCircuitBreaker(cb))
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 2, callCount)
+
+	clock.Advance(10 * time.Second)
+	result, err := DoTyped(ctx, func() (string, error) {
+		return "ok", nil
+	}, WithCircuitBreaker(cb))
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", result)
+	assert.Equal(t, StateClosed, cb.State())
+}
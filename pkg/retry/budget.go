@@ -0,0 +1,108 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBudgetExhausted is returned, wrapping the last error, when a retry is
+// refused because the retry budget of the context is spent
+var ErrBudgetExhausted = errors.New("retry budget exhausted")
+
+// Budget is a number of retries shared by the retry loops of a context
+//
+// Nested retries multiply: a handler retrying twice a copy retried three times
+// makes up to twelve attempts. Every retry of any loop running with the
+// context takes from the same budget, first attempts are free.
+type Budget struct {
+	remaining atomic.Int64
+}
+
+// NewBudget creates a budget of retries
+func NewBudget(retries int) *Budget {
+	b := &Budget{}
+	b.remaining.Store(int64(retries))
+	return b
+}
+
+// Remaining returns the number of retries left
+func (b *Budget) Remaining() int {
+	return int(max(b.remaining.Load(), 0))
+}
+
+// take reserves a retry, it returns false once the budget is spent
+func (b *Budget) take() bool {
+	return b.remaining.Add(-1) >= 0
+}
+
+type budgetKey struct{}
+
+// ContextWithBudget returns a copy of ctx carrying the retry budget
+func ContextWithBudget(ctx context.Context, b *Budget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, b)
+}
+
+// BudgetFromContext returns the retry budget of ctx, or nil when there is none
+func BudgetFromContext(ctx context.Context) *Budget {
+	b, _ := ctx.Value(budgetKey{}).(*Budget)
+	return b
+}
+
+// DeadlineError is returned when an attempt is not started because the context
+// deadline is too close to leave the reserve
+type DeadlineError struct {
+	// Remaining is the time left before the deadline
+	Remaining time.Duration
+	// Reserve is the time that had to be left
+	Reserve time.Duration
+	// Err is the error of the last attempt, nil when no attempt was made
+	Err error
+}
+
+func (e *DeadlineError) Error() string {
+	msg := fmt.Sprintf("not enough time left before the deadline: %s remaining, %s reserved",
+		e.Remaining.Round(time.Millisecond), e.Reserve)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *DeadlineError) Unwrap() error {
+	return e.Err
+}
+
+// WithDeadlineReserve makes the retries deadline-aware
+//
+// An attempt is only started when at least d is left before the context
+// deadline, e.g. the one set by the Lambda runtime, and delays are shortened
+// accordingly. A *DeadlineError is returned when there is not enough time left.
+func WithDeadlineReserve(d time.Duration) Option {
+	return func(c *Config) {
+		c.DeadlineReserve = d
+	}
+}
+
+// timeAvailable returns the time left before the context deadline minus the
+// reserve, ok is false when the retries are not deadline-aware
+func (cfg *Config) timeAvailable(ctx context.Context) (time.Duration, bool) {
+	if cfg.DeadlineReserve <= 0 {
+		return 0, false
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline) - cfg.DeadlineReserve, true
+}
+
+func (cfg *Config) deadlineError(available time.Duration, lastErr error) error {
+	return &DeadlineError{
+		Remaining: available + cfg.DeadlineReserve,
+		Reserve:   cfg.DeadlineReserve,
+		Err:       lastErr,
+	}
+}
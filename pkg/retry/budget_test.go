@@ -0,0 +1,124 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBudget(t *testing.T) {
+	errTransient := errors.New("transient")
+
+	t.Run("shared by nested retries", func(t *testing.T) {
+		budget := NewBudget(3)
+		ctx := ContextWithBudget(context.Background(), budget)
+
+		inner := 0
+		err := Do(ctx, func() error {
+			return Do(ctx, func() error {
+				inner++
+				return errTransient
+			}, WithMaxRetries(2), WithBaseDelay(time.Millisecond))
+		}, WithMaxRetries(2), WithBaseDelay(time.Millisecond))
+
+		assert.ErrorIs(t, err, ErrBudgetExhausted)
+		assert.ErrorIs(t, err, errTransient)
+		assert.Equal(t, 4, inner, "one free attempt and three retries")
+		assert.Equal(t, 0, budget.Remaining())
+	})
+
+	t.Run("exhausted budget is final", func(t *testing.T) {
+		ctx := ContextWithBudget(context.Background(), NewBudget(0))
+
+		callCount := 0
+		_, err := DoTyped(ctx, func() (string, error) {
+			callCount++
+			return "", errTransient
+		}, WithMaxRetries(5), WithBaseDelay(time.Millisecond))
+
+		assert.ErrorIs(t, err, ErrBudgetExhausted)
+		assert.EqualError(t, err, "retry budget exhausted: transient")
+		assert.Equal(t, 1, callCount)
+	})
+
+	t.Run("no budget in the context", func(t *testing.T) {
+		assert.Nil(t, BudgetFromContext(context.Background()))
+
+		callCount := 0
+		err := Do(context.Background(), func() error {
+			callCount++
+			return errTransient
+		}, WithMaxRetries(2), WithBaseDelay(time.Millisecond))
+
+		assert.Error(t, err)
+		assert.Equal(t, 3, callCount)
+	})
+}
+
+func TestDeadlineReserve(t *testing.T) {
+	errTransient := errors.New("transient")
+
+	t.Run("refuses to start an attempt", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		called := false
+		err := Do(ctx, func() error {
+			called = true
+			return nil
+		}, WithDeadlineReserve(time.Second))
+
+		var deadlineErr *DeadlineError
+		assert.ErrorAs(t, err, &deadlineErr)
+		assert.Equal(t, time.Second, deadlineErr.Reserve)
+		assert.LessOrEqual(t, deadlineErr.Remaining, 50*time.Millisecond)
+		assert.NoError(t, deadlineErr.Err)
+		assert.False(t, called)
+	})
+
+	t.Run("shortens the delay", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		callCount := 0
+		err := Do(ctx, func() error {
+			callCount++
+			return errTransient
+		},
+			WithMaxRetries(3),
+			WithBaseDelay(time.Minute),
+			WithMaxDelay(time.Minute),
+			WithDeadlineReserve(100*time.Millisecond),
+		)
+
+		var deadlineErr *DeadlineError
+		assert.ErrorAs(t, err, &deadlineErr)
+		assert.ErrorIs(t, err, errTransient, "the last error is wrapped")
+		assert.Less(t, time.Since(start), 300*time.Millisecond, "returns before the deadline")
+		assert.GreaterOrEqual(t, callCount, 1)
+	})
+
+	t.Run("deadline error is final for outer retries", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		outer := 0
+		err := Do(ctx, func() error {
+			outer++
+			return Do(ctx, func() error { return nil }, WithDeadlineReserve(time.Second))
+		}, WithMaxRetries(3), WithBaseDelay(time.Millisecond), WithRetryableError(IsRetryable))
+
+		var deadlineErr *DeadlineError
+		assert.ErrorAs(t, err, &deadlineErr)
+		assert.Equal(t, 1, outer)
+	})
+
+	t.Run("ignored without a deadline", func(t *testing.T) {
+		err := Do(context.Background(), func() error { return nil }, WithDeadlineReserve(time.Hour))
+		assert.NoError(t, err)
+	})
+}
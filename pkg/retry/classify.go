@@ -0,0 +1,204 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/aws/smithy-go"
+)
+
+// throttleCodes are the API error codes of throttled requests
+var throttleCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestThrottledException":              true,
+	"RequestThrottled":                       true,
+	"TooManyRequestsException":               true,
+	"ProvisionedThroughputExceededException": true,
+	"TransactionInProgressException":         true,
+	"RequestLimitExceeded":                   true,
+	"BandwidthLimitExceeded":                 true,
+	"LimitExceededException":                 true,
+	"SlowDown":                               true,
+	"PriorRequestNotComplete":                true,
+	"EC2ThrottledException":                  true,
+}
+
+// transientCodes are the API error codes of server side failures expected to
+// go away on their own
+var transientCodes = map[string]bool{
+	"RequestTimeout":              true,
+	"RequestTimeoutException":     true,
+	"InternalError":               true,
+	"InternalFailure":             true,
+	"InternalServerError":         true,
+	"InternalServiceError":        true,
+	"InternalServiceException":    true,
+	"ServiceUnavailable":          true,
+	"ServiceUnavailableException": true,
+	"IDPCommunicationError":       true,
+}
+
+// retryableStatusCodes are the HTTP status codes of retryable responses
+var retryableStatusCodes = map[int]bool{
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// Classifier decides if an error is retryable, ok is false when the classifier
+// has no opinion on err
+type Classifier func(err error) (retryable, ok bool)
+
+// IsRetryable checks if an error is transient and worth retrying
+//
+// Errors are classified from their type, through wrapping: cancellations, an
+// open circuit and SDK errors flagged as not retryable are final; throttling
+// and server side API error codes, 429 and 5xx responses, network timeouts and
+// reset or refused connections are retried. Anything else, client side API
+// errors included, is not.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// Give up on errors caused by the caller or by the breaker, context
+	// deadlines are net.Error timeouts and must be checked first
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+
+	// Errors classified by the SDK itself, e.g. clock skew
+	var flagged interface{ RetryableError() bool }
+	if errors.As(err, &flagged) {
+		return flagged.RetryableError()
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code := apiErr.ErrorCode()
+		if throttleCodes[code] || transientCodes[code] {
+			return true
+		}
+		if apiErr.ErrorFault() == smithy.FaultClient {
+			return false
+		}
+	}
+
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) && retryableStatusCodes[respErr.HTTPStatusCode()] {
+		return true
+	}
+
+	// The API error carries no known code or status, a server fault is transient
+	if apiErr != nil {
+		return apiErr.ErrorFault() == smithy.FaultServer
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// IsPermanent checks if an error is known to fail again when retried later
+//
+// Unlike !IsRetryable, errors of unknown type are not permanent: only errors
+// flagged as not retryable, client side API errors and 4xx responses are.
+// Cancellations and an open circuit are neither retryable nor permanent.
+func IsPermanent(err error) bool {
+	if err == nil || IsRetryable(err) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+
+	// IsRetryable gave up on it, the flag is false
+	var flagged interface{ RetryableError() bool }
+	if errors.As(err, &flagged) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorFault() == smithy.FaultClient {
+		return true
+	}
+
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		code := respErr.HTTPStatusCode()
+		return code >= 400 && code < 500
+	}
+	return false
+}
+
+// IsRetryableWith returns a predicate asking the classifiers in order, before
+// falling back to IsRetryable
+//
+// It is meant for WithRetryableError, to adapt the classification to an operation.
+func IsRetryableWith(classifiers ...Classifier) func(error) bool {
+	return func(err error) bool {
+		if err == nil {
+			return false
+		}
+		for _, classifier := range classifiers {
+			if retryable, ok := classifier(err); ok {
+				return retryable
+			}
+		}
+		return IsRetryable(err)
+	}
+}
+
+// RetryCodes returns a classifier retrying the API errors with one of the codes
+func RetryCodes(codes ...string) Classifier {
+	return codeClassifier(true, codes)
+}
+
+// NeverRetryCodes returns a classifier giving up on the API errors with one of the codes
+func NeverRetryCodes(codes ...string) Classifier {
+	return codeClassifier(false, codes)
+}
+
+func codeClassifier(retryable bool, codes []string) Classifier {
+	set := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		set[code] = true
+	}
+	return func(err error) (bool, bool) {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && set[apiErr.ErrorCode()] {
+			return retryable, true
+		}
+		return false, false
+	}
+}
+
+// RetryAs returns a classifier retrying the errors with an E in their chain
+func RetryAs[E error]() Classifier {
+	return func(err error) (bool, bool) {
+		var target E
+		if errors.As(err, &target) {
+			return true, true
+		}
+		return false, false
+	}
+}
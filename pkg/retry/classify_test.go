@@ -0,0 +1,159 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+)
+
+// operationError wraps err the way the SDK returns it from an API call
+func operationError(operation string, status int, err error) error {
+	return &smithy.OperationError{
+		ServiceID:     "S3",
+		OperationName: operation,
+		Err: &awshttp.ResponseError{
+			ResponseError: &smithyhttp.ResponseError{
+				Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+				Err:      err,
+			},
+			RequestID: "req-1",
+		},
+	}
+}
+
+func apiError(code string, fault smithy.ErrorFault) error {
+	return &smithy.GenericAPIError{Code: code, Message: "message", Fault: fault}
+}
+
+type sdkFlaggedError struct{ retryable bool }
+
+func (e sdkFlaggedError) Error() string        { return "flagged" }
+func (e sdkFlaggedError) RetryableError() bool { return e.retryable }
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"nil error", nil, false},
+
+		// API error codes
+		{"S3 SlowDown", operationError("PutObject", 503, apiError("SlowDown", smithy.FaultUnknown)), true},
+		{"S3 InternalError", operationError("GetObject", 500, apiError("InternalError", smithy.FaultUnknown)), true},
+		{"throttling", operationError("GetParameter", 400, apiError("ThrottlingException", smithy.FaultClient)), true},
+		{"Kinesis throughput", apiError("ProvisionedThroughputExceededException", smithy.FaultClient), true},
+		{"request limit", apiError("RequestLimitExceeded", smithy.FaultUnknown), true},
+		{"service unavailable", apiError("ServiceUnavailableException", smithy.FaultServer), true},
+		{"unknown server fault", apiError("SomethingBroke", smithy.FaultServer), true},
+		{"NoSuchKey", operationError("GetObject", 404, &s3types.NoSuchKey{Message: stringPtr("gone")}), false},
+		{"access denied", operationError("GetObject", 403, apiError("AccessDenied", smithy.FaultUnknown)), false},
+		{"validation", apiError("ValidationException", smithy.FaultClient), false},
+		{"client fault on 5xx", operationError("GetObject", 503, apiError("InvalidRequest", smithy.FaultClient)), false},
+
+		// HTTP status without a modeled error
+		{"bad gateway", operationError("GetObject", 502, errors.New("unexpected response")), true},
+		{"too many requests", operationError("GetObject", 429, errors.New("unexpected response")), true},
+		{"not found", operationError("HeadObject", 404, errors.New("not found")), false},
+		{"not implemented", operationError("GetObject", 501, errors.New("not implemented")), false},
+
+		// Network
+		{"dial refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{"connection reset", &url.Error{Op: "Get", URL: "https://s3", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}, true},
+		{"i/o timeout", &url.Error{Op: "Get", URL: "https://s3", Err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}}, true},
+		{"DNS timeout", &net.DNSError{Err: "timeout", Name: "s3", IsTimeout: true}, true},
+		{"unknown host", &net.DNSError{Err: "no such host", Name: "s3", IsNotFound: true}, false},
+		{"truncated body", fmt.Errorf("failed to read body: %w", io.ErrUnexpectedEOF), true},
+
+		// Context and breaker
+		{"canceled", &smithy.CanceledError{Err: context.Canceled}, false},
+		{"deadline", operationError("GetObject", 0, context.DeadlineExceeded), false},
+		{"circuit open", fmt.Errorf("s3: %w", ErrCircuitOpen), false},
+
+		// Flagged by the SDK
+		{"flagged retryable", fmt.Errorf("wrapped: %w", sdkFlaggedError{retryable: true}), true},
+		{"flagged not retryable", sdkFlaggedError{retryable: false}, false},
+
+		// Text is not classified
+		{"message mentioning a timeout", errors.New("invalid timeout parameter"), false},
+		{"plain error", errors.New("ServiceUnavailable"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, IsRetryable(tt.err))
+		})
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"nil error", nil, false},
+		{"NoSuchKey", operationError("GetObject", 404, &s3types.NoSuchKey{Message: stringPtr("gone")}), true},
+		{"access denied", operationError("GetObject", 403, apiError("AccessDenied", smithy.FaultUnknown)), true},
+		{"validation", apiError("ValidationException", smithy.FaultClient), true},
+		{"flagged not retryable", fmt.Errorf("wrapped: %w", sdkFlaggedError{retryable: false}), true},
+		{"throttling", operationError("GetParameter", 400, apiError("ThrottlingException", smithy.FaultClient)), false},
+		{"server fault", apiError("SomethingBroke", smithy.FaultServer), false},
+		{"not implemented", operationError("GetObject", 501, errors.New("not implemented")), false},
+		{"canceled", &smithy.CanceledError{Err: context.Canceled}, false},
+		{"circuit open", fmt.Errorf("s3: %w", ErrCircuitOpen), false},
+		{"unknown error", errors.New("partial failure"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, IsPermanent(tt.err))
+		})
+	}
+}
+
+type partialError struct{}
+
+func (partialError) Error() string { return "partial failure" }
+
+func TestIsRetryableWith(t *testing.T) {
+	retryable := IsRetryableWith(
+		NeverRetryCodes("SlowDown"),
+		RetryCodes("NoSuchKey"),
+		RetryAs[partialError](),
+	)
+
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"nil error", nil, false},
+		{"code overridden as final", operationError("PutObject", 503, apiError("SlowDown", smithy.FaultServer)), false},
+		{"code overridden as retryable", operationError("GetObject", 404, &s3types.NoSuchKey{}), true},
+		{"error type", fmt.Errorf("put: %w", partialError{}), true},
+		{"default classification", apiError("InternalError", smithy.FaultServer), true},
+		{"default final", apiError("AccessDenied", smithy.FaultClient), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, retryable(tt.err))
+		})
+	}
+}
+
+func stringPtr(s string) *string { return &s }
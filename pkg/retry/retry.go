@@ -2,6 +2,7 @@ package retry
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
@@ -18,6 +19,10 @@ type Config struct {
 	Multiplier     float64
 	Jitter         bool
 	RetryableError func(error) bool
+	Breaker        *CircuitBreaker
+	// DeadlineReserve is the time to leave before the context deadline when
+	// starting an attempt, zero disables the check
+	DeadlineReserve time.Duration
 }
 
 // DefaultConfig returns a default retry configuration
@@ -90,6 +95,11 @@ func Do(ctx context.Context, fn func() error, opts ...Option) error {
 }
 
 // DoWithConfig executes a function with retry logic using the provided configuration
+//
+// Retries draw from the Budget of the context, when there is one, and stop with
+// an ErrBudgetExhausted error once it is spent. With a deadline reserve, an
+// attempt is not started, and delays are shortened, so that the reserve is left
+// before the context deadline, a *DeadlineError is returned otherwise.
 func DoWithConfig(ctx context.Context, fn func() error, cfg *Config) error {
 	var lastErr error
 
@@ -101,7 +111,11 @@ func DoWithConfig(ctx context.Context, fn func() error, cfg *Config) error {
 		default:
 		}
 
-		err := fn()
+		if available, ok := cfg.timeAvailable(ctx); ok && available < 0 {
+			return cfg.deadlineError(available, lastErr)
+		}
+
+		err := cfg.call(fn)
 		if err == nil {
 			if attempt > 0 {
 				log.Ctx(ctx).Debug().
@@ -114,7 +128,7 @@ func DoWithConfig(ctx context.Context, fn func() error, cfg *Config) error {
 		lastErr = err
 
 		// Check if error is retryable
-		if !cfg.RetryableError(err) {
+		if isFinal(err) || !cfg.RetryableError(err) {
 			log.Ctx(ctx).Debug().
 				Err(err).
 				Msg("non-retryable error, giving up")
@@ -126,8 +140,23 @@ func DoWithConfig(ctx context.Context, fn func() error, cfg *Config) error {
 			break
 		}
 
+		if budget := BudgetFromContext(ctx); budget != nil && !budget.take() {
+			log.Ctx(ctx).Debug().
+				Err(err).
+				Msg("retry budget exhausted, giving up")
+			return fmt.Errorf("%w: %w", ErrBudgetExhausted, err)
+		}
+
 		delay := calculateDelay(attempt, cfg)
 
+		// Shorten the delay to leave the reserve for the next attempt
+		if available, ok := cfg.timeAvailable(ctx); ok {
+			if available <= 0 {
+				return cfg.deadlineError(available, err)
+			}
+			delay = min(delay, available)
+		}
+
 		log.Ctx(ctx).Debug().
 			Int("attempt", attempt).
 			Err(err).
@@ -154,59 +183,35 @@ func DoTyped[T any](ctx context.Context, fn func() (T, error), opts ...Option) (
 	}
 
 	var result T
-	var lastErr error
-
-	for attempt := 0; attempt <= cfg.MaxRetries; attempt++ {
-		// Check context before attempting
-		select {
-		case <-ctx.Done():
-			return result, fmt.Errorf("context cancelled: %w", ctx.Err())
-		default:
-		}
-
+	err := DoWithConfig(ctx, func() error {
 		res, err := fn()
-		if err == nil {
-			if attempt > 0 {
-				log.Ctx(ctx).Debug().
-					Int("attempt", attempt).
-					Msg("operation succeeded after retry")
-			}
-			return res, nil
-		}
-
-		lastErr = err
-
-		// Check if error is retryable
-		if !cfg.RetryableError(err) {
-			log.Ctx(ctx).Debug().
-				Err(err).
-				Msg("non-retryable error, giving up")
-			return result, err
-		}
-
-		// Don't sleep after the last attempt
-		if attempt == cfg.MaxRetries {
-			break
+		if err != nil {
+			return err
 		}
+		result = res
+		return nil
+	}, cfg)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
 
-		delay := calculateDelay(attempt, cfg)
+	return result, nil
+}
 
-		log.Ctx(ctx).Debug().
-			Int("attempt", attempt).
-			Err(err).
-			Dur("delay", delay).
-			Msg("operation failed, retrying")
+// isFinal reports errors of nested retries and breakers that must not be retried
+func isFinal(err error) bool {
+	var deadlineErr *DeadlineError
+	return errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrBudgetExhausted) ||
+		errors.As(err, &deadlineErr)
+}
 
-		// Sleep with context cancellation support
-		select {
-		case <-time.After(delay):
-			// Continue to next attempt
-		case <-ctx.Done():
-			return result, fmt.Errorf("context cancelled during retry: %w", ctx.Err())
-		}
+// call runs an attempt, through the circuit breaker when configured
+func (cfg *Config) call(fn func() error) error {
+	if cfg.Breaker == nil {
+		return fn()
 	}
-
-	return result, fmt.Errorf("operation failed after %d retries: %w", cfg.MaxRetries, lastErr)
+	return cfg.Breaker.Execute(fn)
 }
 
 // calculateDelay calculates the delay for the given attempt
@@ -228,57 +233,3 @@ func calculateDelay(attempt int, cfg *Config) time.Duration {
 
 	return time.Duration(delay)
 }
-
-// IsRetryable checks if an error should be retried based on common patterns
-func IsRetryable(err error) bool {
-	if err == nil {
-		return false
-	}
-
-	// Add common retryable error patterns here
-	// This is a simplified version - you may want to check for specific AWS errors
-	errStr := err.Error()
-
-	// Network and timeout errors
-	retryablePatterns := []string{
-		"timeout",
-		"connection refused",
-		"connection reset",
-		"no such host",
-		"temporary failure",
-		"TooManyRequests",
-		"RequestLimitExceeded",
-		"ServiceUnavailable",
-		"ThrottlingException",
-		"ProvisionedThroughputExceededException",
-		"TransactionInProgressException",
-		"RequestThrottled",
-	}
-
-	for _, pattern := range retryablePatterns {
-		if contains(errStr, pattern) {
-			return true
-		}
-	}
-
-	return false
-}
-
-func contains(s, substr string) bool {
-	return len(substr) > 0 && len(s) >= len(substr) &&
-		(s == substr ||
-			(len(s) > len(substr) && (s[:len(substr)] == substr || s[len(s)-len(substr):] == substr)) ||
-			containsMiddle(s, substr))
-}
-
-func containsMiddle(s, substr string) bool {
-	if len(s) <= len(substr) {
-		return false
-	}
-	for i := 1; i < len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
-		}
-	}
-	return false
-}
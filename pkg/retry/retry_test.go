@@ -213,52 +213,6 @@ func TestCalculateDelay(t *testing.T) {
 	})
 }
 
-func TestIsRetryable(t *testing.T) {
-	tests := []struct {
-		name     string
-		err      error
-		expected bool
-	}{
-		{
-			name:     "nil error",
-			err:      nil,
-			expected: false,
-		},
-		{
-			name:     "timeout error",
-			err:      errors.New("request timeout"),
-			expected: true,
-		},
-		{
-			name:     "connection refused",
-			err:      errors.New("connection refused"),
-			expected: true,
-		},
-		{
-			name:     "throttling error",
-			err:      errors.New("ThrottlingException: Rate exceeded"),
-			expected: true,
-		},
-		{
-			name:     "service unavailable",
-			err:      errors.New("ServiceUnavailable"),
-			expected: true,
-		},
-		{
-			name:     "non-retryable error",
-			err:      errors.New("invalid parameter"),
-			expected: false,
-		},
-	}
-	
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := IsRetryable(tt.err)
-			assert.Equal(t, tt.expected, result)
-		})
-	}
-}
-
 func TestDefaultConfig(t *testing.T) {
 	cfg := DefaultConfig()
 	
@@ -0,0 +1,75 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BadRecordPolicy tells what to do with a record that cannot be decoded or evaluated
+type BadRecordPolicy string
+
+const (
+	// BadRecordFail fails the whole file, the default
+	BadRecordFail BadRecordPolicy = "fail"
+	// BadRecordSkip drops the record
+	BadRecordSkip BadRecordPolicy = "skip"
+	// BadRecordKeep keeps the raw record unfiltered
+	BadRecordKeep BadRecordPolicy = "keep"
+)
+
+// ErrTooManyBadRecords is returned when a file has more bad records than allowed
+var ErrTooManyBadRecords = errors.New("too many bad records")
+
+// ParseBadRecordPolicy parses a policy name, an empty name is BadRecordFail
+func ParseBadRecordPolicy(name string) (BadRecordPolicy, error) {
+	switch policy := BadRecordPolicy(name); policy {
+	case "":
+		return BadRecordFail, nil
+	case BadRecordFail, BadRecordSkip, BadRecordKeep:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown bad record policy %q, expected fail, skip or keep", name)
+	}
+}
+
+// BadRecordError is the error of a record that cannot be decoded or evaluated
+type BadRecordError struct {
+	// Index of the record in the Records array of the file
+	Index int
+	Err   error
+}
+
+func (e *BadRecordError) Error() string {
+	return fmt.Sprintf("record %d: %v", e.Index, e.Err)
+}
+
+func (e *BadRecordError) Unwrap() error { return e.Err }
+
+// RetryableError tells the retry package that the record will not decode better
+func (e *BadRecordError) RetryableError() bool { return false }
+
+// BadRecords applies a BadRecordPolicy to the records of one file
+//
+// A zero Max allows any number of bad records with the skip and keep policies.
+type BadRecords struct {
+	Policy BadRecordPolicy
+	Max    int
+	// Indexes of the bad records skipped or kept, in the order they were handled
+	Indexes []int
+}
+
+// Handle records the bad record at index and tells if it must be kept
+//
+// The returned error fails the file: always with BadRecordFail, and with the
+// other policies once more than Max records are bad.
+func (b *BadRecords) Handle(index int, err error) (keep bool, _ error) {
+	if b.Policy != BadRecordSkip && b.Policy != BadRecordKeep {
+		return false, &BadRecordError{Index: index, Err: err}
+	}
+
+	b.Indexes = append(b.Indexes, index)
+	if b.Max > 0 && len(b.Indexes) > b.Max {
+		return false, fmt.Errorf("%w: more than %d in file: %w", ErrTooManyBadRecords, b.Max, &BadRecordError{Index: index, Err: err})
+	}
+	return b.Policy == BadRecordKeep, nil
+}
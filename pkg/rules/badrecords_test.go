@@ -0,0 +1,76 @@
+package rules_test
+
+import (
+	"ctlp/pkg/rules"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBadRecordPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    rules.BadRecordPolicy
+		wantErr bool
+	}{
+		{name: "", want: rules.BadRecordFail},
+		{name: "fail", want: rules.BadRecordFail},
+		{name: "skip", want: rules.BadRecordSkip},
+		{name: "keep", want: rules.BadRecordKeep},
+		{name: "drop", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := rules.ParseBadRecordPolicy(tt.name)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, policy)
+		})
+	}
+}
+
+func TestBadRecords(t *testing.T) {
+	recordErr := errors.New("unmarshal record failed")
+
+	t.Run("fail", func(t *testing.T) {
+		badRecords := &rules.BadRecords{Policy: rules.BadRecordFail}
+		_, err := badRecords.Handle(3, recordErr)
+
+		var badRecordErr *rules.BadRecordError
+		assert.ErrorAs(t, err, &badRecordErr)
+		assert.Equal(t, 3, badRecordErr.Index)
+		assert.ErrorIs(t, err, recordErr)
+		assert.EqualError(t, err, "record 3: unmarshal record failed")
+		assert.Empty(t, badRecords.Indexes)
+	})
+
+	t.Run("skip and keep", func(t *testing.T) {
+		for _, policy := range []rules.BadRecordPolicy{rules.BadRecordSkip, rules.BadRecordKeep} {
+			badRecords := &rules.BadRecords{Policy: policy}
+			for _, index := range []int{1, 4, 9} {
+				keep, err := badRecords.Handle(index, recordErr)
+				assert.NoError(t, err)
+				assert.Equal(t, policy == rules.BadRecordKeep, keep)
+			}
+			assert.Equal(t, []int{1, 4, 9}, badRecords.Indexes)
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		badRecords := &rules.BadRecords{Policy: rules.BadRecordSkip, Max: 2}
+		_, err := badRecords.Handle(0, recordErr)
+		assert.NoError(t, err)
+		_, err = badRecords.Handle(5, recordErr)
+		assert.NoError(t, err)
+
+		_, err = badRecords.Handle(7, recordErr)
+		assert.ErrorIs(t, err, rules.ErrTooManyBadRecords)
+		assert.ErrorIs(t, err, recordErr)
+		assert.EqualError(t, err, "too many bad records: more than 2 in file: record 7: unmarshal record failed")
+	})
+}
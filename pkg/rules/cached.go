@@ -5,17 +5,31 @@ import (
 	"fmt"
 	"regexp"
 	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
 // CachedConfiguration is an optimized version with pre-compiled regexes
+//
+// Protected is the protected event policy when the configuration was prepared,
+// see ProtectedEvents. Shadow holds the rules in RuleModeShadow, they are only
+// evaluated by EvalShadowRules.
 type CachedConfiguration struct {
-	Rules []*CachedRule
+	Version   string
+	Rules     []*CachedRule
+	Shadow    []*CachedRule
+	Protected []ProtectedEvent
 }
 
 // CachedRule contains pre-compiled regex patterns
+//
+// Expiry is zero when the rule does not expire.
 type CachedRule struct {
 	Name    string
 	Matches []*CachedMatch
+	Expiry  time.Time
+	RuleMetadata
 }
 
 // CachedMatch contains a pre-compiled regex
@@ -49,13 +63,31 @@ var regexCache = struct {
 // Thread safety: The returned CachedConfiguration is immutable and thread-safe
 func PrepareConfiguration(cfg *Configuration) (*CachedConfiguration, error) {
 	cachedCfg := &CachedConfiguration{
-		Rules: make([]*CachedRule, len(cfg.Rules)),
+		Version:   cfg.Version,
+		Rules:     make([]*CachedRule, 0, len(cfg.Rules)),
+		Protected: ProtectedEvents(),
 	}
 
-	for i, rule := range cfg.Rules {
+	now := time.Now()
+	for _, rule := range cfg.Rules {
+		if !rule.active(now) {
+			log.Info().
+				Str("rule", rule.Name).
+				Bool("enabled", rule.IsEnabled()).
+				Str("expires_at", rule.ExpiresAt).
+				Msg("skipping inactive rule")
+			continue
+		}
+
+		expiry, err := rule.Expiry()
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
 		cachedRule := &CachedRule{
-			Name:    rule.Name,
-			Matches: make([]*CachedMatch, len(rule.Matches)),
+			Name:         rule.Name,
+			Matches:      make([]*CachedMatch, len(rule.Matches)),
+			Expiry:       expiry,
+			RuleMetadata: rule.RuleMetadata,
 		}
 
 		for j, match := range rule.Matches {
@@ -70,7 +102,11 @@ func PrepareConfiguration(cfg *Configuration) (*CachedConfiguration, error) {
 			}
 		}
 
-		cachedCfg.Rules[i] = cachedRule
+		if rule.Mode == RuleModeShadow {
+			cachedCfg.Shadow = append(cachedCfg.Shadow, cachedRule)
+		} else {
+			cachedCfg.Rules = append(cachedCfg.Rules, cachedRule)
+		}
 	}
 
 	return cachedCfg, nil
@@ -109,6 +145,9 @@ func getOrCompileRegex(pattern string) (*regexp.Regexp, error) {
 // - First matching rule causes the event to be filtered (early exit optimization)
 // - Within a rule, ALL match conditions must be true (AND logic)
 // - Between rules, ANY rule match filters the event (OR logic)
+// - A protected event is never filtered, whatever the matching rule: the event
+//   is kept and the returned DropedEvent names the rule and the protected event
+// - A rule expiring after PrepareConfiguration is skipped from its expiry
 //
 // This function is optimized for the common case where events don't match rules:
 // - Early exit on first rule match reduces unnecessary evaluations
@@ -117,21 +156,75 @@ func getOrCompileRegex(pattern string) (*regexp.Regexp, error) {
 //
 // Returns:
 // - bool: true if event should be filtered out, false if it should be kept
-// - *DropedEvent: Contains the name of the matching rule (for logging/metrics)
+// - *DropedEvent: Contains the name of the matching rule (for logging/metrics),
+//   also set for a kept protected event
 // - error: Only on evaluation failure (not on non-match)
 func (cc *CachedConfiguration) EvalRules(evt map[string]any) (bool, *DropedEvent, error) {
+	var now time.Time
 	for _, rule := range cc.Rules {
+		if rule.expired(&now) {
+			continue
+		}
+
 		match, dropedEvent, err := rule.Eval(evt)
 		if err != nil {
 			return false, nil, err
 		}
 		if match {
+			// the policy is only checked for the events to drop
+			if pe, ok := cc.protectedEvent(evt); ok {
+				kept := *dropedEvent
+				kept.ProtectedEvent = pe.Name
+				return false, &kept, nil
+			}
 			return true, dropedEvent, nil
 		}
 	}
 	return false, nil, nil
 }
 
+// EvalShadowRules evaluates the shadow rules and returns the rules that would
+// drop the event
+//
+// Every shadow rule is evaluated, whatever the other rules. Shadow rules never
+// drop events, and a protected event is not reported as a would-be drop.
+func (cc *CachedConfiguration) EvalShadowRules(evt map[string]any) ([]*DropedEvent, error) {
+	var now time.Time
+	var drops []*DropedEvent
+	for _, rule := range cc.Shadow {
+		if rule.expired(&now) {
+			continue
+		}
+
+		match, dropedEvent, err := rule.Eval(evt)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			drops = append(drops, dropedEvent)
+		}
+	}
+
+	if len(drops) > 0 {
+		if _, ok := cc.protectedEvent(evt); ok {
+			return nil, nil
+		}
+	}
+	return drops, nil
+}
+
+// expired tells if the rule expired after PrepareConfiguration, now is read
+// once per evaluation
+func (cr *CachedRule) expired(now *time.Time) bool {
+	if cr.Expiry.IsZero() {
+		return false
+	}
+	if now.IsZero() {
+		*now = time.Now()
+	}
+	return !now.Before(cr.Expiry)
+}
+
 // Eval evaluates a rule using pre-compiled regexes
 func (cr *CachedRule) Eval(evt map[string]any) (bool, *DropedEvent, error) {
 	allMatch := true
@@ -158,7 +251,7 @@ func (cr *CachedRule) Eval(evt map[string]any) (bool, *DropedEvent, error) {
 	}
 
 	if allMatch {
-		dropEvent = DropedEvent{RuleName: cr.Name}
+		dropEvent = DropedEvent{RuleName: cr.Name, RuleMetadata: cr.RuleMetadata}
 	}
 
 	return allMatch, &dropEvent, nil
@@ -0,0 +1,175 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxIncludeDepth limits how deep includes can be nested
+const maxIncludeDepth = 8
+
+var (
+	// ErrIncludesNotSupported is returned when a configuration with includes is
+	// loaded from a source that cannot resolve them
+	ErrIncludesNotSupported = errors.New("configuration includes are not supported by this source")
+	// ErrIncludeCycle is returned when a configuration includes itself
+	ErrIncludeCycle = errors.New("configuration include cycle")
+	// ErrRuleCollision is returned by Merge with CollisionError when two layers
+	// define a rule with the same name
+	ErrRuleCollision = errors.New("rule name collision")
+)
+
+// CollisionPolicy tells what Merge does when a layer defines a rule already
+// defined by a layer below it
+type CollisionPolicy string
+
+const (
+	// CollisionOverride replaces the inherited rule, the default
+	CollisionOverride CollisionPolicy = "override"
+	// CollisionError fails the merge
+	CollisionError CollisionPolicy = "error"
+)
+
+// ParseCollisionPolicy parses a policy name, an empty name is CollisionOverride
+func ParseCollisionPolicy(name string) (CollisionPolicy, error) {
+	switch policy := CollisionPolicy(name); policy {
+	case "":
+		return CollisionOverride, nil
+	case CollisionOverride, CollisionError:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown collision policy %q, expected override or error", name)
+	}
+}
+
+// IncludeResolver reads the configuration included as ref by the configuration
+// named from, it returns the name of the included configuration, used to
+// resolve its own includes and to detect cycles
+type IncludeResolver func(ctx context.Context, from, ref string) (name, rawCfg string, err error)
+
+// FileIncludeResolver resolves includes as files, relative paths are relative to
+// the directory of the including file
+func FileIncludeResolver(_ context.Context, from, ref string) (string, string, error) {
+	name := ref
+	if !filepath.IsAbs(ref) {
+		name = filepath.Join(filepath.Dir(from), ref)
+	}
+	rawCfg, err := os.ReadFile(name)
+	if err != nil {
+		return "", "", fmt.Errorf("read included config failed: %w", err)
+	}
+	return filepath.Clean(name), string(rawCfg), nil
+}
+
+// LoadLayered loads the configuration named name with its includes
+//
+// The included configurations are merged in order, the including configuration
+// last: its rules override the included rules of the same name and its disable
+// list removes included rules. The version is the version of the including
+// configuration.
+func LoadLayered(ctx context.Context, name, rawCfg string, resolve IncludeResolver) (*Configuration, error) {
+	return loadLayer(ctx, name, rawCfg, resolve, []string{name})
+}
+
+// loadLayer loads one configuration of the include tree, stack holds the names
+// of the configurations including it
+func loadLayer(ctx context.Context, name, rawCfg string, resolve IncludeResolver, stack []string) (*Configuration, error) {
+	versionedCfg, err := LoadVersioned(rawCfg)
+	if err != nil {
+		return nil, fmt.Errorf("load versioned configuration failed: %w", err)
+	}
+
+	if err := versionedCfg.Validate(); err != nil {
+		return nil, fmt.Errorf("configuration validation failed: %w", err)
+	}
+
+	if len(versionedCfg.Include) == 0 {
+		return versionedCfg.ToConfiguration(), nil
+	}
+	if len(stack) > maxIncludeDepth {
+		return nil, fmt.Errorf("includes of %s nested deeper than %d", name, maxIncludeDepth)
+	}
+
+	layers := make([]*Configuration, 0, len(versionedCfg.Include)+1)
+	for _, ref := range versionedCfg.Include {
+		includedName, includedRaw, err := resolve(ctx, name, ref)
+		if err != nil {
+			return nil, fmt.Errorf("failed to include %s in %s: %w", ref, name, err)
+		}
+		if slices.Contains(stack, includedName) {
+			return nil, fmt.Errorf("%w: %s", ErrIncludeCycle, strings.Join(append(stack, includedName), " -> "))
+		}
+
+		log.Ctx(ctx).Debug().
+			Str("config", name).
+			Str("include", includedName).
+			Msg("including configuration")
+
+		layer, err := loadLayer(ctx, includedName, includedRaw, resolve, append(slices.Clip(stack), includedName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to include %s in %s: %w", ref, name, err)
+		}
+		layers = append(layers, layer)
+	}
+	layers = append(layers, versionedCfg.ToConfiguration())
+
+	return Merge(ctx, CollisionOverride, layers...)
+}
+
+// Merge merges configuration layers, from the lowest to the highest precedence
+//
+// Each layer first removes the inherited rules named in its Disable list, then
+// adds its rules: a rule named like an inherited rule replaces it in place with
+// CollisionOverride, and fails the merge with CollisionError. A layer can
+// disable a rule and define it again to replace it under CollisionError.
+//
+// The merged configuration has the version of the last layer with a version and
+// the Disable lists of all layers, to be applied when it is merged again.
+func Merge(ctx context.Context, policy CollisionPolicy, layers ...*Configuration) (*Configuration, error) {
+	merged := &Configuration{}
+	index := make(map[string]int)
+
+	for _, layer := range layers {
+		for _, name := range layer.Disable {
+			i, ok := index[name]
+			if !ok {
+				log.Ctx(ctx).Warn().
+					Str("rule", name).
+					Str("version", layer.Version).
+					Msg("disabled rule is not inherited")
+				continue
+			}
+			merged.Rules = slices.Delete(merged.Rules, i, i+1)
+			delete(index, name)
+			for j, rule := range merged.Rules[i:] {
+				index[rule.Name] = i + j
+			}
+		}
+
+		for _, rule := range layer.Rules {
+			if i, ok := index[rule.Name]; ok {
+				if policy == CollisionError {
+					return nil, fmt.Errorf("%w: %s", ErrRuleCollision, rule.Name)
+				}
+				merged.Rules[i] = rule
+				continue
+			}
+			index[rule.Name] = len(merged.Rules)
+			merged.Rules = append(merged.Rules, rule)
+		}
+
+		if layer.Version != "" {
+			merged.Version = layer.Version
+		}
+		merged.Disable = append(merged.Disable, layer.Disable...)
+	}
+
+	return merged, nil
+}
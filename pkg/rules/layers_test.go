@@ -0,0 +1,160 @@
+package rules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rule(name, regex string) *Rule {
+	return &Rule{Name: name, Matches: []*Match{{FieldName: "eventName", Regex: regex}}}
+}
+
+func writeConfig(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseCollisionPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    CollisionPolicy
+		wantErr bool
+	}{
+		{"", CollisionOverride, false},
+		{"override", CollisionOverride, false},
+		{"error", CollisionError, false},
+		{"merge", "", true},
+	}
+	for _, tt := range tests {
+		policy, err := ParseCollisionPolicy(tt.name)
+		assert.Equal(t, tt.want, policy)
+		assert.Equal(t, tt.wantErr, err != nil)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	base := &Configuration{Version: "1.0.0", Rules: []*Rule{rule("A", "^A$"), rule("B", "^B$"), rule("C", "^C$")}}
+
+	t.Run("override in place", func(t *testing.T) {
+		cfg, err := Merge(ctx, CollisionOverride, base, &Configuration{
+			Version: "1.1.0",
+			Rules:   []*Rule{rule("B", "^B2$"), rule("D", "^D$")},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "1.1.0", cfg.Version)
+		assert.Len(t, cfg.Rules, 4)
+		assert.Equal(t, "^B2$", cfg.Rules[1].Matches[0].Regex)
+		assert.Equal(t, "D", cfg.Rules[3].Name)
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		cfg, err := Merge(ctx, CollisionOverride, base, &Configuration{Disable: []string{"A", "Unknown"}})
+		assert.NoError(t, err)
+		assert.Equal(t, "1.0.0", cfg.Version)
+		assert.Len(t, cfg.Rules, 2)
+		assert.Equal(t, "B", cfg.Rules[0].Name)
+
+		// the index is updated after a removal
+		cfg, err = Merge(ctx, CollisionOverride, base,
+			&Configuration{Disable: []string{"A"}},
+			&Configuration{Rules: []*Rule{rule("C", "^C2$")}})
+		assert.NoError(t, err)
+		assert.Len(t, cfg.Rules, 2)
+		assert.Equal(t, "^C2$", cfg.Rules[1].Matches[0].Regex)
+	})
+
+	t.Run("collision error", func(t *testing.T) {
+		_, err := Merge(ctx, CollisionError, base, &Configuration{Rules: []*Rule{rule("B", "^B2$")}})
+		assert.ErrorIs(t, err, ErrRuleCollision)
+
+		// disabling the inherited rule first replaces it
+		cfg, err := Merge(ctx, CollisionError, base, &Configuration{
+			Disable: []string{"B"},
+			Rules:   []*Rule{rule("B", "^B2$")},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "B", cfg.Rules[2].Name)
+	})
+}
+
+func TestLoadLayered(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("includes", func(t *testing.T) {
+		dir := t.TempDir()
+		writeConfig(t, dir, "base/org.yaml", `version: 1.0.0
+rules:
+  - name: Drop Describe
+    matches:
+      - field_name: eventName
+        regex: "^Describe.*$"
+  - name: Drop KMS
+    matches:
+      - field_name: eventSource
+        regex: "kms.amazonaws.com"`)
+		writeConfig(t, dir, "base/security.yaml", `version: 1.0.0
+include:
+  - org.yaml
+rules:
+  - name: Drop STS
+    matches:
+      - field_name: eventSource
+        regex: "sts.amazonaws.com"`)
+		path := writeConfig(t, dir, "accounts/123.yaml", `version: 3.0.0
+include:
+  - ../base/security.yaml
+disable:
+  - Drop KMS
+rules:
+  - name: Drop Describe
+    matches:
+      - field_name: eventName
+        regex: "^DescribeInstances$"`)
+
+		cfg, err := LoadFromConfigFile(ctx, path)
+		assert.NoError(t, err)
+		assert.Equal(t, "3.0.0", cfg.Version)
+		assert.Len(t, cfg.Rules, 2)
+		assert.Equal(t, "Drop Describe", cfg.Rules[0].Name)
+		assert.Equal(t, "^DescribeInstances$", cfg.Rules[0].Matches[0].Regex)
+		assert.Equal(t, "Drop STS", cfg.Rules[1].Name)
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		dir := t.TempDir()
+		writeConfig(t, dir, "a.yaml", "version: 1.0.0\ninclude:\n  - b.yaml\n")
+		path := writeConfig(t, dir, "b.yaml", "version: 1.0.0\ninclude:\n  - a.yaml\n")
+
+		_, err := LoadFromConfigFile(ctx, path)
+		assert.ErrorIs(t, err, ErrIncludeCycle)
+	})
+
+	t.Run("missing include", func(t *testing.T) {
+		path := writeConfig(t, t.TempDir(), "a.yaml", "version: 1.0.0\ninclude:\n  - missing.yaml\n")
+
+		_, err := LoadFromConfigFile(ctx, path)
+		assert.ErrorContains(t, err, "missing.yaml")
+	})
+
+	t.Run("not supported by Load", func(t *testing.T) {
+		_, err := Load("version: 1.0.0\ninclude:\n  - base.yaml\n")
+		assert.ErrorIs(t, err, ErrIncludesNotSupported)
+	})
+
+	t.Run("empty configuration", func(t *testing.T) {
+		_, err := Load("version: 1.0.0\n")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,74 @@
+package rules
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// RuleMetadata records who added a rule and why
+//
+// ExpiresAt is a RFC 3339 time or a date, a date expires at the end of the day
+// (UTC).
+type RuleMetadata struct {
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+	Owner       string `yaml:"owner,omitempty" json:"owner,omitempty"`
+	Ticket      string `yaml:"ticket,omitempty" json:"ticket,omitempty"`
+	ExpiresAt   string `yaml:"expires_at,omitempty" json:"expires_at,omitempty" validate:"omitempty,is-expiry"`
+}
+
+// Expiry returns the time the rule expires, zero when it does not expire
+func (m RuleMetadata) Expiry() (time.Time, error) {
+	if m.ExpiresAt == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, m.ExpiresAt); err == nil {
+		return t, nil
+	}
+	day, err := time.Parse(time.DateOnly, m.ExpiresAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expires_at %q: expected RFC 3339 time or date", m.ExpiresAt)
+	}
+	return day.AddDate(0, 0, 1), nil
+}
+
+// Expired tells if the rule expired at now, an invalid expiry never expires
+// and is reported by Validate
+func (m RuleMetadata) Expired(now time.Time) bool {
+	expiry, err := m.Expiry()
+	return err == nil && !expiry.IsZero() && !now.Before(expiry)
+}
+
+// IsEnabled tells if the rule is enabled, rules are enabled by default
+func (r *Rule) IsEnabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// active tells if the rule is enabled and not expired at now
+func (r *Rule) active(now time.Time) bool {
+	return r.IsEnabled() && !r.Expired(now)
+}
+
+// ValidateExpiry implements validator.Func for RuleMetadata.ExpiresAt
+func ValidateExpiry(fl validator.FieldLevel) bool {
+	_, err := RuleMetadata{ExpiresAt: fl.Field().String()}.Expiry()
+	return err == nil
+}
+
+// warnExpiredRules logs the expired rules, they are skipped by
+// PrepareConfiguration
+func (vc *VersionedConfiguration) warnExpiredRules(now time.Time) {
+	for i, rule := range vc.Rules {
+		if rule.IsEnabled() && rule.Expired(now) {
+			log.Warn().
+				Str("field", fmt.Sprintf("rules[%d].expires_at", i)).
+				Str("rule", rule.Name).
+				Str("expires_at", rule.ExpiresAt).
+				Str("owner", rule.Owner).
+				Str("ticket", rule.Ticket).
+				Msg("rule expired, it is skipped")
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleMetadataExpiry(t *testing.T) {
+	tests := []struct {
+		expiresAt string
+		want      time.Time
+		wantErr   bool
+	}{
+		{"", time.Time{}, false},
+		{"2026-03-01T12:00:00Z", time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), false},
+		{"2026-03-01", time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), false},
+		{"next week", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expiresAt, func(t *testing.T) {
+			expiry, err := RuleMetadata{ExpiresAt: tt.expiresAt}.Expiry()
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.True(t, tt.want.Equal(expiry))
+		})
+	}
+
+	day := RuleMetadata{ExpiresAt: "2026-03-01"}
+	assert.False(t, day.Expired(time.Date(2026, 3, 1, 23, 59, 0, 0, time.UTC)))
+	assert.True(t, day.Expired(time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)))
+	assert.False(t, RuleMetadata{}.Expired(time.Now()))
+}
+
+func TestInactiveRules(t *testing.T) {
+	disabled := false
+	yesterday := time.Now().AddDate(0, 0, -1).Format(time.DateOnly)
+	tomorrow := time.Now().AddDate(0, 0, 1).Format(time.DateOnly)
+
+	cfg, err := Load(`version: 1.0.0
+rules:
+  - name: Drop Describe
+    description: Read-only noise
+    owner: platform-team
+    ticket: SEC-123
+    expires_at: ` + tomorrow + `
+    matches:
+      - field_name: eventName
+        regex: "^Describe.*$"
+  - name: Drop KMS
+    enabled: false
+    matches:
+      - field_name: eventSource
+        regex: "kms.amazonaws.com"
+  - name: Drop STS
+    expires_at: ` + yesterday + `
+    matches:
+      - field_name: eventSource
+        regex: "sts.amazonaws.com"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &disabled, cfg.Rules[1].Enabled)
+
+	t.Run("skipped by PrepareConfiguration", func(t *testing.T) {
+		cachedCfg, err := PrepareConfiguration(cfg)
+		assert.NoError(t, err)
+		assert.Len(t, cachedCfg.Rules, 1)
+
+		match, dropEvent, err := cachedCfg.EvalRules(map[string]any{"eventName": "DescribeInstances"})
+		assert.NoError(t, err)
+		assert.True(t, match)
+		assert.Equal(t, RuleMetadata{
+			Description: "Read-only noise",
+			Owner:       "platform-team",
+			Ticket:      "SEC-123",
+			ExpiresAt:   tomorrow,
+		}, dropEvent.RuleMetadata)
+
+		match, _, err = cachedCfg.EvalRules(map[string]any{"eventSource": "kms.amazonaws.com"})
+		assert.NoError(t, err)
+		assert.False(t, match)
+	})
+
+	t.Run("expires after PrepareConfiguration", func(t *testing.T) {
+		cachedCfg, err := PrepareConfiguration(cfg)
+		assert.NoError(t, err)
+		cachedCfg.Rules[0].Expiry = time.Now().Add(-time.Second)
+
+		match, _, err := cachedCfg.EvalRules(map[string]any{"eventName": "DescribeInstances"})
+		assert.NoError(t, err)
+		assert.False(t, match)
+	})
+
+	t.Run("dry run report", func(t *testing.T) {
+		vc := &VersionedConfiguration{Version: cfg.Version, Rules: cfg.Rules}
+		result, err := vc.DryRun([]map[string]any{
+			{"eventName": "DescribeInstances"},
+			{"eventSource": "sts.amazonaws.com"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.FilteredCount)
+		assert.Equal(t, "SEC-123", result.Rules["Drop Describe"].Ticket)
+		assert.Equal(t, []string{"Drop KMS", "Drop STS"}, result.Skipped)
+	})
+
+	t.Run("invalid expiry", func(t *testing.T) {
+		_, err := Load(`version: 1.0.0
+rules:
+  - name: Drop Describe
+    expires_at: soon
+    matches:
+      - field_name: eventName
+        regex: "^Describe.*$"`)
+		assert.Error(t, err)
+	})
+}
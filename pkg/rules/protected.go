@@ -0,0 +1,146 @@
+package rules
+
+import (
+	"ctlp/pkg/utils"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ProtectedEvent is an event that no rule may drop, e.g. the events disabling
+// the logging or the detection of an attacker
+//
+// An event is protected when each field of Fields has one of the listed values.
+type ProtectedEvent struct {
+	Name   string
+	Fields map[string][]string
+}
+
+// protectedEvents is the built-in protected event policy
+var protectedEvents = []ProtectedEvent{
+	{
+		Name: "CloudTrail logging changes",
+		Fields: map[string][]string{
+			"eventSource": {"cloudtrail.amazonaws.com"},
+			"eventName": {
+				"StopLogging", "DeleteTrail", "UpdateTrail", "PutEventSelectors", "PutInsightSelectors",
+				"DeleteEventDataStore", "StopEventDataStoreIngestion",
+			},
+		},
+	},
+	{
+		Name: "MFA device deactivation",
+		Fields: map[string][]string{
+			"eventSource": {"iam.amazonaws.com"},
+			"eventName":   {"DeactivateMFADevice", "DeleteVirtualMFADevice"},
+		},
+	},
+	{
+		Name: "Root console login",
+		Fields: map[string][]string{
+			"eventSource":       {"signin.amazonaws.com"},
+			"eventName":         {"ConsoleLogin"},
+			"userIdentity.type": {"Root"},
+		},
+	},
+	{
+		Name: "GuardDuty detector changes",
+		Fields: map[string][]string{
+			"eventSource": {"guardduty.amazonaws.com"},
+			"eventName":   {"DeleteDetector", "DisassociateFromMasterAccount", "DisassociateFromAdministratorAccount"},
+		},
+	},
+	{
+		Name: "Config recorder changes",
+		Fields: map[string][]string{
+			"eventSource": {"config.amazonaws.com"},
+			"eventName":   {"StopConfigurationRecorder", "DeleteConfigurationRecorder", "DeleteDeliveryChannel"},
+		},
+	},
+}
+
+// allowDropProtected disables the protected event policy
+var allowDropProtected atomic.Bool
+
+// AllowDropProtectedEvents disables the protected event policy of the
+// configurations prepared afterwards, rules may then drop any event
+func AllowDropProtectedEvents(allow bool) {
+	allowDropProtected.Store(allow)
+}
+
+// ProtectedEvents returns the protected event policy, empty when dropping
+// protected events is allowed
+func ProtectedEvents() []ProtectedEvent {
+	if allowDropProtected.Load() {
+		return nil
+	}
+	return protectedEvents
+}
+
+// Match tells if evt is a protected event
+func (pe ProtectedEvent) Match(evt map[string]any) bool {
+	for field, values := range pe.Fields {
+		exists, v := utils.FieldExists(field, evt)
+		if !exists {
+			return false
+		}
+		value, ok := v.(string)
+		if !ok || !slices.Contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// mayMatch tells if rule may drop the protected event, the matches of the rule
+// on other fields are assumed to match
+func (pe ProtectedEvent) mayMatch(rule *Rule) bool {
+	for _, match := range rule.Matches {
+		values, ok := pe.Fields[match.FieldName]
+		if !ok {
+			continue
+		}
+		re, err := regexp.Compile(match.Regex)
+		if err != nil || !slices.ContainsFunc(values, re.MatchString) {
+			return false
+		}
+	}
+	return true
+}
+
+// protectedEvent returns the protected event matching evt, if any
+func (cc *CachedConfiguration) protectedEvent(evt map[string]any) (ProtectedEvent, bool) {
+	for _, pe := range cc.Protected {
+		if pe.Match(evt) {
+			return pe, true
+		}
+	}
+	return ProtectedEvent{}, false
+}
+
+// warnProtectedEvents logs the rules that may match a protected event, these
+// events are kept whatever the rules
+func (vc *VersionedConfiguration) warnProtectedEvents(now time.Time) {
+	for i, rule := range vc.Rules {
+		if !rule.active(now) {
+			continue
+		}
+		var names []string
+		for _, pe := range ProtectedEvents() {
+			if pe.mayMatch(rule) {
+				names = append(names, pe.Name)
+			}
+		}
+		if len(names) > 0 {
+			log.Warn().
+				Str("field", fmt.Sprintf("rules[%d]", i)).
+				Str("rule", rule.Name).
+				Strs("protected_events", names).
+				Msg("rule may match protected events, protected events are never dropped")
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProtectedEvents(t *testing.T) {
+	rules := []*Rule{
+		{Name: "Drop CloudTrail", Matches: []*Match{{FieldName: "eventSource", Regex: "^cloudtrail.amazonaws.com$"}}},
+		{Name: "Drop Console Logins", Matches: []*Match{{FieldName: "eventName", Regex: "^ConsoleLogin$"}}},
+	}
+	cfg, err := PrepareConfiguration(&Configuration{Version: "1.0.0", Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		evt   map[string]any
+		match bool
+	}{
+		{"protected", map[string]any{"eventSource": "cloudtrail.amazonaws.com", "eventName": "StopLogging"}, false},
+		{"not protected", map[string]any{"eventSource": "cloudtrail.amazonaws.com", "eventName": "LookupEvents"}, true},
+		{"root login", map[string]any{
+			"eventSource":  "signin.amazonaws.com",
+			"eventName":    "ConsoleLogin",
+			"userIdentity": map[string]any{"type": "Root"},
+		}, false},
+		{"user login", map[string]any{
+			"eventSource":  "signin.amazonaws.com",
+			"eventName":    "ConsoleLogin",
+			"userIdentity": map[string]any{"type": "IAMUser"},
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, _, err := cfg.EvalRules(tt.evt)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.match, match)
+		})
+	}
+
+	t.Run("kept event names the rule", func(t *testing.T) {
+		match, dropEvent, err := cfg.EvalRules(tests[0].evt)
+		assert.NoError(t, err)
+		assert.False(t, match)
+		assert.Equal(t, "Drop CloudTrail", dropEvent.RuleName)
+		assert.Equal(t, "CloudTrail logging changes", dropEvent.ProtectedEvent)
+	})
+
+	t.Run("allowed by flag", func(t *testing.T) {
+		AllowDropProtectedEvents(true)
+		t.Cleanup(func() { AllowDropProtectedEvents(false) })
+
+		allowed, err := PrepareConfiguration(&Configuration{Version: "1.0.0", Rules: rules})
+		assert.NoError(t, err)
+		assert.Empty(t, allowed.Protected)
+		match, dropEvent, err := allowed.EvalRules(tests[0].evt)
+		assert.NoError(t, err)
+		assert.True(t, match)
+		assert.Equal(t, "Drop CloudTrail", dropEvent.RuleName)
+
+		// configurations prepared before keep their policy
+		match, _, err = cfg.EvalRules(tests[0].evt)
+		assert.NoError(t, err)
+		assert.False(t, match)
+	})
+}
+
+func TestProtectedEventMayMatch(t *testing.T) {
+	cloudtrail := protectedEvents[0]
+
+	tests := []struct {
+		name    string
+		matches []*Match
+		want    bool
+	}{
+		{"event name", []*Match{{FieldName: "eventName", Regex: "^Stop.*$"}}, true},
+		{"event source and name", []*Match{
+			{FieldName: "eventSource", Regex: "cloudtrail"},
+			{FieldName: "eventName", Regex: "^(Delete|Update)Trail$"},
+		}, true},
+		{"other field", []*Match{{FieldName: "awsRegion", Regex: "^us-east-1$"}}, true},
+		{"other event name", []*Match{{FieldName: "eventName", Regex: "^Describe.*$"}}, false},
+		{"other event source", []*Match{
+			{FieldName: "eventSource", Regex: "^s3.amazonaws.com$"},
+			{FieldName: "eventName", Regex: "^Stop.*$"},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, cloudtrail.mayMatch(&Rule{Name: tt.name, Matches: tt.matches}))
+		})
+	}
+}
@@ -6,22 +6,44 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/rs/zerolog/log"
 )
 
 // Configuration configuration containing our rules which are used to filter events
+//
+// Disable names the rules removed from the layers below this one when it is
+// merged, see Merge.
 type Configuration struct {
-	Rules []*Rule `yaml:"rules" validate:"required,dive"`
+	Version string   `yaml:"version,omitempty"`
+	Rules   []*Rule  `yaml:"rules" validate:"required_without=Disable,dive"`
+	Disable []string `yaml:"disable,omitempty" validate:"dive,required"`
 }
 
 // Rule rule with a name, and one or more matches
+//
+// A rule is enabled unless Enabled is false, disabled and expired rules are
+// skipped by PrepareConfiguration. A rule in RuleModeShadow never drops events.
 type Rule struct {
-	Name    string   `yaml:"name" validate:"required"`
-	Matches []*Match `yaml:"matches" validate:"required,dive"`
+	Name         string `yaml:"name" validate:"required"`
+	RuleMetadata `yaml:",inline"`
+	Enabled      *bool    `yaml:"enabled,omitempty"`
+	Mode         RuleMode `yaml:"mode,omitempty" validate:"omitempty,oneof=enforce shadow"`
+	Matches      []*Match `yaml:"matches" validate:"required,dive"`
 }
 
+// RuleMode tells if a rule drops the events it matches
+type RuleMode string
+
+const (
+	// RuleModeEnforce drops the matching events, the default
+	RuleModeEnforce RuleMode = "enforce"
+	// RuleModeShadow only counts and logs the events the rule would drop
+	RuleModeShadow RuleMode = "shadow"
+)
+
 // Match match containing the field to be checked and the REGEX used to match
 //
 //	FieldName string `yaml:"field_name" validate:"required,oneof=eventName eventSource awsRegion recipientAccountId"`
@@ -32,9 +54,16 @@ type Match struct {
 
 type DropedEvent struct {
 	RuleName string `json:"rule_name"`
+	RuleMetadata
+	// ProtectedEvent is the protected event policy that kept the event, the
+	// event is not dropped when it is set
+	ProtectedEvent string `json:"protected_event,omitempty"`
 }
 
 // Load load the configuration from the provided string (uses versioned configuration)
+//
+// A configuration with includes is rejected with ErrIncludesNotSupported, it
+// must be loaded with LoadLayered.
 func Load(rawCfg string) (*Configuration, error) {
 	// Load as versioned configuration
 	versionedCfg, err := LoadVersioned(rawCfg)
@@ -43,6 +72,10 @@ func Load(rawCfg string) (*Configuration, error) {
 		return nil, err
 	}
 
+	if len(versionedCfg.Include) > 0 {
+		return nil, ErrIncludesNotSupported
+	}
+
 	// Validate the versioned configuration
 	if err := versionedCfg.Validate(); err != nil {
 		return nil, fmt.Errorf("configuration validation failed: %w", err)
@@ -52,7 +85,8 @@ func Load(rawCfg string) (*Configuration, error) {
 	return versionedCfg.ToConfiguration(), nil
 }
 
-// LoadFromConfigFile load the configuration from yaml file and validate it
+// LoadFromConfigFile load the configuration from yaml file and validate it,
+// includes are read relative to the file
 func LoadFromConfigFile(ctx context.Context, path string) (*Configuration, error) {
 	rawCfg, err := os.ReadFile(path)
 	if err != nil {
@@ -60,19 +94,7 @@ func LoadFromConfigFile(ctx context.Context, path string) (*Configuration, error
 		return nil, fmt.Errorf("read config from file failed: %w", err)
 	}
 
-	// Load as versioned configuration
-	versionedCfg, err := LoadVersioned(string(rawCfg))
-	if err != nil {
-		return nil, fmt.Errorf("load versioned configuration failed: %w", err)
-	}
-
-	// Validate the versioned configuration
-	if err := versionedCfg.Validate(); err != nil {
-		return nil, fmt.Errorf("configuration validation failed: %w", err)
-	}
-
-	// Convert to Configuration for compatibility
-	return versionedCfg.ToConfiguration(), nil
+	return LoadLayered(ctx, path, string(rawCfg), FileIncludeResolver)
 }
 
 // Validate validate the configuration rules
@@ -83,6 +105,9 @@ func (cr *Configuration) Validate() error {
 	if err != nil {
 		return err
 	}
+	if err := validate.RegisterValidation("is-expiry", ValidateExpiry); err != nil {
+		return err
+	}
 
 	return validate.Struct(cr)
 }
@@ -144,13 +169,29 @@ func containsReDoSPattern(pattern string) bool {
 }
 
 // EvalRules iterate over all rules and return a match if one evaluates to true
+//
+// It follows CachedConfiguration.EvalRules: shadow, disabled and expired rules
+// are skipped, and a protected event is kept with the DropedEvent naming the
+// rule and the protected event
 func (cr *Configuration) EvalRules(evt map[string]any) (bool, *DropedEvent, error) {
+	now := time.Now()
 	for _, rule := range cr.Rules {
+		if rule.Mode == RuleModeShadow || !rule.active(now) {
+			continue
+		}
+
 		match, dropedEvent, err := rule.Eval(evt)
 		if err != nil {
 			return false, nil, err
 		}
 		if match {
+			for _, pe := range ProtectedEvents() {
+				if pe.Match(evt) {
+					kept := *dropedEvent
+					kept.ProtectedEvent = pe.Name
+					return false, &kept, nil
+				}
+			}
 			return true, dropedEvent, nil
 		}
 	}
@@ -187,7 +228,7 @@ func (mc *Rule) Eval(evt map[string]any) (bool, *DropedEvent, error) {
 
 	// if the event is dropped we return the drop event for logging
 	if b {
-		dropEvent = DropedEvent{RuleName: mc.Name}
+		dropEvent = DropedEvent{RuleName: mc.Name, RuleMetadata: mc.RuleMetadata}
 	}
 
 	return b, &dropEvent, nil
@@ -109,6 +109,61 @@ func TestEvalRules(t *testing.T) {
 	assert.NotEqual(t, nil, droped2.RuleName)
 }
 
+func TestConfigurationEvalRules(t *testing.T) {
+	cfg, err := rules.Load(`version: 1.0.0
+rules:
+  - name: Shadow STS
+    mode: shadow
+    matches:
+      - field_name: eventSource
+        regex: "^sts.amazonaws.com$"
+  - name: Disabled STS
+    enabled: false
+    matches:
+      - field_name: eventSource
+        regex: "^sts.amazonaws.com$"
+  - name: Expired STS
+    expires_at: "2020-01-01"
+    matches:
+      - field_name: eventSource
+        regex: "^sts.amazonaws.com$"
+  - name: Drop CloudTrail
+    matches:
+      - field_name: eventSource
+        regex: "^cloudtrail.amazonaws.com$"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("inactive and shadow rules are skipped", func(t *testing.T) {
+		match, dropEvent, err := cfg.EvalRules(testEvent)
+		assert.NoError(t, err)
+		assert.False(t, match)
+		assert.Nil(t, dropEvent)
+	})
+
+	t.Run("protected events are kept", func(t *testing.T) {
+		match, dropEvent, err := cfg.EvalRules(map[string]any{
+			"eventSource": "cloudtrail.amazonaws.com",
+			"eventName":   "StopLogging",
+		})
+		assert.NoError(t, err)
+		assert.False(t, match)
+		if assert.NotNil(t, dropEvent) {
+			assert.Equal(t, "Drop CloudTrail", dropEvent.RuleName)
+			assert.NotEmpty(t, dropEvent.ProtectedEvent)
+		}
+
+		match, dropEvent, err = cfg.EvalRules(map[string]any{
+			"eventSource": "cloudtrail.amazonaws.com",
+			"eventName":   "LookupEvents",
+		})
+		assert.NoError(t, err)
+		assert.True(t, match)
+		assert.Equal(t, "Drop CloudTrail", dropEvent.RuleName)
+	})
+}
+
 func TestEvalRuleComplexField(t *testing.T) {
 	assert := assert.New(t)
 	ctr, _ := rules.Load(yamlConfig)
@@ -147,3 +202,67 @@ func TestEvalRuleWith1NoMatch(t *testing.T) {
 	// Event is dropped rule name must be empty
 	assert.Equal("", droped.RuleName)
 }
+
+func TestShadowRules(t *testing.T) {
+	cfg, err := rules.Load(`version: 1.0.0
+rules:
+  - name: Shadow STS
+    mode: shadow
+    owner: security-team
+    matches:
+      - field_name: eventSource
+        regex: "^(sts|cloudtrail).amazonaws.com$"
+  - name: Drop KMS
+    mode: enforce
+    matches:
+      - field_name: eventSource
+        regex: "kms.amazonaws.com"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cachedCfg, err := rules.PrepareConfiguration(cfg)
+	assert.NoError(t, err)
+	assert.Len(t, cachedCfg.Rules, 1)
+	assert.Len(t, cachedCfg.Shadow, 1)
+
+	t.Run("never drops", func(t *testing.T) {
+		match, _, err := cachedCfg.EvalRules(testEvent)
+		assert.NoError(t, err)
+		assert.False(t, match)
+
+		shadowDrops, err := cachedCfg.EvalShadowRules(testEvent)
+		assert.NoError(t, err)
+		assert.Len(t, shadowDrops, 1)
+		assert.Equal(t, "Shadow STS", shadowDrops[0].RuleName)
+		assert.Equal(t, "security-team", shadowDrops[0].Owner)
+	})
+
+	t.Run("protected event", func(t *testing.T) {
+		shadowDrops, err := cachedCfg.EvalShadowRules(map[string]any{
+			"eventSource": "cloudtrail.amazonaws.com",
+			"eventName":   "StopLogging",
+		})
+		assert.NoError(t, err)
+		assert.Empty(t, shadowDrops)
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		vc := &rules.VersionedConfiguration{Version: cfg.Version, Rules: cfg.Rules}
+		result, err := vc.DryRun([]map[string]any{testEvent})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, result.FilteredCount)
+		assert.Equal(t, map[string]int{"Shadow STS": 1}, result.ShadowHits)
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		_, err := rules.Load(`version: 1.0.0
+rules:
+  - name: Monitor STS
+    mode: monitor
+    matches:
+      - field_name: eventSource
+        regex: "sts.amazonaws.com"`)
+		assert.Error(t, err)
+	})
+}
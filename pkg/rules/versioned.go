@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/rs/zerolog/log"
@@ -61,9 +62,14 @@ var (
 )
 
 // VersionedConfiguration represents a versioned configuration
+//
+// Include lists configurations merged below this one, see LoadLayered. Disable
+// removes inherited rules by name.
 type VersionedConfiguration struct {
 	Version string      `yaml:"version" validate:"required,semver"`
-	Rules   []*Rule     `yaml:"rules" validate:"required,dive"`
+	Include []string    `yaml:"include,omitempty" validate:"dive,required"`
+	Disable []string    `yaml:"disable,omitempty" validate:"dive,required"`
+	Rules   []*Rule     `yaml:"rules" validate:"required_without_all=Include Disable,dive"`
 	Meta    *ConfigMeta `yaml:"meta,omitempty"`
 }
 
@@ -127,6 +133,9 @@ func (vc *VersionedConfiguration) Validate() error {
 	if err := validate.RegisterValidation("is-regex", ValidateIsRegex); err != nil {
 		return err
 	}
+	if err := validate.RegisterValidation("is-expiry", ValidateExpiry); err != nil {
+		return err
+	}
 
 	// Validate struct
 	if err := validate.Struct(vc); err != nil {
@@ -159,6 +168,11 @@ func (vc *VersionedConfiguration) Validate() error {
 		errors = append(errors, err...)
 	}
 
+	// Warn about the expired rules, and the rules that would drop protected events
+	now := time.Now()
+	vc.warnExpiredRules(now)
+	vc.warnProtectedEvents(now)
+
 	if len(errors) > 0 {
 		return errors
 	}
@@ -315,7 +329,9 @@ func ValidateSemver(fl validator.FieldLevel) bool {
 // ToConfiguration converts VersionedConfiguration to Configuration
 func (vc *VersionedConfiguration) ToConfiguration() *Configuration {
 	return &Configuration{
-		Rules: vc.Rules,
+		Version: vc.Version,
+		Rules:   vc.Rules,
+		Disable: vc.Disable,
 	}
 }
 
@@ -325,6 +341,16 @@ func (vc *VersionedConfiguration) DryRun(sampleEvents []map[string]any) (*DryRun
 		TotalEvents:   len(sampleEvents),
 		RuleHits:      make(map[string]int),
 		FilteredCount: 0,
+		Rules:         make(map[string]RuleMetadata),
+		ShadowHits:    make(map[string]int),
+		ProtectedKept: make(map[string]int),
+	}
+
+	now := time.Now()
+	for _, rule := range vc.Rules {
+		if !rule.active(now) {
+			result.Skipped = append(result.Skipped, rule.Name)
+		}
 	}
 
 	// Prepare cached configuration for performance
@@ -343,6 +369,19 @@ func (vc *VersionedConfiguration) DryRun(sampleEvents []map[string]any) (*DryRun
 		if match {
 			result.FilteredCount++
 			result.RuleHits[dropEvent.RuleName]++
+			result.Rules[dropEvent.RuleName] = dropEvent.RuleMetadata
+		} else if dropEvent != nil {
+			result.ProtectedKept[dropEvent.RuleName]++
+			result.Rules[dropEvent.RuleName] = dropEvent.RuleMetadata
+		}
+
+		shadowDrops, err := cachedCfg.EvalShadowRules(event)
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate shadow rules: %w", err)
+		}
+		for _, shadowDrop := range shadowDrops {
+			result.ShadowHits[shadowDrop.RuleName]++
+			result.Rules[shadowDrop.RuleName] = shadowDrop.RuleMetadata
 		}
 	}
 
@@ -359,6 +398,14 @@ type DryRunResult struct {
 	PassedCount   int
 	FilterRate    float64
 	RuleHits      map[string]int
+	// ShadowHits counts the events each shadow rule would drop, they are kept
+	ShadowHits map[string]int
+	// ProtectedKept counts the protected events each rule matched, they are kept
+	ProtectedKept map[string]int
+	// Rules holds the metadata of the rules with hits
+	Rules map[string]RuleMetadata
+	// Skipped lists the disabled and expired rules
+	Skipped []string
 }
 
 // ExportConfiguration exports the configuration in different formats
@@ -371,12 +418,16 @@ func (vc *VersionedConfiguration) Export(format string) ([]byte, error) {
 		type jsonExport struct {
 			Version string           `json:"version"`
 			Meta    *ConfigMeta      `json:"meta,omitempty"`
+			Include []string         `json:"include,omitempty"`
+			Disable []string         `json:"disable,omitempty"`
 			Rules   []map[string]any `json:"rules"`
 		}
 
 		export := jsonExport{
 			Version: vc.Version,
 			Meta:    vc.Meta,
+			Include: vc.Include,
+			Disable: vc.Disable,
 			Rules:   make([]map[string]any, len(vc.Rules)),
 		}
 
@@ -393,6 +444,22 @@ func (vc *VersionedConfiguration) Export(format string) ([]byte, error) {
 				"name":    rule.Name,
 				"matches": matches,
 			}
+			for key, value := range map[string]string{
+				"description": rule.Description,
+				"owner":       rule.Owner,
+				"ticket":      rule.Ticket,
+				"expires_at":  rule.ExpiresAt,
+			} {
+				if value != "" {
+					export.Rules[i][key] = value
+				}
+			}
+			if rule.Enabled != nil {
+				export.Rules[i]["enabled"] = *rule.Enabled
+			}
+			if rule.Mode != "" {
+				export.Rules[i]["mode"] = rule.Mode
+			}
 		}
 
 		// Use our JSON encoder
@@ -363,4 +363,9 @@ func TestToConfiguration(t *testing.T) {
 	assert.NotNil(t, cfg)
 	assert.Len(t, cfg.Rules, 1)
 	assert.Equal(t, "Test Rule", cfg.Rules[0].Name)
+	assert.Equal(t, "1.0.0", cfg.Version)
+
+	cachedCfg, err := PrepareConfiguration(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.0", cachedCfg.Version)
 }
\ No newline at end of file
@@ -0,0 +1,79 @@
+package sinks
+
+import (
+	"context"
+	"ctlp/pkg/cloudtrailprocessor"
+	"ctlp/pkg/retry"
+	"fmt"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// SinkError is the error of a sink run through its circuit breaker, callers
+// with their own breaker leave it to the breaker of the sink
+type SinkError struct {
+	Sink string
+	Err  error
+}
+
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("%s sink: %v", e.Sink, e.Err)
+}
+
+func (e *SinkError) Unwrap() error { return e.Err }
+
+// BreakerSink runs the commits of a sink through a circuit breaker, one call
+// per file: an open circuit fails the commit without calling the sink
+type BreakerSink struct {
+	name    string
+	sink    cloudtrailprocessor.Sink
+	breaker *retry.CircuitBreaker
+}
+
+var _ cloudtrailprocessor.Sink = (*BreakerSink)(nil)
+
+// NewBreakerSink creates a sink named name calling sink through breaker
+func NewBreakerSink(name string, sink cloudtrailprocessor.Sink, breaker *retry.CircuitBreaker) *BreakerSink {
+	return &BreakerSink{name: name, sink: sink, breaker: breaker}
+}
+
+// Open opens a writer on the sink
+func (s *BreakerSink) Open(ctx context.Context, file cloudtrailprocessor.SinkFile) (cloudtrailprocessor.SinkWriter, error) {
+	w, err := s.sink.Open(ctx, file)
+	if err != nil {
+		return nil, &SinkError{Sink: s.name, Err: err}
+	}
+	return &breakerSinkWriter{sink: s, writer: w}, nil
+}
+
+// Unwrap returns the sink called through the breaker
+func (s *BreakerSink) Unwrap() cloudtrailprocessor.Sink {
+	return s.sink
+}
+
+func (s *BreakerSink) String() string {
+	return s.sink.String()
+}
+
+type breakerSinkWriter struct {
+	sink   *BreakerSink
+	writer cloudtrailprocessor.SinkWriter
+}
+
+func (w *breakerSinkWriter) Write(ctx context.Context, record json.RawMessage) error {
+	return w.writer.Write(ctx, record)
+}
+
+func (w *breakerSinkWriter) Commit(ctx context.Context) error {
+	err := w.sink.breaker.Execute(func() error {
+		return w.writer.Commit(ctx)
+	})
+	if err != nil {
+		return &SinkError{Sink: w.sink.name, Err: err}
+	}
+	return nil
+}
+
+func (w *breakerSinkWriter) Abort(ctx context.Context) error {
+	return w.writer.Abort(ctx)
+}
@@ -0,0 +1,54 @@
+package sinks
+
+import (
+	"context"
+	"ctlp/pkg/cloudtrailprocessor"
+	"ctlp/pkg/retry"
+	"errors"
+	"testing"
+
+	"github.com/segmentio/encoding/json"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingRecordSink fails every write with err
+type failingRecordSink struct {
+	err   error
+	calls int
+}
+
+func (s *failingRecordSink) WriteRecords(ctx context.Context, file cloudtrailprocessor.SinkFile, records []json.RawMessage) error {
+	s.calls++
+	return s.err
+}
+
+func (s *failingRecordSink) String() string { return "FailingSink" }
+
+func TestBreakerSink(t *testing.T) {
+	ctx := context.Background()
+	errOutage := errors.New("outage")
+
+	inner := &failingRecordSink{err: errOutage}
+	breaker := retry.NewCircuitBreaker("elasticsearch", retry.WithMinRequests(2), retry.WithFailureRateThreshold(0.5))
+	sink := NewBreakerSink("elasticsearch", cloudtrailprocessor.NewRecordSinkAdapter(inner), breaker)
+	assert.Equal(t, "FailingSink", sink.String())
+
+	for range 2 {
+		w, err := sink.Open(ctx, testFile)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Write(ctx, testRecords()[0]))
+
+		err = w.Commit(ctx)
+		var sinkErr *SinkError
+		if assert.True(t, errors.As(err, &sinkErr)) {
+			assert.Equal(t, "elasticsearch", sinkErr.Sink)
+		}
+		assert.ErrorIs(t, err, errOutage)
+	}
+	assert.Equal(t, retry.StateOpen, breaker.State())
+
+	w, err := sink.Open(ctx, testFile)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, w.Commit(ctx), retry.ErrCircuitOpen)
+	assert.Equal(t, 2, inner.calls, "the open circuit stops the calls")
+}
@@ -0,0 +1,286 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"ctlp/pkg/cloudtrailprocessor"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/encoding/json"
+)
+
+const (
+	// DefaultIndexPattern indexes records into one index per day based on eventTime
+	DefaultIndexPattern = "cloudtrail-YYYY.MM.DD"
+
+	// DefaultMaxBulkBytes keeps bulk requests well below the default 100MB http.max_content_length
+	DefaultMaxBulkBytes = 5 * 1024 * 1024
+)
+
+// HTTPClient interface for the http client methods used by the sinks
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// ElasticsearchConfig holds the settings of the Elasticsearch / OpenSearch sink
+type ElasticsearchConfig struct {
+	// Endpoint is the base URL of the cluster, e.g. https://search.example.com:9200
+	Endpoint string
+	// IndexPattern is the target index name, the tokens YYYY, MM, DD and HH are
+	// replaced by the record eventTime (UTC)
+	IndexPattern string
+	// MaxBulkBytes bounds the size of a single _bulk request body
+	MaxBulkBytes int
+	Username     string
+	Password     string
+	APIKey       string
+}
+
+// ElasticsearchSink indexes kept records through the _bulk API
+//
+// Every record is indexed with its eventID as document _id, so re-processing the
+// same CloudTrail file (retries, replays) overwrites documents instead of creating
+// duplicates. Records without an eventID get an id generated by the cluster.
+type ElasticsearchSink struct {
+	cfg    ElasticsearchConfig
+	client HTTPClient
+}
+
+// BulkItemError describes a single document rejected by the _bulk API
+type BulkItemError struct {
+	Index  string
+	ID     string
+	Status int
+	Type   string
+	Reason string
+}
+
+// BulkError is returned when one or more documents of a bulk request failed
+type BulkError struct {
+	Items []BulkItemError
+}
+
+// RetryableError tells if the failures may go away on their own: every failed
+// item was throttled (429, es_rejected_execution_exception) or a server error
+func (e *BulkError) RetryableError() bool {
+	if len(e.Items) == 0 {
+		return false
+	}
+	for _, item := range e.Items {
+		if item.Status != http.StatusTooManyRequests && item.Status < 500 {
+			return false
+		}
+	}
+	return true
+}
+
+// BulkStatusError is returned when the _bulk request itself fails with a non-2xx status
+type BulkStatusError struct {
+	StatusCode int
+	Endpoint   string
+}
+
+func (e *BulkStatusError) Error() string {
+	return fmt.Sprintf("bulk request to %s returned status %d", e.Endpoint, e.StatusCode)
+}
+
+// HTTPStatusCode returns the status code, it is used to classify retryable errors
+func (e *BulkStatusError) HTTPStatusCode() int { return e.StatusCode }
+
+func (e *BulkError) Error() string {
+	if len(e.Items) == 0 {
+		return "bulk request failed"
+	}
+	first := e.Items[0]
+	return fmt.Sprintf("%d bulk item(s) failed, first: index=%s id=%s status=%d %s: %s",
+		len(e.Items), first.Index, first.ID, first.Status, first.Type, first.Reason)
+}
+
+// bulkResponse is the subset of the _bulk response we need to detect item failures
+type bulkResponse struct {
+	Errors bool                                `json:"errors"`
+	Items  []map[string]bulkResponseItemResult `json:"items"`
+}
+
+type bulkResponseItemResult struct {
+	Index  string `json:"_index"`
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error,omitempty"`
+}
+
+// recordRef holds the fields used to route a record to its index and document id
+type recordRef struct {
+	EventID   string `json:"eventID"`
+	EventTime string `json:"eventTime"`
+}
+
+// NewElasticsearchSink creates a new Elasticsearch / OpenSearch sink
+func NewElasticsearchSink(cfg ElasticsearchConfig, client HTTPClient) *ElasticsearchSink {
+	if cfg.IndexPattern == "" {
+		cfg.IndexPattern = DefaultIndexPattern
+	}
+	if cfg.MaxBulkBytes <= 0 {
+		cfg.MaxBulkBytes = DefaultMaxBulkBytes
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+
+	return &ElasticsearchSink{
+		cfg:    cfg,
+		client: client,
+	}
+}
+
+// WriteRecords indexes the records in as many bulk requests as needed to stay under MaxBulkBytes
+func (s *ElasticsearchSink) WriteRecords(ctx context.Context, file cloudtrailprocessor.SinkFile, records []json.RawMessage) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	body := new(bytes.Buffer)
+	count := 0
+
+	for _, record := range records {
+		action, err := s.actionLine(record)
+		if err != nil {
+			return err
+		}
+
+		// Flush before the body would exceed the limit; a single oversized
+		// record is still sent on its own and left to the cluster to reject
+		size := len(action) + len(record) + 1
+		if count > 0 && body.Len()+size > s.cfg.MaxBulkBytes {
+			if err := s.sendBulk(ctx, body.Bytes(), count); err != nil {
+				return err
+			}
+			body.Reset()
+			count = 0
+		}
+
+		body.Write(action)
+		body.Write(record)
+		body.WriteByte('\n')
+		count++
+	}
+
+	if err := s.sendBulk(ctx, body.Bytes(), count); err != nil {
+		return err
+	}
+
+	log.Ctx(ctx).Debug().
+		Str("file", file.Key).
+		Int("records", len(records)).
+		Msg("indexed records")
+
+	return nil
+}
+
+// actionLine builds the bulk action metadata line for a record
+func (s *ElasticsearchSink) actionLine(record json.RawMessage) ([]byte, error) {
+	ref := recordRef{}
+	if err := json.Unmarshal(record, &ref); err != nil {
+		return nil, fmt.Errorf("unmarshal record failed: %w", err)
+	}
+
+	// a record without a valid eventTime goes to the epoch index, so that
+	// replays keep indexing it under the same _index and _id
+	eventTime, err := time.Parse(time.RFC3339, ref.EventTime)
+	if err != nil {
+		eventTime = time.Unix(0, 0)
+	}
+
+	meta := map[string]string{"_index": IndexName(s.cfg.IndexPattern, eventTime)}
+	if ref.EventID != "" {
+		meta["_id"] = ref.EventID
+	}
+
+	line, err := json.Marshal(map[string]any{"index": meta})
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// sendBulk sends a single _bulk request and parses per-item failures from the response
+func (s *ElasticsearchSink) sendBulk(ctx context.Context, body []byte, count int) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.Endpoint+"/_bulk", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create bulk request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	switch {
+	case s.cfg.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.cfg.APIKey)
+	case s.cfg.Username != "":
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("bulk request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 10*1024*1024))
+	if err != nil {
+		return fmt.Errorf("failed to read bulk response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &BulkStatusError{StatusCode: resp.StatusCode, Endpoint: s.cfg.Endpoint}
+	}
+
+	bulkResp := new(bulkResponse)
+	if err := json.Unmarshal(data, bulkResp); err != nil {
+		return fmt.Errorf("failed to decode bulk response: %w", err)
+	}
+
+	if !bulkResp.Errors {
+		return nil
+	}
+
+	bulkErr := &BulkError{}
+	for _, item := range bulkResp.Items {
+		for _, res := range item {
+			if res.Error == nil && res.Status < 300 {
+				continue
+			}
+			itemErr := BulkItemError{Index: res.Index, ID: res.ID, Status: res.Status}
+			if res.Error != nil {
+				itemErr.Type = res.Error.Type
+				itemErr.Reason = res.Error.Reason
+			}
+			bulkErr.Items = append(bulkErr.Items, itemErr)
+		}
+	}
+
+	log.Ctx(ctx).Error().
+		Int("documents", count).
+		Int("failed", len(bulkErr.Items)).
+		Msg("bulk request had failed items")
+
+	return bulkErr
+}
+
+func (s *ElasticsearchSink) String() string {
+	return fmt.Sprintf("ElasticsearchSink(endpoint=%s, index=%s)", s.cfg.Endpoint, s.cfg.IndexPattern)
+}
+
+// IndexName expands the YYYY, MM, DD and HH tokens of pattern with the UTC time t
+func IndexName(pattern string, t time.Time) string {
+	t = t.UTC()
+	return strings.NewReplacer(
+		"YYYY", fmt.Sprintf("%04d", t.Year()),
+		"MM", fmt.Sprintf("%02d", int(t.Month())),
+		"DD", fmt.Sprintf("%02d", t.Day()),
+		"HH", fmt.Sprintf("%02d", t.Hour()),
+	).Replace(pattern)
+}
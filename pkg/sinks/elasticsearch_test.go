@@ -0,0 +1,192 @@
+package sinks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"ctlp/pkg/cloudtrailprocessor"
+	"ctlp/pkg/retry"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+	"github.com/stretchr/testify/assert"
+)
+
+var testFile = cloudtrailprocessor.SinkFile{
+	Bucket: "source-bucket",
+	Key:    "AWSLogs/123456789012/CloudTrail/eu-west-1/2024/01/15/file.json.gz",
+}
+
+func testRecords() []json.RawMessage {
+	return []json.RawMessage{
+		json.RawMessage(`{"eventID":"id-1","eventTime":"2024-01-15T10:00:00Z","eventName":"CreateUser","recipientAccountId":"123456789012"}`),
+		json.RawMessage(`{"eventID":"id-2","eventTime":"2024-01-16T23:59:59Z","eventName":"DeleteUser","recipientAccountId":"210987654321"}`),
+	}
+}
+
+// bulkServer is an httptest stand-in for the _bulk API
+type bulkServer struct {
+	mu       sync.Mutex
+	requests [][]byte
+	response string
+}
+
+func (b *bulkServer) handler(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	b.mu.Lock()
+	b.requests = append(b.requests, body)
+	b.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if b.response != "" {
+		_, _ = w.Write([]byte(b.response))
+		return
+	}
+	_, _ = w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+}
+
+func readLines(body []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestIndexName(t *testing.T) {
+	ts := time.Date(2024, 1, 5, 7, 0, 0, 0, time.UTC)
+	assert.Equal(t, "cloudtrail-2024.01.05", IndexName("cloudtrail-YYYY.MM.DD", ts))
+	assert.Equal(t, "ct-2024-01-05-07", IndexName("ct-YYYY-MM-DD-HH", ts))
+	assert.Equal(t, "static", IndexName("static", ts))
+}
+
+func TestElasticsearchSink(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("bulk request format", func(t *testing.T) {
+		bs := &bulkServer{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/_bulk", r.URL.Path)
+			assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+			assert.Equal(t, "ApiKey secret", r.Header.Get("Authorization"))
+			bs.handler(w, r)
+		}))
+		defer server.Close()
+
+		sink := NewElasticsearchSink(ElasticsearchConfig{Endpoint: server.URL + "/", APIKey: "secret"}, server.Client())
+
+		err := sink.WriteRecords(ctx, testFile, testRecords())
+		assert.NoError(t, err)
+		assert.Len(t, bs.requests, 1)
+
+		lines := readLines(bs.requests[0])
+		assert.Len(t, lines, 4)
+		assert.JSONEq(t, `{"index":{"_index":"cloudtrail-2024.01.15","_id":"id-1"}}`, lines[0])
+		assert.JSONEq(t, string(testRecords()[0]), lines[1])
+		assert.JSONEq(t, `{"index":{"_index":"cloudtrail-2024.01.16","_id":"id-2"}}`, lines[2])
+	})
+
+	t.Run("replays use the same index", func(t *testing.T) {
+		bs := &bulkServer{}
+		server := httptest.NewServer(http.HandlerFunc(bs.handler))
+		defer server.Close()
+
+		sink := NewElasticsearchSink(ElasticsearchConfig{Endpoint: server.URL}, server.Client())
+		record := json.RawMessage(`{"eventID":"id-3","eventTime":"not a time","eventName":"CreateUser"}`)
+
+		for range 2 {
+			assert.NoError(t, sink.WriteRecords(ctx, testFile, []json.RawMessage{record}))
+		}
+		if assert.Len(t, bs.requests, 2) {
+			first, second := readLines(bs.requests[0]), readLines(bs.requests[1])
+			assert.JSONEq(t, `{"index":{"_index":"cloudtrail-1970.01.01","_id":"id-3"}}`, first[0])
+			assert.Equal(t, first[0], second[0])
+		}
+	})
+
+	t.Run("batches are bounded in bytes", func(t *testing.T) {
+		bs := &bulkServer{}
+		server := httptest.NewServer(http.HandlerFunc(bs.handler))
+		defer server.Close()
+
+		sink := NewElasticsearchSink(ElasticsearchConfig{Endpoint: server.URL, MaxBulkBytes: 200}, server.Client())
+
+		err := sink.WriteRecords(ctx, testFile, testRecords())
+		assert.NoError(t, err)
+		assert.Len(t, bs.requests, 2)
+		for _, req := range bs.requests {
+			assert.Len(t, readLines(req), 2)
+		}
+	})
+
+	t.Run("per item errors", func(t *testing.T) {
+		bs := &bulkServer{response: `{"took":3,"errors":true,"items":[
+			{"index":{"_index":"cloudtrail-2024.01.15","_id":"id-1","status":201}},
+			{"index":{"_index":"cloudtrail-2024.01.16","_id":"id-2","status":400,
+				"error":{"type":"mapper_parsing_exception","reason":"failed to parse field"}}}
+		]}`}
+		server := httptest.NewServer(http.HandlerFunc(bs.handler))
+		defer server.Close()
+
+		sink := NewElasticsearchSink(ElasticsearchConfig{Endpoint: server.URL}, server.Client())
+
+		err := sink.WriteRecords(ctx, testFile, testRecords())
+		assert.Error(t, err)
+
+		bulkErr, ok := err.(*BulkError)
+		assert.True(t, ok)
+		assert.Len(t, bulkErr.Items, 1)
+		assert.Equal(t, "id-2", bulkErr.Items[0].ID)
+		assert.Equal(t, 400, bulkErr.Items[0].Status)
+		assert.Equal(t, "mapper_parsing_exception", bulkErr.Items[0].Type)
+		assert.False(t, retry.IsRetryable(err))
+	})
+
+	t.Run("throttled items", func(t *testing.T) {
+		bs := &bulkServer{response: `{"took":3,"errors":true,"items":[
+			{"index":{"_index":"cloudtrail-2024.01.15","_id":"id-1","status":429,
+				"error":{"type":"es_rejected_execution_exception","reason":"rejected execution"}}},
+			{"index":{"_index":"cloudtrail-2024.01.16","_id":"id-2","status":503,
+				"error":{"type":"unavailable_shards_exception","reason":"primary shard is not active"}}}
+		]}`}
+		server := httptest.NewServer(http.HandlerFunc(bs.handler))
+		defer server.Close()
+
+		sink := NewElasticsearchSink(ElasticsearchConfig{Endpoint: server.URL}, server.Client())
+
+		err := sink.WriteRecords(ctx, testFile, testRecords())
+		assert.Error(t, err)
+		assert.True(t, retry.IsRetryable(err))
+	})
+
+	t.Run("http error", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		sink := NewElasticsearchSink(ElasticsearchConfig{Endpoint: server.URL}, server.Client())
+
+		err := sink.WriteRecords(ctx, testFile, testRecords())
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "status 503")
+		assert.True(t, retry.IsRetryable(err))
+	})
+
+	t.Run("no records", func(t *testing.T) {
+		bs := &bulkServer{}
+		server := httptest.NewServer(http.HandlerFunc(bs.handler))
+		defer server.Close()
+
+		sink := NewElasticsearchSink(ElasticsearchConfig{Endpoint: server.URL}, server.Client())
+
+		assert.NoError(t, sink.WriteRecords(ctx, testFile, nil))
+		assert.Empty(t, bs.requests)
+	})
+}
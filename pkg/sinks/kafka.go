@@ -0,0 +1,276 @@
+package sinks
+
+import (
+	"context"
+	"ctlp/pkg/cloudtrailprocessor"
+	"ctlp/pkg/utils"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/encoding/json"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	// DefaultKafkaKeyField keeps the events of an account on the same partition
+	DefaultKafkaKeyField = "recipientAccountId"
+
+	// DefaultKafkaMaxMessageBytes matches the broker default message.max.bytes (1MB)
+	DefaultKafkaMaxMessageBytes = 1000 * 1000
+
+	// DefaultKafkaClientID identifies the producer to the brokers
+	DefaultKafkaClientID = "ctlp"
+
+	// Header names set on every message
+	HeaderConfigVersion = "ctlp-config-version"
+	HeaderSourceBucket  = "ctlp-source-bucket"
+	HeaderSourceKey     = "ctlp-source-key"
+	HeaderContentType   = "content-type"
+)
+
+// KafkaHeader is a single Kafka record header
+type KafkaHeader struct {
+	Key   string
+	Value []byte
+}
+
+// KafkaMessage is a message handed to the KafkaProducer
+type KafkaMessage struct {
+	Topic   string
+	Key     []byte
+	Value   []byte
+	Headers []KafkaHeader
+}
+
+// KafkaProducer publishes messages to Kafka
+//
+// Produce blocks until every message is acknowledged by the brokers or has failed,
+// and returns one error per message (nil when delivered). Adapters for franz-go,
+// sarama or confluent-kafka-go only need to map their delivery reports to this slice.
+type KafkaProducer interface {
+	Produce(ctx context.Context, messages []KafkaMessage) []error
+}
+
+// KafkaConfig holds the settings of the Kafka sink
+type KafkaConfig struct {
+	Topic string
+	// KeyField is the dot separated path of the record field used as message key,
+	// records without the field are published without key
+	KeyField string
+	// Batch publishes NDJSON batches (one per key) instead of one message per record
+	Batch bool
+	// MaxMessageBytes bounds the value size of a batch message
+	MaxMessageBytes int
+}
+
+// KafkaSink publishes kept records to a Kafka topic
+type KafkaSink struct {
+	cfg      KafkaConfig
+	producer KafkaProducer
+}
+
+// KafkaMessageError describes a message the producer failed to deliver
+type KafkaMessageError struct {
+	Key string
+	Err error
+}
+
+// DeliveryError is returned when one or more messages were not delivered
+type DeliveryError struct {
+	Topic  string
+	Total  int
+	Failed []KafkaMessageError
+}
+
+func (e *DeliveryError) Error() string {
+	if len(e.Failed) == 0 {
+		return fmt.Sprintf("delivery to topic %s failed", e.Topic)
+	}
+	return fmt.Sprintf("%d of %d message(s) failed delivery to topic %s, first: key=%s: %v",
+		len(e.Failed), e.Total, e.Topic, e.Failed[0].Key, e.Failed[0].Err)
+}
+
+// Unwrap returns the producer errors so that errors.Is / errors.As can inspect them
+func (e *DeliveryError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, failed := range e.Failed {
+		errs[i] = failed.Err
+	}
+	return errs
+}
+
+// RetryableError classifies the error for the retry package: the delivery is
+// retried when a message failed on a retriable broker error, a timeout or a
+// network error, e.g. NOT_LEADER_FOR_PARTITION after the producer retries
+func (e *DeliveryError) RetryableError() bool {
+	if len(e.Failed) == 0 {
+		return true
+	}
+	for _, failed := range e.Failed {
+		if isRetriableDelivery(failed.Err) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRetriableDelivery tells if a message failed on a transient condition
+func isRetriableDelivery(err error) bool {
+	if kerr.IsRetriable(err) || errors.Is(err, kgo.ErrRecordTimeout) || errors.Is(err, kgo.ErrRecordRetries) {
+		return true
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// NewKafkaSink creates a new Kafka sink
+func NewKafkaSink(cfg KafkaConfig, producer KafkaProducer) *KafkaSink {
+	if cfg.KeyField == "" {
+		cfg.KeyField = DefaultKafkaKeyField
+	}
+	if cfg.MaxMessageBytes <= 0 {
+		cfg.MaxMessageBytes = DefaultKafkaMaxMessageBytes
+	}
+
+	return &KafkaSink{
+		cfg:      cfg,
+		producer: producer,
+	}
+}
+
+// WriteRecords publishes the records and returns a *DeliveryError if any message was not delivered
+func (s *KafkaSink) WriteRecords(ctx context.Context, file cloudtrailprocessor.SinkFile, records []json.RawMessage) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	headers := []KafkaHeader{
+		{Key: HeaderConfigVersion, Value: []byte(file.ConfigVersion)},
+		{Key: HeaderSourceBucket, Value: []byte(file.Bucket)},
+		{Key: HeaderSourceKey, Value: []byte(file.Key)},
+	}
+
+	var messages []KafkaMessage
+	var err error
+	if s.cfg.Batch {
+		messages, err = s.batchMessages(records, headers)
+	} else {
+		messages, err = s.recordMessages(records, headers)
+	}
+	if err != nil {
+		return err
+	}
+
+	errs := s.producer.Produce(ctx, messages)
+
+	deliveryErr := &DeliveryError{Topic: s.cfg.Topic, Total: len(messages)}
+	for i, err := range errs {
+		if err == nil || i >= len(messages) {
+			continue
+		}
+		deliveryErr.Failed = append(deliveryErr.Failed, KafkaMessageError{Key: string(messages[i].Key), Err: err})
+	}
+
+	if len(deliveryErr.Failed) > 0 {
+		log.Ctx(ctx).Error().
+			Str("file", file.Key).
+			Str("topic", s.cfg.Topic).
+			Int("messages", len(messages)).
+			Int("failed", len(deliveryErr.Failed)).
+			Msg("kafka delivery failed")
+		return deliveryErr
+	}
+
+	log.Ctx(ctx).Debug().
+		Str("file", file.Key).
+		Str("topic", s.cfg.Topic).
+		Int("records", len(records)).
+		Int("messages", len(messages)).
+		Msg("published records")
+
+	return nil
+}
+
+// recordMessages creates one message per record
+func (s *KafkaSink) recordMessages(records []json.RawMessage, headers []KafkaHeader) ([]KafkaMessage, error) {
+	messages := make([]KafkaMessage, 0, len(records))
+	for _, record := range records {
+		key, err := s.recordKey(record)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, KafkaMessage{
+			Topic:   s.cfg.Topic,
+			Key:     key,
+			Value:   record,
+			Headers: headers,
+		})
+	}
+	return messages, nil
+}
+
+// batchMessages groups records by key into NDJSON messages bounded by MaxMessageBytes,
+// the order of records sharing a key is preserved
+func (s *KafkaSink) batchMessages(records []json.RawMessage, headers []KafkaHeader) ([]KafkaMessage, error) {
+	batchHeaders := append(append([]KafkaHeader{}, headers...), KafkaHeader{Key: HeaderContentType, Value: []byte("application/x-ndjson")})
+
+	var keys []string
+	pending := make(map[string]*KafkaMessage)
+	var messages []KafkaMessage
+
+	for _, record := range records {
+		key, err := s.recordKey(record)
+		if err != nil {
+			return nil, err
+		}
+
+		msg, ok := pending[string(key)]
+		if ok && len(msg.Value)+len(record)+1 > s.cfg.MaxMessageBytes {
+			messages = append(messages, *msg)
+			ok = false
+		}
+		if !ok {
+			if _, seen := pending[string(key)]; !seen {
+				keys = append(keys, string(key))
+			}
+			msg = &KafkaMessage{Topic: s.cfg.Topic, Key: key, Headers: batchHeaders}
+			pending[string(key)] = msg
+		}
+
+		msg.Value = append(append(msg.Value, record...), '\n')
+	}
+
+	for _, key := range keys {
+		messages = append(messages, *pending[key])
+	}
+
+	return messages, nil
+}
+
+// recordKey extracts the message key from the configured field path
+func (s *KafkaSink) recordKey(record json.RawMessage) ([]byte, error) {
+	evt := make(map[string]any)
+	if err := json.Unmarshal(record, &evt); err != nil {
+		return nil, fmt.Errorf("unmarshal record failed: %w", err)
+	}
+
+	exists, v := utils.FieldExists(s.cfg.KeyField, evt)
+	if !exists || v == nil {
+		return nil, nil
+	}
+	if str, ok := v.(string); ok {
+		return []byte(str), nil
+	}
+	return []byte(fmt.Sprint(v)), nil
+}
+
+func (s *KafkaSink) String() string {
+	return fmt.Sprintf("KafkaSink(topic=%s, key=%s, batch=%t)", s.cfg.Topic, s.cfg.KeyField, s.cfg.Batch)
+}
@@ -0,0 +1,164 @@
+package sinks
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	saslaws "github.com/twmb/franz-go/pkg/sasl/aws"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// Kafka authentication mechanisms
+const (
+	KafkaAuthNone        = "none"
+	KafkaAuthIAM         = "iam"
+	KafkaAuthSCRAMSHA512 = "scram-sha-512"
+	KafkaAuthPlain       = "plain"
+)
+
+// KafkaProducerConfig holds the connection settings of the Kafka producer
+type KafkaProducerConfig struct {
+	Brokers []string
+	// Auth is the SASL mechanism, one of the KafkaAuth constants
+	Auth string
+	// TLS encrypts the connections to the brokers, always set with IAM
+	TLS bool
+	// Username and Password are the SCRAM or PLAIN credentials
+	Username string
+	Password string
+	// Credentials sign the MSK IAM authentication
+	Credentials aws.CredentialsProvider
+	// MaxMessageBytes bounds the size of a produce batch, it must not be lower
+	// than the largest message
+	MaxMessageBytes int
+	// ClientID identifies the producer to the brokers, DefaultKafkaClientID
+	// when empty
+	ClientID string
+}
+
+// FranzProducer is a KafkaProducer backed by franz-go, it supports the TLS,
+// IAM and SCRAM listeners of Amazon MSK
+type FranzProducer struct {
+	client *kgo.Client
+}
+
+var _ KafkaProducer = (*FranzProducer)(nil)
+
+// NewFranzProducer creates a producer connected to the brokers of cfg
+func NewFranzProducer(cfg KafkaProducerConfig) (*FranzProducer, error) {
+	var brokers []string
+	for _, broker := range cfg.Brokers {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("at least one broker is required")
+	}
+	cfg.Auth = strings.ToLower(strings.TrimSpace(cfg.Auth))
+	if cfg.ClientID == "" {
+		cfg.ClientID = DefaultKafkaClientID
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(brokers...),
+		kgo.ClientID(cfg.ClientID),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+	}
+	if cfg.MaxMessageBytes > DefaultKafkaMaxMessageBytes {
+		// leaves room for the record batch and headers overhead
+		opts = append(opts, kgo.ProducerBatchMaxBytes(int32(cfg.MaxMessageBytes+16*1024)))
+	}
+
+	mechanism, err := kafkaSASL(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if mechanism != nil {
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+	if cfg.TLS || cfg.Auth == KafkaAuthIAM {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka client: %w", err)
+	}
+	return &FranzProducer{client: client}, nil
+}
+
+// kafkaSASL returns the SASL mechanism of cfg, nil without authentication
+func kafkaSASL(cfg KafkaProducerConfig) (sasl.Mechanism, error) {
+	switch cfg.Auth {
+	case "", KafkaAuthNone:
+		return nil, nil
+	case KafkaAuthIAM:
+		if cfg.Credentials == nil {
+			return nil, fmt.Errorf("aws credentials are required for iam authentication")
+		}
+		return saslaws.ManagedStreamingIAM(func(ctx context.Context) (saslaws.Auth, error) {
+			creds, err := cfg.Credentials.Retrieve(ctx)
+			if err != nil {
+				return saslaws.Auth{}, fmt.Errorf("failed to retrieve aws credentials: %w", err)
+			}
+			return saslaws.Auth{
+				AccessKey:    creds.AccessKeyID,
+				SecretKey:    creds.SecretAccessKey,
+				SessionToken: creds.SessionToken,
+				UserAgent:    cfg.ClientID,
+			}, nil
+		}), nil
+	case KafkaAuthSCRAMSHA512:
+		if cfg.Username == "" || cfg.Password == "" {
+			return nil, fmt.Errorf("username and password are required for %s authentication", cfg.Auth)
+		}
+		return scram.Auth{User: cfg.Username, Pass: cfg.Password}.AsSha512Mechanism(), nil
+	case KafkaAuthPlain:
+		if cfg.Username == "" || cfg.Password == "" {
+			return nil, fmt.Errorf("username and password are required for %s authentication", cfg.Auth)
+		}
+		return plain.Auth{User: cfg.Username, Pass: cfg.Password}.AsMechanism(), nil
+	default:
+		return nil, fmt.Errorf("unknown kafka authentication: %s", cfg.Auth)
+	}
+}
+
+// Produce publishes the messages and waits for their delivery reports
+func (p *FranzProducer) Produce(ctx context.Context, messages []KafkaMessage) []error {
+	errs := make([]error, len(messages))
+
+	var wg sync.WaitGroup
+	wg.Add(len(messages))
+	for i, msg := range messages {
+		record := &kgo.Record{
+			Topic: msg.Topic,
+			Key:   msg.Key,
+			Value: msg.Value,
+		}
+		for _, h := range msg.Headers {
+			record.Headers = append(record.Headers, kgo.RecordHeader{Key: h.Key, Value: h.Value})
+		}
+
+		// delivery reports come in completion order, the index maps them back
+		p.client.Produce(ctx, record, func(_ *kgo.Record, err error) {
+			errs[i] = err
+			wg.Done()
+		})
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// Close flushes the buffered messages and closes the connections
+func (p *FranzProducer) Close() {
+	p.client.Close()
+}
@@ -0,0 +1,64 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFranzProducer(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     KafkaProducerConfig
+		wantErr string
+	}{
+		{"no broker", KafkaProducerConfig{Brokers: []string{""}}, "at least one broker is required"},
+		{"plaintext", KafkaProducerConfig{Brokers: []string{"localhost:9092"}}, ""},
+		{"iam", KafkaProducerConfig{
+			Brokers:     []string{"b-1.msk:9098"},
+			Auth:        "IAM",
+			Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		}, ""},
+		{"iam without credentials", KafkaProducerConfig{Brokers: []string{"b-1.msk:9098"}, Auth: KafkaAuthIAM}, "aws credentials are required"},
+		{"scram", KafkaProducerConfig{Brokers: []string{"b-1.msk:9096"}, Auth: KafkaAuthSCRAMSHA512, TLS: true, Username: "ctlp", Password: "secret"}, ""},
+		{"scram without password", KafkaProducerConfig{Brokers: []string{"b-1.msk:9096"}, Auth: KafkaAuthSCRAMSHA512, Username: "ctlp"}, "username and password are required"},
+		{"unknown auth", KafkaProducerConfig{Brokers: []string{"localhost:9092"}, Auth: "kerberos"}, "unknown kafka authentication: kerberos"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			producer, err := NewFranzProducer(tt.cfg)
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			producer.Close()
+		})
+	}
+}
+
+func TestFranzProducerProduce(t *testing.T) {
+	// nothing listens on the port, every message fails once the context expires
+	producer, err := NewFranzProducer(KafkaProducerConfig{Brokers: []string{"127.0.0.1:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	errs := producer.Produce(ctx, []KafkaMessage{
+		{Topic: "cloudtrail", Key: []byte("123456789012"), Value: []byte(`{}`)},
+		{Topic: "cloudtrail", Key: []byte("210987654321"), Value: []byte(`{}`), Headers: []KafkaHeader{{Key: HeaderSourceKey, Value: []byte("key")}}},
+	})
+	assert.Len(t, errs, 2)
+	for _, err := range errs {
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package sinks
+
+import (
+	"context"
+	"ctlp/pkg/cloudtrailprocessor"
+	"ctlp/pkg/retry"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/segmentio/encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+var errNotLeader = errors.New("NOT_LEADER_FOR_PARTITION")
+
+// fakeBroker is an in-process KafkaProducer keeping the published messages per topic
+type fakeBroker struct {
+	mu       sync.Mutex
+	topics   map[string][]KafkaMessage
+	failKeys map[string]error
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		topics:   make(map[string][]KafkaMessage),
+		failKeys: make(map[string]error),
+	}
+}
+
+func (b *fakeBroker) Produce(ctx context.Context, messages []KafkaMessage) []error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	errs := make([]error, len(messages))
+	for i, msg := range messages {
+		if err, ok := b.failKeys[string(msg.Key)]; ok {
+			errs[i] = err
+			continue
+		}
+		b.topics[msg.Topic] = append(b.topics[msg.Topic], msg)
+	}
+	return errs
+}
+
+func header(msg KafkaMessage, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func TestKafkaSink(t *testing.T) {
+	ctx := context.Background()
+	file := cloudtrailprocessor.SinkFile{Bucket: testFile.Bucket, Key: testFile.Key, ConfigVersion: "1.2.0"}
+
+	t.Run("one message per record", func(t *testing.T) {
+		broker := newFakeBroker()
+		sink := NewKafkaSink(KafkaConfig{Topic: "cloudtrail"}, broker)
+
+		err := sink.WriteRecords(ctx, file, testRecords())
+		assert.NoError(t, err)
+
+		messages := broker.topics["cloudtrail"]
+		assert.Len(t, messages, 2)
+		assert.Equal(t, "123456789012", string(messages[0].Key))
+		assert.Equal(t, "210987654321", string(messages[1].Key))
+		assert.JSONEq(t, string(testRecords()[0]), string(messages[0].Value))
+		assert.Equal(t, "1.2.0", header(messages[0], HeaderConfigVersion))
+		assert.Equal(t, testFile.Bucket, header(messages[0], HeaderSourceBucket))
+		assert.Equal(t, testFile.Key, header(messages[0], HeaderSourceKey))
+	})
+
+	t.Run("nested key field", func(t *testing.T) {
+		broker := newFakeBroker()
+		sink := NewKafkaSink(KafkaConfig{Topic: "cloudtrail", KeyField: "userIdentity.arn"}, broker)
+
+		records := []json.RawMessage{
+			json.RawMessage(`{"eventID":"id-1","userIdentity":{"arn":"arn:aws:iam::123456789012:user/alice"}}`),
+			json.RawMessage(`{"eventID":"id-2"}`),
+		}
+
+		err := sink.WriteRecords(ctx, file, records)
+		assert.NoError(t, err)
+
+		messages := broker.topics["cloudtrail"]
+		assert.Len(t, messages, 2)
+		assert.Equal(t, "arn:aws:iam::123456789012:user/alice", string(messages[0].Key))
+		assert.Nil(t, messages[1].Key)
+	})
+
+	t.Run("ndjson batches per key", func(t *testing.T) {
+		broker := newFakeBroker()
+		sink := NewKafkaSink(KafkaConfig{Topic: "cloudtrail", Batch: true}, broker)
+
+		records := append(testRecords(), json.RawMessage(`{"eventID":"id-3","recipientAccountId":"123456789012"}`))
+
+		err := sink.WriteRecords(ctx, file, records)
+		assert.NoError(t, err)
+
+		messages := broker.topics["cloudtrail"]
+		assert.Len(t, messages, 2)
+		assert.Equal(t, "123456789012", string(messages[0].Key))
+		assert.Equal(t, "application/x-ndjson", header(messages[0], HeaderContentType))
+
+		lines := strings.Split(strings.TrimSuffix(string(messages[0].Value), "\n"), "\n")
+		assert.Len(t, lines, 2)
+		assert.JSONEq(t, string(records[0]), lines[0])
+		assert.JSONEq(t, string(records[2]), lines[1])
+	})
+
+	t.Run("batches are bounded in bytes", func(t *testing.T) {
+		broker := newFakeBroker()
+		sink := NewKafkaSink(KafkaConfig{Topic: "cloudtrail", KeyField: "missing", Batch: true, MaxMessageBytes: 200}, broker)
+
+		err := sink.WriteRecords(ctx, file, testRecords())
+		assert.NoError(t, err)
+		assert.Len(t, broker.topics["cloudtrail"], 2)
+	})
+
+	t.Run("delivery errors", func(t *testing.T) {
+		broker := newFakeBroker()
+		broker.failKeys["210987654321"] = errNotLeader
+		sink := NewKafkaSink(KafkaConfig{Topic: "cloudtrail"}, broker)
+
+		err := sink.WriteRecords(ctx, file, testRecords())
+		assert.Error(t, err)
+		assert.ErrorIs(t, err, errNotLeader)
+
+		var deliveryErr *DeliveryError
+		assert.True(t, errors.As(err, &deliveryErr))
+		assert.Equal(t, 2, deliveryErr.Total)
+		assert.Len(t, deliveryErr.Failed, 1)
+		assert.Equal(t, "210987654321", deliveryErr.Failed[0].Key)
+		assert.Len(t, broker.topics["cloudtrail"], 1)
+	})
+
+	t.Run("no records", func(t *testing.T) {
+		broker := newFakeBroker()
+		sink := NewKafkaSink(KafkaConfig{Topic: "cloudtrail"}, broker)
+
+		assert.NoError(t, sink.WriteRecords(ctx, file, nil))
+		assert.Empty(t, broker.topics)
+	})
+}
+
+func TestDeliveryErrorRetryable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"not leader", kerr.NotLeaderForPartition, true},
+		{"request timed out", fmt.Errorf("produce: %w", kerr.RequestTimedOut), true},
+		{"record timeout", kgo.ErrRecordTimeout, true},
+		{"record retries", kgo.ErrRecordRetries, true},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{"message too large", kerr.MessageTooLarge, false},
+		{"topic authorization", kerr.TopicAuthorizationFailed, false},
+		{"unknown error", errors.New("boom"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := fmt.Errorf("failed to write records: %w", &DeliveryError{
+				Topic:  "cloudtrail",
+				Total:  2,
+				Failed: []KafkaMessageError{{Key: "123456789012", Err: tt.err}},
+			})
+			assert.Equal(t, tt.expected, retry.IsRetryable(err))
+			assert.Equal(t, !tt.expected, retry.IsPermanent(err))
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package sinks
+
+import (
+	"context"
+	"ctlp/pkg/cloudtrailprocessor"
+	"ctlp/pkg/retry"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	firehosetypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/encoding/json"
+)
+
+const (
+	// maxBatchRecords is the maximum number of records per PutRecordBatch / PutRecords call
+	maxBatchRecords = 500
+
+	// maxBatchBytes is the maximum payload per call. Firehose allows 4 MiB per
+	// PutRecordBatch and Kinesis 5 MiB per PutRecords, the lower bound is used for both
+	maxBatchBytes = 4 * 1024 * 1024
+
+	// maxStreamRecordBytes is the maximum size of a single Firehose record (1000 KiB),
+	// Kinesis allows 1 MiB including the partition key
+	maxStreamRecordBytes = 1000 * 1024
+
+	// defaultStreamRetries is the number of times failed entries are re-sent
+	defaultStreamRetries = 3
+)
+
+// FirehoseAPI interface for Kinesis Data Firehose client methods
+type FirehoseAPI interface {
+	PutRecordBatch(ctx context.Context, params *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error)
+}
+
+// KinesisAPI interface for Kinesis Data Streams client methods
+type KinesisAPI interface {
+	PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error)
+}
+
+// PartialFailureError is returned when some entries of a batch were still rejected after all retries
+type PartialFailureError struct {
+	Failed       int
+	Total        int
+	ErrorCode    string
+	ErrorMessage string
+}
+
+func (e *PartialFailureError) Error() string {
+	return fmt.Sprintf("%d of %d records failed: %s: %s", e.Failed, e.Total, e.ErrorCode, e.ErrorMessage)
+}
+
+// retryableEntryCodes are the entry error codes of throttled or failed server
+// side writes, UnidentifiedFailure is set when no entry was flagged
+var retryableEntryCodes = map[string]bool{
+	"ProvisionedThroughputExceededException": true,
+	"ServiceUnavailableException":            true,
+	"InternalFailure":                        true,
+	"InternalServerError":                    true,
+	"UnidentifiedFailure":                    true,
+}
+
+// RetryableError classifies the error for the retry package: the write is
+// retried when the last failed entry was throttled or hit a server failure
+func (e *PartialFailureError) RetryableError() bool {
+	return retryableEntryCodes[e.ErrorCode]
+}
+
+// retryEntries returns the entries to send again: the failed entries,
+// or the whole batch when the response counts failures without flagging any
+// entry, so that no record is lost
+func retryEntries(failed, entries []streamEntry, partialErr *PartialFailureError, failedCount int32) []streamEntry {
+	partialErr.Failed = len(failed)
+	if len(failed) > 0 {
+		return failed
+	}
+	partialErr.Failed = int(failedCount)
+	partialErr.ErrorCode = "UnidentifiedFailure"
+	partialErr.ErrorMessage = "failed records not flagged in the response, sending the batch again"
+	return entries
+}
+
+// streamEntry is a record prepared for a streaming put request
+type streamEntry struct {
+	data         []byte
+	partitionKey string
+}
+
+// FirehoseSink writes kept records to a Kinesis Data Firehose delivery stream
+//
+// Records are newline delimited so that destinations which concatenate records
+// (S3, HTTP endpoints, third-party SIEMs) receive NDJSON.
+type FirehoseSink struct {
+	deliveryStream string
+	client         FirehoseAPI
+	maxRetries     int
+}
+
+// NewFirehoseSink creates a new Firehose sink
+func NewFirehoseSink(deliveryStream string, client FirehoseAPI) *FirehoseSink {
+	return &FirehoseSink{
+		deliveryStream: deliveryStream,
+		client:         client,
+		maxRetries:     defaultStreamRetries,
+	}
+}
+
+// WriteRecords writes the records with PutRecordBatch
+func (s *FirehoseSink) WriteRecords(ctx context.Context, file cloudtrailprocessor.SinkFile, records []json.RawMessage) error {
+	entries := make([]streamEntry, 0, len(records))
+	for _, record := range records {
+		data := make([]byte, 0, len(record)+1)
+		data = append(append(data, record...), '\n')
+		entries = append(entries, streamEntry{data: data})
+	}
+
+	return writeEntries(ctx, entries, s.maxRetries, s.putBatch)
+}
+
+// putBatch sends a single PutRecordBatch call and returns the entries that failed
+func (s *FirehoseSink) putBatch(ctx context.Context, entries []streamEntry) ([]streamEntry, *PartialFailureError, error) {
+	input := &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String(s.deliveryStream),
+		Records:            make([]firehosetypes.Record, len(entries)),
+	}
+	for i, entry := range entries {
+		input.Records[i] = firehosetypes.Record{Data: entry.data}
+	}
+
+	resp, err := s.client.PutRecordBatch(ctx, input)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to put record batch: %w", err)
+	}
+
+	if aws.ToInt32(resp.FailedPutCount) == 0 {
+		return nil, nil, nil
+	}
+
+	var failed []streamEntry
+	partialErr := &PartialFailureError{Total: len(entries)}
+	for i, res := range resp.RequestResponses {
+		if res.ErrorCode == nil || i >= len(entries) {
+			continue
+		}
+		failed = append(failed, entries[i])
+		partialErr.ErrorCode = aws.ToString(res.ErrorCode)
+		partialErr.ErrorMessage = aws.ToString(res.ErrorMessage)
+	}
+	failed = retryEntries(failed, entries, partialErr, aws.ToInt32(resp.FailedPutCount))
+
+	return failed, partialErr, nil
+}
+
+func (s *FirehoseSink) String() string {
+	return fmt.Sprintf("FirehoseSink(deliveryStream=%s)", s.deliveryStream)
+}
+
+// KinesisSink writes kept records to a Kinesis Data Stream
+//
+// The partition key is the recipientAccountId of the record, keeping the events of
+// an account ordered within a shard.
+type KinesisSink struct {
+	stream     string
+	client     KinesisAPI
+	maxRetries int
+}
+
+// NewKinesisSink creates a new Kinesis Data Streams sink, stream can be a stream name or ARN
+func NewKinesisSink(stream string, client KinesisAPI) *KinesisSink {
+	return &KinesisSink{
+		stream:     stream,
+		client:     client,
+		maxRetries: defaultStreamRetries,
+	}
+}
+
+// WriteRecords writes the records with PutRecords
+func (s *KinesisSink) WriteRecords(ctx context.Context, file cloudtrailprocessor.SinkFile, records []json.RawMessage) error {
+	entries := make([]streamEntry, 0, len(records))
+	for _, record := range records {
+		entries = append(entries, streamEntry{
+			data:         record,
+			partitionKey: partitionKey(record),
+		})
+	}
+
+	return writeEntries(ctx, entries, s.maxRetries, s.putBatch)
+}
+
+// putBatch sends a single PutRecords call and returns the entries that failed
+func (s *KinesisSink) putBatch(ctx context.Context, entries []streamEntry) ([]streamEntry, *PartialFailureError, error) {
+	input := &kinesis.PutRecordsInput{
+		Records: make([]kinesistypes.PutRecordsRequestEntry, len(entries)),
+	}
+	if strings.HasPrefix(s.stream, "arn:") {
+		input.StreamARN = aws.String(s.stream)
+	} else {
+		input.StreamName = aws.String(s.stream)
+	}
+	for i, entry := range entries {
+		input.Records[i] = kinesistypes.PutRecordsRequestEntry{
+			Data:         entry.data,
+			PartitionKey: aws.String(entry.partitionKey),
+		}
+	}
+
+	resp, err := s.client.PutRecords(ctx, input)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to put records: %w", err)
+	}
+
+	if aws.ToInt32(resp.FailedRecordCount) == 0 {
+		return nil, nil, nil
+	}
+
+	var failed []streamEntry
+	partialErr := &PartialFailureError{Total: len(entries)}
+	for i, res := range resp.Records {
+		if res.ErrorCode == nil || i >= len(entries) {
+			continue
+		}
+		failed = append(failed, entries[i])
+		partialErr.ErrorCode = aws.ToString(res.ErrorCode)
+		partialErr.ErrorMessage = aws.ToString(res.ErrorMessage)
+	}
+	failed = retryEntries(failed, entries, partialErr, aws.ToInt32(resp.FailedRecordCount))
+
+	return failed, partialErr, nil
+}
+
+func (s *KinesisSink) String() string {
+	return fmt.Sprintf("KinesisSink(stream=%s)", s.stream)
+}
+
+// partitionKey derives the Kinesis partition key from the recipientAccountId of a record
+func partitionKey(record json.RawMessage) string {
+	ref := struct {
+		RecipientAccountID string `json:"recipientAccountId"`
+	}{}
+	if err := json.Unmarshal(record, &ref); err != nil || ref.RecipientAccountID == "" {
+		return "unknown"
+	}
+	return ref.RecipientAccountID
+}
+
+// batchEntries splits entries into batches respecting the record count and payload size limits
+func batchEntries(entries []streamEntry) [][]streamEntry {
+	var batches [][]streamEntry
+	var current []streamEntry
+	size := 0
+
+	for _, entry := range entries {
+		entrySize := len(entry.data) + len(entry.partitionKey)
+		if len(current) > 0 && (len(current) == maxBatchRecords || size+entrySize > maxBatchBytes) {
+			batches = append(batches, current)
+			current = nil
+			size = 0
+		}
+		current = append(current, entry)
+		size += entrySize
+	}
+
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches
+}
+
+// writeEntries sends all entries in batches, re-sending only the entries reported as failed
+func writeEntries(ctx context.Context, entries []streamEntry, maxRetries int,
+	put func(context.Context, []streamEntry) ([]streamEntry, *PartialFailureError, error)) error {
+	for _, entry := range entries {
+		if len(entry.data)+len(entry.partitionKey) > maxStreamRecordBytes {
+			return fmt.Errorf("record of %d bytes exceeds the maximum record size", len(entry.data))
+		}
+	}
+
+	for _, batch := range batchEntries(entries) {
+		pending := batch
+
+		err := retry.Do(ctx, func() error {
+			failed, partialErr, err := put(ctx, pending)
+			if err != nil {
+				return err
+			}
+			if partialErr != nil {
+				log.Ctx(ctx).Debug().
+					Int("failed", partialErr.Failed).
+					Int("total", partialErr.Total).
+					Str("errorCode", partialErr.ErrorCode).
+					Msg("retrying failed records")
+				pending = failed
+				return partialErr
+			}
+			return nil
+		},
+			retry.WithMaxRetries(maxRetries),
+			retry.WithRetryableError(retry.IsRetryableWith(retry.RetryAs[*PartialFailureError]())),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+package sinks
+
+import (
+	"context"
+	"ctlp/pkg/retry"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	firehosetypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/segmentio/encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// Mock Firehose client
+type mockFirehoseClient struct {
+	mock.Mock
+}
+
+func (m *mockFirehoseClient) PutRecordBatch(ctx context.Context, params *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*firehose.PutRecordBatchOutput), args.Error(1)
+}
+
+// Mock Kinesis client
+type mockKinesisClient struct {
+	mock.Mock
+}
+
+func (m *mockKinesisClient) PutRecords(ctx context.Context, params *kinesis.PutRecordsInput, optFns ...func(*kinesis.Options)) (*kinesis.PutRecordsOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*kinesis.PutRecordsOutput), args.Error(1)
+}
+
+func TestFirehoseSink(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("newline delimited records", func(t *testing.T) {
+		client := new(mockFirehoseClient)
+		sink := NewFirehoseSink("test-stream", client)
+
+		client.On("PutRecordBatch", ctx, mock.MatchedBy(func(in *firehose.PutRecordBatchInput) bool {
+			return aws.ToString(in.DeliveryStreamName) == "test-stream" &&
+				len(in.Records) == 2 &&
+				string(in.Records[0].Data) == string(testRecords()[0])+"\n"
+		})).Return(&firehose.PutRecordBatchOutput{FailedPutCount: aws.Int32(0)}, nil).Once()
+
+		err := sink.WriteRecords(ctx, testFile, testRecords())
+		assert.NoError(t, err)
+		client.AssertExpectations(t)
+	})
+
+	t.Run("only failed entries are retried", func(t *testing.T) {
+		client := new(mockFirehoseClient)
+		sink := NewFirehoseSink("test-stream", client)
+
+		client.On("PutRecordBatch", ctx, mock.MatchedBy(func(in *firehose.PutRecordBatchInput) bool {
+			return len(in.Records) == 2
+		})).Return(&firehose.PutRecordBatchOutput{
+			FailedPutCount: aws.Int32(1),
+			RequestResponses: []firehosetypes.PutRecordBatchResponseEntry{
+				{RecordId: aws.String("r-1")},
+				{ErrorCode: aws.String("ServiceUnavailableException"), ErrorMessage: aws.String("slow down")},
+			},
+		}, nil).Once()
+		client.On("PutRecordBatch", ctx, mock.MatchedBy(func(in *firehose.PutRecordBatchInput) bool {
+			return len(in.Records) == 1 && string(in.Records[0].Data) == string(testRecords()[1])+"\n"
+		})).Return(&firehose.PutRecordBatchOutput{FailedPutCount: aws.Int32(0)}, nil).Once()
+
+		err := sink.WriteRecords(ctx, testFile, testRecords())
+		assert.NoError(t, err)
+		client.AssertExpectations(t)
+	})
+
+	t.Run("partial failure after retries", func(t *testing.T) {
+		client := new(mockFirehoseClient)
+		sink := NewFirehoseSink("test-stream", client)
+		sink.maxRetries = 1
+
+		client.On("PutRecordBatch", ctx, mock.Anything).Return(&firehose.PutRecordBatchOutput{
+			FailedPutCount: aws.Int32(1),
+			RequestResponses: []firehosetypes.PutRecordBatchResponseEntry{
+				{ErrorCode: aws.String("ServiceUnavailableException"), ErrorMessage: aws.String("slow down")},
+			},
+		}, nil).Twice()
+
+		err := sink.WriteRecords(ctx, testFile, testRecords()[:1])
+		assert.Error(t, err)
+
+		var partialErr *PartialFailureError
+		assert.True(t, errors.As(err, &partialErr))
+		assert.Equal(t, 1, partialErr.Failed)
+		assert.Equal(t, "ServiceUnavailableException", partialErr.ErrorCode)
+		client.AssertExpectations(t)
+	})
+
+	t.Run("request error", func(t *testing.T) {
+		client := new(mockFirehoseClient)
+		sink := NewFirehoseSink("test-stream", client)
+
+		client.On("PutRecordBatch", ctx, mock.Anything).Return(nil, errors.New("AccessDeniedException")).Once()
+
+		err := sink.WriteRecords(ctx, testFile, testRecords())
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to put record batch")
+		client.AssertExpectations(t)
+	})
+}
+
+func TestKinesisSink(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("partition key from recipientAccountId", func(t *testing.T) {
+		client := new(mockKinesisClient)
+		sink := NewKinesisSink("test-stream", client)
+
+		client.On("PutRecords", ctx, mock.MatchedBy(func(in *kinesis.PutRecordsInput) bool {
+			return aws.ToString(in.StreamName) == "test-stream" &&
+				in.StreamARN == nil &&
+				len(in.Records) == 2 &&
+				aws.ToString(in.Records[0].PartitionKey) == "123456789012" &&
+				aws.ToString(in.Records[1].PartitionKey) == "210987654321"
+		})).Return(&kinesis.PutRecordsOutput{FailedRecordCount: aws.Int32(0)}, nil).Once()
+
+		err := sink.WriteRecords(ctx, testFile, testRecords())
+		assert.NoError(t, err)
+		client.AssertExpectations(t)
+	})
+
+	t.Run("stream arn", func(t *testing.T) {
+		client := new(mockKinesisClient)
+		arn := "arn:aws:kinesis:eu-west-1:123456789012:stream/test-stream"
+		sink := NewKinesisSink(arn, client)
+
+		client.On("PutRecords", ctx, mock.MatchedBy(func(in *kinesis.PutRecordsInput) bool {
+			return aws.ToString(in.StreamARN) == arn && in.StreamName == nil
+		})).Return(&kinesis.PutRecordsOutput{FailedRecordCount: aws.Int32(0)}, nil).Once()
+
+		err := sink.WriteRecords(ctx, testFile, testRecords())
+		assert.NoError(t, err)
+		client.AssertExpectations(t)
+	})
+
+	t.Run("only failed entries are retried", func(t *testing.T) {
+		client := new(mockKinesisClient)
+		sink := NewKinesisSink("test-stream", client)
+
+		client.On("PutRecords", ctx, mock.MatchedBy(func(in *kinesis.PutRecordsInput) bool {
+			return len(in.Records) == 2
+		})).Return(&kinesis.PutRecordsOutput{
+			FailedRecordCount: aws.Int32(1),
+			Records: []kinesistypes.PutRecordsResultEntry{
+				{ErrorCode: aws.String("ProvisionedThroughputExceededException")},
+				{SequenceNumber: aws.String("1"), ShardId: aws.String("shardId-000000000000")},
+			},
+		}, nil).Once()
+		client.On("PutRecords", ctx, mock.MatchedBy(func(in *kinesis.PutRecordsInput) bool {
+			return len(in.Records) == 1 && aws.ToString(in.Records[0].PartitionKey) == "123456789012"
+		})).Return(&kinesis.PutRecordsOutput{FailedRecordCount: aws.Int32(0)}, nil).Once()
+
+		err := sink.WriteRecords(ctx, testFile, testRecords())
+		assert.NoError(t, err)
+		client.AssertExpectations(t)
+	})
+
+	t.Run("unidentified failures retry the batch", func(t *testing.T) {
+		client := new(mockKinesisClient)
+		sink := NewKinesisSink("test-stream", client)
+
+		client.On("PutRecords", ctx, mock.MatchedBy(func(in *kinesis.PutRecordsInput) bool {
+			return len(in.Records) == 2
+		})).Return(&kinesis.PutRecordsOutput{
+			FailedRecordCount: aws.Int32(1),
+			Records: []kinesistypes.PutRecordsResultEntry{
+				{SequenceNumber: aws.String("1"), ShardId: aws.String("shardId-000000000000")},
+				{SequenceNumber: aws.String("2"), ShardId: aws.String("shardId-000000000000")},
+			},
+		}, nil).Once()
+		client.On("PutRecords", ctx, mock.MatchedBy(func(in *kinesis.PutRecordsInput) bool {
+			return len(in.Records) == 2
+		})).Return(&kinesis.PutRecordsOutput{FailedRecordCount: aws.Int32(0)}, nil).Once()
+
+		err := sink.WriteRecords(ctx, testFile, testRecords())
+		assert.NoError(t, err)
+		client.AssertExpectations(t)
+	})
+}
+
+func TestPartialFailureErrorRetryable(t *testing.T) {
+	tests := []struct {
+		code     string
+		expected bool
+	}{
+		{"ProvisionedThroughputExceededException", true},
+		{"ServiceUnavailableException", true},
+		{"InternalFailure", true},
+		{"InternalServerError", true},
+		{"UnidentifiedFailure", true},
+		{"KMSAccessDeniedException", false},
+		{"InvalidArgumentException", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			err := fmt.Errorf("failed to write records: %w", &PartialFailureError{Failed: 1, Total: 2, ErrorCode: tt.code})
+			assert.Equal(t, tt.expected, retry.IsRetryable(err))
+			assert.Equal(t, !tt.expected, retry.IsPermanent(err))
+		})
+	}
+}
+
+func TestPartitionKey(t *testing.T) {
+	assert.Equal(t, "123456789012", partitionKey(json.RawMessage(`{"recipientAccountId":"123456789012"}`)))
+	assert.Equal(t, "unknown", partitionKey(json.RawMessage(`{"eventName":"CreateUser"}`)))
+	assert.Equal(t, "unknown", partitionKey(json.RawMessage(`not json`)))
+}
+
+func TestBatchEntries(t *testing.T) {
+	t.Run("record count limit", func(t *testing.T) {
+		entries := make([]streamEntry, 1201)
+		for i := range entries {
+			entries[i] = streamEntry{data: []byte(fmt.Sprintf(`{"n":%d}`, i))}
+		}
+
+		batches := batchEntries(entries)
+		assert.Len(t, batches, 3)
+		assert.Len(t, batches[0], 500)
+		assert.Len(t, batches[1], 500)
+		assert.Len(t, batches[2], 201)
+	})
+
+	t.Run("byte limit", func(t *testing.T) {
+		data := make([]byte, 900*1024)
+		entries := make([]streamEntry, 10)
+		for i := range entries {
+			entries[i] = streamEntry{data: data, partitionKey: "123456789012"}
+		}
+
+		batches := batchEntries(entries)
+		assert.Len(t, batches, 3)
+		for _, batch := range batches {
+			size := 0
+			for _, entry := range batch {
+				size += len(entry.data) + len(entry.partitionKey)
+			}
+			assert.LessOrEqual(t, size, maxBatchBytes)
+		}
+	})
+
+	t.Run("oversized record", func(t *testing.T) {
+		err := writeEntries(context.Background(), []streamEntry{{data: make([]byte, maxStreamRecordBytes+1)}}, 0, nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "exceeds the maximum record size")
+	})
+}
@@ -0,0 +1,273 @@
+package sinks
+
+import (
+	"crypto/tls"
+	"ctlp/pkg/cloudtrailprocessor"
+	"ctlp/pkg/retry"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog/log"
+)
+
+// NewKafkaProducer creates the KafkaProducer used by the Kafka sink, tests replace
+// it with an in-process producer
+var NewKafkaProducer = func(cfg KafkaProducerConfig) (KafkaProducer, error) {
+	return NewFranzProducer(cfg)
+}
+
+// factory describes an output sink that can be selected through OUTPUT_SINKS
+type factory struct {
+	name string
+	// enabledBy is the variable enabling the sink when OUTPUT_SINKS is not set
+	enabledBy string
+	create    func(awsConfig *aws.Config, outputBucket string) (cloudtrailprocessor.Sink, error)
+}
+
+// factories lists the available sinks, in the order they are enabled by default
+var factories = []factory{
+	{name: "s3", create: createS3Sink},
+	{name: "elasticsearch", enabledBy: "ELASTICSEARCH_ENDPOINT", create: createElasticsearchSink},
+	{name: "firehose", enabledBy: "FIREHOSE_DELIVERY_STREAM", create: createFirehoseSink},
+	{name: "kinesis", enabledBy: "KINESIS_STREAM_NAME", create: createKinesisSink},
+	{name: "syslog", enabledBy: "SYSLOG_ADDRESS", create: createSyslogSink},
+	{name: "kafka", enabledBy: "KAFKA_TOPIC", create: createKafkaSink},
+}
+
+// Option configures CreateFromEnv
+type Option func(*options)
+
+type options struct {
+	newBreaker func(name string) *retry.CircuitBreaker
+}
+
+// WithCircuitBreakers runs every sink through the circuit breaker returned by
+// newBreaker for the sink name ("s3", "elasticsearch", ...), see BreakerSink
+func WithCircuitBreakers(newBreaker func(name string) *retry.CircuitBreaker) Option {
+	return func(o *options) {
+		o.newBreaker = newBreaker
+	}
+}
+
+// wrap returns sink as configured by the options
+func (o *options) wrap(name string, sink cloudtrailprocessor.Sink) cloudtrailprocessor.Sink {
+	if o.newBreaker == nil {
+		return sink
+	}
+	return NewBreakerSink(name, sink, o.newBreaker(name))
+}
+
+// CreateFromEnv creates the output sink of the copier
+//
+// OUTPUT_SINKS selects the sinks by name (e.g. "s3,kinesis"); a listed sink that
+// cannot be created is an error. When it is not set, the S3 output bucket is used
+// together with every sink whose settings are present, and sinks that cannot be
+// created are logged and skipped.
+func CreateFromEnv(awsConfig *aws.Config, outputBucket string, opts ...Option) (cloudtrailprocessor.Sink, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	var sinks []cloudtrailprocessor.Sink
+
+	if selected := getEnv("OUTPUT_SINKS", ""); selected != "" {
+		for name := range strings.SplitSeq(selected, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+
+			f, ok := findFactory(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown output sink: %s", name)
+			}
+
+			sink, err := f.create(awsConfig, outputBucket)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create %s sink: %w", name, err)
+			}
+			sinks = append(sinks, o.wrap(name, sink))
+		}
+	} else {
+		for _, f := range factories {
+			if f.enabledBy != "" && getEnv(f.enabledBy, "") == "" {
+				continue
+			}
+
+			sink, err := f.create(awsConfig, outputBucket)
+			if err != nil {
+				log.Error().Err(err).Str("sink", f.name).Msg("failed to create sink, sink disabled")
+				continue
+			}
+			sinks = append(sinks, o.wrap(f.name, sink))
+		}
+	}
+
+	switch len(sinks) {
+	case 0:
+		return nil, fmt.Errorf("no output sink configured")
+	case 1:
+		return sinks[0], nil
+	default:
+		return cloudtrailprocessor.NewFanOutSink(sinks...), nil
+	}
+}
+
+func findFactory(name string) (factory, bool) {
+	for _, f := range factories {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return factory{}, false
+}
+
+// requireEnv returns the value of a variable a selected sink cannot work without
+func requireEnv(key string) (string, error) {
+	val := getEnv(key, "")
+	if val == "" {
+		return "", fmt.Errorf("%s is required", key)
+	}
+	return val, nil
+}
+
+func createS3Sink(awsConfig *aws.Config, outputBucket string) (cloudtrailprocessor.Sink, error) {
+	if outputBucket == "" {
+		return nil, fmt.Errorf("output bucket is required")
+	}
+
+	uploader := manager.NewUploader(s3.NewFromConfig(*awsConfig), func(u *manager.Uploader) {
+		u.PartSize = 64 * 1024 * 1024 // 64MB per part
+	})
+	return cloudtrailprocessor.NewS3Sink(uploader, outputBucket), nil
+}
+
+func createElasticsearchSink(awsConfig *aws.Config, outputBucket string) (cloudtrailprocessor.Sink, error) {
+	endpoint, err := requireEnv("ELASTICSEARCH_ENDPOINT")
+	if err != nil {
+		return nil, err
+	}
+
+	return cloudtrailprocessor.NewRecordSinkAdapter(NewElasticsearchSink(ElasticsearchConfig{
+		Endpoint:     endpoint,
+		IndexPattern: getEnv("ELASTICSEARCH_INDEX_PATTERN", DefaultIndexPattern),
+		MaxBulkBytes: getEnvInt("ELASTICSEARCH_MAX_BULK_BYTES", DefaultMaxBulkBytes),
+		Username:     getEnv("ELASTICSEARCH_USERNAME", ""),
+		Password:     getEnv("ELASTICSEARCH_PASSWORD", ""),
+		APIKey:       getEnv("ELASTICSEARCH_API_KEY", ""),
+	}, &http.Client{Timeout: 30 * time.Second})), nil
+}
+
+func createFirehoseSink(awsConfig *aws.Config, outputBucket string) (cloudtrailprocessor.Sink, error) {
+	deliveryStream, err := requireEnv("FIREHOSE_DELIVERY_STREAM")
+	if err != nil {
+		return nil, err
+	}
+
+	return cloudtrailprocessor.NewRecordSinkAdapter(NewFirehoseSink(deliveryStream, firehose.NewFromConfig(*awsConfig))), nil
+}
+
+func createKinesisSink(awsConfig *aws.Config, outputBucket string) (cloudtrailprocessor.Sink, error) {
+	stream, err := requireEnv("KINESIS_STREAM_NAME")
+	if err != nil {
+		return nil, err
+	}
+
+	return cloudtrailprocessor.NewRecordSinkAdapter(NewKinesisSink(stream, kinesis.NewFromConfig(*awsConfig))), nil
+}
+
+func createSyslogSink(awsConfig *aws.Config, outputBucket string) (cloudtrailprocessor.Sink, error) {
+	address, err := requireEnv("SYSLOG_ADDRESS")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := SyslogConfig{
+		Network:  getEnv("SYSLOG_NETWORK", "tcp"),
+		Address:  address,
+		Format:   getEnv("SYSLOG_FORMAT", SyslogFormatRFC5424),
+		AppName:  getEnv("SYSLOG_APP_NAME", DefaultSyslogAppName),
+		Hostname: getEnv("SYSLOG_HOSTNAME", ""),
+		Facility: getEnvInt("SYSLOG_FACILITY", DefaultSyslogFacility),
+	}
+
+	if raw := getEnv("SYSLOG_CEF_MAPPING", ""); raw != "" {
+		mapping, err := ParseCEFMapping(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SYSLOG_CEF_MAPPING: %w", err)
+		}
+		cfg.CEFMapping = mapping
+	}
+
+	if cfg.Network == "tls" {
+		cfg.TLSConfig = &tls.Config{
+			ServerName: getEnv("SYSLOG_TLS_SERVER_NAME", ""),
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	sink, err := NewSyslogSink(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cloudtrailprocessor.NewRecordSinkAdapter(sink), nil
+}
+
+func createKafkaSink(awsConfig *aws.Config, outputBucket string) (cloudtrailprocessor.Sink, error) {
+	topic, err := requireEnv("KAFKA_TOPIC")
+	if err != nil {
+		return nil, err
+	}
+
+	brokers, err := requireEnv("KAFKA_BROKERS")
+	if err != nil {
+		return nil, err
+	}
+
+	maxMessageBytes := getEnvInt("KAFKA_MAX_MESSAGE_BYTES", DefaultKafkaMaxMessageBytes)
+	producer, err := NewKafkaProducer(KafkaProducerConfig{
+		Brokers:         strings.Split(brokers, ","),
+		Auth:            getEnv("KAFKA_AUTH", KafkaAuthNone),
+		TLS:             getEnv("KAFKA_TLS", "false") == "true",
+		Username:        getEnv("KAFKA_USERNAME", ""),
+		Password:        getEnv("KAFKA_PASSWORD", ""),
+		Credentials:     awsConfig.Credentials,
+		MaxMessageBytes: maxMessageBytes,
+		ClientID:        getEnv("KAFKA_CLIENT_ID", DefaultKafkaClientID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka producer: %w", err)
+	}
+
+	return cloudtrailprocessor.NewRecordSinkAdapter(NewKafkaSink(KafkaConfig{
+		Topic:           topic,
+		KeyField:        getEnv("KAFKA_KEY_FIELD", DefaultKafkaKeyField),
+		Batch:           getEnv("KAFKA_BATCH", "false") == "true",
+		MaxMessageBytes: maxMessageBytes,
+	}, producer)), nil
+}
+
+func getEnv(key, defaultVal string) string {
+	if val := strings.TrimSpace(os.Getenv(key)); val != "" {
+		return val
+	}
+	return defaultVal
+}
+
+func getEnvInt(key string, defaultVal int) int {
+	val, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil {
+		return defaultVal
+	}
+	return val
+}
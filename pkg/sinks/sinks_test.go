@@ -0,0 +1,100 @@
+package sinks
+
+import (
+	"ctlp/pkg/cloudtrailprocessor"
+	"ctlp/pkg/retry"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateFromEnv(t *testing.T) {
+	awsConfig := &aws.Config{Region: "eu-west-1"}
+
+	t.Run("defaults to the output bucket", func(t *testing.T) {
+		sink, err := CreateFromEnv(awsConfig, "output-bucket")
+		assert.NoError(t, err)
+		assert.Equal(t, "S3Sink(bucket=output-bucket)", sink.String())
+	})
+
+	t.Run("circuit breakers per sink", func(t *testing.T) {
+		t.Setenv("KINESIS_STREAM_NAME", "test-stream")
+
+		var names []string
+		sink, err := CreateFromEnv(awsConfig, "output-bucket", WithCircuitBreakers(func(name string) *retry.CircuitBreaker {
+			names = append(names, name)
+			return retry.NewCircuitBreaker(name)
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"s3", "kinesis"}, names)
+
+		fanOut, ok := sink.(*cloudtrailprocessor.FanOutSink)
+		assert.True(t, ok)
+		for _, inner := range fanOut.Sinks {
+			assert.IsType(t, &BreakerSink{}, inner)
+		}
+	})
+
+	t.Run("sinks enabled by their settings", func(t *testing.T) {
+		t.Setenv("KINESIS_STREAM_NAME", "test-stream")
+		t.Setenv("KAFKA_TOPIC", "cloudtrail") // skipped, KAFKA_BROKERS is not set
+
+		sink, err := CreateFromEnv(awsConfig, "output-bucket")
+		assert.NoError(t, err)
+
+		fanOut, ok := sink.(*cloudtrailprocessor.FanOutSink)
+		assert.True(t, ok)
+		assert.Len(t, fanOut.Sinks, 2)
+		assert.Equal(t, "KinesisSink(stream=test-stream)", fanOut.Sinks[1].String())
+	})
+
+	t.Run("kafka producer settings", func(t *testing.T) {
+		t.Setenv("OUTPUT_SINKS", "kafka")
+		t.Setenv("KAFKA_TOPIC", "cloudtrail")
+		t.Setenv("KAFKA_BROKERS", "b-1.msk:9098,b-2.msk:9098")
+		t.Setenv("KAFKA_AUTH", "iam")
+
+		var producerCfg KafkaProducerConfig
+		newProducer := NewKafkaProducer
+		NewKafkaProducer = func(cfg KafkaProducerConfig) (KafkaProducer, error) {
+			producerCfg = cfg
+			return newFakeBroker(), nil
+		}
+		t.Cleanup(func() { NewKafkaProducer = newProducer })
+
+		sink, err := CreateFromEnv(awsConfig, "output-bucket")
+		assert.NoError(t, err)
+		assert.Contains(t, sink.String(), "KafkaSink(topic=cloudtrail")
+		assert.Equal(t, []string{"b-1.msk:9098", "b-2.msk:9098"}, producerCfg.Brokers)
+		assert.Equal(t, KafkaAuthIAM, producerCfg.Auth)
+		assert.Equal(t, DefaultKafkaMaxMessageBytes, producerCfg.MaxMessageBytes)
+		assert.Equal(t, DefaultKafkaClientID, producerCfg.ClientID)
+	})
+
+	t.Run("explicit selection", func(t *testing.T) {
+		t.Setenv("OUTPUT_SINKS", "firehose, kinesis")
+		t.Setenv("FIREHOSE_DELIVERY_STREAM", "delivery")
+		t.Setenv("KINESIS_STREAM_NAME", "test-stream")
+
+		sink, err := CreateFromEnv(awsConfig, "output-bucket")
+		assert.NoError(t, err)
+		assert.Equal(t, "FanOutSink(FirehoseSink(deliveryStream=delivery), KinesisSink(stream=test-stream))", sink.String())
+	})
+
+	t.Run("selected sink without settings", func(t *testing.T) {
+		t.Setenv("OUTPUT_SINKS", "s3,elasticsearch")
+
+		_, err := CreateFromEnv(awsConfig, "output-bucket")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "ELASTICSEARCH_ENDPOINT is required")
+	})
+
+	t.Run("unknown sink", func(t *testing.T) {
+		t.Setenv("OUTPUT_SINKS", "s3,splunk")
+
+		_, err := CreateFromEnv(awsConfig, "output-bucket")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "unknown output sink: splunk")
+	})
+}
@@ -0,0 +1,408 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"ctlp/pkg/cloudtrailprocessor"
+	"ctlp/pkg/retry"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/encoding/json"
+)
+
+const (
+	// SyslogFormatRFC5424 sends the raw JSON record as RFC 5424 message
+	SyslogFormatRFC5424 = "rfc5424"
+	// SyslogFormatCEF sends an ArcSight CEF event wrapped in an RFC 5424 message
+	SyslogFormatCEF = "cef"
+
+	// DefaultSyslogAppName is the APP-NAME of the RFC 5424 header
+	DefaultSyslogAppName = "ctlp"
+
+	// DefaultSyslogFacility is log audit (13), messages are sent with severity informational
+	DefaultSyslogFacility = 13
+
+	// DefaultSyslogWriteTimeout bounds how long a slow receiver can block a write
+	DefaultSyslogWriteTimeout = 10 * time.Second
+
+	// syslogChunkBytes is the amount of framed messages written at once on stream connections
+	syslogChunkBytes = 64 * 1024
+
+	// syslogSDID is the structured data element id, 32473 is the IANA example enterprise number
+	syslogSDID = "ctlp@32473"
+
+	syslogSeverityInfo = 6
+)
+
+// CEFField maps a CEF extension key to a dot separated record field path
+type CEFField struct {
+	Key   string
+	Field string
+}
+
+// DefaultCEFMapping is the extension mapping used when none is configured
+var DefaultCEFMapping = []CEFField{
+	{Key: "act", Field: "eventName"},
+	{Key: "src", Field: "sourceIPAddress"},
+	{Key: "suser", Field: "userIdentity.arn"},
+	{Key: "requestClientApplication", Field: "userAgent"},
+	{Key: "externalId", Field: "eventID"},
+	{Key: "cs1", Field: "recipientAccountId"},
+	{Key: "cs2", Field: "awsRegion"},
+	{Key: "cs3", Field: "errorCode"},
+}
+
+// SyslogConfig holds the settings of the syslog sink
+type SyslogConfig struct {
+	// Network is one of tcp, tls or udp
+	Network string
+	Address string
+	// Format is rfc5424 or cef
+	Format   string
+	AppName  string
+	Hostname string
+	Facility int
+	// CEFMapping lists the CEF extensions taken from the record, csN keys get a
+	// matching csNLabel set to the field path
+	CEFMapping   []CEFField
+	TLSConfig    *tls.Config
+	WriteTimeout time.Duration
+	MaxRetries   int
+}
+
+// SyslogSink forwards kept records to a syslog receiver
+//
+// Stream connections (tcp, tls) use octet-counting framing (RFC 6587) and are kept
+// open across invocations. A failed write closes the connection and the chunk is
+// re-sent on a new connection, so delivery is at-least-once. Writes carry a deadline:
+// a receiver that stops reading fails the file instead of blocking the function
+// until it times out.
+type SyslogSink struct {
+	cfg SyslogConfig
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogSink creates a new syslog sink
+func NewSyslogSink(cfg SyslogConfig) (*SyslogSink, error) {
+	switch cfg.Network {
+	case "":
+		cfg.Network = "tcp"
+	case "tcp", "tls", "udp":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network: %s", cfg.Network)
+	}
+
+	switch cfg.Format {
+	case "":
+		cfg.Format = SyslogFormatRFC5424
+	case SyslogFormatRFC5424, SyslogFormatCEF:
+	default:
+		return nil, fmt.Errorf("unsupported syslog format: %s", cfg.Format)
+	}
+
+	if cfg.AppName == "" {
+		cfg.AppName = DefaultSyslogAppName
+	}
+	if cfg.Hostname == "" {
+		cfg.Hostname, _ = os.Hostname()
+	}
+	if cfg.Facility <= 0 {
+		cfg.Facility = DefaultSyslogFacility
+	}
+	if len(cfg.CEFMapping) == 0 {
+		cfg.CEFMapping = DefaultCEFMapping
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = DefaultSyslogWriteTimeout
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 3
+	}
+
+	return &SyslogSink{cfg: cfg}, nil
+}
+
+// WriteRecords formats and sends the records
+func (s *SyslogSink) WriteRecords(ctx context.Context, file cloudtrailprocessor.SinkFile, records []json.RawMessage) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	messages := make([][]byte, 0, len(records))
+	for _, record := range records {
+		msg, err := s.formatMessage(file, record)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, msg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// retries resume at the chunk that failed and are shared by the whole file, so a
+	// receiver that keeps stalling does not get a fresh connection for every chunk
+	chunks := s.chunks(messages)
+	sent := 0
+	err := retry.Do(ctx, func() error {
+		for sent < len(chunks) {
+			if err := s.write(ctx, chunks[sent]); err != nil {
+				return err
+			}
+			sent++
+		}
+		return nil
+	}, retry.WithMaxRetries(s.cfg.MaxRetries))
+	if err != nil {
+		return fmt.Errorf("failed to send syslog messages: %w", err)
+	}
+
+	log.Ctx(ctx).Debug().
+		Str("file", file.Key).
+		Int("records", len(records)).
+		Msg("forwarded records to syslog")
+
+	return nil
+}
+
+// chunks groups messages into the payloads written on the connection; udp sends one
+// datagram per message, stream connections get octet-counted frames
+func (s *SyslogSink) chunks(messages [][]byte) [][]byte {
+	if s.cfg.Network == "udp" {
+		return messages
+	}
+
+	var chunks [][]byte
+	buf := new(bytes.Buffer)
+	for _, msg := range messages {
+		if buf.Len() > 0 && buf.Len()+len(msg)+12 > syslogChunkBytes {
+			chunks = append(chunks, bytes.Clone(buf.Bytes()))
+			buf.Reset()
+		}
+		buf.WriteString(strconv.Itoa(len(msg)))
+		buf.WriteByte(' ')
+		buf.Write(msg)
+	}
+	if buf.Len() > 0 {
+		chunks = append(chunks, buf.Bytes())
+	}
+	return chunks
+}
+
+// write sends a payload, (re)connecting when needed; the connection is dropped on error
+func (s *SyslogSink) write(ctx context.Context, payload []byte) error {
+	if s.conn == nil {
+		conn, err := s.dial(ctx)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	deadline := time.Now().Add(s.cfg.WriteTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := s.conn.SetWriteDeadline(deadline); err != nil {
+		s.closeConn()
+		return err
+	}
+
+	if _, err := s.conn.Write(payload); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("address", s.cfg.Address).Msg("syslog write failed, reconnecting")
+		s.closeConn()
+		return err
+	}
+
+	return nil
+}
+
+func (s *SyslogSink) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.cfg.WriteTimeout}
+
+	if s.cfg.Network == "tls" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: s.cfg.TLSConfig}
+		return tlsDialer.DialContext(ctx, "tcp", s.cfg.Address)
+	}
+	return dialer.DialContext(ctx, s.cfg.Network, s.cfg.Address)
+}
+
+func (s *SyslogSink) closeConn() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// Close closes the connection to the receiver
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeConn()
+	return nil
+}
+
+// formatMessage builds the RFC 5424 message for a record
+func (s *SyslogSink) formatMessage(file cloudtrailprocessor.SinkFile, record json.RawMessage) ([]byte, error) {
+	evt := make(map[string]any)
+	if err := json.Unmarshal(record, &evt); err != nil {
+		return nil, fmt.Errorf("unmarshal record failed: %w", err)
+	}
+
+	timestamp := time.Now().UTC()
+	if eventTime, ok := evt["eventTime"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, eventTime); err == nil {
+			timestamp = t.UTC()
+		}
+	}
+
+	msgID := "-"
+	if eventName, ok := evt["eventName"].(string); ok && eventName != "" {
+		msgID = syslogHeaderField(eventName, 32)
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "<%d>1 %s %s %s - %s ",
+		s.cfg.Facility*8+syslogSeverityInfo,
+		timestamp.Format(time.RFC3339Nano),
+		syslogHeaderField(s.cfg.Hostname, 255),
+		syslogHeaderField(s.cfg.AppName, 48),
+		msgID,
+	)
+	fmt.Fprintf(buf, `[%s bucket="%s" key="%s" configVersion="%s"] `,
+		syslogSDID, escapeSDParam(file.Bucket), escapeSDParam(file.Key), escapeSDParam(file.ConfigVersion))
+
+	if s.cfg.Format == SyslogFormatCEF {
+		buf.WriteString(FormatCEF(evt, s.cfg.CEFMapping))
+	} else {
+		buf.Write(record)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *SyslogSink) String() string {
+	return fmt.Sprintf("SyslogSink(network=%s, address=%s, format=%s)", s.cfg.Network, s.cfg.Address, s.cfg.Format)
+}
+
+// FormatCEF formats a CloudTrail record as ArcSight CEF event
+func FormatCEF(evt map[string]any, mapping []CEFField) string {
+	eventName := cefString(evt, "eventName")
+	eventSource := cefString(evt, "eventSource")
+
+	severity := 3
+	if cefString(evt, "errorCode") != "" {
+		severity = 5
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|AWS|CloudTrail|1.0|%s|%s|%d|",
+		escapeCEFHeader(eventSource+":"+eventName), escapeCEFHeader(eventName), severity)
+
+	var ext []string
+	if eventTime, err := time.Parse(time.RFC3339, cefString(evt, "eventTime")); err == nil {
+		ext = append(ext, "rt="+strconv.FormatInt(eventTime.UnixMilli(), 10))
+	}
+	for _, m := range mapping {
+		value := cefString(evt, m.Field)
+		if value == "" {
+			continue
+		}
+		ext = append(ext, m.Key+"="+escapeCEFExtension(value))
+		if strings.HasPrefix(m.Key, "cs") && !strings.HasSuffix(m.Key, "Label") {
+			ext = append(ext, m.Key+"Label="+escapeCEFExtension(m.Field))
+		}
+	}
+	b.WriteString(strings.Join(ext, " "))
+
+	return b.String()
+}
+
+// ParseCEFMapping parses a "key=field.path,key=field.path" mapping
+func ParseCEFMapping(raw string) ([]CEFField, error) {
+	var mapping []CEFField
+	for pair := range strings.SplitSeq(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, field, ok := strings.Cut(pair, "=")
+		if !ok || key == "" || field == "" {
+			return nil, fmt.Errorf("invalid CEF mapping entry: %s", pair)
+		}
+		mapping = append(mapping, CEFField{Key: strings.TrimSpace(key), Field: strings.TrimSpace(field)})
+	}
+	return mapping, nil
+}
+
+// cefString returns the string value of a field path, non string values are JSON encoded
+func cefString(evt map[string]any, field string) string {
+	v, ok := lookupField(evt, field)
+	if !ok || v == nil {
+		return ""
+	}
+	if str, ok := v.(string); ok {
+		return str
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// lookupField resolves a dot separated path, unlike utils.FieldExists it also returns nested objects
+func lookupField(evt map[string]any, field string) (any, bool) {
+	var current any = evt
+	for part := range strings.SplitSeq(field, ".") {
+		obj, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		current, ok = obj[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// syslogHeaderField makes a value valid for an RFC 5424 header field (PRINTUSASCII, bounded length)
+func syslogHeaderField(value string, maxLen int) string {
+	var b strings.Builder
+	for _, r := range value {
+		if r < 33 || r > 126 {
+			continue
+		}
+		b.WriteRune(r)
+		if b.Len() == maxLen {
+			break
+		}
+	}
+	if b.Len() == 0 {
+		return "-"
+	}
+	return b.String()
+}
+
+func escapeSDParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+func escapeCEFHeader(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ").Replace(value)
+}
+
+func escapeCEFExtension(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,212 @@
+package sinks
+
+import (
+	"bufio"
+	"context"
+	"ctlp/pkg/cloudtrailprocessor"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+	"github.com/stretchr/testify/assert"
+)
+
+// readFrames reads octet-counted syslog frames from a stream connection
+func readFrames(conn net.Conn, n int) ([]string, error) {
+	reader := bufio.NewReader(conn)
+	var frames []string
+	for len(frames) < n {
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			return frames, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			return frames, err
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(reader, msg); err != nil {
+			return frames, err
+		}
+		frames = append(frames, string(msg))
+	}
+	return frames, nil
+}
+
+// listenTCP starts a local listener returning the frames of the first connection
+func listenTCP(t *testing.T, n int) (string, <-chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	frames := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		received, _ := readFrames(conn, n)
+		frames <- received
+	}()
+
+	return listener.Addr().String(), frames
+}
+
+func TestSyslogSink(t *testing.T) {
+	ctx := context.Background()
+	file := cloudtrailprocessor.SinkFile{Bucket: testFile.Bucket, Key: testFile.Key, ConfigVersion: "1.2.0"}
+
+	t.Run("rfc5424 over tcp", func(t *testing.T) {
+		address, frames := listenTCP(t, 2)
+
+		sink, err := NewSyslogSink(SyslogConfig{Address: address, Hostname: "lambda"})
+		assert.NoError(t, err)
+		defer sink.Close()
+
+		assert.NoError(t, sink.WriteRecords(ctx, file, testRecords()))
+
+		received := <-frames
+		assert.Len(t, received, 2)
+		header := `<110>1 2024-01-15T10:00:00Z lambda ctlp - CreateUser ` +
+			`[ctlp@32473 bucket="source-bucket" key="` + testFile.Key + `" configVersion="1.2.0"] `
+		assert.Equal(t, header+string(testRecords()[0]), received[0])
+	})
+
+	t.Run("cef over udp", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		sink, err := NewSyslogSink(SyslogConfig{Network: "udp", Address: conn.LocalAddr().String(), Format: SyslogFormatCEF})
+		assert.NoError(t, err)
+		defer sink.Close()
+
+		assert.NoError(t, sink.WriteRecords(ctx, file, testRecords()[:1]))
+
+		buf := make([]byte, 4096)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		assert.NoError(t, err)
+
+		msg := string(buf[:n])
+		assert.Contains(t, msg, "] CEF:0|AWS|CloudTrail|1.0|:CreateUser|CreateUser|3|")
+		assert.Contains(t, msg, "act=CreateUser")
+		assert.Contains(t, msg, "cs1=123456789012 cs1Label=recipientAccountId")
+	})
+
+	t.Run("reconnect after failure", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		address := listener.Addr().String()
+		listener.Close()
+
+		sink, err := NewSyslogSink(SyslogConfig{Address: address, MaxRetries: 1, WriteTimeout: time.Second})
+		assert.NoError(t, err)
+		defer sink.Close()
+
+		err = sink.WriteRecords(ctx, file, testRecords())
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to send syslog messages")
+
+		listener, err = net.Listen("tcp", address)
+		if err != nil {
+			t.Skipf("address %s not reusable: %v", address, err)
+		}
+		defer listener.Close()
+
+		frames := make(chan []string, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			received, _ := readFrames(conn, 2)
+			frames <- received
+		}()
+
+		assert.NoError(t, sink.WriteRecords(ctx, file, testRecords()))
+		assert.Len(t, <-frames, 2)
+	})
+
+	t.Run("slow receiver", func(t *testing.T) {
+		// shrink the receive buffer of accepted connections and never read from them
+		lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				_ = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4096)
+			})
+		}}
+		listener, err := lc.Listen(ctx, "tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer listener.Close()
+
+		// accept but never read so that the socket buffers fill up
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				defer conn.Close()
+				time.Sleep(5 * time.Second)
+			}
+		}()
+
+		sink, err := NewSyslogSink(SyslogConfig{Address: listener.Addr().String(), MaxRetries: 1, WriteTimeout: 50 * time.Millisecond})
+		assert.NoError(t, err)
+		defer sink.Close()
+
+		padding := strings.Repeat("x", 100*1024)
+		records := make([]json.RawMessage, 500)
+		for i := range records {
+			records[i] = json.RawMessage(fmt.Sprintf(`{"eventID":"id-%d","requestParameters":{"padding":"%s"}}`, i, padding))
+		}
+
+		err = sink.WriteRecords(ctx, file, records)
+		assert.Error(t, err)
+	})
+}
+
+func TestNewSyslogSink(t *testing.T) {
+	_, err := NewSyslogSink(SyslogConfig{Network: "http", Address: "localhost:514"})
+	assert.Error(t, err)
+
+	_, err = NewSyslogSink(SyslogConfig{Format: "leef", Address: "localhost:514"})
+	assert.Error(t, err)
+}
+
+func TestFormatCEF(t *testing.T) {
+	evt := map[string]any{
+		"eventTime":       "2024-01-15T10:00:00Z",
+		"eventSource":     "iam.amazonaws.com",
+		"eventName":       "CreateUser",
+		"sourceIPAddress": "203.0.113.10",
+		"errorCode":       "AccessDenied",
+		"userIdentity": map[string]any{
+			"arn": "arn:aws:iam::123456789012:user/a=b",
+		},
+	}
+
+	cef := FormatCEF(evt, DefaultCEFMapping)
+	assert.True(t, strings.HasPrefix(cef, "CEF:0|AWS|CloudTrail|1.0|iam.amazonaws.com:CreateUser|CreateUser|5|rt=1705312800000 "))
+	assert.Contains(t, cef, "src=203.0.113.10")
+	assert.Contains(t, cef, `suser=arn:aws:iam::123456789012:user/a\=b`)
+	assert.Contains(t, cef, "cs3=AccessDenied cs3Label=errorCode")
+	assert.NotContains(t, cef, "externalId")
+}
+
+func TestParseCEFMapping(t *testing.T) {
+	mapping, err := ParseCEFMapping("act=eventName, duser=requestParameters.userName")
+	assert.NoError(t, err)
+	assert.Equal(t, []CEFField{
+		{Key: "act", Field: "eventName"},
+		{Key: "duser", Field: "requestParameters.userName"},
+	}, mapping)
+
+	_, err = ParseCEFMapping("act")
+	assert.Error(t, err)
+}
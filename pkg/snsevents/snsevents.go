@@ -93,3 +93,35 @@ func (ps *Processor) Handler(ctx context.Context, payload []byte) ([]byte, error
 
 	return []byte(""), nil
 }
+
+// NewNotification returns the SNS message announcing the objects of bucket, in
+// the format of payloadType, e.g. to replay files through the function topic
+func NewNotification(payloadType, bucket string, keys ...string) (string, error) {
+	var msg any
+
+	switch payloadType {
+	case "cloudtrail":
+		msg = CloudtrailSNSEvent{S3Bucket: bucket, S3ObjectKeys: keys}
+	case "s3":
+		s3Event := events.S3Event{}
+		for _, key := range keys {
+			s3Event.Records = append(s3Event.Records, events.S3EventRecord{
+				EventSource: "aws:s3",
+				EventName:   "ObjectCreated:Put",
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{Name: bucket},
+					Object: events.S3Object{Key: key},
+				},
+			})
+		}
+		msg = s3Event
+	default:
+		return "", fmt.Errorf("unsupported SNS payload type: %s", payloadType)
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
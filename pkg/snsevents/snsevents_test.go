@@ -0,0 +1,46 @@
+package snsevents
+
+import (
+	"context"
+	"testing"
+
+	"ctlp/pkg/flags"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/segmentio/encoding/json"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingCopier struct {
+	copied []string
+}
+
+func (c *recordingCopier) Copy(ctx context.Context, bucket, key string) error {
+	c.copied = append(c.copied, bucket+"/"+key)
+	return nil
+}
+
+func TestNewNotification(t *testing.T) {
+	for _, payloadType := range []string{"s3", "cloudtrail"} {
+		t.Run(payloadType, func(t *testing.T) {
+			message, err := NewNotification(payloadType, "trail-bucket", "a.json.gz", "b.json.gz")
+			assert.NoError(t, err)
+
+			payload, err := json.Marshal(events.SNSEvent{Records: []events.SNSEventRecord{
+				{SNS: events.SNSEntity{Message: message}},
+			}})
+			assert.NoError(t, err)
+
+			copier := &recordingCopier{}
+			ps := &Processor{cfg: flags.S3Processor{SNSPayloadType: payloadType}, Copier: copier}
+			_, err = ps.Handler(context.Background(), payload)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"trail-bucket/a.json.gz", "trail-bucket/b.json.gz"}, copier.copied)
+		})
+	}
+
+	t.Run("unsupported payload type", func(t *testing.T) {
+		_, err := NewNotification("eventbridge", "trail-bucket", "a.json.gz")
+		assert.EqualError(t, err, "unsupported SNS payload type: eventbridge")
+	})
+}
@@ -0,0 +1,87 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// lambdaTraceHeader is the context key used by aws-lambda-go for the X-Ray trace header
+const lambdaTraceHeader = "x-amzn-trace-id"
+
+// Tracer returns a tracer of the global provider
+//
+// Tracers obtained before Setup are valid: they delegate to the provider
+// installed later and are no-ops until then.
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// Setup installs the global tracer provider selected by OTEL_TRACES_EXPORTER
+//
+// "otlp" exports spans with OTLP/HTTP, configured with the standard
+// OTEL_EXPORTER_OTLP_* variables (e.g. the ADOT collector layer on
+// localhost:4318). "none", the default, keeps the no-op provider and returns a
+// nil provider. Trace IDs are X-Ray compatible so that spans join the Lambda trace.
+func Setup(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	exporterName := strings.ToLower(strings.TrimSpace(os.Getenv("OTEL_TRACES_EXPORTER")))
+
+	switch exporterName {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+	default:
+		return nil, fmt.Errorf("unsupported traces exporter: %s", exporterName)
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.Default()),
+		sdktrace.WithIDGenerator(xray.NewIDGenerator()),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(xray.Propagator{})
+
+	return provider, nil
+}
+
+// ContextFromLambda returns ctx with the Lambda trace as remote parent
+//
+// The X-Ray trace header is read from the invocation context, or from
+// _X_AMZN_TRACE_ID when the context does not carry it.
+func ContextFromLambda(ctx context.Context) context.Context {
+	header, _ := ctx.Value(lambdaTraceHeader).(string)
+	if header == "" {
+		header = os.Getenv("_X_AMZN_TRACE_ID")
+	}
+	if header == "" {
+		return ctx
+	}
+
+	carrier := propagation.MapCarrier{"X-Amzn-Trace-Id": header}
+	return xray.Propagator{}.Extract(ctx, carrier)
+}
+
+// End records err on the span, when not nil, and ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
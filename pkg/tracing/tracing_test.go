@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSetup(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("no-op by default", func(t *testing.T) {
+		provider, err := Setup(ctx)
+		assert.NoError(t, err)
+		assert.Nil(t, provider)
+	})
+
+	t.Run("unsupported exporter", func(t *testing.T) {
+		t.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+		_, err := Setup(ctx)
+		assert.EqualError(t, err, "unsupported traces exporter: zipkin")
+	})
+}
+
+func TestContextFromLambda(t *testing.T) {
+	header := "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"
+
+	t.Run("from the invocation context", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), lambdaTraceHeader, header)
+
+		sc := trace.SpanContextFromContext(ContextFromLambda(ctx))
+		assert.True(t, sc.IsRemote())
+		assert.True(t, sc.IsSampled())
+		assert.Equal(t, "5759e988bd862e3fe1be46a994272793", sc.TraceID().String())
+		assert.Equal(t, "53995c3f42cd8ad8", sc.SpanID().String())
+	})
+
+	t.Run("from the environment", func(t *testing.T) {
+		t.Setenv("_X_AMZN_TRACE_ID", header)
+
+		sc := trace.SpanContextFromContext(ContextFromLambda(context.Background()))
+		assert.Equal(t, "5759e988bd862e3fe1be46a994272793", sc.TraceID().String())
+	})
+
+	t.Run("outside of Lambda", func(t *testing.T) {
+		sc := trace.SpanContextFromContext(ContextFromLambda(context.Background()))
+		assert.False(t, sc.IsValid())
+	})
+}
+
+func TestEnd(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)).Tracer("test")
+
+	_, span := tracer.Start(context.Background(), "ok")
+	End(span, nil)
+	_, span = tracer.Start(context.Background(), "failed")
+	End(span, errors.New("boom"))
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+	assert.Equal(t, "boom", spans[1].Status.Description)
+	assert.Len(t, spans[1].Events, 1, "the error is recorded as an event")
+}